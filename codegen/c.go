@@ -0,0 +1,418 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+	"tinyass/utils"
+)
+
+// cHelpers are the C functions a translation may need, written before main only
+// when the body calls them. Arithmetic goes through unsigned integers so overflow wraps like in Go.
+var cHelpers = []struct{ name, code string }{
+	{"add", "static int64_t add(int64_t a, int64_t b) { return (int64_t)((uint64_t)a + (uint64_t)b); }\n"},
+	{"sub", "static int64_t sub(int64_t a, int64_t b) { return (int64_t)((uint64_t)a - (uint64_t)b); }\n"},
+	{"mul", "static int64_t mul(int64_t a, int64_t b) { return (int64_t)((uint64_t)a * (uint64_t)b); }\n"},
+	{"quo", "static int64_t quo(int64_t a, int64_t b) { return b == -1 ? (int64_t)(0 - (uint64_t)a) : a / b; }\n"},
+	{"rem", "static int64_t rem(int64_t a, int64_t b) { return b == -1 ? 0 : a % b; }\n"},
+	{"shl", "static int64_t shl(int64_t a, int64_t b) { return (uint64_t)b >= 64 ? 0 : (int64_t)((uint64_t)a << b); }\n"},
+	{"shr", "static int64_t shr(int64_t a, int64_t b) { return (uint64_t)b >= 64 ? (a < 0 ? -1 : 0) : a >> b; }\n"},
+	{"fault", `
+/* fault reports the error that stops the program. */
+static void fault(const char *format, ...) {
+	va_list args;
+	va_start(args, format);
+	printf(` + cString(string(utils.RED)+"Error: ") + `);
+	vprintf(format, args);
+	printf(` + cString("\n"+string(utils.RESET)) + `);
+	va_end(args);
+}
+`},
+	{"hex", `
+/* hex formats n like Go's %02X. */
+static const char *hex(int64_t n, char *buf) {
+	if (n < 0) {
+		sprintf(buf, "-%llX", (unsigned long long)(0 - (uint64_t)n));
+	} else {
+		sprintf(buf, "%02llX", (unsigned long long)n);
+	}
+	return buf;
+}
+`},
+	{"put_rune", `
+/* put_rune writes a memory cell as a UTF-8 character. */
+static void put_rune(int64_t cell) {
+	int32_t c = (int32_t)cell;
+	if (c < 0 || c > 0x10FFFF || (c >= 0xD800 && c <= 0xDFFF)) {
+		c = 0xFFFD;
+	}
+	if (c < 0x80) {
+		putchar(c);
+	} else if (c < 0x800) {
+		putchar(0xC0 | c >> 6);
+		putchar(0x80 | (c & 0x3F));
+	} else if (c < 0x10000) {
+		putchar(0xE0 | c >> 12);
+		putchar(0x80 | (c >> 6 & 0x3F));
+		putchar(0x80 | (c & 0x3F));
+	} else {
+		putchar(0xF0 | c >> 18);
+		putchar(0x80 | (c >> 12 & 0x3F));
+		putchar(0x80 | (c >> 6 & 0x3F));
+		putchar(0x80 | (c & 0x3F));
+	}
+}
+`},
+}
+
+// cEmitter writes the C translation of one program.
+type cEmitter struct {
+	buf     bytes.Buffer // Body of main
+	program *commands.Program
+	costs   *runtime.CostTable
+}
+
+// EmitC translates program into a self-contained C file. Registers are local
+// variables, memory is an array and jumps are gotos; returns and traps, whose
+// targets are only known at run time, go through a switch on the program
+// counter. The compiled program prints exactly what RunFile prints for the
+// script and exits with the status of the exit system call.
+func EmitC(w io.Writer, program *commands.Program, costs *runtime.CostTable) error {
+	if err := checkProgram(program); err != nil {
+		return err
+	}
+	e := &cEmitter{program: program, costs: costs}
+	for pc, inst := range program.Instructions {
+		e.printf("L%d: /* %s", pc, commands.Disassemble(inst))
+		if line := program.LineOf(pc); line > 0 {
+			e.printf(", line %d", line)
+		}
+		e.printf(" */\n")
+		e.instruction(pc, inst)
+	}
+	e.printf("\tgoto done;\n\ndispatch:\n\tswitch (pc) {\n")
+	for pc := range program.Instructions {
+		e.printf("\tcase %d: goto L%d;\n", pc, pc)
+	}
+	e.printf("\t}\n\ndone:\n")
+	e.printf("\t(void)mem, (void)r0, (void)r1, (void)r2, (void)r3, (void)sp, (void)cycles, (void)interrupts, (void)user;\n")
+	e.printf("\tprintf(%s);\n", cString(utils.GREEN.Sprintln("Execution completed.")))
+	e.printf("\tif (exited) {\n")
+	e.printf("\t\tprintf(%s, (long long)status);\n", cString(utils.GREEN.Sprintf("Exit status %%lld\n")))
+	e.printf("\t\treturn (int)status;\n\t}\n\treturn 0;\n}\n")
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "/* Generated by tinyass emit-c. */\n")
+	fmt.Fprintf(&out, "#include <stdarg.h>\n#include <stdint.h>\n#include <stdio.h>\n#include <time.h>\n\n")
+	fmt.Fprintf(&out, "#define MEMORY_SIZE %d\n", commands.MEMORY_SIZE)
+	fmt.Fprintf(&out, "#define STACK_FLOOR %d\n\n", runtime.STACK_FLOOR)
+	for _, helper := range cHelpers {
+		if bytes.Contains(e.buf.Bytes(), []byte(helper.name+"(")) {
+			out.WriteString(helper.code)
+		}
+	}
+	fmt.Fprintf(&out, "\nint main(void) {\n")
+	fmt.Fprintf(&out, "\tstatic int64_t mem[MEMORY_SIZE];\n")
+	fmt.Fprintf(&out, "\tint64_t r0 = 0, r1 = 0, r2 = 0, r3 = 0;\n")
+	fmt.Fprintf(&out, "\tint64_t pc = 0, sp = MEMORY_SIZE, status = 0;\n")
+	fmt.Fprintf(&out, "\tuint64_t cycles = 0;\n")
+	fmt.Fprintf(&out, "\tint interrupts = 0, user = 0, exited = 0;\n\n")
+	fmt.Fprintf(&out, "\tgoto dispatch;\n")
+	out.Write(e.buf.Bytes())
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+func (e *cEmitter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&e.buf, format, args...)
+}
+
+// line writes one statement of the instruction being translated.
+func (e *cEmitter) line(format string, args ...interface{}) {
+	e.printf("\t"+format+"\n", args...)
+}
+
+// fault writes a statement stopping the program with a fault message.
+func (e *cEmitter) fault(format string, args ...interface{}) {
+	e.line("fault(%s);", cString(fmt.Sprintf(format, args...)))
+	e.line("goto done;")
+}
+
+// jump writes a transfer of control to a known address.
+func (e *cEmitter) jump(target int) {
+	if target < 0 || target >= len(e.program.Instructions) {
+		e.line("goto done;")
+		return
+	}
+	e.line("goto L%d;", target)
+}
+
+// cycles writes the cost of the instruction being translated.
+func (e *cEmitter) cycles(c instCost, accesses uint64, jumped bool) {
+	e.line("cycles += %d;", c.cycles(accesses, jumped))
+}
+
+// instruction writes the translation of inst at pc.
+func (e *cEmitter) instruction(pc int, inst commands.Instruction) {
+	ops := inst.Operands
+	c := costOf(e.costs, inst.Opcode)
+	if runtime.IsPrivileged(inst.Opcode) {
+		e.line("if (user) {")
+		e.line("\tint64_t handler = mem[%d];", runtime.PRIVILEGE_FAULT_VECTOR)
+		e.line("\tif (handler == 0) {")
+		e.line("\t\tfault(%s);", cString(fmt.Sprintf("Privileged instruction %s in user mode on program counter %d", commands.Mnemonic(inst.Opcode), pc)))
+		e.line("\t\tgoto done;")
+		e.line("\t}")
+		e.trap(pc, c, pc, 0, "\t")
+		e.line("}")
+	}
+
+	switch inst.Opcode {
+	case commands.LOAD:
+		e.line("r%d = %d;", ops[0], ops[1])
+		e.cycles(c, 0, false)
+	case commands.STORE:
+		e.guardWrite(pc, ops[1], "")
+		e.line("mem[%d] = r%d;", ops[1], ops[0])
+		e.cycles(c, 1, false)
+	case commands.LOADM:
+		e.line("r%d = mem[%d];", ops[0], ops[1])
+		e.cycles(c, 1, false)
+	case commands.CAS:
+		e.line("{")
+		e.line("\tint64_t old = mem[%d];", ops[2])
+		e.line("\tif (old == r%d) {", ops[0])
+		e.guardWrite(pc, ops[2], "\t\t")
+		e.line("\t\tmem[%d] = r%d;", ops[2], ops[1])
+		e.line("\t\tcycles += %d;", c.memory)
+		e.line("\t}")
+		e.line("\tr%d = old;", ops[0])
+		e.line("}")
+		e.cycles(c, 1, false)
+	case commands.XCHG:
+		e.guardWrite(pc, ops[1], "")
+		e.line("{")
+		e.line("\tint64_t old = mem[%d];", ops[1])
+		e.line("\tmem[%d] = r%d;", ops[1], ops[0])
+		e.line("\tr%d = old;", ops[0])
+		e.line("}")
+		e.cycles(c, 2, false)
+	case commands.FENCE, commands.TLBFLUSH:
+		e.cycles(c, 0, false)
+	case commands.CORE:
+		e.line("r%d = 0;", ops[0])
+		e.cycles(c, 0, false)
+	case commands.SETPTB:
+		e.fault("SETPTB needs an MMU (run with --mmu) on program counter %d", pc)
+	case commands.SYSCALL:
+		e.syscall(pc, c, ops[0])
+	case commands.USER:
+		e.line("user = 1;")
+		e.cycles(c, 0, true)
+		e.jump(ops[0])
+	case commands.ADD:
+		e.line("r%d = add(r%d, r%d);", ops[0], ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.SUB:
+		e.line("r%d = sub(r%d, r%d);", ops[0], ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.MUL:
+		e.line("r%d = mul(r%d, r%d);", ops[0], ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.DIV, commands.REM:
+		e.line("if (r%d == 0) {", ops[2])
+		if inst.Opcode == commands.DIV {
+			e.line("\tfault(%s);", cString(fmt.Sprintf("Division by zero on program counter %d", pc+1)))
+		} else {
+			e.line("\tfault(%s);", cString("Division by zero"))
+		}
+		e.line("\tgoto done;")
+		e.line("}")
+		fn := map[int]string{commands.DIV: "quo", commands.REM: "rem"}[inst.Opcode]
+		e.line("r%d = %s(r%d, r%d);", ops[0], fn, ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.AND, commands.OR, commands.XOR:
+		op := map[int]string{commands.AND: "&", commands.OR: "|", commands.XOR: "^"}[inst.Opcode]
+		e.line("r%d = r%d %s r%d;", ops[0], ops[1], op, ops[2])
+		e.cycles(c, 0, false)
+	case commands.NOT:
+		e.line("r%d = ~r%d;", ops[0], ops[1])
+		e.cycles(c, 0, false)
+	case commands.SHL:
+		e.line("r%d = shl(r%d, r%d);", ops[0], ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.SHR:
+		e.line("r%d = shr(r%d, r%d);", ops[0], ops[1], ops[2])
+		e.cycles(c, 0, false)
+	case commands.GT, commands.LT, commands.GTE, commands.LTE, commands.EQ, commands.NEQ:
+		if ops[1] == ops[2] {
+			// Comparing a register with itself is constant; C compilers warn about it
+			e.line("r%d = %d;", ops[0], map[int]int{commands.GTE: 1, commands.LTE: 1, commands.EQ: 1}[inst.Opcode])
+		} else {
+			e.line("r%d = r%d %s r%d;", ops[0], ops[1], comparisons[inst.Opcode], ops[2])
+		}
+		e.cycles(c, 0, false)
+	case commands.JMP:
+		e.cycles(c, 0, true)
+		e.jump(ops[0])
+	case commands.JZ, commands.JNZ:
+		test := map[int]string{commands.JZ: "==", commands.JNZ: "!="}[inst.Opcode]
+		e.line("if (r%d %s 0) {", ops[0], test)
+		e.line("\tcycles += %d;", c.cycles(0, true))
+		e.printf("\t")
+		e.jump(ops[1])
+		e.line("}")
+		e.cycles(c, 0, false)
+	case commands.PRINT:
+		if ops[0] == -1 {
+			e.line("printf(%s, (long long)r%d);", cString(utils.BLUE.Sprintf("Register R%d = %%lld\n", ops[1])), ops[1])
+			e.cycles(c, 0, false)
+		} else {
+			e.line("printf(%s, (long long)mem[%d]);", cString(utils.BLUE.Sprintf("Memory[%d] = %%lld\n", ops[0])), ops[0])
+			e.cycles(c, 1, false)
+		}
+	case commands.CALL:
+		e.line("if (sp <= STACK_FLOOR) {")
+		e.line("\tfault(%s);", cString(fmt.Sprintf("Stack overflow on program counter %d", pc+1)))
+		e.line("\tgoto done;")
+		e.line("}")
+		e.line("mem[--sp] = %d;", pc+1)
+		e.cycles(c, 1, true)
+		e.jump(ops[0])
+	case commands.RET:
+		e.line("if (sp >= MEMORY_SIZE) {")
+		e.line("\tfault(%s);", cString(fmt.Sprintf("Stack underflow on program counter %d", pc+1)))
+		e.line("\tgoto done;")
+		e.line("}")
+		e.line("pc = mem[sp++];")
+		e.cycles(c, 1, true)
+		e.line("goto dispatch;")
+	case commands.CYCLES:
+		e.line("r%d = (int64_t)cycles;", ops[0])
+		e.cycles(c, 0, false)
+	case commands.EI, commands.DI:
+		e.line("interrupts = %d;", map[int]int{commands.EI: 1, commands.DI: 0}[inst.Opcode])
+		e.cycles(c, 0, false)
+	case commands.IRET:
+		e.line("if (sp > MEMORY_SIZE - 2) {")
+		e.line("\tfault(%s);", cString(fmt.Sprintf("Stack underflow on program counter %d", pc+1)))
+		e.line("\tgoto done;")
+		e.line("}")
+		e.line("interrupts = (mem[sp] & %d) != 0;", runtime.FLAG_INTERRUPTS_ENABLED)
+		e.line("user = (mem[sp] & %d) != 0;", runtime.FLAG_USER_MODE)
+		e.line("pc = mem[sp + 1];")
+		e.line("sp += 2;")
+		e.cycles(c, 2, true)
+		e.line("goto dispatch;")
+	case commands.HALT:
+		e.line("goto done;")
+	}
+}
+
+// trap writes the entry into the supervisor handler held in the variable
+// handler, returning to ret. accesses are the memory accesses the instruction
+// made before the trap.
+func (e *cEmitter) trap(pc int, c instCost, ret int, accesses uint64, indent string) {
+	e.line("%sif (sp - 2 < STACK_FLOOR) {", indent)
+	e.line("%s\tfault(%s);", indent, cString(fmt.Sprintf("Stack overflow entering a trap handler on program counter %d", pc)))
+	e.line("%s\tgoto done;", indent)
+	e.line("%s}", indent)
+	e.line("%smem[--sp] = %d;", indent, ret)
+	e.line("%smem[--sp] = (interrupts ? %d : 0) | (user ? %d : 0);", indent, runtime.FLAG_INTERRUPTS_ENABLED, runtime.FLAG_USER_MODE)
+	e.line("%sinterrupts = 0;", indent)
+	e.line("%suser = 0;", indent)
+	e.line("%spc = handler;", indent)
+	e.line("%scycles += %d;", indent, c.cycles(accesses+2, true))
+	e.line("%sgoto dispatch;", indent)
+}
+
+// guardWrite writes the protection fault of a write to addr in user mode,
+// when addr holds a vector.
+func (e *cEmitter) guardWrite(pc, addr int, indent string) {
+	if !runtime.SupervisorOnly(addr) {
+		return
+	}
+	e.line("%sif (user) {", indent)
+	e.line("%s\tfault(%s);", indent, cString(runtime.VectorFault(runtime.ACCESS_WRITE, addr, pc)))
+	e.line("%s\tgoto done;", indent)
+	e.line("%s}", indent)
+}
+
+// syscall writes system call n: a trap into the handler installed by the
+// program, or else the host's implementation.
+func (e *cEmitter) syscall(pc int, c instCost, n int) {
+	e.line("{")
+	e.line("\tint64_t handler = mem[%d];", runtime.SYSCALL_VECTOR)
+	e.line("\tif (handler != 0) {")
+	e.line("\t\tmem[%d] = %d;", runtime.SYSCALL_NUMBER, n)
+	e.trap(pc, c, pc+1, 1, "\t\t")
+	e.line("\t}")
+	e.line("}")
+	switch n {
+	case runtime.SYS_EXIT:
+		e.line("status = r0;")
+		e.line("exited = 1;")
+		e.line("goto done;")
+	case runtime.SYS_WRITE:
+		e.line("if (r2 < 0 || r1 < 0 || r1 + r2 > MEMORY_SIZE) {")
+		e.line("\tchar buf[24];")
+		e.line("\tfault(\"write of %%lld cells at 0x%%s is outside memory on program counter %d\", (long long)r2, hex(r1, buf));", pc)
+		e.line("\tgoto done;")
+		e.line("}")
+		e.line("for (int64_t i = 0; i < r2; i++) {")
+		e.line("\tput_rune(mem[r1 + i]);")
+		e.line("}")
+		e.line("cycles += %d + (uint64_t)r2 * %d;", c.base, c.memory)
+	case runtime.SYS_READ:
+		e.line("{")
+		e.line("\tint ch = getchar();")
+		e.line("\tr0 = ch == EOF ? -1 : ch;")
+		e.line("}")
+		e.cycles(c, 0, false)
+	case runtime.SYS_TIME:
+		e.line("{")
+		e.line("\tstruct timespec now;")
+		e.line("\ttimespec_get(&now, TIME_UTC);")
+		e.line("\tr0 = (int64_t)now.tv_sec * 1000 + now.tv_nsec / 1000000;")
+		e.line("}")
+		e.cycles(c, 0, false)
+	default:
+		e.fault("Unknown system call %d on program counter %d", n, pc)
+	}
+}
+
+// comparisons maps comparison opcodes to their operator.
+var comparisons = map[int]string{
+	commands.GT:  ">",
+	commands.LT:  "<",
+	commands.GTE: ">=",
+	commands.LTE: "<=",
+	commands.EQ:  "==",
+	commands.NEQ: "!=",
+}
+
+// cString quotes s as a C string literal. Control characters use octal escapes,
+// so the color codes printed by the CPU come out unchanged.
+func cString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c < 0x20 || c >= 0x7F:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,334 @@
+package codegen
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+)
+
+// testScripts exercise every instruction a translation supports, with the
+// input they read.
+var testScripts = []struct {
+	name, source, input string
+}{
+	{"arithmetic", `
+		LOAD R0 10
+		LOAD R1 3
+		ADD R2 R0 R1
+		SUB R3 R1 R0
+		PRINT R2
+		PRINT R3
+		MUL R2 R0 R1
+		DIV R3 R0 R1
+		PRINT R2
+		PRINT R3
+		REM R2 R3 R1
+		AND R3 R0 R1
+		PRINT R2
+		PRINT R3
+		OR R2 R0 R1
+		XOR R3 R0 R1
+		NOT R1 R1
+		PRINT R2
+		PRINT R3
+		PRINT R1
+		LOAD R1 62
+		SHL R2 R1 R1
+		LOAD R3 1
+		SHL R2 R3 R1
+		PRINT R2
+		ADD R2 R2 R2
+		PRINT R2
+		SUB R2 R2 R3
+		MUL R2 R2 R2
+		PRINT R2
+		LOAD R1 -1
+		SHR R2 R1 R3
+		PRINT R2
+		LOAD R3 100
+		SHL R2 R1 R3
+		SHR R1 R1 R3
+		PRINT R2
+		PRINT R1`, ""},
+	{"comparisons and memory", `
+		LOAD R0 4
+		LOAD R1 7
+		GT R2 R0 R1
+		LT R3 R0 R1
+		STORE R2 0x10
+		STORE R3 0x11
+		GTE R2 R1 R1
+		LTE R3 R1 R0
+		STORE R2 0x12
+		STORE R3 0x13
+		EQ R2 R0 R0
+		NEQ R3 R0 R0
+		STORE R2 0x14
+		STORE R3 0x15
+		PRINT MEM 0x10
+		PRINT MEM 0x11
+		PRINT MEM 0x12
+		PRINT MEM 0x13
+		PRINT MEM 0x14
+		PRINT MEM 0x15
+		LOADM R0 0x14
+		PRINT R0
+		XCHG R1 0x14
+		PRINT R1
+		PRINT MEM 0x14
+		LOAD R0 7
+		LOAD R3 9
+		CAS R0 R3 0x14
+		PRINT R0
+		PRINT MEM 0x14
+		CAS R0 R1 0x14
+		PRINT MEM 0x14
+		FENCE
+		CORE R2
+		TLBFLUSH
+		PRINT R2`, ""},
+	{"loops and calls", `
+		LOAD R0 10
+		LOAD R1 1
+		LOAD R2 0
+	loop:
+		ADD R2 R2 R0
+		SUB R0 R0 R1
+		JNZ R0 loop
+		PRINT R2
+		LOAD R0 5
+		CALL fact
+		PRINT R0
+		CYCLES R3
+		PRINT R3
+		JZ R1 skip
+		JMP end
+	skip:
+		PRINT R1
+	end:
+		HALT
+		PRINT R1
+	fact:
+		LOAD R1 1
+		LTE R3 R0 R1
+		JZ R3 recurse
+		LOAD R0 1
+		RET
+	recurse:
+		STORE R0 0x10
+		SUB R0 R0 R1
+		CALL fact
+		LOADM R1 0x10
+		MUL R0 R0 R1
+		RET`, ""},
+	{"division by zero", `
+		LOAD R0 1
+		PRINT R0
+		DIV R0 R0 R1`, ""},
+	{"remainder by zero", `
+		REM R0 R0 R1`, ""},
+	{"stack overflow", `
+	recurse:
+		CALL recurse`, ""},
+	{"stack underflow", `
+		RET`, ""},
+	{"return past the end", `
+		LOAD R0 9
+		STORE R0 0xFF
+		LOAD R0 0
+		PRINT R0
+		CALL sub
+		PRINT R0
+	sub:
+		LOAD R0 250
+		RET`, ""},
+	{"host system calls", `
+		LOAD R0 72
+		STORE R0 0x40
+		LOAD R0 105
+		STORE R0 0x41
+		LOAD R0 0x20AC
+		STORE R0 0x42
+		LOAD R0 -1
+		STORE R0 0x43
+		LOAD R0 10
+		STORE R0 0x44
+		LOAD R1 0x40
+		LOAD R2 5
+		SYSCALL 1
+	read:
+		SYSCALL 2
+		PRINT R0
+		LOAD R3 1
+		ADD R0 R0 R3
+		JNZ R0 read
+		LOAD R0 3
+		SYSCALL 0
+		PRINT R0`, "ok"},
+	{"bad write", `
+		LOAD R1 -20
+		LOAD R2 1
+		SYSCALL 1`, ""},
+	{"unknown system call", `
+		SYSCALL 9`, ""},
+	{"system call handler", `
+		LOAD R0 handler
+		STORE R0 0xDC
+		LOAD R0 handler2
+		STORE R0 0xDB
+		EI
+		USER main
+	main:
+		SYSCALL 7
+		PRINT R1
+		DI
+		PRINT R2
+		SETPTB R0
+	handler:
+		LOADM R1 0xDD
+		IRET
+	handler2:
+		LOAD R2 42
+		CYCLES R3
+		PRINT R3
+		LOAD R0 0
+		STORE R0 0xDB
+		IRET`, ""},
+	{"supervisor only", `
+		SETPTB R0`, ""},
+	{"user writes a vector", `
+		USER start
+	start:
+		LOAD R0 evil
+		STORE R0 0xDC
+		SYSCALL 7
+	evil:
+		DI
+		PRINT R0`, ""},
+	{"user stack overflows before the vectors", `
+		USER deeper
+	deeper:
+		CALL deeper`, ""},
+}
+
+// captureStdout returns what f writes to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	defer func() {
+		w.Close()
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	os.Stdout = stdout
+	return <-output
+}
+
+// runEmulator runs the script in dir with RunFile, returning its output and exit status.
+func runEmulator(t *testing.T, dir, source, input string) (string, int) {
+	t.Helper()
+	path := filepath.Join(dir, "script.ass")
+	if err := os.WriteFile(path, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cpu := runtime.NewCPU()
+	output := captureStdout(t, func() {
+		cpu.SetSyscalls(runtime.NewSyscallTable(strings.NewReader(input), os.Stdout))
+		runtime.RunFile(cpu, path, runtime.Options{})
+	})
+	status, _ := cpu.ExitStatus()
+	return output, status
+}
+
+func assemble(t *testing.T, source string) *commands.Program {
+	t.Helper()
+	program, err := commands.Assemble(source, commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func TestEmitCMatchesEmulator(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	for _, script := range testScripts {
+		dir := t.TempDir()
+		var source bytes.Buffer
+		if err := EmitC(&source, assemble(t, script.source), runtime.DefaultCostTable()); err != nil {
+			t.Fatalf("%s: EmitC() error = %v", script.name, err)
+		}
+		cFile, binary := filepath.Join(dir, "script.c"), filepath.Join(dir, "script")
+		if err := os.WriteFile(cFile, source.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(cc, "-std=c11", "-Wall", "-Werror", "-O2", "-o", binary, cFile).CombinedOutput(); err != nil {
+			t.Fatalf("%s: compiling the translation failed: %v\n%s", script.name, err, out)
+		}
+
+		cmd := exec.Command(binary)
+		cmd.Stdin = strings.NewReader(script.input)
+		got, err := cmd.Output()
+		status := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			t.Fatalf("%s: running the translation failed: %v", script.name, err)
+		}
+
+		want, wantStatus := runEmulator(t, dir, script.source, script.input)
+		if string(got) != want {
+			t.Errorf("%s: output of the translation\n%q\nwant\n%q", script.name, got, want)
+		}
+		if status != wantStatus {
+			t.Errorf("%s: exit status %d, want %d", script.name, status, wantStatus)
+		}
+	}
+}
+
+func TestEmitC(t *testing.T) {
+	var out bytes.Buffer
+	if err := EmitC(&out, assemble(t, "LOAD R0 1\nloop:\nSHL R0 R0 R0\nJMP loop"), nil); err != nil {
+		t.Fatal(err)
+	}
+	source := out.String()
+	for _, want := range []string{"L1: /* SHL R0 R0 R0, line 3 */", "r0 = shl(r0, r0);", "goto L1;", "case 1: goto L1;", "cycles += 1;"} {
+		if !strings.Contains(source, want) {
+			t.Errorf("translation lacks %q:\n%s", want, source)
+		}
+	}
+	// Only the helpers the program calls are written
+	if !strings.Contains(source, "static int64_t shl(") || strings.Contains(source, "static int64_t add(") ||
+		strings.Contains(source, "static void fault(") {
+		t.Errorf("unexpected helpers:\n%s", source)
+	}
+
+	if err := EmitC(&out, assemble(t, "LOAD R0 1\n.region rodata 0x00 0x0F"), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("EmitC() with a region: error = %v, want one for line 2", err)
+	}
+	if err := EmitC(&out, assemble(t, "LOAD R0 1\nHALT\n.REGION rodata 0x00 0x0F"), nil); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("EmitC() with an uppercase region: error = %v, want one for line 3", err)
+	}
+}
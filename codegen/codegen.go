@@ -0,0 +1,106 @@
+// Package codegen translates assembled TinyASS programs to other languages, so
+// they can run without the emulator.
+package codegen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+	"tinyass/utils"
+)
+
+// Emitter translates an assembled program. The translation behaves like the
+// program run by the CPU with the timing model in costs, so CYCLES reads the
+// same counts.
+type Emitter func(w io.Writer, program *commands.Program, costs *runtime.CostTable) error
+
+// EmitFile assembles the script in filename and writes its translation to
+// standard output, reporting any error to the user.
+func EmitFile(filename string, opts runtime.Options, emit Emitter) bool {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		utils.RED.Printf("Error reading file %s: %v\n", filename, err)
+		return false
+	}
+	program, err := commands.Assemble(string(source), commands.ParseOptions{StrictCase: opts.StrictCase})
+	if err != nil {
+		utils.RED.Printf("Error parsing %v\n", err)
+		return false
+	}
+	costs := runtime.DefaultCostTable()
+	if opts.Costs != "" {
+		if costs, err = runtime.LoadCostTable(opts.Costs); err != nil {
+			utils.RED.Printf("Error loading cost table: %v\n", err)
+			return false
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	if err := emit(out, program, costs); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	if err := out.Flush(); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// checkProgram reports what keeps program from being translated: features that
+// need the emulator, such as memory protection.
+func checkProgram(program *commands.Program) error {
+	if len(program.Regions) > 0 {
+		return fmt.Errorf("line %d: memory regions (.region) need the emulator and cannot be translated", regionLine(program))
+	}
+	for pc, inst := range program.Instructions {
+		if inst.Opcode == commands.IRQ || inst.Opcode < 0 || inst.Opcode >= commands.NUM_OPCODES {
+			return fmt.Errorf("instruction %s at 0x%02X cannot be translated", commands.Mnemonic(inst.Opcode), pc)
+		}
+	}
+	return nil
+}
+
+// regionLine returns the source line of the first .region directive, which the
+// assembler accepts in any case.
+func regionLine(program *commands.Program) int {
+	for i, line := range program.Source {
+		fields := commands.SplitFields(line)
+		for _, field := range fields {
+			if strings.EqualFold(field, ".region") {
+				return i + 1
+			}
+		}
+	}
+	return 0
+}
+
+// instCost is the timing of one instruction in a translation.
+type instCost struct {
+	base   uint64 // Base cost of the opcode
+	memory uint64 // Extra cycles per memory access
+	branch uint64 // Extra cycles when control is transferred
+}
+
+// costOf returns the timing of an opcode under costs.
+func costOf(costs *runtime.CostTable, opcode int) instCost {
+	if costs == nil {
+		return instCost{base: 1}
+	}
+	return instCost{costs.Cost(opcode), costs.MemoryAccess, costs.BranchTaken}
+}
+
+// cycles returns the cost of an instruction making accesses memory accesses,
+// and transferring control when jumped is set.
+func (c instCost) cycles(accesses uint64, jumped bool) uint64 {
+	cost := c.base + accesses*c.memory
+	if jumped {
+		cost += c.branch
+	}
+	return cost
+}
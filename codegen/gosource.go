@@ -0,0 +1,383 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"go/token"
+	"io"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+)
+
+// goHeader starts every Go translation. The imports are filled in once the body is known.
+const goHeader = `// Code generated by tinyass emit-go. DO NOT EDIT.
+
+// Package %[1]s runs a TinyASS program compiled to Go.
+package %[1]s
+
+import (
+%[2]s)
+
+// Number of memory cells
+const MEMORY_SIZE = %[3]d
+
+// Lowest address of the stack, which grows down from the top of memory
+const STACK_FLOOR = %[4]d
+
+// Result is the state of the machine when the program stopped.
+type Result struct {
+	Registers  [4]int
+	Memory     [MEMORY_SIZE]int
+	Cycles     uint64
+	Exited     bool  // Whether the program made the exit system call
+	ExitStatus int   // Status passed to the exit system call
+	Err        error // Fault that stopped the program, nil when it halted or ran to its end
+}
+`
+
+// goEmitter writes the Go translation of one program.
+type goEmitter struct {
+	buf     bytes.Buffer // Body of Run
+	program *commands.Program
+	costs   *runtime.CostTable
+}
+
+// GoEmitter returns an Emitter translating programs into Go package pkg. The
+// package has a function Run(memory, out) executing the program on the given
+// initial memory, writing what it prints to out and returning the final state.
+// Register and memory lines printed by PRINT look like the CPU's, without
+// colors; faults are returned in the result instead of printed. Programs
+// reading input with the read system call take it from the package variable Input.
+func GoEmitter(pkg string) Emitter {
+	return func(w io.Writer, program *commands.Program, costs *runtime.CostTable) error {
+		if !token.IsIdentifier(pkg) {
+			return fmt.Errorf("invalid package name %q", pkg)
+		}
+		if err := checkProgram(program); err != nil {
+			return err
+		}
+		e := &goEmitter{program: program, costs: costs}
+		return e.emit(w, pkg)
+	}
+}
+
+func (e *goEmitter) emit(w io.Writer, pkg string) error {
+	readsInput := false
+	for pc, inst := range e.program.Instructions {
+		e.printf("L%d: // %s", pc, commands.Disassemble(inst))
+		if line := e.program.LineOf(pc); line > 0 {
+			e.printf(", line %d", line)
+		}
+		e.printf("\n")
+		e.instruction(pc, inst)
+		readsInput = readsInput || (inst.Opcode == commands.SYSCALL && inst.Operands[0] == runtime.SYS_READ)
+	}
+	e.printf("goto done\n\ndispatch:\nswitch pc {\n")
+	for pc := range e.program.Instructions {
+		e.printf("case %d:\ngoto L%d\n", pc, pc)
+	}
+	e.printf("}\n\ndone:\n")
+	e.printf("_, _, _, _ = mem, sp, interrupts, user\n")
+	e.printf("result.Registers = [4]int{r0, r1, r2, r3}\n")
+	e.printf("result.Cycles = cycles\n")
+	e.printf("return result\n}\n")
+
+	var src bytes.Buffer
+	var imports strings.Builder
+	for _, name := range []string{"bufio", "errors", "fmt", "io", "os", "time"} {
+		used := bytes.Contains(e.buf.Bytes(), []byte(name+"."))
+		if name == "io" || (readsInput && (name == "bufio" || name == "os")) {
+			used = true
+		}
+		if used {
+			fmt.Fprintf(&imports, "\t%q\n", name)
+		}
+	}
+	fmt.Fprintf(&src, goHeader, pkg, imports.String(), commands.MEMORY_SIZE, runtime.STACK_FLOOR)
+	if readsInput {
+		src.WriteString("\n// Input is read by the read system call.\nvar Input io.Reader = os.Stdin\n")
+	}
+	src.WriteString(`
+// Run executes the program with memory initialized from memory, writing what
+// it prints to out.
+func Run(memory [MEMORY_SIZE]int, out io.Writer) (result Result) {
+	result.Memory = memory
+	mem := &result.Memory
+	var r0, r1, r2, r3, pc int
+	var cycles uint64
+	var interrupts, user bool
+	sp := MEMORY_SIZE
+`)
+	if readsInput {
+		src.WriteString("in := bufio.NewReader(Input)\n")
+	}
+	src.WriteString("\ngoto dispatch\n")
+	src.Write(e.buf.Bytes())
+
+	formatted, err := format.Source(src.Bytes())
+	if err != nil {
+		return fmt.Errorf("formatting the translation: %v", err)
+	}
+	_, err = w.Write(formatted)
+	return err
+}
+
+func (e *goEmitter) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&e.buf, format, args...)
+}
+
+// line writes one statement of the instruction being translated.
+func (e *goEmitter) line(format string, args ...interface{}) {
+	e.printf(format+"\n", args...)
+}
+
+// fault writes statements stopping the program with a fault message. Like on
+// the CPU, the faulting instruction still costs cost cycles.
+func (e *goEmitter) fault(cost uint64, format string, args ...interface{}) {
+	e.line("result.Err = errors.New(%q)", fmt.Sprintf(format, args...))
+	e.stop(cost)
+}
+
+// stop writes statements stopping the program after an instruction costing cost cycles.
+func (e *goEmitter) stop(cost uint64) {
+	e.line("cycles += %d", cost)
+	e.line("goto done")
+}
+
+// jump writes a transfer of control to a known address.
+func (e *goEmitter) jump(target int) {
+	if target < 0 || target >= len(e.program.Instructions) {
+		e.line("goto done")
+		return
+	}
+	e.line("goto L%d", target)
+}
+
+// cycles writes the cost of the instruction being translated.
+func (e *goEmitter) cycles(c instCost, accesses uint64, jumped bool) {
+	e.line("cycles += %d", c.cycles(accesses, jumped))
+}
+
+// instruction writes the translation of inst at pc.
+func (e *goEmitter) instruction(pc int, inst commands.Instruction) {
+	ops := inst.Operands
+	c := costOf(e.costs, inst.Opcode)
+	if runtime.IsPrivileged(inst.Opcode) {
+		e.line("if user {")
+		e.line("handler := mem[%d]", runtime.PRIVILEGE_FAULT_VECTOR)
+		e.line("if handler == 0 {")
+		e.fault(c.base, "Privileged instruction %s in user mode on program counter %d", commands.Mnemonic(inst.Opcode), pc)
+		e.line("}")
+		e.trap(pc, c, pc, 0)
+		e.line("}")
+	}
+
+	switch inst.Opcode {
+	case commands.LOAD:
+		e.line("r%d = %d", ops[0], ops[1])
+		e.cycles(c, 0, false)
+	case commands.STORE:
+		e.guardWrite(pc, ops[1], c.base)
+		e.line("mem[%d] = r%d", ops[1], ops[0])
+		e.cycles(c, 1, false)
+	case commands.LOADM:
+		e.line("r%d = mem[%d]", ops[0], ops[1])
+		e.cycles(c, 1, false)
+	case commands.CAS:
+		e.line("if old := mem[%d]; old == r%d {", ops[2], ops[0])
+		e.guardWrite(pc, ops[2], c.cycles(1, false))
+		e.line("mem[%d] = r%d", ops[2], ops[1])
+		e.line("r%d = old", ops[0])
+		e.line("cycles += %d", c.cycles(2, false))
+		e.line("} else {")
+		e.line("r%d = old", ops[0])
+		e.line("cycles += %d", c.cycles(1, false))
+		e.line("}")
+	case commands.XCHG:
+		e.guardWrite(pc, ops[1], c.cycles(1, false))
+		e.line("mem[%d], r%d = r%d, mem[%d]", ops[1], ops[0], ops[0], ops[1])
+		e.cycles(c, 2, false)
+	case commands.FENCE, commands.TLBFLUSH:
+		e.cycles(c, 0, false)
+	case commands.CORE:
+		e.line("r%d = 0", ops[0])
+		e.cycles(c, 0, false)
+	case commands.SETPTB:
+		e.fault(c.base, "SETPTB needs an MMU (run with --mmu) on program counter %d", pc)
+	case commands.SYSCALL:
+		e.syscall(pc, c, ops[0])
+	case commands.USER:
+		e.line("user = true")
+		e.cycles(c, 0, true)
+		e.jump(ops[0])
+	case commands.DIV, commands.REM:
+		e.line("if r%d == 0 {", ops[2])
+		if inst.Opcode == commands.DIV {
+			e.fault(c.base, "Division by zero on program counter %d", pc+1)
+		} else {
+			e.fault(c.base, "Division by zero")
+		}
+		e.line("}")
+		e.line("r%d = r%d %s r%d", ops[0], ops[1], goOperators[inst.Opcode], ops[2])
+		e.cycles(c, 0, false)
+	case commands.ADD, commands.SUB, commands.MUL, commands.AND, commands.OR, commands.XOR:
+		e.line("r%d = r%d %s r%d", ops[0], ops[1], goOperators[inst.Opcode], ops[2])
+		e.cycles(c, 0, false)
+	case commands.SHL, commands.SHR:
+		e.line("r%d = r%d %s uint(r%d)", ops[0], ops[1], goOperators[inst.Opcode], ops[2])
+		e.cycles(c, 0, false)
+	case commands.NOT:
+		e.line("r%d = ^r%d", ops[0], ops[1])
+		e.cycles(c, 0, false)
+	case commands.GT, commands.LT, commands.GTE, commands.LTE, commands.EQ, commands.NEQ:
+		e.line("if r%d %s r%d {", ops[1], comparisons[inst.Opcode], ops[2])
+		e.line("r%d = 1", ops[0])
+		e.line("} else {")
+		e.line("r%d = 0", ops[0])
+		e.line("}")
+		e.cycles(c, 0, false)
+	case commands.JMP:
+		e.cycles(c, 0, true)
+		e.jump(ops[0])
+	case commands.JZ, commands.JNZ:
+		test := map[int]string{commands.JZ: "==", commands.JNZ: "!="}[inst.Opcode]
+		e.line("if r%d %s 0 {", ops[0], test)
+		e.line("cycles += %d", c.cycles(0, true))
+		e.jump(ops[1])
+		e.line("}")
+		e.cycles(c, 0, false)
+	case commands.PRINT:
+		if ops[0] == -1 {
+			e.line("fmt.Fprintf(out, \"Register R%d = %%d\\n\", r%d)", ops[1], ops[1])
+			e.cycles(c, 0, false)
+		} else {
+			e.line("fmt.Fprintf(out, \"Memory[%d] = %%d\\n\", mem[%d])", ops[0], ops[0])
+			e.cycles(c, 1, false)
+		}
+	case commands.CALL:
+		e.line("if sp <= STACK_FLOOR {")
+		e.fault(c.base, "Stack overflow on program counter %d", pc+1)
+		e.line("}")
+		e.line("sp--")
+		e.line("mem[sp] = %d", pc+1)
+		e.cycles(c, 1, true)
+		e.jump(ops[0])
+	case commands.RET:
+		e.line("if sp >= MEMORY_SIZE {")
+		e.fault(c.base, "Stack underflow on program counter %d", pc+1)
+		e.line("}")
+		e.line("pc = mem[sp]")
+		e.line("sp++")
+		e.cycles(c, 1, true)
+		e.line("goto dispatch")
+	case commands.CYCLES:
+		e.line("r%d = int(cycles)", ops[0])
+		e.cycles(c, 0, false)
+	case commands.EI, commands.DI:
+		e.line("interrupts = %v", inst.Opcode == commands.EI)
+		e.cycles(c, 0, false)
+	case commands.IRET:
+		e.line("if sp > MEMORY_SIZE-2 {")
+		e.fault(c.base, "Stack underflow on program counter %d", pc+1)
+		e.line("}")
+		e.line("interrupts = mem[sp]&%d != 0", runtime.FLAG_INTERRUPTS_ENABLED)
+		e.line("user = mem[sp]&%d != 0", runtime.FLAG_USER_MODE)
+		e.line("pc = mem[sp+1]")
+		e.line("sp += 2")
+		e.cycles(c, 2, true)
+		e.line("goto dispatch")
+	case commands.HALT:
+		e.stop(c.base)
+	}
+}
+
+// trap writes the entry into the supervisor handler held in the variable
+// handler, returning to ret. accesses are the memory accesses the instruction
+// made before the trap.
+func (e *goEmitter) trap(pc int, c instCost, ret int, accesses uint64) {
+	e.line("if sp-2 < STACK_FLOOR {")
+	e.fault(c.cycles(accesses, false), "Stack overflow entering a trap handler on program counter %d", pc)
+	e.line("}")
+	e.line("flags := 0")
+	e.line("if interrupts {")
+	e.line("flags |= %d", runtime.FLAG_INTERRUPTS_ENABLED)
+	e.line("}")
+	e.line("if user {")
+	e.line("flags |= %d", runtime.FLAG_USER_MODE)
+	e.line("}")
+	e.line("sp--")
+	e.line("mem[sp] = %d", ret)
+	e.line("sp--")
+	e.line("mem[sp] = flags")
+	e.line("interrupts, user = false, false")
+	e.line("pc = handler")
+	e.line("cycles += %d", c.cycles(accesses+2, true))
+	e.line("goto dispatch")
+}
+
+// guardWrite writes the protection fault of a write to addr in user mode, when
+// addr holds a vector. The faulting instruction costs cost cycles.
+func (e *goEmitter) guardWrite(pc, addr int, cost uint64) {
+	if !runtime.SupervisorOnly(addr) {
+		return
+	}
+	e.line("if user {")
+	e.fault(cost, "%s", runtime.VectorFault(runtime.ACCESS_WRITE, addr, pc))
+	e.line("}")
+}
+
+// syscall writes system call n: a trap into the handler installed by the
+// program, or else the host's implementation.
+func (e *goEmitter) syscall(pc int, c instCost, n int) {
+	e.line("if handler := mem[%d]; handler != 0 {", runtime.SYSCALL_VECTOR)
+	e.line("mem[%d] = %d", runtime.SYSCALL_NUMBER, n)
+	e.trap(pc, c, pc+1, 1)
+	e.line("}")
+	switch n {
+	case runtime.SYS_EXIT:
+		e.line("result.ExitStatus, result.Exited = r0, true")
+		e.stop(c.base)
+	case runtime.SYS_WRITE:
+		e.line("if r2 < 0 || r1 < 0 || r1+r2 > MEMORY_SIZE {")
+		e.line("result.Err = fmt.Errorf(\"write of %%d cells at 0x%%02X is outside memory on program counter %d\", r2, r1)", pc)
+		e.stop(c.base)
+		e.line("}")
+		e.line("{")
+		e.line("text := make([]rune, 0, r2)")
+		e.line("for _, cell := range mem[r1 : r1+r2] {")
+		e.line("text = append(text, rune(cell))")
+		e.line("}")
+		e.line("fmt.Fprint(out, string(text))")
+		e.line("}")
+		e.line("cycles += %d + uint64(r2)*%d", c.base, c.memory)
+	case runtime.SYS_READ:
+		e.line("if b, err := in.ReadByte(); err != nil {")
+		e.line("r0 = -1")
+		e.line("} else {")
+		e.line("r0 = int(b)")
+		e.line("}")
+		e.cycles(c, 0, false)
+	case runtime.SYS_TIME:
+		e.line("r0 = int(time.Now().UnixMilli())")
+		e.cycles(c, 0, false)
+	default:
+		e.fault(c.base, "Unknown system call %d on program counter %d", n, pc)
+	}
+}
+
+// goOperators maps arithmetic opcodes to their Go operator.
+var goOperators = map[int]string{
+	commands.ADD: "+",
+	commands.SUB: "-",
+	commands.MUL: "*",
+	commands.DIV: "/",
+	commands.REM: "%",
+	commands.AND: "&",
+	commands.OR:  "|",
+	commands.XOR: "^",
+	commands.SHL: "<<",
+	commands.SHR: ">>",
+}
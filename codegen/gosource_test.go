@@ -0,0 +1,192 @@
+package codegen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+)
+
+// goResult is the final state reported by a translated program, or the
+// interpreter, as compared by TestEmitGoMatchesInterpreter.
+type goResult struct {
+	Output     string
+	Registers  [4]int
+	Memory     [commands.MEMORY_SIZE]int
+	Cycles     uint64
+	Exited     bool
+	ExitStatus int
+	Err        string
+}
+
+// initialMemory is the memory image every translated program starts from.
+func initialMemory() [commands.MEMORY_SIZE]int {
+	var memory [commands.MEMORY_SIZE]int
+	for i := 0x30; i < 0x38; i++ {
+		memory[i] = i * 3
+	}
+	return memory
+}
+
+// goScripts are the test scripts, plus one reading the initial memory.
+var goScripts = append(testScripts[:len(testScripts):len(testScripts)], struct{ name, source, input string }{
+	"initial memory", `
+		LOADM R0 0x31
+		LOADM R1 0x37
+		ADD R2 R0 R1
+		PRINT R2
+		LOAD R1 0x30
+		LOAD R2 8
+		SYSCALL 1`, "",
+})
+
+// colors matches the escape codes of colored output.
+var colors = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// runInterpreter runs source on the CPU from initialMemory.
+func runInterpreter(t *testing.T, dir, source, input string) goResult {
+	t.Helper()
+	memory := initialMemory()
+	image := filepath.Join(dir, "memory.hex")
+	var buf bytes.Buffer
+	if err := runtime.WriteMemoryImage(&buf, memory[:], runtime.MEMIMAGE_DUMP); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(image, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cpu := runtime.NewCPU()
+	if err := cpu.LoadMemoryImage(image, runtime.MEMIMAGE_DUMP); err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(assemble(t, source).Instructions)
+	output := captureStdout(t, func() {
+		cpu.SetSyscalls(runtime.NewSyscallTable(strings.NewReader(input), os.Stdout))
+		cpu.Run()
+	})
+
+	snap, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := goResult{Cycles: snap.Cycles}
+	copy(result.Registers[:], snap.Registers)
+	copy(result.Memory[:], snap.Memory)
+	result.ExitStatus, result.Exited = cpu.ExitStatus()
+	// The translation returns faults rather than printing them, and has no colors
+	lines := strings.SplitAfter(colors.ReplaceAllString(output, ""), "\n")
+	for _, line := range lines {
+		if strings.HasPrefix(line, "Error: ") {
+			continue
+		}
+		result.Output += line
+	}
+	if fault := cpu.Fault(); fault != nil {
+		result.Err = fault.Message
+	}
+	return result
+}
+
+func TestEmitGoMatchesInterpreter(t *testing.T) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	// All translations go in one module, run by one main package
+	dir := t.TempDir()
+	write := func(path, content string) {
+		t.Helper()
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module generated\n\ngo 1.23\n")
+	var main strings.Builder
+	main.WriteString("package main\n\nimport (\n\t\"bytes\"\n\t\"encoding/json\"\n\t\"os\"\n\t\"strings\"\n")
+	for i := range goScripts {
+		fmt.Fprintf(&main, "\t\"generated/p%d\"\n", i)
+	}
+	main.WriteString(")\n\nfunc main() {\n\tenc := json.NewEncoder(os.Stdout)\n\t_ = strings.NewReader\n")
+	memory := initialMemory()
+	for i, script := range goScripts {
+		var source bytes.Buffer
+		if err := GoEmitter(fmt.Sprintf("p%d", i))(&source, assemble(t, script.source), runtime.DefaultCostTable()); err != nil {
+			t.Fatalf("%s: EmitGo() error = %v", script.name, err)
+		}
+		write(fmt.Sprintf("p%d/program.go", i), source.String())
+		if strings.Contains(source.String(), "var Input") {
+			fmt.Fprintf(&main, "\tp%d.Input = strings.NewReader(%q)\n", i, script.input)
+		}
+		fmt.Fprintf(&main, "\t{\n\t\tvar out bytes.Buffer\n\t\tr := p%d.Run(%#v, &out)\n", i, memory)
+		main.WriteString("\t\terr := \"\"\n\t\tif r.Err != nil {\n\t\t\terr = r.Err.Error()\n\t\t}\n")
+		main.WriteString("\t\tenc.Encode(map[string]any{\"Output\": out.String(), \"Registers\": r.Registers, \"Memory\": r.Memory, \"Cycles\": r.Cycles, \"Exited\": r.Exited, \"ExitStatus\": r.ExitStatus, \"Err\": err})\n\t}\n")
+	}
+	main.WriteString("}\n")
+	write("main.go", main.String())
+
+	cmd := exec.Command(goTool, "run", ".")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+	out, err := cmd.Output()
+	if err != nil {
+		var stderr []byte
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = exitErr.Stderr
+		}
+		t.Fatalf("running the translations failed: %v\n%s", err, stderr)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for _, script := range goScripts {
+		var got goResult
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("%s: reading the result: %v", script.name, err)
+		}
+		want := runInterpreter(t, t.TempDir(), script.source, script.input)
+		if got.Output != want.Output {
+			t.Errorf("%s: output\n%q\nwant\n%q", script.name, got.Output, want.Output)
+		}
+		if got.Err != want.Err || got.Exited != want.Exited || got.ExitStatus != want.ExitStatus {
+			t.Errorf("%s: error %q, exit %v %d, want error %q, exit %v %d", script.name,
+				got.Err, got.Exited, got.ExitStatus, want.Err, want.Exited, want.ExitStatus)
+		}
+		if got.Registers != want.Registers || got.Cycles != want.Cycles || got.Memory != want.Memory {
+			t.Errorf("%s: registers %v, %d cycles, want registers %v, %d cycles (memory equal: %v)", script.name,
+				got.Registers, got.Cycles, want.Registers, want.Cycles, got.Memory == want.Memory)
+		}
+	}
+}
+
+func TestEmitGo(t *testing.T) {
+	var out bytes.Buffer
+	if err := GoEmitter("loop")(&out, assemble(t, "LOAD R0 1\nloop:\nSHL R0 R0 R0\nJMP loop"), nil); err != nil {
+		t.Fatal(err)
+	}
+	source := out.String()
+	for _, want := range []string{"package loop\n", "L1: // SHL R0 R0 R0, line 3", "r0 = r0 << uint(r0)", "goto L1", "cycles += 1"} {
+		if !strings.Contains(source, want) {
+			t.Errorf("translation lacks %q:\n%s", want, source)
+		}
+	}
+	// Only the packages the program uses are imported
+	if strings.Contains(source, `"fmt"`) || strings.Contains(source, `"bufio"`) {
+		t.Errorf("unexpected imports:\n%s", source)
+	}
+
+	if err := GoEmitter("not a name")(&out, assemble(t, "HALT"), nil); err == nil {
+		t.Errorf("GoEmitter() with an invalid package name should fail")
+	}
+}
@@ -0,0 +1,632 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+)
+
+// Values returned by the exported run function of a WebAssembly translation
+const (
+	WAT_HALTED  = 0 // The program halted or ran past its last instruction
+	WAT_EXITED  = 1 // The program made the exit system call, see the exit_status global
+	WAT_FAULTED = 2 // The program faulted, after reporting the message with the fault import
+)
+
+// Byte size of a memory cell in the linear memory
+const WAT_CELL_SIZE = 8
+
+// Linear memory address of the fault messages, after the memory cells
+const WAT_MESSAGES = commands.MEMORY_SIZE * WAT_CELL_SIZE
+
+// watImports are the host functions a translation may import from the
+// "tinyass" module, declared only when the program calls them.
+var watImports = []struct{ name, signature string }{
+	{"print_register", "(param $register i32) (param $value i64)"},
+	{"print_memory", "(param $address i32) (param $value i64)"},
+	{"write", "(param $address i32) (param $length i32)"},
+	{"read", "(result i64)"},
+	{"time", "(result i64)"},
+	{"fault", "(param $message i32) (param $length i32)"},
+}
+
+// watHelpers are the functions a translation may need for Go's semantics,
+// written only when the program calls them.
+var watHelpers = []struct{ name, code string }{
+	{"quo", `  ;; Division, with the overflow of the most negative value by -1 wrapping like in Go
+  (func $quo (param $a i64) (param $b i64) (result i64)
+    local.get $b
+    i64.const -1
+    i64.eq
+    if (result i64)
+      i64.const 0
+      local.get $a
+      i64.sub
+    else
+      local.get $a
+      local.get $b
+      i64.div_s
+    end)
+`},
+	{"shl", `  ;; Left shift, 0 when shifting by 64 bits or more like in Go
+  (func $shl (param $a i64) (param $b i64) (result i64)
+    local.get $b
+    i64.const 64
+    i64.ge_u
+    if (result i64)
+      i64.const 0
+    else
+      local.get $a
+      local.get $b
+      i64.shl
+    end)
+`},
+	{"shr", `  ;; Arithmetic right shift, filling with the sign bit when shifting by 64 bits or more like in Go
+  (func $shr (param $a i64) (param $b i64) (result i64)
+    local.get $a
+    local.get $b
+    i64.const 63
+    local.get $b
+    i64.const 64
+    i64.lt_u
+    select
+    i64.shr_s)
+`},
+}
+
+// watEmitter writes the WebAssembly text translation of one program.
+type watEmitter struct {
+	buf      bytes.Buffer // Body of the run function
+	indent   int
+	program  *commands.Program
+	costs    *runtime.CostTable
+	messages bytes.Buffer   // Fault messages, stored at WAT_MESSAGES
+	offsets  map[string]int // Offset of each message in messages
+}
+
+// EmitWAT translates program into a WebAssembly module in text format. The
+// module exports its linear memory as "memory", whose first MEMORY_SIZE
+// little-endian 64-bit words mirror the CPU's memory cells, and a function
+// "run" executing the program and returning WAT_HALTED, WAT_EXITED or
+// WAT_FAULTED. The "cycles" and "exit_status" globals hold the cycle count
+// and the status passed to the exit system call.
+//
+// The host provides print_register and print_memory for PRINT, write, read
+// and time for the system calls, and fault, which receives the address and
+// length of a UTF-8 message, in the "tinyass" import module. Messages are
+// those of the CPU, except that a write outside memory does not tell the
+// cells it tried to write.
+func EmitWAT(w io.Writer, program *commands.Program, costs *runtime.CostTable) error {
+	if err := checkProgram(program); err != nil {
+		return err
+	}
+	e := &watEmitter{program: program, costs: costs, offsets: map[string]int{}, indent: 2}
+	e.body()
+
+	var out bytes.Buffer
+	out.WriteString(";; Generated by tinyass emit-wat.\n(module\n")
+	for _, imp := range watImports {
+		if bytes.Contains(e.buf.Bytes(), []byte("call $"+imp.name+"\n")) {
+			fmt.Fprintf(&out, "  (import \"tinyass\" %q (func $%s %s))\n", imp.name, imp.name, imp.signature)
+		}
+	}
+	pages := (WAT_MESSAGES + e.messages.Len() + 0xFFFF) / 0x10000
+	fmt.Fprintf(&out, "  (memory (export \"memory\") %d)\n", pages)
+	out.WriteString("  (global $cycles (export \"cycles\") (mut i64) (i64.const 0))\n")
+	out.WriteString("  (global $exit_status (export \"exit_status\") (mut i64) (i64.const 0))\n")
+	if e.messages.Len() > 0 {
+		fmt.Fprintf(&out, "  (data (i32.const %d) %s)\n", WAT_MESSAGES, watString(e.messages.String()))
+	}
+	for _, helper := range watHelpers {
+		if bytes.Contains(e.buf.Bytes(), []byte("call $"+helper.name+"\n")) {
+			out.WriteString(helper.code)
+		}
+	}
+	out.WriteString("  (func $run (export \"run\") (result i32)\n")
+	out.WriteString("    (local $r0 i64) (local $r1 i64) (local $r2 i64) (local $r3 i64)\n")
+	out.WriteString("    (local $pc i64) (local $sp i64) (local $handler i64) (local $old i64)\n")
+	out.WriteString("    (local $interrupts i32) (local $user i32) (local $status i32)\n")
+	fmt.Fprintf(&out, "    i64.const %d\n    local.set $sp\n", commands.MEMORY_SIZE)
+	out.Write(e.buf.Bytes())
+	out.WriteString("    local.get $status)\n)\n")
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// body writes the run function's code. Every instruction follows the end of
+// a block labeled after its address; a br_table on the program counter
+// branches out of the right block, so a jump sets pc and branches back to the
+// dispatch loop. Known targets could branch directly, but WebAssembly only
+// branches to enclosing blocks.
+func (e *watEmitter) body() {
+	n := len(e.program.Instructions)
+	e.open("block $done")
+	e.open("loop $dispatch")
+	e.open("block $end")
+	for pc := n - 1; pc >= 0; pc-- {
+		e.open("block $L%d", pc)
+	}
+	e.line("local.get $pc")
+	e.line("i64.const %d", n)
+	e.line("i64.ge_u")
+	e.line("br_if $end")
+	e.line("local.get $pc")
+	e.line("i32.wrap_i64")
+	targets := make([]string, 0, n+1)
+	for pc := 0; pc < n; pc++ {
+		targets = append(targets, fmt.Sprintf("$L%d", pc))
+	}
+	e.line("br_table %s $end", strings.Join(targets, " "))
+	for pc, inst := range e.program.Instructions {
+		e.close()
+		comment := fmt.Sprintf(";; 0x%02X %s", pc, commands.Disassemble(inst))
+		if line := e.program.LineOf(pc); line > 0 {
+			comment += fmt.Sprintf(", line %d", line)
+		}
+		e.line("%s", comment)
+		e.instruction(pc, inst)
+	}
+	e.close() // $end: past the last instruction
+	e.close() // $dispatch
+	e.close() // $done
+}
+
+func (e *watEmitter) line(format string, args ...interface{}) {
+	e.buf.WriteString(strings.Repeat("  ", e.indent))
+	fmt.Fprintf(&e.buf, format+"\n", args...)
+}
+
+// open writes a block, loop or if and indents its contents.
+func (e *watEmitter) open(format string, args ...interface{}) {
+	e.line(format, args...)
+	e.indent++
+}
+
+// close ends the innermost block.
+func (e *watEmitter) close() {
+	e.indent--
+	e.line("end")
+}
+
+// otherwise writes the else of the innermost if.
+func (e *watEmitter) otherwise() {
+	e.indent--
+	e.line("else")
+	e.indent++
+}
+
+// message returns the address of a fault message in linear memory.
+func (e *watEmitter) message(msg string) int {
+	offset, ok := e.offsets[msg]
+	if !ok {
+		offset = e.messages.Len()
+		e.offsets[msg] = offset
+		e.messages.WriteString(msg)
+	}
+	return WAT_MESSAGES + offset
+}
+
+// fault writes code reporting a fault message and stopping the program. Like
+// on the CPU, the faulting instruction still costs cost cycles.
+func (e *watEmitter) fault(cost uint64, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	e.line("i32.const %d", e.message(msg))
+	e.line("i32.const %d", len(msg))
+	e.line("call $fault")
+	e.stop(cost, WAT_FAULTED)
+}
+
+// stop writes code stopping the program with status after an instruction costing cost cycles.
+func (e *watEmitter) stop(cost uint64, status int) {
+	e.cycles(cost)
+	if status != WAT_HALTED {
+		e.line("i32.const %d", status)
+		e.line("local.set $status")
+	}
+	e.line("br $done")
+}
+
+// cycles writes code adding n to the cycle count.
+func (e *watEmitter) cycles(n uint64) {
+	e.line("global.get $cycles")
+	e.line("i64.const %d", n)
+	e.line("i64.add")
+	e.line("global.set $cycles")
+}
+
+// jump writes a transfer of control to a known address.
+func (e *watEmitter) jump(target int) {
+	if target < 0 || target >= len(e.program.Instructions) {
+		e.line("br $done")
+		return
+	}
+	e.line("i64.const %d", target)
+	e.line("local.set $pc")
+	e.line("br $dispatch")
+}
+
+// cell pushes the linear memory address of a constant memory cell.
+func (e *watEmitter) cell(addr int) {
+	e.line("i32.const %d", addr*WAT_CELL_SIZE)
+}
+
+// stackCell pushes the linear memory address of the cell at sp+offset.
+func (e *watEmitter) stackCell(offset int) {
+	e.line("local.get $sp")
+	if offset != 0 {
+		e.line("i64.const %d", offset)
+		e.line("i64.add")
+	}
+	e.line("i32.wrap_i64")
+	e.line("i32.const 3")
+	e.line("i32.shl")
+}
+
+// binary writes d = a op b.
+func (e *watEmitter) binary(d, a, b int, op string) {
+	e.line("local.get $r%d", a)
+	e.line("local.get $r%d", b)
+	e.line("%s", op)
+	e.line("local.set $r%d", d)
+}
+
+// watOperators maps opcodes to the WebAssembly instruction computing them.
+var watOperators = map[int]string{
+	commands.ADD: "i64.add",
+	commands.SUB: "i64.sub",
+	commands.MUL: "i64.mul",
+	commands.DIV: "call $quo",
+	commands.REM: "i64.rem_s", // Does not trap on overflow, the result is 0 like in Go
+	commands.AND: "i64.and",
+	commands.OR:  "i64.or",
+	commands.XOR: "i64.xor",
+	commands.SHL: "call $shl",
+	commands.SHR: "call $shr",
+	commands.GT:  "i64.gt_s",
+	commands.LT:  "i64.lt_s",
+	commands.GTE: "i64.ge_s",
+	commands.LTE: "i64.le_s",
+	commands.EQ:  "i64.eq",
+	commands.NEQ: "i64.ne",
+}
+
+// instruction writes the translation of inst at pc.
+func (e *watEmitter) instruction(pc int, inst commands.Instruction) {
+	ops := inst.Operands
+	c := costOf(e.costs, inst.Opcode)
+	if runtime.IsPrivileged(inst.Opcode) {
+		e.line("local.get $user")
+		e.open("if")
+		e.cell(runtime.PRIVILEGE_FAULT_VECTOR)
+		e.line("i64.load")
+		e.line("local.set $handler")
+		e.line("local.get $handler")
+		e.line("i64.eqz")
+		e.open("if")
+		e.fault(c.base, "Privileged instruction %s in user mode on program counter %d", commands.Mnemonic(inst.Opcode), pc)
+		e.close()
+		e.trap(pc, c, pc, 0)
+		e.close()
+	}
+
+	switch inst.Opcode {
+	case commands.LOAD:
+		e.line("i64.const %d", ops[1])
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(0, false))
+	case commands.STORE:
+		e.guardWrite(pc, ops[1], c.base)
+		e.cell(ops[1])
+		e.line("local.get $r%d", ops[0])
+		e.line("i64.store")
+		e.cycles(c.cycles(1, false))
+	case commands.LOADM:
+		e.cell(ops[1])
+		e.line("i64.load")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(1, false))
+	case commands.CAS:
+		e.cell(ops[2])
+		e.line("i64.load")
+		e.line("local.tee $old")
+		e.line("local.get $r%d", ops[0])
+		e.line("i64.eq")
+		e.open("if")
+		e.guardWrite(pc, ops[2], c.cycles(1, false))
+		e.cell(ops[2])
+		e.line("local.get $r%d", ops[1])
+		e.line("i64.store")
+		e.cycles(c.memory)
+		e.close()
+		e.line("local.get $old")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(1, false))
+	case commands.XCHG:
+		e.guardWrite(pc, ops[1], c.cycles(1, false))
+		e.cell(ops[1])
+		e.line("i64.load")
+		e.line("local.set $old")
+		e.cell(ops[1])
+		e.line("local.get $r%d", ops[0])
+		e.line("i64.store")
+		e.line("local.get $old")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(2, false))
+	case commands.FENCE, commands.TLBFLUSH:
+		e.cycles(c.cycles(0, false))
+	case commands.CORE:
+		e.line("i64.const 0")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(0, false))
+	case commands.SETPTB:
+		e.fault(c.base, "SETPTB needs an MMU (run with --mmu) on program counter %d", pc)
+	case commands.SYSCALL:
+		e.syscall(pc, c, ops[0])
+	case commands.USER:
+		e.line("i32.const 1")
+		e.line("local.set $user")
+		e.cycles(c.cycles(0, true))
+		e.jump(ops[0])
+	case commands.DIV, commands.REM:
+		e.line("local.get $r%d", ops[2])
+		e.line("i64.eqz")
+		e.open("if")
+		if inst.Opcode == commands.DIV {
+			e.fault(c.base, "Division by zero on program counter %d", pc+1)
+		} else {
+			e.fault(c.base, "Division by zero")
+		}
+		e.close()
+		e.binary(ops[0], ops[1], ops[2], watOperators[inst.Opcode])
+		e.cycles(c.cycles(0, false))
+	case commands.ADD, commands.SUB, commands.MUL, commands.AND, commands.OR, commands.XOR, commands.SHL, commands.SHR:
+		e.binary(ops[0], ops[1], ops[2], watOperators[inst.Opcode])
+		e.cycles(c.cycles(0, false))
+	case commands.NOT:
+		e.line("local.get $r%d", ops[1])
+		e.line("i64.const -1")
+		e.line("i64.xor")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(0, false))
+	case commands.GT, commands.LT, commands.GTE, commands.LTE, commands.EQ, commands.NEQ:
+		e.line("local.get $r%d", ops[1])
+		e.line("local.get $r%d", ops[2])
+		e.line("%s", watOperators[inst.Opcode])
+		e.line("i64.extend_i32_u")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(0, false))
+	case commands.JMP:
+		e.cycles(c.cycles(0, true))
+		e.jump(ops[0])
+	case commands.JZ, commands.JNZ:
+		e.line("local.get $r%d", ops[0])
+		e.line("i64.eqz")
+		if inst.Opcode == commands.JNZ {
+			e.line("i32.eqz")
+		}
+		e.open("if")
+		e.cycles(c.cycles(0, true))
+		e.jump(ops[1])
+		e.close()
+		e.cycles(c.cycles(0, false))
+	case commands.PRINT:
+		if ops[0] == -1 {
+			e.line("i32.const %d", ops[1])
+			e.line("local.get $r%d", ops[1])
+			e.line("call $print_register")
+			e.cycles(c.cycles(0, false))
+		} else {
+			e.line("i32.const %d", ops[0])
+			e.cell(ops[0])
+			e.line("i64.load")
+			e.line("call $print_memory")
+			e.cycles(c.cycles(1, false))
+		}
+	case commands.CALL:
+		e.line("local.get $sp")
+		e.line("i64.const %d", runtime.STACK_FLOOR)
+		e.line("i64.le_s")
+		e.open("if")
+		e.fault(c.base, "Stack overflow on program counter %d", pc+1)
+		e.close()
+		e.line("local.get $sp")
+		e.line("i64.const 1")
+		e.line("i64.sub")
+		e.line("local.set $sp")
+		e.stackCell(0)
+		e.line("i64.const %d", pc+1)
+		e.line("i64.store")
+		e.cycles(c.cycles(1, true))
+		e.jump(ops[0])
+	case commands.RET:
+		e.line("local.get $sp")
+		e.line("i64.const %d", commands.MEMORY_SIZE)
+		e.line("i64.ge_s")
+		e.open("if")
+		e.fault(c.base, "Stack underflow on program counter %d", pc+1)
+		e.close()
+		e.stackCell(0)
+		e.line("i64.load")
+		e.line("local.set $pc")
+		e.line("local.get $sp")
+		e.line("i64.const 1")
+		e.line("i64.add")
+		e.line("local.set $sp")
+		e.cycles(c.cycles(1, true))
+		e.line("br $dispatch")
+	case commands.CYCLES:
+		e.line("global.get $cycles")
+		e.line("local.set $r%d", ops[0])
+		e.cycles(c.cycles(0, false))
+	case commands.EI, commands.DI:
+		e.line("i32.const %d", map[int]int{commands.EI: 1, commands.DI: 0}[inst.Opcode])
+		e.line("local.set $interrupts")
+		e.cycles(c.cycles(0, false))
+	case commands.IRET:
+		e.line("local.get $sp")
+		e.line("i64.const %d", commands.MEMORY_SIZE-2)
+		e.line("i64.gt_s")
+		e.open("if")
+		e.fault(c.base, "Stack underflow on program counter %d", pc+1)
+		e.close()
+		e.stackCell(0)
+		e.line("i64.load")
+		e.line("local.set $old") // The flags word
+		e.line("local.get $old")
+		e.line("i64.const %d", runtime.FLAG_INTERRUPTS_ENABLED)
+		e.line("i64.and")
+		e.line("i64.const 0")
+		e.line("i64.ne")
+		e.line("local.set $interrupts")
+		e.line("local.get $old")
+		e.line("i64.const %d", runtime.FLAG_USER_MODE)
+		e.line("i64.and")
+		e.line("i64.const 0")
+		e.line("i64.ne")
+		e.line("local.set $user")
+		e.stackCell(1)
+		e.line("i64.load")
+		e.line("local.set $pc")
+		e.line("local.get $sp")
+		e.line("i64.const 2")
+		e.line("i64.add")
+		e.line("local.set $sp")
+		e.cycles(c.cycles(2, true))
+		e.line("br $dispatch")
+	case commands.HALT:
+		e.stop(c.base, WAT_HALTED)
+	}
+}
+
+// trap writes the entry into the supervisor handler held in $handler,
+// returning to ret. accesses are the memory accesses the instruction made
+// before the trap.
+func (e *watEmitter) trap(pc int, c instCost, ret int, accesses uint64) {
+	e.line("local.get $sp")
+	e.line("i64.const %d", runtime.STACK_FLOOR+2)
+	e.line("i64.lt_s")
+	e.open("if")
+	e.fault(c.cycles(accesses, false), "Stack overflow entering a trap handler on program counter %d", pc)
+	e.close()
+	e.stackCell(-1)
+	e.line("i64.const %d", ret)
+	e.line("i64.store")
+	e.stackCell(-2)
+	e.line("local.get $interrupts")
+	e.line("i64.extend_i32_u")
+	e.line("i64.const %d", runtime.FLAG_INTERRUPTS_ENABLED)
+	e.line("i64.mul")
+	e.line("local.get $user")
+	e.line("i64.extend_i32_u")
+	e.line("i64.const %d", runtime.FLAG_USER_MODE)
+	e.line("i64.mul")
+	e.line("i64.or")
+	e.line("i64.store")
+	e.line("local.get $sp")
+	e.line("i64.const 2")
+	e.line("i64.sub")
+	e.line("local.set $sp")
+	e.line("i32.const 0")
+	e.line("local.set $interrupts")
+	e.line("i32.const 0")
+	e.line("local.set $user")
+	e.line("local.get $handler")
+	e.line("local.set $pc")
+	e.cycles(c.cycles(accesses+2, true))
+	e.line("br $dispatch")
+}
+
+// guardWrite writes the protection fault of a write to addr in user mode, when
+// addr holds a vector. The faulting instruction costs cost cycles.
+func (e *watEmitter) guardWrite(pc, addr int, cost uint64) {
+	if !runtime.SupervisorOnly(addr) {
+		return
+	}
+	e.line("local.get $user")
+	e.open("if")
+	e.fault(cost, "%s", runtime.VectorFault(runtime.ACCESS_WRITE, addr, pc))
+	e.close()
+}
+
+// syscall writes system call n: a trap into the handler installed by the
+// program, or else the host's implementation.
+func (e *watEmitter) syscall(pc int, c instCost, n int) {
+	e.cell(runtime.SYSCALL_VECTOR)
+	e.line("i64.load")
+	e.line("local.tee $handler")
+	e.line("i64.eqz")
+	e.line("i32.eqz")
+	e.open("if")
+	e.cell(runtime.SYSCALL_NUMBER)
+	e.line("i64.const %d", n)
+	e.line("i64.store")
+	e.trap(pc, c, pc+1, 1)
+	e.close()
+	switch n {
+	case runtime.SYS_EXIT:
+		e.line("local.get $r0")
+		e.line("global.set $exit_status")
+		e.stop(c.base, WAT_EXITED)
+	case runtime.SYS_WRITE:
+		// r2 < 0 || r1 < 0 || r1+r2 > MEMORY_SIZE
+		e.line("local.get $r2")
+		e.line("i64.const 0")
+		e.line("i64.lt_s")
+		e.line("local.get $r1")
+		e.line("i64.const 0")
+		e.line("i64.lt_s")
+		e.line("i32.or")
+		e.line("local.get $r1")
+		e.line("local.get $r2")
+		e.line("i64.add")
+		e.line("i64.const %d", commands.MEMORY_SIZE)
+		e.line("i64.gt_s")
+		e.line("i32.or")
+		e.open("if")
+		e.fault(c.base, "write outside memory on program counter %d", pc)
+		e.close()
+		e.line("local.get $r1")
+		e.line("i32.wrap_i64")
+		e.line("local.get $r2")
+		e.line("i32.wrap_i64")
+		e.line("call $write")
+		e.line("global.get $cycles")
+		e.line("local.get $r2")
+		e.line("i64.const %d", c.memory)
+		e.line("i64.mul")
+		e.line("i64.const %d", c.base)
+		e.line("i64.add")
+		e.line("i64.add")
+		e.line("global.set $cycles")
+	case runtime.SYS_READ, runtime.SYS_TIME:
+		e.line("call $%s", map[int]string{runtime.SYS_READ: "read", runtime.SYS_TIME: "time"}[n])
+		e.line("local.set $r0")
+		e.cycles(c.cycles(0, false))
+	default:
+		e.fault(c.base, "Unknown system call %d on program counter %d", n, pc)
+	}
+}
+
+// watString quotes s as a WebAssembly string. Bytes outside printable ASCII
+// are written as hexadecimal escapes.
+func watString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7F:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
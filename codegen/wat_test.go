@@ -0,0 +1,448 @@
+package codegen
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"tinyass/runtime"
+)
+
+// sexpr is a parsed WebAssembly text element: an atom, or a list when atom is empty.
+type sexpr struct {
+	atom string
+	list []sexpr
+}
+
+// parseWAT parses the s-expressions of a module, skipping comments.
+func parseWAT(text string) (sexpr, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		switch c := text[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.HasPrefix(text[i:], ";;"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case c == '(' || c == ')':
+			tokens = append(tokens, text[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(text) && text[j] != '"' {
+				if text[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(text) {
+				return sexpr{}, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, text[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(text) && !strings.ContainsRune(" \t\n()\";", rune(text[j])) {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		}
+	}
+
+	var parse func() (sexpr, error)
+	parse = func() (sexpr, error) {
+		if len(tokens) == 0 {
+			return sexpr{}, fmt.Errorf("unexpected end of text")
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+		switch token {
+		case ")":
+			return sexpr{}, fmt.Errorf("unbalanced )")
+		case "(":
+			var list sexpr
+			for len(tokens) > 0 && tokens[0] != ")" {
+				element, err := parse()
+				if err != nil {
+					return sexpr{}, err
+				}
+				list.list = append(list.list, element)
+			}
+			if len(tokens) == 0 {
+				return sexpr{}, fmt.Errorf("unbalanced (")
+			}
+			tokens = tokens[1:]
+			return list, nil
+		}
+		return sexpr{atom: token}, nil
+	}
+	module, err := parse()
+	if err == nil && len(tokens) > 0 {
+		err = fmt.Errorf("text after the module")
+	}
+	return module, err
+}
+
+// head returns the keyword of a list.
+func (s sexpr) head() string {
+	if len(s.list) == 0 {
+		return ""
+	}
+	return s.list[0].atom
+}
+
+// watSignature is the type of a function.
+type watSignature struct {
+	params, results []string
+}
+
+// signature reads the parameters, results and locals declared in a func.
+func signature(fields []sexpr) (sig watSignature, locals map[string]string, body []sexpr) {
+	locals = map[string]string{}
+	for i, field := range fields {
+		switch field.head() {
+		case "export":
+		case "param", "local":
+			name, typ := field.list[1].atom, field.list[len(field.list)-1].atom
+			locals[name] = typ
+			if field.head() == "param" {
+				sig.params = append(sig.params, typ)
+			}
+		case "result":
+			sig.results = append(sig.results, field.list[1].atom)
+		default:
+			return sig, locals, fields[i:]
+		}
+	}
+	return sig, locals, nil
+}
+
+// watOpTypes are the operand and result types of the plain instructions a translation uses.
+var watOpTypes = map[string]watSignature{
+	"i64.eqz":          {[]string{"i64"}, []string{"i32"}},
+	"i32.eqz":          {[]string{"i32"}, []string{"i32"}},
+	"i64.extend_i32_u": {[]string{"i32"}, []string{"i64"}},
+	"i32.wrap_i64":     {[]string{"i64"}, []string{"i32"}},
+	"i64.load":         {[]string{"i32"}, []string{"i64"}},
+	"i64.store":        {[]string{"i32", "i64"}, nil},
+	"i32.or":           {[]string{"i32", "i32"}, []string{"i32"}},
+	"i32.shl":          {[]string{"i32", "i32"}, []string{"i32"}},
+}
+
+func init() {
+	for _, op := range []string{"add", "sub", "mul", "div_s", "rem_s", "and", "or", "xor", "shl", "shr_s"} {
+		watOpTypes["i64."+op] = watSignature{[]string{"i64", "i64"}, []string{"i64"}}
+	}
+	for _, op := range []string{"eq", "ne", "lt_s", "gt_s", "le_s", "ge_s", "lt_u", "ge_u"} {
+		watOpTypes["i64."+op] = watSignature{[]string{"i64", "i64"}, []string{"i32"}}
+	}
+}
+
+// validateWAT checks that text is a module whose functions type check: the
+// operand stack holds the right types for every instruction, branches target
+// enclosing blocks, and calls and variables refer to declarations.
+func validateWAT(text string) error {
+	module, err := parseWAT(text)
+	if err != nil {
+		return err
+	}
+	if module.head() != "module" {
+		return fmt.Errorf("not a module")
+	}
+	funcs := map[string]watSignature{}
+	globals := map[string]string{}
+	var bodies [][]sexpr
+	var sigs []watSignature
+	var localSets []map[string]string
+	for _, field := range module.list[1:] {
+		switch field.head() {
+		case "import":
+			fn := field.list[3]
+			sig, _, _ := signature(fn.list[2:])
+			funcs[fn.list[1].atom] = sig
+		case "global":
+			globals[field.list[1].atom] = field.list[3].list[1].atom
+		case "func":
+			sig, locals, body := signature(field.list[2:])
+			funcs[field.list[1].atom] = sig
+			bodies, sigs, localSets = append(bodies, body), append(sigs, sig), append(localSets, locals)
+		case "memory", "data":
+		default:
+			return fmt.Errorf("unexpected module field %q", field.head())
+		}
+	}
+	for i, body := range bodies {
+		if err := checkBody(body, sigs[i].results, funcs, globals, localSets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watFrame is an enclosing block during validation.
+type watFrame struct {
+	label       string
+	loop        bool
+	results     []string
+	height      int
+	unreachable bool
+}
+
+// checkBody type checks the flat instructions of a function body.
+func checkBody(body []sexpr, results []string, funcs map[string]watSignature, globals, locals map[string]string) error {
+	var stack []string
+	frames := []watFrame{{results: results}}
+	pop := func(want string) error {
+		frame := &frames[len(frames)-1]
+		if len(stack) == frame.height {
+			if frame.unreachable {
+				return nil
+			}
+			return fmt.Errorf("popping %s from an empty stack", want)
+		}
+		got := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if got != want {
+			return fmt.Errorf("popped %s, want %s", got, want)
+		}
+		return nil
+	}
+	// target returns the types a branch to label carries.
+	target := func(label string) ([]string, error) {
+		for i := len(frames) - 1; i > 0; i-- {
+			if frames[i].label == label {
+				if frames[i].loop {
+					return nil, nil
+				}
+				return frames[i].results, nil
+			}
+		}
+		return nil, fmt.Errorf("branch to %s outside its block", label)
+	}
+	branch := func(label string) error {
+		types, err := target(label)
+		if err != nil {
+			return err
+		}
+		for i := len(types) - 1; i >= 0; i-- {
+			if err := pop(types[i]); err != nil {
+				return err
+			}
+		}
+		for _, typ := range types {
+			stack = append(stack, typ)
+		}
+		return nil
+	}
+	unreachable := func() {
+		frame := &frames[len(frames)-1]
+		stack = stack[:frame.height]
+		frame.unreachable = true
+	}
+	endFrame := func() error {
+		frame := frames[len(frames)-1]
+		for i := len(frame.results) - 1; i >= 0; i-- {
+			if err := pop(frame.results[i]); err != nil {
+				return err
+			}
+		}
+		if len(stack) != frame.height {
+			return fmt.Errorf("%d values left at the end of block %s", len(stack)-frame.height, frame.label)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(body); i++ {
+		op := body[i].atom
+		if op == "" {
+			return fmt.Errorf("unexpected list in a function body")
+		}
+		immediate := func() string {
+			i++
+			if i >= len(body) {
+				return ""
+			}
+			return body[i].atom
+		}
+		var err error
+		switch op {
+		case "i64.const", "i32.const":
+			immediate()
+			stack = append(stack, op[:3])
+		case "local.get", "local.set", "local.tee":
+			typ, ok := locals[immediate()]
+			if !ok {
+				return fmt.Errorf("undeclared local %s", body[i].atom)
+			}
+			if op != "local.get" {
+				err = pop(typ)
+			}
+			if op != "local.set" {
+				stack = append(stack, typ)
+			}
+		case "global.get", "global.set":
+			typ, ok := globals[immediate()]
+			if !ok {
+				return fmt.Errorf("undeclared global %s", body[i].atom)
+			}
+			if op == "global.set" {
+				err = pop(typ)
+			} else {
+				stack = append(stack, typ)
+			}
+		case "call":
+			sig, ok := funcs[immediate()]
+			if !ok {
+				return fmt.Errorf("call to undeclared function %s", body[i].atom)
+			}
+			for j := len(sig.params) - 1; j >= 0 && err == nil; j-- {
+				err = pop(sig.params[j])
+			}
+			stack = append(stack, sig.results...)
+		case "select":
+			if err = pop("i32"); err == nil {
+				if err = pop("i64"); err == nil {
+					err = pop("i64")
+				}
+			}
+			stack = append(stack, "i64")
+		case "block", "loop", "if":
+			frame := watFrame{loop: op == "loop"}
+			if i+1 < len(body) && strings.HasPrefix(body[i+1].atom, "$") {
+				frame.label = immediate()
+			}
+			if i+1 < len(body) && body[i+1].head() == "result" {
+				i++
+				frame.results = []string{body[i].list[1].atom}
+			}
+			if op == "if" {
+				err = pop("i32")
+			}
+			frame.height = len(stack)
+			frames = append(frames, frame)
+		case "else":
+			if err = endFrame(); err == nil {
+				frames[len(frames)-1].unreachable = false
+			}
+		case "end":
+			if len(frames) == 1 {
+				return fmt.Errorf("end outside a block")
+			}
+			if err = endFrame(); err == nil {
+				stack = append(stack, frames[len(frames)-1].results...)
+				frames = frames[:len(frames)-1]
+			}
+		case "br":
+			if err = branch(immediate()); err == nil {
+				unreachable()
+			}
+		case "br_if":
+			if err = pop("i32"); err == nil {
+				err = branch(immediate())
+			}
+		case "br_table":
+			if err = pop("i32"); err != nil {
+				break
+			}
+			for i+1 < len(body) && strings.HasPrefix(body[i+1].atom, "$") {
+				if err = branch(immediate()); err != nil {
+					break
+				}
+			}
+			unreachable()
+		default:
+			sig, ok := watOpTypes[op]
+			if !ok {
+				return fmt.Errorf("unknown instruction %s", op)
+			}
+			for j := len(sig.params) - 1; j >= 0 && err == nil; j-- {
+				err = pop(sig.params[j])
+			}
+			stack = append(stack, sig.results...)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", op, err)
+		}
+	}
+	if len(frames) != 1 {
+		return fmt.Errorf("%d blocks left open", len(frames)-1)
+	}
+	return endFrame()
+}
+
+func TestEmitWATValidates(t *testing.T) {
+	for _, script := range testScripts {
+		var out bytes.Buffer
+		if err := EmitWAT(&out, assemble(t, script.source), runtime.DefaultCostTable()); err != nil {
+			t.Fatalf("%s: EmitWAT() error = %v", script.name, err)
+		}
+		if err := validateWAT(out.String()); err != nil {
+			t.Errorf("%s: invalid translation: %v\n%s", script.name, err, out.String())
+		}
+	}
+}
+
+func TestValidateWAT(t *testing.T) {
+	// The validator must catch the mistakes a translation could make
+	invalid := map[string]string{
+		"type mismatch":  "(module (func $f (result i32) i64.const 1))",
+		"empty stack":    "(module (func $f i64.add))",
+		"outer branch":   "(module (func $f block $a end br $a))",
+		"unknown call":   "(module (func $f call $g))",
+		"unknown local":  "(module (func $f local.get $x drop))",
+		"open block":     "(module (func $f block $a))",
+		"leftover value": "(module (func $f i32.const 1))",
+	}
+	for name, text := range invalid {
+		if err := validateWAT(text); err == nil {
+			t.Errorf("%s: validateWAT(%q) succeeded", name, text)
+		}
+	}
+	valid := "(module (func $f (param $a i64) (result i64) block $b loop $l local.get $a i64.eqz br_if $b br $l end end local.get $a))"
+	if err := validateWAT(valid); err != nil {
+		t.Errorf("validateWAT(%q) error = %v", valid, err)
+	}
+}
+
+func TestEmitWAT(t *testing.T) {
+	var out bytes.Buffer
+	if err := EmitWAT(&out, assemble(t, "LOAD R0 1\nloop:\nSHL R0 R0 R0\nPRINT R0\nJMP loop"), nil); err != nil {
+		t.Fatal(err)
+	}
+	text := out.String()
+	for _, want := range []string{
+		";; 0x01 SHL R0 R0 R0, line 3",
+		`(memory (export "memory") 1)`,
+		`(func $run (export "run") (result i32)`,
+		"br_table $L0 $L1 $L2 $L3 $end",
+		"call $shl\n",
+		"br $dispatch",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("translation lacks %q:\n%s", want, text)
+		}
+	}
+	// Only the imports and helpers the program calls are declared
+	if !strings.Contains(text, `(import "tinyass" "print_register"`) || strings.Contains(text, `"print_memory"`) ||
+		strings.Contains(text, `"fault"`) || strings.Contains(text, "$quo") || strings.Contains(text, "(data") {
+		t.Errorf("unexpected declarations:\n%s", text)
+	}
+
+	out.Reset()
+	if err := EmitWAT(&out, assemble(t, "LOAD R1 0\nDIV R0 R0 R1\nDIV R0 R0 R1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Messages are stored once, after the memory cells
+	text = out.String()
+	want := fmt.Sprintf(`(data (i32.const %d) "Division by zero on program counter 2Division by zero on program counter 3")`, WAT_MESSAGES)
+	if !strings.Contains(text, want) || !strings.Contains(text, "i32.const 2085\n") {
+		t.Errorf("translation lacks the messages %q:\n%s", want, text)
+	}
+
+	if err := EmitWAT(&out, assemble(t, "LOAD R0 1\n.region rodata 0x00 0x0F"), nil); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("EmitWAT() with a region: error = %v, want one for line 2", err)
+	}
+}
@@ -0,0 +1,161 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Program is an assembled script: its instructions plus the source information
+// needed to map them back to lines and labels.
+type Program struct {
+	Instructions []Instruction
+	Lines        []int          // Source line (1-based) of each instruction
+	Source       []string       // Original source lines
+	Labels       map[string]int // Label name to instruction address
+	Regions      []Region       // Memory regions declared with .region
+}
+
+// SourceError reports a problem on a specific line of a script.
+type SourceError struct {
+	Line int
+	Err  error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// Assemble parses a whole script. A line may start with a label definition ("loop:"),
+// optionally followed by an instruction. Labels can be used anywhere an address is
+// expected and resolve to the address of the next instruction. Lines starting with
+// "." are directives, such as ".region rodata 0x00 0x1F".
+func Assemble(source string, opts ParseOptions) (*Program, error) {
+	program := &Program{
+		Source: strings.Split(source, "\n"),
+		Labels: map[string]int{},
+	}
+
+	// First pass: split lines and collect label addresses
+	fields := make([][]string, len(program.Source))
+	address := 0
+	for i, line := range program.Source {
+		parts := SplitFields(line)
+		if len(parts) > 0 && strings.HasSuffix(parts[0], ":") {
+			label := strings.TrimSuffix(parts[0], ":")
+			if err := validateLabel(label, program.Labels); err != nil {
+				return nil, &SourceError{i + 1, err}
+			}
+			program.Labels[label] = address
+			parts = parts[1:]
+		}
+		if len(parts) > 0 && strings.HasPrefix(parts[0], ".") {
+			if err := program.parseDirective(parts); err != nil {
+				return nil, &SourceError{i + 1, err}
+			}
+			parts = nil
+		}
+		if len(parts) > 0 {
+			address++
+		}
+		fields[i] = parts
+	}
+
+	// Second pass: resolve label operands and parse instructions
+	for i, parts := range fields {
+		if len(parts) == 0 {
+			continue
+		}
+		if err := NormalizeCase(parts, opts); err != nil {
+			return nil, &SourceError{i + 1, err}
+		}
+		if err := resolveLabels(parts, program.Labels); err != nil {
+			return nil, &SourceError{i + 1, err}
+		}
+		inst, err := parseFields(parts)
+		if err != nil {
+			return nil, &SourceError{i + 1, err}
+		}
+		program.Instructions = append(program.Instructions, inst)
+		program.Lines = append(program.Lines, i+1)
+	}
+
+	return program, nil
+}
+
+// LineOf returns the source line of the instruction at pc, or 0 if there is none.
+func (p *Program) LineOf(pc int) int {
+	if pc < 0 || pc >= len(p.Lines) {
+		return 0
+	}
+	return p.Lines[pc]
+}
+
+// AddressOfLine returns the address of the first instruction on or after the given source line.
+func (p *Program) AddressOfLine(line int) (int, bool) {
+	for pc, l := range p.Lines {
+		if l >= line {
+			return pc, true
+		}
+	}
+	return 0, false
+}
+
+// LabelAt returns the label defined at pc, if any. When several labels share
+// an address the alphabetically first one is returned.
+func (p *Program) LabelAt(pc int) (string, bool) {
+	found := ""
+	for name, addr := range p.Labels {
+		if addr == pc && (found == "" || name < found) {
+			found = name
+		}
+	}
+	return found, found != ""
+}
+
+// validateLabel checks that label is a usable, not yet defined label name.
+func validateLabel(label string, labels map[string]int) error {
+	if !isIdentifier(label) {
+		return fmt.Errorf("invalid label: %q", label)
+	}
+	upper := strings.ToUpper(label)
+	if upper == "MEM" || isRegisterName(upper) {
+		return fmt.Errorf("label %q clashes with a register or keyword", label)
+	}
+	if _, ok := labels[label]; ok {
+		return fmt.Errorf("label %q is already defined", label)
+	}
+	return nil
+}
+
+// resolveLabels replaces label operands with their hexadecimal addresses.
+func resolveLabels(parts []string, labels map[string]int) error {
+	for i := 1; i < len(parts); i++ {
+		if !isIdentifier(parts[i]) || parts[i] == "MEM" || isRegisterName(parts[i]) {
+			continue
+		}
+		addr, ok := labels[parts[i]]
+		if !ok {
+			return fmt.Errorf("undefined label: %s", parts[i])
+		}
+		parts[i] = fmt.Sprintf("0x%02X", addr)
+	}
+	return nil
+}
+
+// isIdentifier reports whether s is a letter or underscore followed by letters, digits or underscores.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		letter := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
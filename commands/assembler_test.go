@@ -0,0 +1,113 @@
+package commands
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAssembleLabels(t *testing.T) {
+	source := `; count down
+start:  LOAD R0 3
+        LOAD R1 1
+Loop:
+        SUB R0 R0 R1
+        jnz r0 Loop
+        CALL done
+done:   HALT`
+
+	program, err := Assemble(source, ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+
+	expected := []Instruction{
+		{LOAD, []int{0, 3}},
+		{LOAD, []int{1, 1}},
+		{SUB, []int{0, 0, 1}},
+		{JNZ, []int{0, 2}},
+		{CALL, []int{5}},
+		{HALT, []int{}},
+	}
+	if len(program.Instructions) != len(expected) {
+		t.Fatalf("Assemble() produced %d instructions, want %d", len(program.Instructions), len(expected))
+	}
+	for i := range expected {
+		if !compareInstructions(program.Instructions[i], expected[i]) {
+			t.Errorf("instruction %d = %v, want %v", i, program.Instructions[i], expected[i])
+		}
+	}
+
+	expectedLines := []int{2, 3, 5, 6, 7, 8}
+	for i, line := range expectedLines {
+		if program.LineOf(i) != line {
+			t.Errorf("LineOf(%d) = %d, want %d", i, program.LineOf(i), line)
+		}
+	}
+
+	if program.Labels["Loop"] != 2 || program.Labels["start"] != 0 || program.Labels["done"] != 5 {
+		t.Errorf("Labels = %v", program.Labels)
+	}
+	if _, ok := program.Labels["loop"]; ok {
+		t.Errorf("labels must keep their case, got %v", program.Labels)
+	}
+	if label, ok := program.LabelAt(2); !ok || label != "Loop" {
+		t.Errorf("LabelAt(2) = %q, %v", label, ok)
+	}
+	if addr, ok := program.AddressOfLine(4); !ok || addr != 2 {
+		t.Errorf("AddressOfLine(4) = %d, %v, want 2, true", addr, ok)
+	}
+
+	// Labels may also be loaded as values
+	program, err = Assemble("LOAD R0 done\ndone: HALT", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	if !compareInstructions(program.Instructions[0], Instruction{LOAD, []int{0, 1}}) {
+		t.Errorf("LOAD of a label = %v, want LOAD R0 1", program.Instructions[0])
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		line   int
+	}{
+		{"unknown instruction", "LOAD R0 1\nFOO R0", 2},
+		{"undefined label", "JMP nowhere", 1},
+		{"duplicate label", "a: HALT\na: HALT", 2},
+		{"register label", "R1: HALT", 1},
+		{"strict case", "LOAD R0 1\nhalt", 2},
+		{"unknown directive", "HALT\n.segment data", 2},
+		{"unknown region kind", ".region heap 0x00 0x0F", 1},
+		{"backwards region", ".region data 0x10 0x0F", 1},
+		{"overlapping regions", ".region data 0x00 0x0F\n.region rodata 0x0F 0x1F", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Assemble(tt.source, ParseOptions{StrictCase: tt.name == "strict case"})
+			var sourceErr *SourceError
+			if !errors.As(err, &sourceErr) {
+				t.Fatalf("Assemble() error = %v, want a SourceError", err)
+			}
+			if sourceErr.Line != tt.line {
+				t.Errorf("error line = %d, want %d", sourceErr.Line, tt.line)
+			}
+		})
+	}
+}
+
+func TestAssembleRegions(t *testing.T) {
+	program, err := Assemble(".region rodata 0x00 0x0F\nstart:\n.REGION Stack 0xF8 0xFF\nLOAD R0 1\nJMP start", ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	want := []Region{{REGION_RODATA, 0x00, 0x0F}, {REGION_STACK, 0xF8, 0xFF}}
+	if len(program.Regions) != 2 || program.Regions[0] != want[0] || program.Regions[1] != want[1] {
+		t.Errorf("Regions = %v, want %v", program.Regions, want)
+	}
+	if len(program.Instructions) != 2 || program.Labels["start"] != 0 || program.LineOf(0) != 4 {
+		t.Errorf("directives must not produce instructions: %v, labels %v", program.Instructions, program.Labels)
+	}
+}
@@ -11,30 +11,48 @@ const MEMORY_SIZE = 256
 
 // Opcodes
 const (
-	LOAD  = iota // Load value into register
-	STORE        // Store register to memory
-	ADD          // Add
-	SUB          // Subtract
-	MUL          // Multiply
-	DIV          // Divide
-	REM          // Remainder
-	AND          // Bitwise AND
-	OR           // Bitwise OR
-	XOR          // Bitwise XOR
-	NOT          // Bitwise NOT
-	SHL          // Shift left
-	SHR          // Shift right
-	GT           // Greater than
-	LT           // Less than
-	GTE          // Greater than or equal
-	LTE          // Less than or equal
-	EQ           // Equal
-	NEQ          // Not equal
-	JMP          // Unconditional jump
-	JZ           // Jump if zero
-	JNZ          // Jump if not zero
-	PRINT        // Print value
-	HALT         // Stop execution
+	LOAD     = iota // Load value into register
+	STORE           // Store register to memory
+	ADD             // Add
+	SUB             // Subtract
+	MUL             // Multiply
+	DIV             // Divide
+	REM             // Remainder
+	AND             // Bitwise AND
+	OR              // Bitwise OR
+	XOR             // Bitwise XOR
+	NOT             // Bitwise NOT
+	SHL             // Shift left
+	SHR             // Shift right
+	GT              // Greater than
+	LT              // Less than
+	GTE             // Greater than or equal
+	LTE             // Less than or equal
+	EQ              // Equal
+	NEQ             // Not equal
+	JMP             // Unconditional jump
+	JZ              // Jump if zero
+	JNZ             // Jump if not zero
+	PRINT           // Print value
+	HALT            // Stop execution
+	CALL            // Call subroutine
+	RET             // Return from subroutine
+	CYCLES          // Read the cycle counter
+	LOADM           // Load memory into register
+	EI              // Enable interrupts
+	DI              // Disable interrupts
+	IRET            // Return from interrupt handler
+	IRQ             // Interrupt entry, inserted by the CPU when it takes an interrupt
+	CAS             // Atomic compare and swap
+	XCHG            // Atomic exchange of register and memory
+	FENCE           // Memory fence
+	CORE            // Read the core number
+	SETPTB          // Set the page-table base and enable paging
+	TLBFLUSH        // Discard cached address translations
+	SYSCALL         // System call
+	USER            // Jump to an address in user mode
+
+	NUM_OPCODES // Number of opcodes, keep last
 )
 
 const INVALID_REGISTER_ERROR = "invalid register: %s\nValid registers are R0, R1, R2, R3"
@@ -47,23 +65,37 @@ type Instruction struct {
 	Operands []int
 }
 
-// ParseInstruction converts a string to Instruction
+// ParseOptions controls how source text is turned into instructions.
+type ParseOptions struct {
+	// StrictCase rejects mnemonics, registers and keywords that are not written in upper case.
+	StrictCase bool
+}
+
 // ParseInstruction converts a string to Instruction
 func ParseInstruction(line string) (Instruction, error) {
-	// Strip comments
-	commentIndex := strings.Index(line, ";")
-	if commentIndex != -1 {
-		line = line[:commentIndex]
-	}
+	return ParseInstructionWithOptions(line, ParseOptions{})
+}
 
-	line = strings.TrimSpace(line)
+// ParseInstructionWithOptions converts a string to Instruction using the given options.
+// Mnemonics, registers and the MEM keyword are case-insensitive unless opts.StrictCase is set;
+// every other operand (labels, string literals) keeps its original case.
+func ParseInstructionWithOptions(line string, opts ParseOptions) (Instruction, error) {
+	parts := SplitFields(line)
 
 	// Skip empty lines
-	if len(line) == 0 {
+	if len(parts) == 0 {
 		return Instruction{}, fmt.Errorf("empty instruction")
 	}
 
-	parts := strings.Fields(line)
+	if err := NormalizeCase(parts, opts); err != nil {
+		return Instruction{}, err
+	}
+
+	return parseFields(parts)
+}
+
+// parseFields converts already split and case-normalized fields to an Instruction.
+func parseFields(parts []string) (Instruction, error) {
 	opcode := parts[0]
 
 	switch opcode {
@@ -115,11 +147,118 @@ func ParseInstruction(line string) (Instruction, error) {
 		return ParsePrint(parts)
 	case "HALT":
 		return Instruction{HALT, []int{}}, nil
+	case "CALL":
+		return ParseCall(parts)
+	case "RET":
+		return Instruction{RET, []int{}}, nil
+	case "CYCLES":
+		return ParseCycles(parts)
+	case "LOADM":
+		return ParseLoadM(parts)
+	case "EI":
+		return parseNoOperands(EI, parts)
+	case "DI":
+		return parseNoOperands(DI, parts)
+	case "IRET":
+		return parseNoOperands(IRET, parts)
+	case "CAS":
+		return ParseCAS(parts)
+	case "XCHG":
+		return ParseXchg(parts)
+	case "FENCE":
+		return parseNoOperands(FENCE, parts)
+	case "CORE":
+		return ParseCore(parts)
+	case "SETPTB":
+		return ParseSetPTB(parts)
+	case "TLBFLUSH":
+		return parseNoOperands(TLBFLUSH, parts)
+	case "SYSCALL":
+		return ParseSyscall(parts)
+	case "USER":
+		return ParseUser(parts)
 	default:
 		return Instruction{}, fmt.Errorf("unknown instruction: %s", opcode)
 	}
 }
 
+// SplitFields strips a trailing comment from line and splits the rest into whitespace
+// separated fields. Double-quoted string literals are kept as a single field, so spaces
+// and semicolons inside them are preserved.
+func SplitFields(line string) []string {
+	var fields []string
+	var field strings.Builder
+	inString := false
+
+scan:
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inString:
+			field.WriteByte(c)
+			if c == '\\' && i+1 < len(line) {
+				i++
+				field.WriteByte(line[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			field.WriteByte(c)
+		case c == ';':
+			break scan
+		case c == ' ' || c == '\t' || c == '\r':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+		default:
+			field.WriteByte(c)
+		}
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// NormalizeCase upper-cases the mnemonic, register names and the MEM keyword in parts.
+// Any other field is left untouched so labels and string literals keep their case.
+// With opts.StrictCase set, a field that would have to be changed is reported as an error instead.
+func NormalizeCase(parts []string, opts ParseOptions) error {
+	for i, part := range parts {
+		upper := strings.ToUpper(part)
+		if i > 0 && upper != "MEM" && !isRegisterName(upper) {
+			continue
+		}
+		if upper == part {
+			continue
+		}
+		if opts.StrictCase {
+			if i == 0 {
+				return fmt.Errorf("instruction %q must be written in upper case: %s", part, upper)
+			}
+			return fmt.Errorf("operand %q must be written in upper case: %s", part, upper)
+		}
+		parts[i] = upper
+	}
+	return nil
+}
+
+// isRegisterName reports whether s looks like a register name ("R" followed by digits).
+// It does not check that the register exists; ParseRegister does that.
+func isRegisterName(s string) bool {
+	if len(s) < 2 || s[0] != 'R' {
+		return false
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
 // ParseRegister validates and parses a register string formatted as "R0" to "R3".
 // It checks that the input string begins with "R", is exactly 2 characters long,
 // and that the following character represents a numeric value between 0 and 3 (inclusive).
@@ -157,6 +296,7 @@ func ParseMemory(addr string) (int, error) {
 
 // ParseValue parses a string value into an integer. It trims any surrounding whitespace,
 // and attempts to convert the string into an integer. If the conversion fails, an error
+// is returned. Values with a "0x" prefix are hexadecimal, so addresses and labels can be loaded.
 func ParseValue(val string) (int, error) {
 
 	//validate length of value
@@ -164,7 +304,16 @@ func ParseValue(val string) (int, error) {
 		return 0, fmt.Errorf(INVALID_VALUE, val)
 	}
 
-	num, err := strconv.Atoi(strings.TrimSpace(val)) // convert string to integer
+	trimmed := strings.TrimSpace(val)
+	if strings.HasPrefix(trimmed, "0x") || strings.HasPrefix(trimmed, "0X") {
+		num, err := strconv.ParseInt(trimmed[2:], 16, 0)
+		if err != nil {
+			return 0, fmt.Errorf(INVALID_VALUE, val)
+		}
+		return int(num), nil
+	}
+
+	num, err := strconv.Atoi(trimmed) // convert string to integer
 	if err != nil {
 		return 0, fmt.Errorf(INVALID_VALUE, val)
 	}
@@ -397,6 +546,140 @@ func ParseJnz(parts []string) (Instruction, error) {
 	return Instruction{JNZ, []int{reg, addr}}, nil
 }
 
+// ParseCall parses the CALL instruction. It expects 2 parts: "CALL" and a memory address.
+func ParseCall(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("CALL requires 1 operand\nExample: CALL addr")
+	}
+	addr, err := ParseMemory(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{CALL, []int{addr}}, nil
+}
+
+// ParseCycles parses the CYCLES instruction. It expects 2 parts: "CYCLES" and a destination register.
+func ParseCycles(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("CYCLES requires 1 operand\nExample: CYCLES R[0-3]")
+	}
+	reg, err := ParseRegister(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{CYCLES, []int{reg}}, nil
+}
+
+// parseNoOperands parses an instruction that takes no operands.
+func parseNoOperands(opcode int, parts []string) (Instruction, error) {
+	if len(parts) != 1 {
+		return Instruction{}, fmt.Errorf("%s takes no operands", parts[0])
+	}
+	return Instruction{opcode, []int{}}, nil
+}
+
+// ParseLoadM parses the LOADM instruction. It expects 3 parts: "LOADM", a register, and a memory address.
+func ParseLoadM(parts []string) (Instruction, error) {
+	if len(parts) != 3 {
+		return Instruction{}, fmt.Errorf("LOADM requires 2 operands\nExample: LOADM R[0-3] addr")
+	}
+	reg, err := ParseRegister(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	addr, err := ParseMemory(parts[2])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{LOADM, []int{reg, addr}}, nil
+}
+
+// ParseCAS parses the CAS instruction. It expects 4 parts: "CAS", the register holding the
+// expected value, the register holding the new value, and a memory address.
+func ParseCAS(parts []string) (Instruction, error) {
+	if len(parts) != 4 {
+		return Instruction{}, fmt.Errorf("CAS requires 3 operands\nExample: CAS R[0-3] R[0-3] addr")
+	}
+	registers, err := ParseRegisters(parts[1:3]...)
+	if err != nil {
+		return Instruction{}, err
+	}
+	addr, err := ParseMemory(parts[3])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{CAS, append(registers, addr)}, nil
+}
+
+// ParseXchg parses the XCHG instruction. It expects 3 parts: "XCHG", a register, and a memory address.
+func ParseXchg(parts []string) (Instruction, error) {
+	if len(parts) != 3 {
+		return Instruction{}, fmt.Errorf("XCHG requires 2 operands\nExample: XCHG R[0-3] addr")
+	}
+	reg, err := ParseRegister(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	addr, err := ParseMemory(parts[2])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{XCHG, []int{reg, addr}}, nil
+}
+
+// ParseCore parses the CORE instruction. It expects 2 parts: "CORE" and a destination register.
+func ParseCore(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("CORE requires 1 operand\nExample: CORE R[0-3]")
+	}
+	reg, err := ParseRegister(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{CORE, []int{reg}}, nil
+}
+
+// ParseSetPTB parses the SETPTB instruction. It expects 2 parts: "SETPTB" and a
+// register holding the page-table base.
+func ParseSetPTB(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("SETPTB requires 1 operand\nExample: SETPTB R[0-3]")
+	}
+	reg, err := ParseRegister(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{SETPTB, []int{reg}}, nil
+}
+
+// ParseSyscall parses the SYSCALL instruction. It expects 2 parts: "SYSCALL" and
+// a non-negative system call number.
+func ParseSyscall(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("SYSCALL requires 1 operand\nExample: SYSCALL 1")
+	}
+	n, err := ParseValue(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	if n < 0 {
+		return Instruction{}, fmt.Errorf("invalid system call number: %s", parts[1])
+	}
+	return Instruction{SYSCALL, []int{n}}, nil
+}
+
+// ParseUser parses the USER instruction. It expects 2 parts: "USER" and a memory address.
+func ParseUser(parts []string) (Instruction, error) {
+	if len(parts) != 2 {
+		return Instruction{}, fmt.Errorf("USER requires 1 operand\nExample: USER addr")
+	}
+	addr, err := ParseMemory(parts[1])
+	if err != nil {
+		return Instruction{}, err
+	}
+	return Instruction{USER, []int{addr}}, nil
+}
+
 // ParsePrint parses the PRINT instruction. It expects 2 parts: "PRINT" and a register or memory address.
 func ParsePrint(parts []string) (Instruction, error) {
 	if len(parts) != 2 && len(parts) != 3 {
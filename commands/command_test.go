@@ -35,6 +35,25 @@ func TestParseInstruction(t *testing.T) {
 		{"PRINT R0", Instruction{PRINT, []int{-1, 0}}, false},
 		{"PRINT MEM 0x40", Instruction{PRINT, []int{64}}, false},
 		{"HALT", Instruction{HALT, []int{}}, false},
+		{"CALL 0x05", Instruction{CALL, []int{5}}, false},
+		{"RET", Instruction{RET, []int{}}, false},
+		{"CYCLES R2", Instruction{CYCLES, []int{2}}, false},
+		{"LOADM R1 0xE1", Instruction{LOADM, []int{1, 0xE1}}, false},
+		{"LOAD R0 0x1F", Instruction{LOAD, []int{0, 31}}, false},
+		{"EI", Instruction{EI, []int{}}, false},
+		{"IRET", Instruction{IRET, []int{}}, false},
+		{"DI R0", Instruction{}, true},
+		{"CAS R0 R1 0x41", Instruction{CAS, []int{0, 1, 0x41}}, false},
+		{"XCHG R2 0x41", Instruction{XCHG, []int{2, 0x41}}, false},
+		{"FENCE", Instruction{FENCE, []int{}}, false},
+		{"CORE R3", Instruction{CORE, []int{3}}, false},
+		{"SETPTB R0", Instruction{SETPTB, []int{0}}, false},
+		{"SETPTB 0xC0", Instruction{}, true},
+		{"TLBFLUSH", Instruction{TLBFLUSH, []int{}}, false},
+		{"SYSCALL 1", Instruction{SYSCALL, []int{1}}, false},
+		{"SYSCALL -1", Instruction{}, true},
+		{"USER 0x10", Instruction{USER, []int{0x10}}, false},
+		{"LOADM R1 10", Instruction{}, true},
 		{"INVALID", Instruction{}, true},
 	}
 
@@ -140,3 +159,90 @@ func TestParseValue(t *testing.T) {
 		}
 	}
 }
+
+func TestParseInstructionCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Instruction
+	}{
+		{"load r1 10", Instruction{LOAD, []int{1, 10}}},
+		{"Store R2 0x1a", Instruction{STORE, []int{2, 26}}},
+		{"add r1 R2 r3", Instruction{ADD, []int{1, 2, 3}}},
+		{"print mem 0x40", Instruction{PRINT, []int{64}}},
+		{"print r0 ; Comment", Instruction{PRINT, []int{-1, 0}}},
+		{"halt", Instruction{HALT, []int{}}},
+	}
+
+	for _, test := range tests {
+		result, err := ParseInstruction(test.input)
+		if err != nil {
+			t.Errorf("ParseInstruction(%q) error = %v", test.input, err)
+			continue
+		}
+		if !compareInstructions(result, test.expected) {
+			t.Errorf("ParseInstruction(%q) = %v, want %v", test.input, result, test.expected)
+		}
+	}
+}
+
+func TestParseInstructionStrictCase(t *testing.T) {
+	tests := []struct {
+		input    string
+		hasError bool
+	}{
+		{"LOAD R1 10", false},
+		{"STORE R2 0x1a", false},
+		{"load R1 10", true},
+		{"LOAD r1 10", true},
+		{"PRINT mem 0x40", true},
+	}
+
+	opts := ParseOptions{StrictCase: true}
+	for _, test := range tests {
+		_, err := ParseInstructionWithOptions(test.input, opts)
+		if (err != nil) != test.hasError {
+			t.Errorf("ParseInstructionWithOptions(%q) error = %v, wantErr %v", test.input, err, test.hasError)
+		}
+	}
+}
+
+func TestSplitFields(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []string
+	}{
+		{"LOAD R0 10", []string{"LOAD", "R0", "10"}},
+		{"  ADD\tR0 R1 R2  ; comment", []string{"ADD", "R0", "R1", "R2"}},
+		{"; only a comment", nil},
+		{`MSG "Hello; World" R0`, []string{"MSG", `"Hello; World"`, "R0"}},
+		{`MSG "say \"hi\"" ; tail`, []string{"MSG", `"say \"hi\""`}},
+	}
+
+	for _, test := range tests {
+		result := SplitFields(test.input)
+		if len(result) != len(test.expected) {
+			t.Errorf("SplitFields(%q) = %q, want %q", test.input, result, test.expected)
+			continue
+		}
+		for i := range result {
+			if result[i] != test.expected[i] {
+				t.Errorf("SplitFields(%q) = %q, want %q", test.input, result, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestNormalizeCasePreservesOtherOperands(t *testing.T) {
+	parts := []string{"jmp", "LoopStart", `"MixedCase"`, "r2", "0xab"}
+	if err := NormalizeCase(parts, ParseOptions{}); err != nil {
+		t.Fatalf("NormalizeCase() error = %v", err)
+	}
+	expected := []string{"JMP", "LoopStart", `"MixedCase"`, "R2", "0xab"}
+	for i := range parts {
+		if parts[i] != expected[i] {
+			t.Errorf("NormalizeCase() = %q, want %q", parts, expected)
+			break
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mnemonics indexed by opcode
+var mnemonics = map[int]string{
+	LOAD:     "LOAD",
+	STORE:    "STORE",
+	ADD:      "ADD",
+	SUB:      "SUB",
+	MUL:      "MUL",
+	DIV:      "DIV",
+	REM:      "REM",
+	AND:      "AND",
+	OR:       "OR",
+	XOR:      "XOR",
+	NOT:      "NOT",
+	SHL:      "SHL",
+	SHR:      "SHR",
+	GT:       "GT",
+	LT:       "LT",
+	GTE:      "GTE",
+	LTE:      "LTE",
+	EQ:       "EQ",
+	NEQ:      "NEQ",
+	JMP:      "JMP",
+	JZ:       "JZ",
+	JNZ:      "JNZ",
+	PRINT:    "PRINT",
+	HALT:     "HALT",
+	CALL:     "CALL",
+	RET:      "RET",
+	CYCLES:   "CYCLES",
+	LOADM:    "LOADM",
+	EI:       "EI",
+	DI:       "DI",
+	IRET:     "IRET",
+	IRQ:      "IRQ",
+	CAS:      "CAS",
+	XCHG:     "XCHG",
+	FENCE:    "FENCE",
+	CORE:     "CORE",
+	SETPTB:   "SETPTB",
+	TLBFLUSH: "TLBFLUSH",
+	SYSCALL:  "SYSCALL",
+	USER:     "USER",
+}
+
+// Mnemonic returns the assembly name of an opcode.
+func Mnemonic(opcode int) string {
+	if name, ok := mnemonics[opcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("OP%d", opcode)
+}
+
+// Disassemble converts an Instruction back to assembly source.
+func Disassemble(inst Instruction) string {
+	ops := inst.Operands
+	reg := func(i int) string { return fmt.Sprintf("R%d", ops[i]) }
+	addr := func(i int) string { return fmt.Sprintf("0x%02X", ops[i]) }
+
+	var operands []string
+	switch inst.Opcode {
+	case LOAD:
+		operands = []string{reg(0), fmt.Sprint(ops[1])}
+	case STORE, LOADM, XCHG:
+		operands = []string{reg(0), addr(1)}
+	case JMP, CALL, USER:
+		operands = []string{addr(0)}
+	case CAS:
+		operands = []string{reg(0), reg(1), addr(2)}
+	case IRQ, SYSCALL:
+		operands = []string{fmt.Sprint(ops[0])}
+	case JZ, JNZ:
+		operands = []string{reg(0), addr(1)}
+	case PRINT:
+		if ops[0] == -1 {
+			operands = []string{reg(1)}
+		} else {
+			operands = []string{"MEM", addr(0)}
+		}
+	default:
+		for i := range ops {
+			operands = append(operands, reg(i))
+		}
+	}
+
+	if len(operands) == 0 {
+		return Mnemonic(inst.Opcode)
+	}
+	return Mnemonic(inst.Opcode) + " " + strings.Join(operands, " ")
+}
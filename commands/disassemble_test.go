@@ -0,0 +1,37 @@
+package commands
+
+import "testing"
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	tests := []string{
+		"LOAD R1 -10",
+		"STORE R2 0x1A",
+		"LOADM R3 0x1A",
+		"CAS R0 R1 0x41",
+		"XCHG R2 0x41",
+		"SETPTB R1",
+		"TLBFLUSH",
+		"SYSCALL 3",
+		"USER 0x08",
+		"ADD R1 R2 R3",
+		"NOT R3 R2",
+		"EQ R0 R1 R2",
+		"JMP 0x10",
+		"JNZ R2 0x30",
+		"PRINT R0",
+		"PRINT MEM 0x40",
+		"CALL 0x05",
+		"RET",
+		"HALT",
+	}
+
+	for _, source := range tests {
+		inst, err := ParseInstruction(source)
+		if err != nil {
+			t.Fatalf("ParseInstruction(%q) error = %v", source, err)
+		}
+		if result := Disassemble(inst); result != source {
+			t.Errorf("Disassemble(%v) = %q, want %q", inst, result, source)
+		}
+	}
+}
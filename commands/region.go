@@ -0,0 +1,75 @@
+package commands
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Memory region kinds
+const (
+	REGION_RODATA = "rodata" // Readable, not writable
+	REGION_DATA   = "data"   // Readable and writable
+	REGION_STACK  = "stack"  // Only accessed by the stack
+	REGION_DEVICE = "device" // Memory-mapped devices, never used by the stack
+	REGION_GUARD  = "guard"  // Not accessible at all
+)
+
+// Region gives a range of memory addresses a kind that limits how it may be accessed.
+type Region struct {
+	Kind       string
+	Start, End int // Inclusive address range
+}
+
+func (r Region) String() string {
+	return fmt.Sprintf("%s 0x%02X-0x%02X", r.Kind, r.Start, r.End)
+}
+
+// Overlaps reports whether two regions share an address.
+func (r Region) Overlaps(other Region) bool {
+	return r.Start <= other.End && other.Start <= r.End
+}
+
+// ParseRegion parses a region declaration: a kind followed by the first and
+// last address, e.g. "rodata 0x00 0x1F".
+func ParseRegion(fields []string) (Region, error) {
+	if len(fields) != 3 {
+		return Region{}, fmt.Errorf("a region requires a kind, a start and an end address\nExample: rodata 0x00 0x1F")
+	}
+	kind := strings.ToLower(fields[0])
+	switch kind {
+	case REGION_RODATA, REGION_DATA, REGION_STACK, REGION_DEVICE, REGION_GUARD:
+	default:
+		return Region{}, fmt.Errorf("unknown region kind: %s\nKinds are rodata, data, stack, device and guard", fields[0])
+	}
+	start, err := ParseMemory(fields[1])
+	if err != nil {
+		return Region{}, err
+	}
+	end, err := ParseMemory(fields[2])
+	if err != nil {
+		return Region{}, err
+	}
+	if end < start {
+		return Region{}, fmt.Errorf("region ends at 0x%02X before it starts at 0x%02X", end, start)
+	}
+	return Region{kind, start, end}, nil
+}
+
+// parseDirective handles an assembler directive, a line starting with ".".
+func (p *Program) parseDirective(parts []string) error {
+	switch strings.ToLower(parts[0]) {
+	case ".region":
+		region, err := ParseRegion(parts[1:])
+		if err != nil {
+			return err
+		}
+		for _, other := range p.Regions {
+			if region.Overlaps(other) {
+				return fmt.Errorf("region %v overlaps region %v", region, other)
+			}
+		}
+		p.Regions = append(p.Regions, region)
+		return nil
+	}
+	return fmt.Errorf("unknown directive: %s", parts[0])
+}
@@ -0,0 +1,740 @@
+package lang
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+	"tinyass/utils"
+)
+
+// Memory limits of compiled programs. Variables are kept below the interrupt
+// and trap vectors, and calls may nest as deep as the CPU's stack has room for
+// return addresses.
+const (
+	DATA_LIMIT     = runtime.VECTOR_TABLE
+	MAX_CALL_DEPTH = commands.MEMORY_SIZE - runtime.STACK_FLOOR
+)
+
+// builtins are the functions provided by the language, with their number of arguments.
+var builtins = map[string]int{"print": 1, "read": 0, "exit": 1}
+
+// cell is a memory cell holding a variable or a spilled value, given its
+// address when the program is laid out.
+type cell struct {
+	name    string
+	address int
+}
+
+// symbol is a variable.
+type symbol struct {
+	cell   *cell
+	global bool
+}
+
+// R is a register operand.
+type R int
+
+// label is a label operand.
+type label string
+
+// line is a line of the generated source: a label, a comment or an instruction.
+type line struct {
+	label   label
+	comment string
+	op      string
+	args    []interface{}
+}
+
+// funcInfo is a function being compiled, or the startup code initializing the globals.
+type funcInfo struct {
+	name   string
+	decl   *function
+	label  label
+	params []*cell
+	cells  []*cell // Parameters, locals and spill slots: the function's frame
+	free   []*cell // Spill slots not in use
+	calls  []*call // Calls to other functions, to check for recursion
+}
+
+// generator translates the syntax tree into TinyASS instructions.
+type generator struct {
+	source  []string
+	lines   []line
+	labels  int
+	funcs   map[string]*funcInfo
+	globals map[string]*symbol
+	order   []*cell // Global cells, in declaration order
+	fn      *funcInfo
+	scopes  []map[string]*symbol
+	regs    [4]register
+	clock   int
+}
+
+// Compile translates a Tiny program into TinyASS source. As TinyASS has no
+// indirect memory access, every function has a frame at a fixed address, so
+// functions cannot be recursive.
+func Compile(source string) (string, error) {
+	program, err := parse(source)
+	if err != nil {
+		return "", err
+	}
+	g := &generator{
+		source:  strings.Split(source, "\n"),
+		funcs:   map[string]*funcInfo{},
+		globals: map[string]*symbol{},
+	}
+	for _, fn := range program.functions {
+		if _, ok := builtins[fn.name]; ok {
+			return "", &commands.SourceError{Line: fn.line, Err: fmt.Errorf("function %s redeclares a built-in function", fn.name)}
+		}
+		if _, ok := g.funcs[fn.name]; ok {
+			return "", &commands.SourceError{Line: fn.line, Err: fmt.Errorf("function %s is already declared", fn.name)}
+		}
+		info := &funcInfo{name: fn.name, decl: fn, label: label("fn_" + fn.name)}
+		for i, param := range fn.params {
+			for _, other := range fn.params[:i] {
+				if param == other {
+					return "", &commands.SourceError{Line: fn.line, Err: fmt.Errorf("parameter %s is already declared", param)}
+				}
+			}
+			c := &cell{name: fn.name + "." + param}
+			info.params = append(info.params, c)
+			info.cells = append(info.cells, c)
+		}
+		g.funcs[fn.name] = info
+	}
+	main, ok := g.funcs["main"]
+	if !ok {
+		return "", fmt.Errorf("the program has no main function")
+	}
+	if len(main.params) > 0 {
+		return "", &commands.SourceError{Line: main.decl.line, Err: fmt.Errorf("main must not take parameters")}
+	}
+
+	// Startup code: initialize the globals, run main, halt
+	startup := &funcInfo{name: "globals"}
+	g.fn = startup
+	for _, decl := range program.globals {
+		if _, ok := g.globals[decl.name]; ok {
+			return "", &commands.SourceError{Line: decl.line, Err: fmt.Errorf("variable %s is already declared", decl.name)}
+		}
+		g.comment(decl.line)
+		v, err := g.expr(decl.value)
+		if err != nil {
+			return "", err
+		}
+		sym := &symbol{cell: &cell{name: decl.name}, global: true}
+		g.globals[decl.name] = sym
+		g.order = append(g.order, sym.cell)
+		g.assign(sym, v)
+	}
+	g.flush(false)
+	g.emit("CALL", main.label)
+	g.emit("HALT")
+	startup.calls = append(startup.calls, &call{name: "main"})
+
+	for _, fn := range program.functions {
+		if err := g.function(g.funcs[fn.name]); err != nil {
+			return "", err
+		}
+	}
+	if err := g.checkCalls(startup); err != nil {
+		return "", err
+	}
+	return g.layout(startup, program)
+}
+
+// CompileFile compiles the program in filename and writes the TinyASS source
+// to standard output, reporting any error to the user.
+func CompileFile(filename string) bool {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		utils.RED.Printf("Error reading file %s: %v\n", filename, err)
+		return false
+	}
+	asm, err := Compile(string(source))
+	if err != nil {
+		utils.RED.Printf("Error compiling %s: %v\n", filename, err)
+		return false
+	}
+	out := bufio.NewWriter(os.Stdout)
+	out.WriteString(asm)
+	if err := out.Flush(); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	return true
+}
+
+func (g *generator) emit(op string, args ...interface{}) {
+	g.lines = append(g.lines, line{op: op, args: args})
+}
+
+// comment writes the source line a statement comes from.
+func (g *generator) comment(n int) {
+	text := ""
+	if n > 0 && n <= len(g.source) {
+		text = strings.TrimSpace(g.source[n-1])
+	}
+	g.lines = append(g.lines, line{comment: fmt.Sprintf("%d: %s", n, text)})
+}
+
+// newLabel returns a fresh label for the code generated for kind.
+func (g *generator) newLabel(kind string) label {
+	g.labels++
+	return label(fmt.Sprintf("%s_%d", kind, g.labels))
+}
+
+// place defines l at the next instruction. The assigned variables must have
+// been written back, as control may reach l from elsewhere.
+func (g *generator) place(l label) {
+	g.forget()
+	g.lines = append(g.lines, line{label: l})
+}
+
+// lookup finds a variable, from the innermost scope out to the globals.
+func (g *generator) lookup(n *name) (*symbol, error) {
+	for i := len(g.scopes) - 1; i >= 0; i-- {
+		if sym, ok := g.scopes[i][n.name]; ok {
+			return sym, nil
+		}
+	}
+	if sym, ok := g.globals[n.name]; ok {
+		return sym, nil
+	}
+	return nil, &commands.SourceError{Line: n.line, Err: fmt.Errorf("undefined variable %s", n.name)}
+}
+
+// function generates the code of a function. Its parameters are passed in its
+// frame and its result in R0.
+func (g *generator) function(fn *funcInfo) error {
+	g.fn = fn
+	g.place(fn.label)
+	params := map[string]*symbol{}
+	for i, param := range fn.decl.params {
+		params[param] = &symbol{cell: fn.params[i]}
+	}
+	g.scopes = []map[string]*symbol{params}
+	if err := g.block(fn.decl.body); err != nil {
+		return err
+	}
+	if body := fn.decl.body; len(body) == 0 || !isReturn(body[len(body)-1]) {
+		return g.ret(nil)
+	}
+	return nil
+}
+
+func isReturn(stmt statement) bool {
+	_, ok := stmt.(*returnStmt)
+	return ok
+}
+
+// block generates statements in a new scope.
+func (g *generator) block(stmts []statement) error {
+	g.scopes = append(g.scopes, map[string]*symbol{})
+	defer func() { g.scopes = g.scopes[:len(g.scopes)-1] }()
+	for _, stmt := range stmts {
+		if err := g.statement(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *generator) statement(stmt statement) error {
+	switch s := stmt.(type) {
+	case *varDecl:
+		g.comment(s.line)
+		scope := g.scopes[len(g.scopes)-1]
+		if _, ok := scope[s.name]; ok {
+			return &commands.SourceError{Line: s.line, Err: fmt.Errorf("variable %s is already declared", s.name)}
+		}
+		// The value is computed before the variable exists, so it may use an outer one of the same name
+		v, err := g.expr(s.value)
+		if err != nil {
+			return err
+		}
+		sym := &symbol{cell: &cell{name: g.fn.name + "." + s.name}}
+		g.fn.cells = append(g.fn.cells, sym.cell)
+		scope[s.name] = sym
+		g.assign(sym, v)
+	case *assign:
+		g.comment(s.line)
+		sym, err := g.lookup(&name{s.name, s.line})
+		if err != nil {
+			return err
+		}
+		v, err := g.expr(s.value)
+		if err != nil {
+			return err
+		}
+		g.assign(sym, v)
+	case *exprStmt:
+		g.comment(s.line)
+		if s.call.name == "print" || s.call.name == "exit" {
+			return g.builtinStatement(s.call)
+		}
+		v, err := g.expr(s.call)
+		if err != nil {
+			return err
+		}
+		g.release(v)
+	case *returnStmt:
+		g.comment(s.line)
+		return g.ret(s.value)
+	case *ifStmt:
+		return g.ifStatement(s)
+	case *whileStmt:
+		return g.whileStatement(s)
+	}
+	return nil
+}
+
+// builtinStatement generates print(x) and exit(x), which have no value.
+func (g *generator) builtinStatement(c *call) error {
+	if len(c.args) != 1 {
+		return &commands.SourceError{Line: c.line, Err: fmt.Errorf("%s takes 1 argument, not %d", c.name, len(c.args))}
+	}
+	if c.name == "exit" {
+		if err := g.intoR0(c.args[0]); err != nil {
+			return err
+		}
+		g.flush(false)
+		g.emit("SYSCALL", runtime.SYS_EXIT)
+		return nil
+	}
+	v, err := g.expr(c.args[0])
+	if err != nil {
+		return err
+	}
+	r := g.load(v)
+	g.release(v)
+	g.emit("PRINT", R(r))
+	return nil
+}
+
+// ret returns from the current function with value, or 0 when value is nil.
+func (g *generator) ret(x expression) error {
+	if x == nil {
+		x = &number{0}
+	}
+	if err := g.intoR0(x); err != nil {
+		return err
+	}
+	g.flush(true)
+	g.emit("RET")
+	g.forget()
+	return nil
+}
+
+// intoR0 evaluates x into R0, where results and exit statuses are passed.
+func (g *generator) intoR0(x expression) error {
+	if n, ok := fold(x).(*number); ok {
+		g.claim(0)
+		g.emit("LOAD", R(0), n.value)
+		return nil
+	}
+	v, err := g.expr(x)
+	if err != nil {
+		return err
+	}
+	r := g.load(v)
+	g.release(v)
+	if r != 0 {
+		g.claim(0)
+		// TinyASS has no move: OR a value with itself copies it
+		g.emit("OR", R(0), R(r), R(r))
+	}
+	return nil
+}
+
+// condition evaluates cond and jumps to target when it is zero. A constant
+// condition jumps unconditionally or not at all.
+func (g *generator) condition(cond expression, target label) error {
+	cond = fold(cond)
+	if n, ok := cond.(*number); ok {
+		g.flush(false)
+		if n.value == 0 {
+			g.emit("JMP", target)
+		}
+		return nil
+	}
+	v, err := g.expr(cond)
+	if err != nil {
+		return err
+	}
+	r := g.load(v)
+	g.release(v)
+	g.flush(false)
+	g.emit("JZ", R(r), target)
+	return nil
+}
+
+func (g *generator) ifStatement(s *ifStmt) error {
+	g.comment(s.line)
+	elseLabel, end := g.newLabel("else"), g.newLabel("endif")
+	if s.els == nil {
+		elseLabel = end
+	}
+	if err := g.condition(s.cond, elseLabel); err != nil {
+		return err
+	}
+	if err := g.block(s.then); err != nil {
+		return err
+	}
+	g.flush(false)
+	if s.els != nil {
+		g.emit("JMP", end)
+		g.place(elseLabel)
+		if err := g.block(s.els); err != nil {
+			return err
+		}
+		g.flush(false)
+	}
+	g.place(end)
+	return nil
+}
+
+func (g *generator) whileStatement(s *whileStmt) error {
+	top, end := g.newLabel("while"), g.newLabel("endwhile")
+	g.flush(false)
+	g.comment(s.line)
+	g.place(top)
+	if err := g.condition(s.cond, end); err != nil {
+		return err
+	}
+	if err := g.block(s.body); err != nil {
+		return err
+	}
+	g.flush(false)
+	g.emit("JMP", top)
+	g.place(end)
+	return nil
+}
+
+// opcodes maps binary operators to the instruction computing them.
+var opcodes = map[string]string{
+	"+": "ADD", "-": "SUB", "*": "MUL", "/": "DIV", "%": "REM",
+	"&": "AND", "|": "OR", "^": "XOR", "<<": "SHL", ">>": "SHR",
+	"<": "LT", "<=": "LTE", ">": "GT", ">=": "GTE", "==": "EQ", "!=": "NEQ",
+}
+
+// expr generates the code computing x and returns its value.
+func (g *generator) expr(x expression) (*value, error) {
+	switch e := fold(x).(type) {
+	case *number:
+		r := g.alloc()
+		g.emit("LOAD", R(r), e.value)
+		return g.temp(r), nil
+	case *name:
+		sym, err := g.lookup(e)
+		if err != nil {
+			return nil, err
+		}
+		return g.variable(sym), nil
+	case *unary:
+		operand, err := g.expr(e.x)
+		if err != nil {
+			return nil, err
+		}
+		if e.op == "~" {
+			r := g.load(operand)
+			g.release(operand)
+			d := g.result(r)
+			g.emit("NOT", R(d), R(r))
+			return g.temp(d), nil
+		}
+		zero := g.zero(operand)
+		if e.op == "-" {
+			return g.binaryOp("SUB", zero, operand), nil
+		}
+		return g.binaryOp("EQ", operand, zero), nil
+	case *binary:
+		if e.op == "&&" || e.op == "||" {
+			return g.logical(e)
+		}
+		left, err := g.expr(e.x)
+		if err != nil {
+			return nil, err
+		}
+		right, err := g.expr(e.y)
+		if err != nil {
+			return nil, err
+		}
+		return g.binaryOp(opcodes[e.op], left, right), nil
+	case *call:
+		return g.call(e)
+	}
+	return nil, fmt.Errorf("unexpected expression %T", x)
+}
+
+// zero returns a new value 0, keeping the register of operand.
+func (g *generator) zero(operand *value) *value {
+	var r int
+	if operand.reg >= 0 {
+		r = g.alloc(operand.reg)
+	} else {
+		r = g.alloc()
+	}
+	g.emit("LOAD", R(r), 0)
+	return g.temp(r)
+}
+
+// binaryOp generates x op y.
+func (g *generator) binaryOp(op string, x, y *value) *value {
+	rx := g.load(x)
+	ry := g.load(y, rx)
+	g.release(x)
+	g.release(y)
+	d := g.result(rx, ry)
+	g.emit(op, R(d), R(rx), R(ry))
+	return g.temp(d)
+}
+
+// logical generates x && y and x || y, which only evaluate y when x does not
+// decide the result. Both paths leave the result, 0 or 1, in a spill slot.
+func (g *generator) logical(e *binary) (*value, error) {
+	g.spillAll()
+	g.flush(false)
+	result := g.spillSlot()
+	end := g.newLabel("logic")
+	jump := map[string]string{"&&": "JZ", "||": "JNZ"}[e.op]
+	for i, operand := range []expression{e.x, e.y} {
+		v, err := g.expr(operand)
+		if err != nil {
+			return nil, err
+		}
+		r := g.load(v)
+		g.release(v)
+		d := g.alloc(r)
+		g.emit("LOAD", R(d), 0)
+		g.emit("NEQ", R(d), R(r), R(d))
+		g.emit("STORE", R(d), result)
+		if i == 0 {
+			g.emit(jump, R(d), end)
+		}
+	}
+	g.place(end)
+	return &value{reg: -1, slot: result, refs: 1}, nil
+}
+
+// call generates a call to a function or to read().
+func (g *generator) call(c *call) (*value, error) {
+	if n, ok := builtins[c.name]; ok {
+		if c.name != "read" {
+			return nil, &commands.SourceError{Line: c.line, Err: fmt.Errorf("%s has no value", c.name)}
+		}
+		if len(c.args) != n {
+			return nil, &commands.SourceError{Line: c.line, Err: fmt.Errorf("read takes no arguments")}
+		}
+		g.claim(0)
+		g.emit("SYSCALL", runtime.SYS_READ)
+		return g.temp(0), nil
+	}
+	callee, ok := g.funcs[c.name]
+	if !ok {
+		return nil, &commands.SourceError{Line: c.line, Err: fmt.Errorf("undefined function %s", c.name)}
+	}
+	if len(c.args) != len(callee.params) {
+		return nil, &commands.SourceError{Line: c.line, Err: fmt.Errorf("%s takes %d arguments, not %d", c.name, len(callee.params), len(c.args))}
+	}
+	g.fn.calls = append(g.fn.calls, c)
+	// All arguments are computed before any is passed, as computing one may call the same function
+	args := make([]*value, len(c.args))
+	for i, arg := range c.args {
+		v, err := g.expr(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+	for i, v := range args {
+		r := g.load(v)
+		g.release(v)
+		g.emit("STORE", R(r), callee.params[i])
+	}
+	g.spillAll()
+	g.flush(false)
+	g.emit("CALL", callee.label)
+	g.forget()
+	return g.temp(0), nil
+}
+
+// fold computes the operations on constants of x.
+func fold(x expression) expression {
+	switch e := x.(type) {
+	case *unary:
+		operand := fold(e.x)
+		if n, ok := operand.(*number); ok {
+			switch e.op {
+			case "-":
+				return &number{-n.value}
+			case "~":
+				return &number{^n.value}
+			case "!":
+				return &number{boolInt(n.value == 0)}
+			}
+		}
+		return &unary{e.op, operand}
+	case *binary:
+		left, right := fold(e.x), fold(e.y)
+		a, okA := left.(*number)
+		b, okB := right.(*number)
+		if okA && okB {
+			if n, ok := foldBinary(e.op, a.value, b.value); ok {
+				return &number{n}
+			}
+		}
+		return &binary{e.op, left, right}
+	}
+	return x
+}
+
+// foldBinary computes a op b like the CPU does, except for divisions by zero,
+// which are left to fault when the program runs.
+func foldBinary(op string, a, b int) (int, bool) {
+	switch op {
+	case "+":
+		return a + b, true
+	case "-":
+		return a - b, true
+	case "*":
+		return a * b, true
+	case "/", "%":
+		if b == 0 {
+			return 0, false
+		}
+		if op == "/" {
+			return a / b, true
+		}
+		return a % b, true
+	case "&":
+		return a & b, true
+	case "|":
+		return a | b, true
+	case "^":
+		return a ^ b, true
+	case "<<":
+		return a << uint(b), true
+	case ">>":
+		return a >> uint(b), true
+	case "<":
+		return boolInt(a < b), true
+	case "<=":
+		return boolInt(a <= b), true
+	case ">":
+		return boolInt(a > b), true
+	case ">=":
+		return boolInt(a >= b), true
+	case "==":
+		return boolInt(a == b), true
+	case "!=":
+		return boolInt(a != b), true
+	case "&&":
+		return boolInt(a != 0 && b != 0), true
+	case "||":
+		return boolInt(a != 0 || b != 0), true
+	}
+	return 0, false
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// checkCalls rejects recursion, which static frames cannot support, and call
+// chains deeper than the stack, which would overflow at run time.
+func (g *generator) checkCalls(startup *funcInfo) error {
+	depths := map[*funcInfo]int{}
+	active := map[*funcInfo]bool{}
+	var depth func(fn *funcInfo) (int, error)
+	depth = func(fn *funcInfo) (int, error) {
+		if d, ok := depths[fn]; ok {
+			return d, nil
+		}
+		active[fn] = true
+		deepest := 0
+		for _, c := range fn.calls {
+			callee := g.funcs[c.name]
+			if active[callee] {
+				return 0, &commands.SourceError{Line: c.line, Err: fmt.Errorf("recursive call to %s: functions have a single frame at a fixed address, as TinyASS has no indirect memory access", c.name)}
+			}
+			d, err := depth(callee)
+			if err != nil {
+				return 0, err
+			}
+			deepest = max(deepest, d+1)
+		}
+		active[fn] = false
+		depths[fn] = deepest
+		return deepest, nil
+	}
+	d, err := depth(startup)
+	if err != nil {
+		return err
+	}
+	if d > MAX_CALL_DEPTH {
+		return fmt.Errorf("calls nest %d deep, more than the %d the stack has room for", d, MAX_CALL_DEPTH)
+	}
+	return nil
+}
+
+// layout assigns the memory cells, globals first then the frames, and writes
+// the program's source.
+func (g *generator) layout(startup *funcInfo, program *file) (string, error) {
+	cells := append([]*cell{}, g.order...)
+	cells = append(cells, startup.cells...)
+	for _, fn := range program.functions {
+		cells = append(cells, g.funcs[fn.name].cells...)
+	}
+	if len(cells) > DATA_LIMIT {
+		return "", fmt.Errorf("the variables need %d memory cells, more than the %d available", len(cells), DATA_LIMIT)
+	}
+	for i, c := range cells {
+		c.address = i
+	}
+	instructions := 0
+	for _, l := range g.lines {
+		if l.op != "" {
+			instructions++
+		}
+	}
+	if instructions > commands.MEMORY_SIZE {
+		return "", fmt.Errorf("the program needs %d instructions, more than the %d TinyASS can address", instructions, commands.MEMORY_SIZE)
+	}
+
+	var b strings.Builder
+	b.WriteString("; Compiled by tinyass compile.\n")
+	for _, c := range cells {
+		fmt.Fprintf(&b, "; 0x%02X %s\n", c.address, c.name)
+	}
+	for _, l := range g.lines {
+		switch {
+		case l.label != "":
+			fmt.Fprintf(&b, "%s:\n", l.label)
+		case l.comment != "":
+			fmt.Fprintf(&b, "    ; %s\n", l.comment)
+		default:
+			b.WriteString("    " + l.op)
+			for _, arg := range l.args {
+				switch a := arg.(type) {
+				case R:
+					fmt.Fprintf(&b, " R%d", a)
+				case *cell:
+					fmt.Fprintf(&b, " 0x%02X", a.address)
+				default:
+					fmt.Fprintf(&b, " %v", a)
+				}
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String(), nil
+}
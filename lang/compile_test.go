@@ -0,0 +1,553 @@
+package lang
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+	"tinyass/runtime"
+)
+
+// outcome is what running a program shows: the printed values, how it
+// stopped and its exit status.
+type outcome struct {
+	printed []int
+	exited  bool
+	status  int
+	faulted bool
+}
+
+func (o outcome) String() string {
+	return fmt.Sprintf("printed %v, exited %v with %d, faulted %v", o.printed, o.exited, o.status, o.faulted)
+}
+
+func (o outcome) equal(other outcome) bool {
+	return fmt.Sprint(o.printed) == fmt.Sprint(other.printed) && o.exited == other.exited &&
+		o.status == other.status && o.faulted == other.faulted
+}
+
+// Signals unwinding the reference interpreter
+type (
+	exitSignal  struct{ status int }
+	faultSignal struct{}
+)
+
+// interpreter runs a parsed program directly, as the reference for compiled programs.
+type interpreter struct {
+	funcs   map[string]*function
+	globals map[string]*int
+	input   []byte
+	out     outcome
+	steps   int
+}
+
+// interpret runs program with input.
+func interpret(t *testing.T, program *file, input string) (out outcome) {
+	t.Helper()
+	in := &interpreter{funcs: map[string]*function{}, globals: map[string]*int{}, input: []byte(input)}
+	for _, fn := range program.functions {
+		in.funcs[fn.name] = fn
+	}
+	defer func() {
+		switch s := recover().(type) {
+		case nil:
+		case exitSignal:
+			in.out.exited, in.out.status = true, s.status
+		case faultSignal:
+			in.out.faulted = true
+		default:
+			panic(s)
+		}
+		out = in.out
+	}()
+	for _, decl := range program.globals {
+		v := in.eval(decl.value, nil)
+		in.globals[decl.name] = &v
+	}
+	in.call(in.funcs["main"], nil)
+	return in.out
+}
+
+func (in *interpreter) lookup(name string, scopes []map[string]*int) *int {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if v, ok := scopes[i][name]; ok {
+			return v
+		}
+	}
+	return in.globals[name]
+}
+
+func (in *interpreter) call(fn *function, args []int) int {
+	params := map[string]*int{}
+	for i, param := range fn.params {
+		params[param] = &args[i]
+	}
+	result, _ := in.block(fn.body, []map[string]*int{params})
+	return result
+}
+
+// block runs statements in a new scope, returning the result of a return statement.
+func (in *interpreter) block(stmts []statement, scopes []map[string]*int) (int, bool) {
+	scopes = append(scopes, map[string]*int{})
+	for _, stmt := range stmts {
+		if in.steps++; in.steps > 100000 {
+			panic("the program does not stop")
+		}
+		switch s := stmt.(type) {
+		case *varDecl:
+			v := in.eval(s.value, scopes)
+			scopes[len(scopes)-1][s.name] = &v
+		case *assign:
+			v := in.eval(s.value, scopes)
+			*in.lookup(s.name, scopes) = v
+		case *exprStmt:
+			in.eval(s.call, scopes)
+		case *returnStmt:
+			if s.value == nil {
+				return 0, true
+			}
+			return in.eval(s.value, scopes), true
+		case *ifStmt:
+			body := s.els
+			if in.eval(s.cond, scopes) != 0 {
+				body = s.then
+			}
+			if result, returned := in.block(body, scopes); returned {
+				return result, true
+			}
+		case *whileStmt:
+			for in.eval(s.cond, scopes) != 0 {
+				if result, returned := in.block(s.body, scopes); returned {
+					return result, true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+func (in *interpreter) eval(x expression, scopes []map[string]*int) int {
+	switch e := x.(type) {
+	case *number:
+		return e.value
+	case *name:
+		return *in.lookup(e.name, scopes)
+	case *unary:
+		v := in.eval(e.x, scopes)
+		n, _ := fold(&unary{e.op, &number{v}}).(*number)
+		return n.value
+	case *binary:
+		a := in.eval(e.x, scopes)
+		if (e.op == "&&" && a == 0) || (e.op == "||" && a != 0) {
+			return boolInt(a != 0)
+		}
+		b := in.eval(e.y, scopes)
+		v, ok := foldBinary(e.op, a, b)
+		if !ok {
+			panic(faultSignal{})
+		}
+		return v
+	case *call:
+		args := make([]int, len(e.args))
+		for i, arg := range e.args {
+			args[i] = in.eval(arg, scopes)
+		}
+		switch e.name {
+		case "print":
+			in.out.printed = append(in.out.printed, args[0])
+			return 0
+		case "exit":
+			panic(exitSignal{args[0]})
+		case "read":
+			if len(in.input) == 0 {
+				return -1
+			}
+			b := in.input[0]
+			in.input = in.input[1:]
+			return int(b)
+		}
+		return in.call(in.funcs[e.name], args)
+	}
+	panic(fmt.Sprintf("unexpected expression %T", x))
+}
+
+// printedValue matches the values printed by PRINT.
+var printedValue = regexp.MustCompile(`Register R[0-3] = (-?\d+)`)
+
+// runCompiled compiles source and runs it on the CPU.
+func runCompiled(t *testing.T, source, input string) (outcome, string) {
+	t.Helper()
+	asm, err := Compile(source)
+	if err != nil {
+		t.Fatalf("Compile() error = %v\n%s", err, source)
+	}
+	program, err := commands.Assemble(asm, commands.ParseOptions{StrictCase: true})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v\n%s", err, asm)
+	}
+	cpu := runtime.NewCPU()
+	cpu.LoadProgram(program.Instructions)
+	cpu.SetSyscalls(runtime.NewSyscallTable(strings.NewReader(input), io.Discard))
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	runErr := cpu.RunContext(context.Background(), runtime.Limits{MaxSteps: 1000000})
+	w.Close()
+	os.Stdout = stdout
+	printed := <-output
+
+	var out outcome
+	for _, match := range printedValue.FindAllStringSubmatch(printed, -1) {
+		v, _ := strconv.Atoi(match[1])
+		out.printed = append(out.printed, v)
+	}
+	out.status, out.exited = cpu.ExitStatus()
+	if runErr != nil {
+		if !strings.HasPrefix(runErr.Error(), "Division by zero") {
+			t.Fatalf("unexpected fault: %v\n%s", runErr, asm)
+		}
+		out.faulted = true
+	}
+	return out, asm
+}
+
+// checkProgram compares the compiled program to the reference interpreter.
+func checkProgram(t *testing.T, name, source, input string) string {
+	t.Helper()
+	program, err := parse(source)
+	if err != nil {
+		t.Fatalf("%s: parse() error = %v", name, err)
+	}
+	want := interpret(t, program, input)
+	got, asm := runCompiled(t, source, input)
+	if !got.equal(want) {
+		t.Errorf("%s: compiled program %v, want %v\n%s\n%s", name, got, want, source, asm)
+	}
+	return asm
+}
+
+var testPrograms = []struct {
+	name, source, input string
+}{
+	{"arithmetic", `
+func main() {
+    var a = 7;
+    var b = -3;
+    print(a + b); print(a - b); print(a * b); print(a / b); print(a % b);
+    print(a & b); print(a | b); print(a ^ b); print(a << 2); print(b >> 1); print(~a); print(-a);
+    print(a < b); print(a <= 7); print(a > b); print(b >= a); print(a == 7); print(a != 7); print(!a); print(!0);
+}`, ""},
+	{"loops and conditions", `
+func main() {
+    var i = 0;
+    var evens = 0;
+    while i < 20 {
+        if i % 2 == 0 {
+            evens = evens + i;
+        } else if i % 3 == 0 {
+            print(i);
+        } else {
+            evens = evens - 1;
+        }
+        i = i + 1;
+    }
+    print(evens);
+}`, ""},
+	{"functions and globals", `
+var calls = 0;
+var base = 10 * 3;
+
+func gcd(a, b) {
+    calls = calls + 1;
+    while b != 0 {
+        var t = a % b;
+        a = b;
+        b = t;
+    }
+    return a;
+}
+
+func lcm(a, b) {
+    return a / gcd(a, b) * b;
+}
+
+func nothing() {
+}
+
+func main() {
+    print(gcd(base, 84));
+    print(lcm(4, 6) + lcm(10, gcd(25, 15)));
+    print(nothing());
+    print(calls);
+}`, ""},
+	{"iterative fibonacci", `
+func fib(n) {
+    var a = 0;
+    var b = 1;
+    while n > 0 {
+        var next = a + b;
+        a = b;
+        b = next;
+        n = n - 1;
+    }
+    return a;
+}
+
+func main() {
+    var i = 0;
+    while i <= 30 {
+        print(fib(i));
+        i = i + 10;
+    }
+}`, ""},
+	{"short circuit", `
+var touched = 0;
+
+func touch(x) {
+    touched = touched + 1;
+    return x;
+}
+
+func main() {
+    var zero = 0;
+    print(zero != 0 && 10 / zero > 1);
+    print(zero == 0 || 10 / zero > 1);
+    print(touch(0) && touch(1));
+    print(touch(2) || touch(3));
+    print(touch(4) && touch(0) || touch(5));
+    print(touched);
+}`, ""},
+	{"globals changed by calls", `
+var g = 1;
+
+func bump() {
+    g = g * 2;
+    return g;
+}
+
+func main() {
+    g = g + 1;
+    print(g + bump());
+    print(bump() + g);
+    print(g);
+}`, ""},
+	{"deep expression", `
+func main() {
+    var a = 1; var b = 2; var c = 3; var d = 4; var e = 5; var f = 6;
+    print(a + (b * (c - (d + (e * (f - (a + (b * c))))))));
+    print((a + b) * (c + d) - (e + f) * (a - c) + (b * d - e) * (f - a + c));
+}`, ""},
+	{"shadowing", `
+var x = 1;
+
+func main() {
+    print(x);
+    var x = x + 10;
+    if x > 0 {
+        var x = x + 100;
+        print(x);
+    }
+    print(x);
+}`, ""},
+	{"read and exit", `
+func main() {
+    var sum = 0;
+    var c = read();
+    while c != -1 {
+        sum = sum + c;
+        c = read();
+    }
+    print(sum);
+    exit(sum % 7);
+    print(0);
+}`, "hello"},
+	{"division by zero", `
+func main() {
+    var x = 0;
+    print(1);
+    print(1 / x);
+}`, ""},
+	{"constants", `
+func main() {
+    while 0 { print(1); }
+    if 1 { print(2 * 3 + (1 << 4)); } else { print(3); }
+    print(-(5 - 9));
+    return 1 / 0;
+}`, ""},
+}
+
+func TestCompileMatchesInterpreter(t *testing.T) {
+	for _, tt := range testPrograms {
+		checkProgram(t, tt.name, tt.source, tt.input)
+	}
+}
+
+// randomExpr returns a random expression over the variables in vars.
+func randomExpr(rng *rand.Rand, vars []string, depth int) string {
+	if depth == 0 || rng.Intn(5) == 0 {
+		if rng.Intn(3) == 0 {
+			return strconv.Itoa(rng.Intn(21) - 10)
+		}
+		return vars[rng.Intn(len(vars))]
+	}
+	switch rng.Intn(10) {
+	case 0:
+		return fmt.Sprintf("mix(%s, %s)", randomExpr(rng, vars, depth-1), randomExpr(rng, vars, depth-1))
+	case 1:
+		return fmt.Sprintf("%s(%s)", []string{"-", "!", "~"}[rng.Intn(3)], randomExpr(rng, vars, depth-1))
+	case 2:
+		return "read()"
+	}
+	ops := []string{"+", "-", "*", "/", "%", "&", "|", "^", "<<", ">>", "<", "<=", ">", ">=", "==", "!=", "&&", "||"}
+	op := ops[rng.Intn(len(ops))]
+	right := randomExpr(rng, vars, depth-1)
+	if op == "<<" || op == ">>" {
+		right = fmt.Sprintf("(%s & 7)", right)
+	}
+	return fmt.Sprintf("(%s %s %s)", randomExpr(rng, vars, depth-1), op, right)
+}
+
+// TestCompileRandomPrograms checks random programs with enough variables and
+// nesting to need every register and spill to memory.
+func TestCompileRandomPrograms(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	spilled := 0
+	for i := 0; i < 150; i++ {
+		vars := []string{"g0", "g1"}
+		var body strings.Builder
+		for v := 0; v < 4; v++ {
+			fmt.Fprintf(&body, "    var v%d = %s;\n", v, randomExpr(rng, vars, 3))
+			vars = append(vars, fmt.Sprintf("v%d", v))
+			if rng.Intn(3) == 0 {
+				fmt.Fprintf(&body, "    if %s { v%d = %s; } else { g1 = %s; }\n",
+					randomExpr(rng, vars, 2), v, randomExpr(rng, vars, 2), randomExpr(rng, vars, 2))
+			}
+			fmt.Fprintf(&body, "    print(v%d);\n", v)
+		}
+		fmt.Fprintf(&body, "    var n = 3;\n    while n > 0 {\n        g0 = g0 + %s;\n        n = n - 1;\n    }\n", randomExpr(rng, vars, 2))
+		fmt.Fprintf(&body, "    print(g0 + %s);\n    exit(%s);\n", randomExpr(rng, vars, 4), randomExpr(rng, vars, 1))
+		source := fmt.Sprintf(`var g0 = %d;
+var g1 = %d;
+
+func twice(x) {
+    g1 = g1 + 1;
+    return x * 2;
+}
+
+func mix(a, b) {
+    var t = a - b;
+    if t < 0 {
+        t = -t;
+    }
+    return twice(t) + a - g1;
+}
+
+func main() {
+%s}
+`, rng.Intn(9), rng.Intn(9), body.String())
+		asm := checkProgram(t, fmt.Sprintf("program %d", i), source, "random input")
+		if strings.Contains(asm, ".spill") {
+			spilled++
+		}
+		if t.Failed() {
+			break
+		}
+	}
+	if spilled == 0 {
+		t.Errorf("no random program spilled a value")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name, source string
+		line         int // 0 for an error about the whole program
+	}{
+		{"no main", "func f() {}", 0},
+		{"main with parameters", "func main(x) {}", 1},
+		{"undefined variable", "func main() {\n  print(x);\n}", 2},
+		{"undefined function", "func main() {\n  f();\n}", 2},
+		{"wrong argument count", "func f(a) {}\nfunc main() {\n  f(1, 2);\n}", 3},
+		{"redeclared variable", "func main() {\n  var a = 1;\n  var a = 2;\n}", 3},
+		{"redeclared function", "func main() {}\nfunc main() {}", 2},
+		{"redeclared built-in", "func print(x) {}\nfunc main() {}", 1},
+		{"print as a value", "func main() {\n  var a = print(1);\n}", 2},
+		{"direct recursion", "func f(n) {\n  return f(n - 1);\n}\nfunc main() { f(1); }", 2},
+		{"indirect recursion", "func f() {\n  g();\n}\nfunc g() { f(); }\nfunc main() { g(); }", 2},
+	}
+	for _, tt := range tests {
+		_, err := Compile(tt.source)
+		var srcErr *commands.SourceError
+		switch {
+		case err == nil:
+			t.Errorf("%s: Compile() succeeded", tt.name)
+		case tt.line == 0 && errors.As(err, &srcErr):
+			t.Errorf("%s: Compile() error = %v, want one without a line", tt.name, err)
+		case tt.line > 0 && (!errors.As(err, &srcErr) || srcErr.Line != tt.line):
+			t.Errorf("%s: Compile() error = %v, want one on line %d", tt.name, err, tt.line)
+		}
+	}
+
+	// Programs must fit the instruction and data address spaces
+	var big strings.Builder
+	big.WriteString("func main() {\n")
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(&big, "  var v%d = %d;\n  print(v%d);\n", i, i, i)
+	}
+	big.WriteString("}\n")
+	if _, err := Compile(big.String()); err == nil || !strings.Contains(err.Error(), "instructions") {
+		t.Errorf("Compile() of a long program: error = %v, want one about instructions", err)
+	}
+	big.Reset()
+	big.WriteString("func main() {\n")
+	for i := 0; i < DATA_LIMIT+1; i++ {
+		fmt.Fprintf(&big, "  var v%d = 0;\n", i)
+	}
+	big.WriteString("}\n")
+	if _, err := Compile(big.String()); err == nil || !strings.Contains(err.Error(), "memory cells") {
+		t.Errorf("Compile() of a program with many variables: error = %v, want one about memory cells", err)
+	}
+}
+
+func TestCompileRegisterAllocation(t *testing.T) {
+	asm, err := Compile(`
+var g = 0;
+
+func main() {
+    var a = 1;
+    var b = a + 2;
+    g = a + b;
+    print(g);
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := asm[strings.Index(asm, "fn_main:"):]
+	// Assigned variables stay in registers until the function returns: only g
+	// is stored, and none is loaded back
+	if strings.Count(main, "STORE") != 1 || strings.Contains(main, "LOADM") {
+		t.Errorf("unexpected memory accesses:\n%s", main)
+	}
+	for _, want := range []string{"; 0x00 g\n", "; 0x01 main.a\n", "    ; 6: var b = a + 2;\n", "    CALL fn_main\n    HALT\n"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("compiled program lacks %q:\n%s", want, asm)
+		}
+	}
+}
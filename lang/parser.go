@@ -0,0 +1,482 @@
+// Package lang compiles Tiny, a small structured language, to TinyASS source.
+//
+// A Tiny program declares global variables and functions, and starts in main:
+//
+//	var total = 0;
+//
+//	func square(n) {
+//	    return n * n;
+//	}
+//
+//	func main() {
+//	    var i = 1;
+//	    while i <= 10 {
+//	        total = total + square(i);
+//	        i = i + 1;
+//	    }
+//	    print(total);
+//	}
+//
+// Values are integers. Operators and their precedence are those of Go, with
+// comparisons and the logical operators giving 0 or 1. Statements are
+// declarations, assignments, calls, if/else, while and return. The built-in
+// print(x) prints a value, read() returns the next input byte (-1 at the end)
+// and exit(x) stops the program with status x.
+package lang
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Node types of the syntax tree
+type (
+	// expression is a node of an expression: number, name, unary, binary or call.
+	expression interface{}
+
+	number struct{ value int }
+	name   struct {
+		name string
+		line int
+	}
+	unary struct {
+		op string
+		x  expression
+	}
+	binary struct {
+		op   string
+		x, y expression
+	}
+	call struct {
+		name string
+		args []expression
+		line int
+	}
+
+	// statement is a node of a statement: varDecl, assign, ifStmt, whileStmt, returnStmt or exprStmt.
+	statement interface{}
+
+	varDecl struct {
+		name  string
+		value expression
+		line  int
+	}
+	assign struct {
+		name  string
+		value expression
+		line  int
+	}
+	ifStmt struct {
+		cond      expression
+		then, els []statement
+		line      int
+	}
+	whileStmt struct {
+		cond expression
+		body []statement
+		line int
+	}
+	returnStmt struct {
+		value expression // nil when returning nothing
+		line  int
+	}
+	exprStmt struct {
+		call *call
+		line int
+	}
+
+	function struct {
+		name   string
+		params []string
+		body   []statement
+		line   int
+	}
+
+	// file is a parsed program.
+	file struct {
+		globals   []*varDecl
+		functions []*function
+	}
+)
+
+// Token kinds
+const (
+	TOKEN_EOF = iota
+	TOKEN_NAME
+	TOKEN_NUMBER
+	TOKEN_KEYWORD
+	TOKEN_OPERATOR
+)
+
+type token struct {
+	kind int
+	text string
+	line int
+}
+
+var keywords = map[string]bool{"var": true, "func": true, "if": true, "else": true, "while": true, "return": true}
+
+// operators lists the operators and punctuation, longest first so "<=" is not read as "<".
+var operators = []string{
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "&", "|", "^", "~", "!", "<", ">", "=", "(", ")", "{", "}", ",", ";",
+}
+
+// tokenize splits source into tokens. Comments run from "//" to the end of the line.
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	line := 1
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(source[i:], "//"):
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case isLetter(c):
+			j := i
+			for j < len(source) && (isLetter(source[j]) || isDigit(source[j])) {
+				j++
+			}
+			kind := TOKEN_NAME
+			if keywords[source[i:j]] {
+				kind = TOKEN_KEYWORD
+			}
+			tokens = append(tokens, token{kind, source[i:j], line})
+			i = j
+		case isDigit(c):
+			j := i
+			for j < len(source) && (isLetter(source[j]) || isDigit(source[j])) {
+				j++
+			}
+			tokens = append(tokens, token{TOKEN_NUMBER, source[i:j], line})
+			i = j
+		default:
+			op := ""
+			for _, candidate := range operators {
+				if strings.HasPrefix(source[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &commands.SourceError{Line: line, Err: fmt.Errorf("unexpected character %q", c)}
+			}
+			tokens = append(tokens, token{TOKEN_OPERATOR, op, line})
+			i += len(op)
+		}
+	}
+	return append(tokens, token{TOKEN_EOF, "end of file", line}), nil
+}
+
+func isLetter(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// parser is a recursive descent parser over the tokens of a program.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses a program. Errors are *commands.SourceError values giving the line.
+func parse(source string) (*file, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	program := &file{}
+	for p.peek().kind != TOKEN_EOF {
+		switch {
+		case p.is("var"):
+			decl, err := p.varDecl()
+			if err != nil {
+				return nil, err
+			}
+			program.globals = append(program.globals, decl)
+		case p.is("func"):
+			fn, err := p.function()
+			if err != nil {
+				return nil, err
+			}
+			program.functions = append(program.functions, fn)
+		default:
+			return nil, p.errorf("unexpected %s, want var or func", p.peek().text)
+		}
+	}
+	return program, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != TOKEN_EOF {
+		p.pos++
+	}
+	return t
+}
+
+// is reports whether the next token is the keyword or operator text.
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == TOKEN_KEYWORD || t.kind == TOKEN_OPERATOR) && t.text == text
+}
+
+// accept consumes the next token if it is text.
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("unexpected %s, want %s", p.peek().text, text)
+	}
+	return nil
+}
+
+func (p *parser) expectName() (string, error) {
+	if p.peek().kind != TOKEN_NAME {
+		return "", p.errorf("unexpected %s, want a name", p.peek().text)
+	}
+	return p.next().text, nil
+}
+
+// errorf reports an error on the line of the next token.
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &commands.SourceError{Line: p.peek().line, Err: fmt.Errorf(format, args...)}
+}
+
+// varDecl parses "var name = value;".
+func (p *parser) varDecl() (*varDecl, error) {
+	line := p.next().line
+	decl := &varDecl{line: line}
+	var err error
+	if decl.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	if decl.value, err = p.expr(); err != nil {
+		return nil, err
+	}
+	return decl, p.expect(";")
+}
+
+// function parses "func name(params) { body }".
+func (p *parser) function() (*function, error) {
+	fn := &function{line: p.next().line}
+	var err error
+	if fn.name, err = p.expectName(); err != nil {
+		return nil, err
+	}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		param, err := p.expectName()
+		if err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, param)
+	}
+	fn.body, err = p.block()
+	return fn, err
+}
+
+// block parses statements between braces.
+func (p *parser) block() ([]statement, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var stmts []statement
+	for !p.is("}") {
+		if p.peek().kind == TOKEN_EOF {
+			return nil, p.errorf("unexpected end of file, want }")
+		}
+		stmt, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	p.next()
+	return stmts, nil
+}
+
+func (p *parser) statement() (statement, error) {
+	line := p.peek().line
+	switch {
+	case p.is("var"):
+		return p.varDecl()
+	case p.is("if"):
+		return p.ifStatement()
+	case p.accept("while"):
+		cond, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.block()
+		return &whileStmt{cond, body, line}, err
+	case p.accept("return"):
+		stmt := &returnStmt{line: line}
+		if !p.is(";") {
+			var err error
+			if stmt.value, err = p.expr(); err != nil {
+				return nil, err
+			}
+		}
+		return stmt, p.expect(";")
+	case p.peek().kind == TOKEN_NAME && p.tokens[p.pos+1].text == "=":
+		target := p.next().text
+		p.next()
+		value, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return &assign{target, value, line}, p.expect(";")
+	}
+	x, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	c, ok := x.(*call)
+	if !ok {
+		return nil, &commands.SourceError{Line: line, Err: fmt.Errorf("expression is not a statement: only calls can be")}
+	}
+	return &exprStmt{c, line}, p.expect(";")
+}
+
+// ifStatement parses an if, with else and else if branches.
+func (p *parser) ifStatement() (statement, error) {
+	stmt := &ifStmt{line: p.next().line}
+	var err error
+	if stmt.cond, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if stmt.then, err = p.block(); err != nil {
+		return nil, err
+	}
+	if p.accept("else") {
+		if p.is("if") {
+			elseIf, err := p.ifStatement()
+			if err != nil {
+				return nil, err
+			}
+			stmt.els = []statement{elseIf}
+		} else if stmt.els, err = p.block(); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// precedence gives the binding strength of binary operators, as in Go.
+var precedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4, "|": 4, "^": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5, "&": 5,
+}
+
+func (p *parser) expr() (expression, error) {
+	return p.binaryExpr(1)
+}
+
+// binaryExpr parses operators binding at least as strongly as prec, grouping left to right.
+func (p *parser) binaryExpr(prec int) (expression, error) {
+	x, err := p.unaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t := p.peek()
+		opPrec, ok := precedence[t.text]
+		if t.kind != TOKEN_OPERATOR || !ok || opPrec < prec {
+			return x, nil
+		}
+		p.next()
+		y, err := p.binaryExpr(opPrec + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = &binary{t.text, x, y}
+	}
+}
+
+func (p *parser) unaryExpr() (expression, error) {
+	if p.is("-") || p.is("!") || p.is("~") {
+		op := p.next().text
+		x, err := p.unaryExpr()
+		if err != nil {
+			return nil, err
+		}
+		return &unary{op, x}, nil
+	}
+	return p.primary()
+}
+
+func (p *parser) primary() (expression, error) {
+	t := p.peek()
+	switch {
+	case t.kind == TOKEN_NUMBER:
+		p.next()
+		value, err := strconv.ParseInt(t.text, 0, 64)
+		if err != nil {
+			return nil, &commands.SourceError{Line: t.line, Err: fmt.Errorf("invalid number %s", t.text)}
+		}
+		return &number{int(value)}, nil
+	case t.kind == TOKEN_NAME:
+		p.next()
+		if !p.accept("(") {
+			return &name{t.text, t.line}, nil
+		}
+		c := &call{name: t.text, line: t.line}
+		for !p.accept(")") {
+			if len(c.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			c.args = append(c.args, arg)
+		}
+		return c, nil
+	case p.accept("("):
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return x, p.expect(")")
+	}
+	return nil, p.errorf("unexpected %s, want an expression", t.text)
+}
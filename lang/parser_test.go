@@ -0,0 +1,109 @@
+package lang
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// show writes an expression fully parenthesized.
+func show(x expression) string {
+	switch e := x.(type) {
+	case *number:
+		return fmt.Sprint(e.value)
+	case *name:
+		return e.name
+	case *unary:
+		return e.op + show(e.x)
+	case *binary:
+		return "(" + show(e.x) + " " + e.op + " " + show(e.y) + ")"
+	case *call:
+		args := make([]string, len(e.args))
+		for i, arg := range e.args {
+			args[i] = show(arg)
+		}
+		return e.name + "(" + strings.Join(args, ", ") + ")"
+	}
+	return "?"
+}
+
+func TestParseExpressions(t *testing.T) {
+	tests := map[string]string{
+		"1 + 2 * 3":            "(1 + (2 * 3))",
+		"1 - 2 - 3":            "((1 - 2) - 3)",
+		"a << 2 + b":           "((a << 2) + b)",
+		"a < b == c":           "((a < b) == c)",
+		"a || b && c | d":      "(a || (b && (c | d)))",
+		"-a * ~b":              "(-a * ~b)",
+		"!(a + 0x10) % f(1,x)": "(!(a + 16) % f(1, x))",
+		"g()":                  "g()",
+	}
+	for source, want := range tests {
+		program, err := parse("var x = " + source + ";")
+		if err != nil {
+			t.Errorf("parse(%q) error = %v", source, err)
+			continue
+		}
+		if got := show(program.globals[0].value); got != want {
+			t.Errorf("parse(%q) = %s, want %s", source, got, want)
+		}
+	}
+}
+
+func TestParseStatements(t *testing.T) {
+	program, err := parse(`
+// A comment
+var g = 1;
+
+func f(a, b) {
+    var c = a;
+    if c { c = b; } else if b { return; } else { f(c, 2); }
+    while c > 0 { c = c - 1; }
+    return c;
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.globals) != 1 || len(program.functions) != 1 {
+		t.Fatalf("parse() = %d globals, %d functions", len(program.globals), len(program.functions))
+	}
+	fn := program.functions[0]
+	if fn.name != "f" || strings.Join(fn.params, ",") != "a,b" || fn.line != 5 || len(fn.body) != 4 {
+		t.Fatalf("function = %s(%v) on line %d with %d statements", fn.name, fn.params, fn.line, len(fn.body))
+	}
+	elseIf, ok := fn.body[1].(*ifStmt)
+	if !ok || len(elseIf.els) != 1 {
+		t.Fatalf("statement 2 = %#v, want an if with an else if", fn.body[1])
+	}
+	if inner := elseIf.els[0].(*ifStmt); len(inner.then) != 1 || !isReturn(inner.then[0]) || len(inner.els) != 1 {
+		t.Errorf("else if = %#v", inner)
+	}
+	if w, ok := fn.body[2].(*whileStmt); !ok || w.line != 8 {
+		t.Errorf("statement 3 = %#v, want a while on line 8", fn.body[2])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, source string
+		line         int
+	}{
+		{"bad character", "var x = 1;\nvar y = 2 $ 3;", 2},
+		{"missing semicolon", "func main() {\n  var x = 1\n}", 3},
+		{"not a statement", "func main() {\n  1 + 2;\n}", 2},
+		{"unclosed block", "func main() {\n  print(1);", 2},
+		{"bad number", "var x = 12ab;", 1},
+		{"top level statement", "print(1);", 1},
+		{"keyword as name", "func main() {\n  var while = 1;\n}", 2},
+	}
+	for _, tt := range tests {
+		_, err := parse(tt.source)
+		var srcErr *commands.SourceError
+		if !errors.As(err, &srcErr) || srcErr.Line != tt.line {
+			t.Errorf("%s: parse() error = %v, want one on line %d", tt.name, err, tt.line)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package lang
+
+// value is an intermediate result of an expression. It lives in a register,
+// or in a spill slot of the function's frame when registers ran out.
+type value struct {
+	reg  int   // Register holding the value, -1 while spilled
+	slot *cell // Spill slot holding the value while spilled
+	refs int   // Uses left before the value can be discarded
+}
+
+// register is what the generator knows about a register's contents.
+type register struct {
+	value    *value  // Intermediate result held, nil if none
+	variable *symbol // Variable whose value the register holds, nil if none
+	dirty    bool    // The variable was assigned and its cell not yet written
+	used     int     // Time of the last use, to evict the least recently used
+}
+
+// evictionCost orders the registers by what reusing them costs: nothing when
+// empty, losing a cached variable, storing an assigned one, or spilling an
+// intermediate result.
+func (r *register) evictionCost() int {
+	switch {
+	case r.value != nil:
+		return 3
+	case r.variable != nil && r.dirty:
+		return 2
+	case r.variable != nil:
+		return 1
+	}
+	return 0
+}
+
+// touch marks register r as just used.
+func (g *generator) touch(r int) {
+	g.clock++
+	g.regs[r].used = g.clock
+}
+
+// alloc returns a register free to be written, evicting its contents. The
+// registers in keep are operands of the instruction being generated and are
+// left alone.
+func (g *generator) alloc(keep ...int) int {
+	best := -1
+	for r := range g.regs {
+		kept := false
+		for _, k := range keep {
+			kept = kept || k == r
+		}
+		if kept {
+			continue
+		}
+		if best == -1 {
+			best = r
+			continue
+		}
+		cost, bestCost := g.regs[r].evictionCost(), g.regs[best].evictionCost()
+		if cost < bestCost || (cost == bestCost && g.regs[r].used < g.regs[best].used) {
+			best = r
+		}
+	}
+	g.evict(best)
+	g.touch(best)
+	return best
+}
+
+// evict empties register r: an intermediate result is spilled to memory and
+// an assigned variable written back.
+func (g *generator) evict(r int) {
+	reg := &g.regs[r]
+	if v := reg.value; v != nil {
+		v.slot = g.spillSlot()
+		v.reg = -1
+		g.emit("STORE", R(r), v.slot)
+	}
+	if reg.variable != nil && reg.dirty {
+		g.emit("STORE", R(r), reg.variable.cell)
+	}
+	*reg = register{used: reg.used}
+}
+
+// spillSlot returns an unused spill slot of the current function.
+func (g *generator) spillSlot() *cell {
+	fn := g.fn
+	if n := len(fn.free); n > 0 {
+		slot := fn.free[n-1]
+		fn.free = fn.free[:n-1]
+		return slot
+	}
+	slot := &cell{name: fn.name + ".spill"}
+	fn.cells = append(fn.cells, slot)
+	return slot
+}
+
+// temp records that register r now holds a new intermediate result.
+func (g *generator) temp(r int) *value {
+	v := &value{reg: r, refs: 1}
+	g.regs[r].value = v
+	g.touch(r)
+	return v
+}
+
+// load returns the register holding v, reloading it if it was spilled.
+func (g *generator) load(v *value, keep ...int) int {
+	if v.reg >= 0 {
+		g.touch(v.reg)
+		return v.reg
+	}
+	r := g.alloc(keep...)
+	g.emit("LOADM", R(r), v.slot)
+	g.fn.free = append(g.fn.free, v.slot)
+	v.reg, v.slot = r, nil
+	g.regs[r].value = v
+	return r
+}
+
+// release records one use of v, discarding it after its last use.
+func (g *generator) release(v *value) {
+	v.refs--
+	if v.refs > 0 {
+		return
+	}
+	if v.reg >= 0 {
+		g.regs[v.reg].value = nil
+	} else {
+		g.fn.free = append(g.fn.free, v.slot)
+	}
+}
+
+// result returns the register to write the result of an instruction whose
+// operands, already released, are in operands. An operand register no longer
+// needed is reused, else a free one is allocated.
+func (g *generator) result(operands ...int) int {
+	for _, r := range operands {
+		if reg := &g.regs[r]; reg.value == nil && reg.variable == nil {
+			g.touch(r)
+			return r
+		}
+	}
+	return g.alloc()
+}
+
+// variable returns the value of a variable, from the register caching it if any.
+func (g *generator) variable(sym *symbol) *value {
+	for r := range g.regs {
+		if reg := &g.regs[r]; reg.variable == sym {
+			if reg.value != nil {
+				reg.value.refs++
+				g.touch(r)
+				return reg.value
+			}
+			return g.temp(r)
+		}
+	}
+	r := g.alloc()
+	g.emit("LOADM", R(r), sym.cell)
+	g.regs[r].variable = sym
+	return g.temp(r)
+}
+
+// assign stores v in a variable. The register holding v caches the new
+// value; its cell is only written when the register is needed or before
+// control leaves the straight-line code.
+func (g *generator) assign(sym *symbol, v *value) {
+	r := g.load(v)
+	g.release(v)
+	for other := range g.regs {
+		if reg := &g.regs[other]; other != r && reg.variable == sym {
+			reg.variable, reg.dirty = nil, false
+		}
+	}
+	reg := &g.regs[r]
+	if reg.variable != nil && reg.variable != sym && reg.dirty {
+		// The register caches another assigned variable: write through
+		g.emit("STORE", R(r), sym.cell)
+		return
+	}
+	reg.variable, reg.dirty = sym, true
+}
+
+// claim empties register r so an instruction can use it, moving what it held.
+func (g *generator) claim(r int) {
+	g.evict(r)
+	g.touch(r)
+}
+
+// spillAll moves every intermediate result to memory, as the registers do
+// not survive a call and must be in the same state on every path reaching a
+// label.
+func (g *generator) spillAll() {
+	for r := range g.regs {
+		if v := g.regs[r].value; v != nil {
+			v.slot = g.spillSlot()
+			v.reg = -1
+			g.emit("STORE", R(r), v.slot)
+			g.regs[r].value = nil
+		}
+	}
+}
+
+// flush writes the assigned variables cached in registers back to memory.
+// Only globals are written when onlyGlobals is set, as locals are dead after
+// a return.
+func (g *generator) flush(onlyGlobals bool) {
+	for r := range g.regs {
+		if reg := &g.regs[r]; reg.variable != nil && reg.dirty && (!onlyGlobals || reg.variable.global) {
+			g.emit("STORE", R(r), reg.variable.cell)
+			reg.dirty = false
+		}
+	}
+}
+
+// forget discards what the registers are known to hold, at labels and after
+// calls. The registers must not hold intermediate results or assigned variables.
+func (g *generator) forget() {
+	for r := range g.regs {
+		g.regs[r] = register{used: g.regs[r].used}
+	}
+}
@@ -2,22 +2,158 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"tinyass/codegen"
+	"tinyass/lang"
 	"tinyass/runtime"
 )
 
+// stringList collects the values of a flag that may be repeated.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
+	var opts runtime.Options
+	version := flag.Bool("version", false, "show version info")
+	pkg := flag.String("package", "program", "package name of the code written by emit-go")
+	flag.BoolVar(&opts.StrictCase, "strict-case", false, "require upper case mnemonics and registers")
+	flag.Var((*stringList)(&opts.Watches), "watch", "log accesses matching a watchpoint, e.g. \"write 0x10\" (repeatable)")
+	flag.IntVar(&opts.HistorySize, "history", runtime.DEFAULT_HISTORY_SIZE, "instructions kept for reverse execution in the debugger and REPL (0 to disable)")
+	flag.StringVar(&opts.Trace, "trace", "", "write a record of every executed instruction to `file` (- for stdout)")
+	flag.StringVar(&opts.TraceFormat, "trace-format", runtime.TRACE_TEXT, "trace format: text or jsonl")
+	flag.BoolVar(&opts.Profile, "profile", false, "print a hotspot report and annotated listing when the script finishes")
+	flag.StringVar(&opts.Coverage, "coverage", "", "accumulate coverage data across runs in `file`")
+	flag.BoolVar(&opts.CoverageListing, "coverage-listing", false, "print the source annotated with coverage counts")
+	flag.StringVar(&opts.LCOV, "lcov", "", "write an LCOV coverage report to `file`")
+	flag.StringVar(&opts.Costs, "costs", "", "read per-opcode cycle costs from `file`")
+	flag.Uint64Var(&opts.MaxSteps, "max-steps", 0, "stop the script after `n` instructions (0 for no limit)")
+	flag.DurationVar(&opts.Timeout, "timeout", 0, "stop the script after this much time, e.g. 5s (0 for no limit)")
+	flag.StringVar(&opts.Resume, "resume", "", "continue from the machine state saved in snapshot `file`")
+	flag.StringVar(&opts.SaveSnapshot, "save-snapshot", "", "save the machine state to `file` when the script stops")
+	flag.StringVar(&opts.MemIn, "mem-in", "", "load memory from image `file` before running")
+	flag.StringVar(&opts.MemOut, "mem-out", "", "save memory to image `file` when the program stops")
+	flag.StringVar(&opts.MemFormat, "mem-format", "", "memory image format: raw, dump or ihex (default: from the file extension)")
+	flag.Var((*stringList)(&opts.Devices), "device", "map a device into memory: console, keyboard, timer or rng, optionally @0xNN (repeatable)")
+	flag.IntVar(&opts.Cores, "cores", 1, "run the script on `n` cores sharing memory")
+	flag.StringVar(&opts.Schedule, "schedule", runtime.SCHEDULE_SEEDED, "how cores are interleaved: seeded or goroutines")
+	flag.Int64Var(&opts.Seed, "seed", 1, "seed of the core scheduler")
+	flag.BoolVar(&opts.Race, "race", false, "report data races between cores")
+	flag.BoolVar(&opts.MMU, "mmu", false, "translate addresses through page tables set up with SETPTB")
+	flag.IntVar(&opts.TLBSize, "tlb-size", runtime.DEFAULT_TLB_SIZE, "number of translations cached by the MMU's TLB")
+	flag.Var((*stringList)(&opts.Caches), "cache", "add a cache level, e.g. \"size=64,line=4,ways=2,write=back,replace=lru,hit=1\" (repeat for L2, L3)")
+	flag.StringVar(&opts.Pipeline, "pipeline", "", "model a 5-stage pipeline: forwarding or stall")
+	flag.IntVar(&opts.PipelineDiagram, "pipeline-diagram", 0, "draw the pipeline stages of the first `n` instructions")
+	flag.Var((*stringList)(&opts.Predictors), "predict", "compare branch predictors: taken, not-taken, 1bit, 2bit, gshare or all (comma separated, repeatable)")
+	flag.Uint64Var(&opts.MispredictPenalty, "mispredict-penalty", runtime.DEFAULT_MISPREDICT_PENALTY, "cycles lost per mispredicted branch")
+	flag.StringVar(&opts.Engine, "engine", runtime.ENGINE_INTERPRETER, "execution engine: interpreter or compiled (faster, used when no tracing, profiling, devices, protection, MMU or cache is active)")
+	flag.BoolVar(&opts.UserMode, "user-mode", false, "start the program in user mode, where privileged instructions fault")
+	flag.Var((*stringList)(&opts.Regions), "region", "protect a memory region: \"kind 0xSS 0xEE\" with kind rodata, data, stack, device or guard (repeatable)")
+	args := parseArgs(os.Args[1:])
+
+	if *version {
+		fmt.Println("TinyASS version 1.0.0")
+		return
+	}
+
 	cpu := runtime.NewCPU()
-	// Check if a script file or flag is passed as a command-line argument
-	if len(os.Args) > 1 {
-		if os.Args[1] == "--version" {
-			fmt.Println("TinyASS version 1.0.0")
-			return
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+	switch command {
+	// Debugger mode: tinyass debug file.ass
+	case "debug":
+		if len(args) > 2 || (len(args) == 1 && opts.Resume == "") {
+			fmt.Println("Usage: tinyass debug file.ass")
+			os.Exit(2)
+		}
+		file := ""
+		if len(args) == 2 {
+			file = args[1]
+		}
+		runtime.RunDebugger(cpu, file, opts)
+		return
+	// Translation: tinyass emit-c file.ass > file.c
+	case "emit-c":
+		if !codegen.EmitFile(fileArg(args, "tinyass emit-c file.ass"), opts, codegen.EmitC) {
+			os.Exit(1)
+		}
+		return
+	// Translation: tinyass emit-go --package name file.ass > name/program.go
+	case "emit-go":
+		if !codegen.EmitFile(fileArg(args, "tinyass emit-go [--package name] file.ass"), opts, codegen.GoEmitter(*pkg)) {
+			os.Exit(1)
+		}
+		return
+	// Translation: tinyass emit-wat file.ass > file.wat
+	case "emit-wat":
+		if !codegen.EmitFile(fileArg(args, "tinyass emit-wat file.ass"), opts, codegen.EmitWAT) {
+			os.Exit(1)
+		}
+		return
+	// Compilation: tinyass compile file.tiny > file.ass
+	case "compile":
+		if !lang.CompileFile(fileArg(args, "tinyass compile file.tiny")) {
+			os.Exit(1)
+		}
+		return
+	}
+	// Check if a script file or a snapshot to resume is passed as a command-line argument
+	if len(args) > 1 {
+		fmt.Println("Usage: tinyass [flags] [file.ass]")
+		os.Exit(2)
+	}
+	if len(args) == 1 || opts.Resume != "" {
+		file := ""
+		if len(args) == 1 {
+			file = args[0]
+		}
+		runtime.RunFile(cpu, file, opts)
+		if status, ok := cpu.ExitStatus(); ok {
+			os.Exit(status)
 		}
-		runtime.RunFile(cpu)
 		return
 	}
 	// REPL mode
-	runtime.StartRepl(cpu)
+	runtime.StartRepl(cpu, opts)
+}
+
+// parseArgs parses the flags in args and returns the other arguments. Unlike
+// flag.Parse, flags may follow the subcommand and the file name; only "--"
+// ends the flags.
+func parseArgs(args []string) []string {
+	var positional []string
+	for {
+		flag.CommandLine.Parse(args)
+		rest := flag.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// fileArg returns the file named after a subcommand, or exits with its usage
+// when there is not exactly one.
+func fileArg(args []string, usage string) string {
+	if len(args) != 2 {
+		fmt.Println("Usage: " + usage)
+		os.Exit(2)
+	}
+	return args[1]
 }
@@ -0,0 +1,310 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"tinyass/utils"
+)
+
+// Replacement policies
+const (
+	REPLACE_LRU    = "lru"    // Evict the least recently used line
+	REPLACE_FIFO   = "fifo"   // Evict the line loaded first
+	REPLACE_RANDOM = "random" // Evict a pseudo-random line, the same sequence on every run
+)
+
+// Write policies
+const (
+	WRITE_BACK    = "back"    // Writes stay in the cache until the line is evicted; misses allocate a line
+	WRITE_THROUGH = "through" // Writes go to the next level at once; misses do not allocate
+)
+
+// CacheConfig describes one cache level. Sizes are in memory cells.
+type CacheConfig struct {
+	Size        int
+	LineSize    int
+	Ways        int    // Lines per set; Size/LineSize makes the cache fully associative
+	Write       string // WRITE_BACK or WRITE_THROUGH
+	Replacement string // REPLACE_LRU, REPLACE_FIFO or REPLACE_RANDOM
+	HitCycles   uint64 // Cycles of an access served by this level
+}
+
+// DefaultCacheConfig is a small direct-mapped write-back cache.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{Size: 64, LineSize: 4, Ways: 1, Write: WRITE_BACK, Replacement: REPLACE_LRU, HitCycles: 1}
+}
+
+// ParseCacheConfig parses a cache level given as comma separated key=value
+// settings on top of DefaultCacheConfig, e.g. "size=32,line=4,ways=2,write=through,replace=fifo,hit=2".
+func ParseCacheConfig(spec string) (CacheConfig, error) {
+	config := DefaultCacheConfig()
+	for _, setting := range strings.Split(spec, ",") {
+		setting = strings.TrimSpace(setting)
+		if setting == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(setting, "=")
+		if !ok {
+			return config, fmt.Errorf("invalid cache setting %q\nExample: size=64,line=4,ways=2", setting)
+		}
+		value = strings.ToLower(strings.TrimSpace(value))
+		var err error
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "size":
+			config.Size, err = strconv.Atoi(value)
+		case "line":
+			config.LineSize, err = strconv.Atoi(value)
+		case "ways":
+			config.Ways, err = strconv.Atoi(value)
+		case "hit":
+			config.HitCycles, err = strconv.ParseUint(value, 10, 64)
+		case "write":
+			config.Write = value
+		case "replace":
+			config.Replacement = value
+		default:
+			return config, fmt.Errorf("unknown cache setting %q (size, line, ways, write, replace or hit)", key)
+		}
+		if err != nil {
+			return config, fmt.Errorf("invalid number in cache setting %q", setting)
+		}
+	}
+	return config, config.validate()
+}
+
+func (c CacheConfig) validate() error {
+	if c.Size <= 0 || c.LineSize <= 0 || c.Ways <= 0 || c.Size%(c.LineSize*c.Ways) != 0 {
+		return fmt.Errorf("a cache of %d cells cannot be split into %d-way sets of %d-cell lines", c.Size, c.Ways, c.LineSize)
+	}
+	if c.Write != WRITE_BACK && c.Write != WRITE_THROUGH {
+		return fmt.Errorf("unknown write policy %q (back or through)", c.Write)
+	}
+	switch c.Replacement {
+	case REPLACE_LRU, REPLACE_FIFO, REPLACE_RANDOM:
+		return nil
+	}
+	return fmt.Errorf("unknown replacement policy %q (lru, fifo or random)", c.Replacement)
+}
+
+func (c CacheConfig) String() string {
+	return fmt.Sprintf("%d cells, %d-cell lines, %d-way, write-%s, %s", c.Size, c.LineSize, c.Ways, c.Write, c.Replacement)
+}
+
+// CacheStats counts the accesses served by a cache level.
+type CacheStats struct {
+	Reads      uint64
+	Writes     uint64
+	Hits       uint64
+	Misses     uint64
+	WriteBacks uint64 // Dirty lines written to the next level on eviction
+}
+
+// cacheLine is the tag of a cached memory line. The cache only models timing:
+// values are always read from and written to memory.
+type cacheLine struct {
+	valid  bool
+	dirty  bool
+	tag    int
+	used   uint64 // Time of the last access, for LRU
+	loaded uint64 // Time the line was loaded, for FIFO
+}
+
+// Cache is one level of a cache hierarchy. Misses go to the next level, or to
+// memory after the last one.
+type Cache struct {
+	Config CacheConfig
+	Stats  CacheStats
+	sets   [][]cacheLine
+	next   *Cache
+	clock  uint64
+	random uint32 // Xorshift state for random replacement
+}
+
+// NewCacheHierarchy creates connected cache levels, the first one closest to the CPU.
+func NewCacheHierarchy(configs []CacheConfig) (*Cache, error) {
+	var first *Cache
+	for i := len(configs) - 1; i >= 0; i-- {
+		if err := configs[i].validate(); err != nil {
+			return nil, fmt.Errorf("L%d: %v", i+1, err)
+		}
+		c := &Cache{Config: configs[i], next: first, random: DEFAULT_RNG_SEED}
+		c.sets = make([][]cacheLine, configs[i].Size/(configs[i].LineSize*configs[i].Ways))
+		for s := range c.sets {
+			c.sets[s] = make([]cacheLine, configs[i].Ways)
+		}
+		first = c
+	}
+	return first, nil
+}
+
+// Levels returns the cache and the levels below it.
+func (c *Cache) Levels() []*Cache {
+	var levels []*Cache
+	for ; c != nil; c = c.next {
+		levels = append(levels, c)
+	}
+	return levels
+}
+
+// configs returns the configuration of every level, to build another hierarchy like this one.
+func (c *Cache) configs() []CacheConfig {
+	var configs []CacheConfig
+	for _, level := range c.Levels() {
+		configs = append(configs, level.Config)
+	}
+	return configs
+}
+
+// access looks up addr and returns the cycles it takes, including the accesses
+// to lower levels and to memory, which takes memoryCycles.
+func (c *Cache) access(addr int, write bool, memoryCycles uint64) uint64 {
+	c.clock++
+	if write {
+		c.Stats.Writes++
+	} else {
+		c.Stats.Reads++
+	}
+	line := addr / c.Config.LineSize
+	set := c.sets[line%len(c.sets)]
+	tag := line / len(c.sets)
+
+	for i := range set {
+		if set[i].valid && set[i].tag == tag {
+			c.Stats.Hits++
+			set[i].used = c.clock
+			cycles := c.Config.HitCycles
+			if write {
+				if c.Config.Write == WRITE_BACK {
+					set[i].dirty = true
+				} else {
+					cycles += c.lower(addr, true, memoryCycles)
+				}
+			}
+			return cycles
+		}
+	}
+
+	c.Stats.Misses++
+	cycles := c.Config.HitCycles
+	if write && c.Config.Write == WRITE_THROUGH {
+		return cycles + c.lower(addr, true, memoryCycles)
+	}
+	victim := &set[c.victim(set)]
+	if victim.valid && victim.dirty {
+		c.Stats.WriteBacks++
+		victimLine := victim.tag*len(c.sets) + line%len(c.sets)
+		cycles += c.lower(victimLine*c.Config.LineSize, true, memoryCycles)
+	}
+	cycles += c.lower(addr, false, memoryCycles)
+	*victim = cacheLine{valid: true, dirty: write, tag: tag, used: c.clock, loaded: c.clock}
+	return cycles
+}
+
+// lower passes an access on to the next level, or to memory.
+func (c *Cache) lower(addr int, write bool, memoryCycles uint64) uint64 {
+	if c.next == nil {
+		return memoryCycles
+	}
+	return c.next.access(addr, write, memoryCycles)
+}
+
+// victim chooses the line of set to replace: an invalid one if there is any,
+// otherwise one chosen by the replacement policy.
+func (c *Cache) victim(set []cacheLine) int {
+	for i := range set {
+		if !set[i].valid {
+			return i
+		}
+	}
+	best := 0
+	switch c.Config.Replacement {
+	case REPLACE_LRU:
+		for i := range set {
+			if set[i].used < set[best].used {
+				best = i
+			}
+		}
+	case REPLACE_FIFO:
+		for i := range set {
+			if set[i].loaded < set[best].loaded {
+				best = i
+			}
+		}
+	case REPLACE_RANDOM:
+		c.random ^= c.random << 13
+		c.random ^= c.random >> 17
+		c.random ^= c.random << 5
+		best = int(c.random % uint32(len(set)))
+	}
+	return best
+}
+
+// SetCache places a cache hierarchy between the CPU and memory, or removes it when c is nil.
+func (cpu *CPU) SetCache(c *Cache) {
+	cpu.cache = c
+}
+
+// Cache returns the first level of the CPU's cache hierarchy, or nil.
+func (cpu *CPU) Cache() *Cache {
+	return cpu.cache
+}
+
+// access accounts for a memory access by the current instruction. With a cache,
+// its cost comes from the cache hierarchy; device registers are never cached.
+func (cpu *CPU) access(addr int, write bool) {
+	cpu.memAccesses++
+	if cpu.cache == nil {
+		return
+	}
+	var memoryCycles uint64
+	if cpu.costs != nil {
+		memoryCycles = cpu.costs.MemoryAccess
+	}
+	if cpu.bus != nil {
+		if _, _, ok := cpu.bus.lookup(addr); ok {
+			cpu.memCycles += memoryCycles
+			return
+		}
+	}
+	cpu.memCycles += cpu.cache.access(addr, write, memoryCycles)
+}
+
+// configureCache builds the cache hierarchy described by opts.
+func configureCache(cpu *CPU, opts Options) error {
+	if len(opts.Caches) == 0 {
+		return nil
+	}
+	var configs []CacheConfig
+	for i, spec := range opts.Caches {
+		config, err := ParseCacheConfig(spec)
+		if err != nil {
+			return fmt.Errorf("L%d: %v", i+1, err)
+		}
+		configs = append(configs, config)
+	}
+	c, err := NewCacheHierarchy(configs)
+	if err != nil {
+		return err
+	}
+	cpu.SetCache(c)
+	return nil
+}
+
+// printCache shows the statistics of every cache level.
+func printCache(cpu *CPU) {
+	if cpu.cache == nil {
+		utils.YELLOW.Println("No cache (run with --cache)")
+		return
+	}
+	for i, level := range cpu.cache.Levels() {
+		s := level.Stats
+		rate := 0.0
+		if total := s.Hits + s.Misses; total > 0 {
+			rate = 100 * float64(s.Hits) / float64(total)
+		}
+		utils.GREEN.Printf("%sL%d (%v): %d reads, %d writes, %d hits, %d misses (%.1f%% hit rate), %d write-backs\n",
+			cpu.outputPrefix(), i+1, level.Config, s.Reads, s.Writes, s.Hits, s.Misses, rate, s.WriteBacks)
+	}
+}
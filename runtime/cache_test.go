@@ -0,0 +1,126 @@
+package runtime
+
+import (
+	"testing"
+
+	"tinyass/commands"
+)
+
+func newTestCache(t *testing.T, specs ...string) *Cache {
+	t.Helper()
+	var configs []CacheConfig
+	for _, spec := range specs {
+		config, err := ParseCacheConfig(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config)
+	}
+	c, err := NewCacheHierarchy(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestDirectMappedCache(t *testing.T) {
+	c := newTestCache(t, "size=16,line=4")
+	for _, addr := range []int{0x00, 0x01, 0x10, 0x00, 0x05} {
+		c.access(addr, false, 10)
+	}
+	// 0x10 maps to the same set as 0x00 and evicts it.
+	if c.Stats.Hits != 1 || c.Stats.Misses != 4 {
+		t.Errorf("stats = %+v, want 1 hit and 4 misses", c.Stats)
+	}
+}
+
+func TestCacheReplacement(t *testing.T) {
+	for _, tt := range []struct {
+		policy string
+		hit    bool
+	}{
+		{REPLACE_LRU, true},   // C evicts B, which was used least recently
+		{REPLACE_FIFO, false}, // C evicts A, which was loaded first
+	} {
+		c := newTestCache(t, "size=8,line=4,ways=2,replace="+tt.policy)
+		for _, addr := range []int{0x00, 0x04, 0x00, 0x08} {
+			c.access(addr, false, 10)
+		}
+		hits := c.Stats.Hits
+		c.access(0x00, false, 10)
+		if got := c.Stats.Hits > hits; got != tt.hit {
+			t.Errorf("%s: access to the first line hit = %v, want %v", tt.policy, got, tt.hit)
+		}
+	}
+}
+
+func TestCacheWritePolicies(t *testing.T) {
+	back := newTestCache(t, "size=4,line=4,write=back")
+	if cycles := back.access(0x00, true, 10); cycles != 11 {
+		t.Errorf("write-back miss took %d cycles, want 11", cycles)
+	}
+	back.access(0x01, true, 10)
+	if cycles := back.access(0x04, false, 10); cycles != 21 || back.Stats.WriteBacks != 1 {
+		t.Errorf("evicting a dirty line took %d cycles with %d write-backs, want 21 and 1", cycles, back.Stats.WriteBacks)
+	}
+
+	through := newTestCache(t, "size=4,line=4,write=through")
+	through.access(0x00, true, 10)
+	if cycles := through.access(0x00, false, 10); cycles != 11 {
+		t.Errorf("read after a write-through miss took %d cycles, want a miss of 11", cycles)
+	}
+	if cycles := through.access(0x00, true, 10); cycles != 11 || through.Stats.WriteBacks != 0 {
+		t.Errorf("write-through hit took %d cycles, want 11", cycles)
+	}
+}
+
+func TestCacheHierarchy(t *testing.T) {
+	c := newTestCache(t, "size=4,line=4,hit=1", "size=16,line=4,hit=5")
+	for _, tt := range []struct {
+		addr   int
+		cycles uint64
+	}{
+		{0x00, 26}, // Misses both levels
+		{0x01, 1},  // L1 hit
+		{0x04, 26}, // Evicts 0x00 from L1
+		{0x00, 6},  // L2 hit
+	} {
+		if cycles := c.access(tt.addr, false, 20); cycles != tt.cycles {
+			t.Errorf("access to 0x%02X took %d cycles, want %d", tt.addr, cycles, tt.cycles)
+		}
+	}
+	if levels := c.Levels(); len(levels) != 2 || levels[1].Stats.Hits != 1 || levels[1].Stats.Misses != 2 {
+		t.Errorf("L2 stats = %+v", levels[1].Stats)
+	}
+}
+
+func TestCacheTiming(t *testing.T) {
+	program, err := commands.Assemble("LOADM R0 0x40\nLOADM R1 0x41\nLOADM R2 0x80", commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU()
+	cpu.SetCache(newTestCache(t, "size=16,line=4"))
+	cpu.LoadScript(program, "test.ass")
+	cpu.Run()
+	// Each LOADM costs 1; a miss adds the hit time and 2 cycles of memory, a hit 1.
+	if cpu.Cycles() != 4+2+4 {
+		t.Errorf("cycles = %d, want 10", cpu.Cycles())
+	}
+	if s := cpu.Cache().Stats; s.Hits != 1 || s.Misses != 2 {
+		t.Errorf("stats = %+v, want 1 hit and 2 misses", s)
+	}
+}
+
+func TestParseCacheConfig(t *testing.T) {
+	config, err := ParseCacheConfig("size=32, line=8, ways=2, write=Through, replace=random, hit=3")
+	want := CacheConfig{Size: 32, LineSize: 8, Ways: 2, Write: WRITE_THROUGH, Replacement: REPLACE_RANDOM, HitCycles: 3}
+	if err != nil || config != want {
+		t.Errorf("ParseCacheConfig() = %+v, %v, want %+v", config, err, want)
+	}
+	for _, spec := range []string{"size=30,line=4", "ways=0", "write=around", "replace=mru", "color=red", "size"} {
+		if _, err := ParseCacheConfig(spec); err == nil {
+			t.Errorf("ParseCacheConfig(%q) should fail", spec)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package runtime
+
+import (
+	"fmt"
+
+	"tinyass/commands"
+)
+
+// Execution engines
+const (
+	ENGINE_INTERPRETER = "interpreter" // Decode and dispatch every instruction as it runs
+	ENGINE_COMPILED    = "compiled"    // Run the program pre-compiled into closures
+)
+
+// compiledOp carries out one pre-decoded instruction. It returns false when the program stops.
+type compiledOp func(cpu *CPU) bool
+
+// Compiled is a program translated into one closure per instruction, with the
+// operands already decoded and the base cost already looked up. Compiled code
+// touches registers and memory directly, so it only runs while nothing needs to
+// see individual accesses: see compilable.
+type Compiled struct {
+	ops    []compiledOp
+	cost   []uint64 // Base cost of each instruction
+	memory uint64   // Extra cycles per memory access
+	branch uint64   // Extra cycles when control is transferred
+}
+
+// Compile translates program for the timing model in costs. A nil table makes
+// every instruction take one cycle, like on the CPU.
+func Compile(program []commands.Instruction, costs *CostTable) *Compiled {
+	code := &Compiled{
+		ops:  make([]compiledOp, len(program)),
+		cost: make([]uint64, len(program)),
+	}
+	if costs != nil {
+		code.memory = costs.MemoryAccess
+		code.branch = costs.BranchTaken
+	}
+	for pc, inst := range program {
+		code.ops[pc] = compileInstruction(inst)
+		code.cost[pc] = 1
+		if costs != nil {
+			code.cost[pc] = costs.Cost(inst.Opcode)
+		}
+	}
+	return code
+}
+
+// compileInstruction returns a closure with the effect of execute for inst when
+// no hooks are active. Frequent instructions get a specialized closure; the
+// others are handed to execute, which also performs the privilege check.
+func compileInstruction(inst commands.Instruction) compiledOp {
+	ops := inst.Operands
+	switch inst.Opcode {
+	case commands.LOAD:
+		r, val := ops[0], ops[1]
+		return func(cpu *CPU) bool {
+			cpu.registers[r] = val
+			return true
+		}
+	case commands.STORE:
+		r, addr := ops[0], ops[1]
+		if SupervisorOnly(addr) {
+			break // execute checks whether user mode may write it
+		}
+		return func(cpu *CPU) bool {
+			cpu.memAccesses++
+			cpu.memory[addr] = cpu.registers[r]
+			return true
+		}
+	case commands.LOADM:
+		r, addr := ops[0], ops[1]
+		return func(cpu *CPU) bool {
+			cpu.memAccesses++
+			cpu.registers[r] = cpu.memory[addr]
+			return true
+		}
+	case commands.ADD:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] + cpu.registers[b]
+			return true
+		}
+	case commands.SUB:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] - cpu.registers[b]
+			return true
+		}
+	case commands.MUL:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] * cpu.registers[b]
+			return true
+		}
+	case commands.DIV:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			if cpu.registers[b] == 0 {
+				return cpu.raise(FAULT_DIVISION_BY_ZERO, cpu.instPC, "Division by zero on program counter %d", cpu.pc)
+			}
+			cpu.registers[d] = cpu.registers[a] / cpu.registers[b]
+			return true
+		}
+	case commands.REM:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			if cpu.registers[b] == 0 {
+				return cpu.raise(FAULT_DIVISION_BY_ZERO, cpu.instPC, "Division by zero")
+			}
+			cpu.registers[d] = cpu.registers[a] % cpu.registers[b]
+			return true
+		}
+	case commands.AND:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] & cpu.registers[b]
+			return true
+		}
+	case commands.OR:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] | cpu.registers[b]
+			return true
+		}
+	case commands.XOR:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] ^ cpu.registers[b]
+			return true
+		}
+	case commands.NOT:
+		d, a := ops[0], ops[1]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = ^cpu.registers[a]
+			return true
+		}
+	case commands.SHL:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] << uint(cpu.registers[b])
+			return true
+		}
+	case commands.SHR:
+		d, a, b := ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = cpu.registers[a] >> uint(cpu.registers[b])
+			return true
+		}
+	case commands.GT, commands.LT, commands.GTE, commands.LTE, commands.EQ, commands.NEQ:
+		opcode, d, a, b := inst.Opcode, ops[0], ops[1], ops[2]
+		return func(cpu *CPU) bool {
+			cpu.registers[d] = compare(opcode, cpu.registers[a], cpu.registers[b])
+			return true
+		}
+	case commands.JMP:
+		target := ops[0]
+		return func(cpu *CPU) bool {
+			cpu.pc = target
+			cpu.jumped = true
+			return true
+		}
+	case commands.JZ:
+		r, target := ops[0], ops[1]
+		return func(cpu *CPU) bool {
+			if cpu.registers[r] == 0 {
+				cpu.pc = target
+				cpu.jumped = true
+			}
+			return true
+		}
+	case commands.JNZ:
+		r, target := ops[0], ops[1]
+		return func(cpu *CPU) bool {
+			if cpu.registers[r] != 0 {
+				cpu.pc = target
+				cpu.jumped = true
+			}
+			return true
+		}
+	case commands.CALL:
+		target := ops[0]
+		return func(cpu *CPU) bool {
+			if cpu.sp <= cpu.stackFloor {
+				return cpu.raise(FAULT_STACK, cpu.instPC, "Stack overflow on program counter %d", cpu.pc)
+			}
+			cpu.memAccesses++
+			cpu.sp--
+			cpu.memory[cpu.sp] = cpu.pc
+			cpu.pc = target
+			cpu.jumped = true
+			return true
+		}
+	case commands.RET:
+		return func(cpu *CPU) bool {
+			if cpu.sp >= cpu.stackTop {
+				return cpu.raise(FAULT_STACK, cpu.instPC, "Stack underflow on program counter %d", cpu.pc)
+			}
+			cpu.memAccesses++
+			cpu.pc = cpu.memory[cpu.sp]
+			cpu.sp++
+			cpu.jumped = true
+			return true
+		}
+	case commands.CYCLES:
+		r := ops[0]
+		return func(cpu *CPU) bool {
+			cpu.registers[r] = int(cpu.cycles)
+			return true
+		}
+	case commands.HALT:
+		return func(cpu *CPU) bool {
+			return false
+		}
+	}
+	return func(cpu *CPU) bool {
+		cpu.inst = inst
+		return cpu.execute(inst)
+	}
+}
+
+// SetEngine selects how RunContext executes programs: ENGINE_INTERPRETER, or
+// ENGINE_COMPILED to pre-compile the program when a run starts. An empty name
+// selects the interpreter.
+func (cpu *CPU) SetEngine(name string) error {
+	switch name {
+	case ENGINE_INTERPRETER, "":
+		cpu.engine = ENGINE_INTERPRETER
+	case ENGINE_COMPILED:
+		cpu.engine = ENGINE_COMPILED
+	default:
+		return fmt.Errorf("unknown engine %q (use %s or %s)", name, ENGINE_INTERPRETER, ENGINE_COMPILED)
+	}
+	return nil
+}
+
+// Engine returns the name of the selected execution engine.
+func (cpu *CPU) Engine() string {
+	if cpu.engine == "" {
+		return ENGINE_INTERPRETER
+	}
+	return cpu.engine
+}
+
+// compilable reports whether compiled code can run on cpu: nothing watches,
+// records, translates, protects, caches or shares the accesses instructions make.
+func (cpu *CPU) compilable() bool {
+	return cpu.watches == nil && cpu.history == nil && cpu.observers == nil && cpu.bus == nil &&
+		cpu.machine == nil && cpu.protection == nil && cpu.mmu == nil && cpu.cache == nil
+}
+
+// stepper returns the function RunContext calls to execute one instruction: a
+// step of the compiled program when the compiled engine is selected and
+// compilable allows it, and Step otherwise.
+func (cpu *CPU) stepper() func() bool {
+	if cpu.engine != ENGINE_COMPILED || !cpu.compilable() {
+		return cpu.Step
+	}
+	code := Compile(cpu.program, cpu.costs)
+	cpu.aborted = false
+	return func() bool {
+		return cpu.stepCompiled(code)
+	}
+}
+
+// stepCompiled is Step for compiled code, with the same bookkeeping as Execute.
+func (cpu *CPU) stepCompiled(code *Compiled) bool {
+	pc := cpu.pc
+	if cpu.halted || pc < 0 || pc >= len(code.ops) {
+		return false
+	}
+	if cpu.interrupts && cpu.pending != 0 {
+		return cpu.Step() // Entering a handler is rare, the interpreter takes care of it
+	}
+	cpu.instPC = pc
+	cpu.pc++
+	cpu.steps++
+	cpu.memAccesses = 0
+	cpu.jumped = false
+
+	ok := code.ops[pc](cpu) && !cpu.aborted // Writing the vectors in user mode aborts
+	cost := code.cost[pc] + cpu.memAccesses*code.memory
+	if cpu.jumped {
+		cost += code.branch
+	}
+	cpu.cycles += cost
+	if !ok {
+		cpu.halted = true
+	}
+	return ok
+}
@@ -0,0 +1,283 @@
+package runtime
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// machineState is everything an engine may change, for comparing engines.
+type machineState struct {
+	Registers  [4]int
+	Memory     [commands.MEMORY_SIZE]int
+	PC, SP     int
+	Steps      uint64
+	Cycles     uint64
+	Halted     bool
+	Interrupts bool
+	User       bool
+	Pending    uint
+	Fault      Fault
+}
+
+func stateOf(cpu *CPU) machineState {
+	state := machineState{
+		Registers:  cpu.registers,
+		Memory:     *cpu.memory,
+		PC:         cpu.pc,
+		SP:         cpu.sp,
+		Steps:      cpu.steps,
+		Cycles:     cpu.cycles,
+		Halted:     cpu.halted,
+		Interrupts: cpu.interrupts,
+		User:       cpu.user,
+		Pending:    cpu.pending,
+	}
+	if cpu.fault != nil {
+		state.Fault = *cpu.fault
+	}
+	return state
+}
+
+// runEngine runs program on a fresh CPU with the given engine. Interrupt line 1
+// is pending, so programs that enable interrupts enter its handler.
+func runEngine(t *testing.T, engine string, program []commands.Instruction, costs *CostTable, limits Limits) machineState {
+	t.Helper()
+	cpu := NewCPU()
+	cpu.SetCostTable(costs)
+	if err := cpu.SetEngine(engine); err != nil {
+		t.Fatal(err)
+	}
+	cpu.LoadProgram(program)
+	cpu.RaiseInterrupt(1)
+	cpu.RunContext(context.Background(), limits)
+	return stateOf(cpu)
+}
+
+// checkEngines fails when the compiled engine ends in a different state than the interpreter.
+func checkEngines(t *testing.T, name string, program []commands.Instruction, costs *CostTable, limits Limits) {
+	t.Helper()
+	want := runEngine(t, ENGINE_INTERPRETER, program, costs, limits)
+	got := runEngine(t, ENGINE_COMPILED, program, costs, limits)
+	if got != want {
+		t.Errorf("%s: compiled engine differs from the interpreter\ncompiled:    pc %d sp %d steps %d cycles %d registers %v fault %+v\ninterpreter: pc %d sp %d steps %d cycles %d registers %v fault %+v",
+			name, got.PC, got.SP, got.Steps, got.Cycles, got.Registers, got.Fault,
+			want.PC, want.SP, want.Steps, want.Cycles, want.Registers, want.Fault)
+	}
+}
+
+var engineScripts = map[string]string{
+	"loop": `
+		LOAD R0 0
+		LOAD R1 1
+		LOAD R2 100
+	loop:
+		ADD R0 R0 R1
+		STORE R0 0x20
+		LOADM R3 0x20
+		LT R3 R1 R2
+		ADD R1 R1 R3
+		JNZ R3 loop
+		HALT`,
+	"calls": `
+		LOAD R0 5
+		CALL fact
+		CYCLES R2
+		HALT
+	fact:
+		LOAD R1 1
+		LTE R3 R0 R1
+		JZ R3 recurse
+		LOAD R0 1
+		RET
+	recurse:
+		STORE R0 0x10
+		SUB R0 R0 R1
+		CALL fact
+		LOADM R1 0x10
+		MUL R0 R0 R1
+		RET`,
+	"division by zero": `
+		LOAD R0 7
+		LOAD R1 0
+		DIV R2 R0 R1`,
+	"stack overflow": `
+	recurse:
+		CALL recurse`,
+	"stack underflow": `
+		RET`,
+	"interrupt": `
+		LOAD R0 handler
+		STORE R0 0xD1
+		EI
+		LOAD R3 9
+		HALT
+	handler:
+		LOAD R2 4
+		IRET`,
+	"user mode": `
+		LOAD R0 handler
+		STORE R0 0xDB
+		USER work
+	work:
+		LOAD R1 3
+		DI
+		HALT
+	handler:
+		LOAD R2 1
+		HALT`,
+	"atomics": `
+		LOAD R0 0
+		LOAD R1 5
+		CAS R0 R1 0x30
+		XCHG R1 0x30
+		CORE R2
+		FENCE`,
+	"run off the end": `
+		LOAD R0 1
+		JMP 0x40`,
+}
+
+func TestCompiledEngineMatchesInterpreter(t *testing.T) {
+	for name, source := range engineScripts {
+		program, err := commands.Assemble(source, commands.ParseOptions{})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		checkEngines(t, name, program.Instructions, DefaultCostTable(), Limits{})
+		checkEngines(t, name+" without costs", program.Instructions, nil, Limits{})
+		checkEngines(t, name+" with a step limit", program.Instructions, DefaultCostTable(), Limits{MaxSteps: 7})
+	}
+}
+
+// randomOpcodes are the opcodes used in random programs: everything except
+// PRINT and SYSCALL, which talk to the host.
+var randomOpcodes = []int{
+	commands.LOAD, commands.STORE, commands.LOADM, commands.ADD, commands.SUB, commands.MUL,
+	commands.DIV, commands.REM, commands.AND, commands.OR, commands.XOR, commands.NOT,
+	commands.SHL, commands.SHR, commands.GT, commands.LT, commands.GTE, commands.LTE,
+	commands.EQ, commands.NEQ, commands.JMP, commands.JZ, commands.JNZ, commands.HALT,
+	commands.CALL, commands.RET, commands.CYCLES, commands.EI, commands.DI, commands.IRET,
+	commands.IRQ, commands.CAS, commands.XCHG, commands.FENCE, commands.CORE, commands.USER,
+}
+
+// randomProgram returns size random instructions with valid operands. Jumps
+// stay within the program and small values make division by zero likely.
+func randomProgram(rng *rand.Rand, size int) []commands.Instruction {
+	reg := func() int { return rng.Intn(4) }
+	addr := func() int { return rng.Intn(commands.MEMORY_SIZE) }
+	target := func() int { return rng.Intn(size + 1) }
+	program := make([]commands.Instruction, size)
+	for i := range program {
+		opcode := randomOpcodes[rng.Intn(len(randomOpcodes))]
+		var operands []int
+		switch opcode {
+		case commands.LOAD:
+			operands = []int{reg(), rng.Intn(9) - 2}
+		case commands.STORE, commands.LOADM, commands.XCHG:
+			operands = []int{reg(), addr()}
+		case commands.CAS:
+			operands = []int{reg(), reg(), addr()}
+		case commands.NOT:
+			operands = []int{reg(), reg()}
+		case commands.JMP, commands.CALL, commands.USER:
+			operands = []int{target()}
+		case commands.JZ, commands.JNZ:
+			operands = []int{reg(), target()}
+		case commands.CYCLES, commands.CORE:
+			operands = []int{reg()}
+		case commands.IRQ:
+			operands = []int{rng.Intn(NUM_IRQ_LINES)}
+		case commands.HALT, commands.RET, commands.EI, commands.DI, commands.IRET, commands.FENCE:
+		default:
+			operands = []int{reg(), reg(), reg()}
+		}
+		program[i] = commands.Instruction{Opcode: opcode, Operands: operands}
+	}
+	return program
+}
+
+func TestCompiledEngineRandomPrograms(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 500; i++ {
+		program := randomProgram(rng, 5+rng.Intn(40))
+		checkEngines(t, "random program", program, DefaultCostTable(), Limits{MaxSteps: 2000})
+		if t.Failed() {
+			for pc, inst := range program {
+				t.Logf("0x%02X  %s", pc, commands.Disassemble(inst))
+			}
+			return
+		}
+	}
+}
+
+func TestCompiledEngineFallsBack(t *testing.T) {
+	program, err := commands.Assemble(engineScripts["loop"], commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU()
+	cpu.SetEngine(ENGINE_COMPILED)
+	cpu.LoadProgram(program.Instructions)
+	profiler := NewProfiler(program)
+	cpu.AddObserver(profiler)
+	cpu.Run()
+	if !cpu.halted || cpu.registers[0] != 5050 || profiler.total != cpu.steps {
+		t.Errorf("with an observer: halted = %v, R0 = %d, profiled %d of %d steps",
+			cpu.halted, cpu.registers[0], profiler.total, cpu.steps)
+	}
+}
+
+func TestSetEngine(t *testing.T) {
+	cpu := NewCPU()
+	if cpu.Engine() != ENGINE_INTERPRETER {
+		t.Errorf("default engine = %s", cpu.Engine())
+	}
+	if err := cpu.SetEngine(ENGINE_COMPILED); err != nil || cpu.Engine() != ENGINE_COMPILED {
+		t.Errorf("SetEngine(compiled) = %v, engine %s", err, cpu.Engine())
+	}
+	if err := cpu.SetEngine("jit"); err == nil {
+		t.Errorf("SetEngine(jit) should fail")
+	}
+}
+
+// benchmarkEngine runs a loop of 100000 iterations on the given engine.
+func benchmarkEngine(b *testing.B, engine string) {
+	program, err := commands.Assemble(`
+		LOAD R0 100000
+		LOAD R1 1
+		LOAD R2 0
+	loop:
+		SUB R0 R0 R1
+		STORE R0 0x20
+		LOADM R3 0x20
+		AND R3 R3 R1
+		ADD R2 R2 R3
+		JNZ R0 loop
+		HALT`, commands.ParseOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var steps uint64
+	for i := 0; i < b.N; i++ {
+		cpu := NewCPU()
+		cpu.SetEngine(engine)
+		cpu.LoadProgram(program.Instructions)
+		cpu.Run()
+		if cpu.registers[2] != 50000 {
+			b.Fatalf("R2 = %d, want 50000", cpu.registers[2])
+		}
+		steps += cpu.steps
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(steps), "ns/inst")
+}
+
+func BenchmarkInterpreter(b *testing.B) {
+	benchmarkEngine(b, ENGINE_INTERPRETER)
+}
+
+func BenchmarkCompiled(b *testing.B) {
+	benchmarkEngine(b, ENGINE_COMPILED)
+}
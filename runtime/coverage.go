@@ -0,0 +1,291 @@
+package runtime
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Coverage records which instructions ran and which way conditional jumps went.
+// It can be saved and merged with the coverage of other runs of the same program.
+type Coverage struct {
+	File     string   `json:"file"`      // Script the coverage belongs to
+	Hash     string   `json:"hash"`      // Hash of the script source, to detect edits
+	Runs     int      `json:"runs"`      // Number of runs merged into the counts
+	Hits     []uint64 `json:"hits"`      // Executions per instruction address
+	Taken    []uint64 `json:"taken"`     // Taken conditional jumps per address
+	NotTaken []uint64 `json:"not_taken"` // Not taken conditional jumps per address
+
+	program *commands.Program
+}
+
+// NewCoverage creates empty coverage for a single run of program, loaded from file.
+func NewCoverage(program *commands.Program, file string) *Coverage {
+	size := len(program.Instructions)
+	sum := sha256.Sum256([]byte(strings.Join(program.Source, "\n")))
+	return &Coverage{
+		File:     file,
+		Hash:     hex.EncodeToString(sum[:]),
+		Runs:     1,
+		Hits:     make([]uint64, size),
+		Taken:    make([]uint64, size),
+		NotTaken: make([]uint64, size),
+		program:  program,
+	}
+}
+
+// ObserveStep records one executed instruction.
+func (c *Coverage) ObserveStep(rec *StepRecord) {
+	if rec.PC < 0 || rec.PC >= len(c.Hits) || rec.Inst.Opcode == commands.IRQ {
+		return // Taking an interrupt does not run the interrupted instruction
+	}
+	c.Hits[rec.PC]++
+	if isConditionalJump(rec.Inst.Opcode) {
+		if rec.Taken {
+			c.Taken[rec.PC]++
+		} else {
+			c.NotTaken[rec.PC]++
+		}
+	}
+}
+
+// isConditionalJump reports whether opcode may or may not transfer control.
+func isConditionalJump(opcode int) bool {
+	return opcode == commands.JZ || opcode == commands.JNZ
+}
+
+// Merge adds the counts of another run of the same program.
+func (c *Coverage) Merge(other *Coverage) error {
+	if other.Hash != c.Hash || len(other.Hits) != len(c.Hits) ||
+		len(other.Taken) != len(c.Hits) || len(other.NotTaken) != len(c.Hits) {
+		return fmt.Errorf("coverage data for %s was recorded for a different version of the program", other.File)
+	}
+	c.Runs += other.Runs
+	for i := range c.Hits {
+		c.Hits[i] += other.Hits[i]
+		c.Taken[i] += other.Taken[i]
+		c.NotTaken[i] += other.NotTaken[i]
+	}
+	return nil
+}
+
+// LoadCoverage reads coverage data saved by Save.
+func LoadCoverage(path string) (*Coverage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Coverage
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid coverage data in %s: %v", path, err)
+	}
+	return &c, nil
+}
+
+// Save writes the coverage data to path as JSON.
+func (c *Coverage) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// Summary returns instruction and branch coverage in one line.
+func (c *Coverage) Summary() string {
+	covered := 0
+	for _, hits := range c.Hits {
+		if hits > 0 {
+			covered++
+		}
+	}
+	branches, branchesHit := c.branchCounts()
+	return fmt.Sprintf("Coverage: %d/%d instructions (%s), %d/%d branches (%s) over %d run(s)",
+		covered, len(c.Hits), ratio(covered, len(c.Hits)), branchesHit, branches, ratio(branchesHit, branches), c.Runs)
+}
+
+// branchCounts returns the number of branch outcomes and how many of them were seen.
+func (c *Coverage) branchCounts() (total, hit int) {
+	for pc, inst := range c.program.Instructions {
+		if !isConditionalJump(inst.Opcode) {
+			continue
+		}
+		total += 2
+		if c.Taken[pc] > 0 {
+			hit++
+		}
+		if c.NotTaken[pc] > 0 {
+			hit++
+		}
+	}
+	return total, hit
+}
+
+// ratio formats part/total as a percentage.
+func ratio(part, total int) string {
+	if total == 0 {
+		return "100.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(total))
+}
+
+// WriteListing writes the source annotated with execution counts. Lines with
+// instructions that never ran are marked "#####", conditional jumps that only
+// went one way are marked with the missing outcome.
+func (c *Coverage) WriteListing(w io.Writer) {
+	lineHits := map[int]uint64{}
+	hasCode := map[int]bool{}
+	notes := map[int]string{}
+	for pc, inst := range c.program.Instructions {
+		line := c.program.LineOf(pc)
+		lineHits[line] += c.Hits[pc]
+		hasCode[line] = true
+		if isConditionalJump(inst.Opcode) && c.Hits[pc] > 0 {
+			switch {
+			case c.Taken[pc] == 0:
+				notes[line] = "  <- never taken"
+			case c.NotTaken[pc] == 0:
+				notes[line] = "  <- always taken"
+			}
+		}
+	}
+
+	fmt.Fprintln(w, c.Summary())
+	for i, text := range c.program.Source {
+		line := i + 1
+		if line == len(c.program.Source) && strings.TrimSpace(text) == "" {
+			break // Trailing newline
+		}
+		text = strings.TrimRight(text, " \t\r")
+		count := "-"
+		if hasCode[line] {
+			count = fmt.Sprint(lineHits[line])
+			if lineHits[line] == 0 {
+				count = "#####"
+			}
+		}
+		fmt.Fprintf(w, "%9s: %4d: %s%s\n", count, line, text, notes[line])
+	}
+}
+
+// WriteLCOV writes the coverage as an LCOV tracefile. Subroutines (CALL targets)
+// are reported as functions.
+func (c *Coverage) WriteLCOV(w io.Writer) {
+	fmt.Fprintln(w, "TN:")
+	fmt.Fprintf(w, "SF:%s\n", c.File)
+
+	// Functions, in address order
+	targets := map[int]bool{}
+	for _, inst := range c.program.Instructions {
+		if inst.Opcode == commands.CALL && inst.Operands[0] < len(c.Hits) {
+			targets[inst.Operands[0]] = true
+		}
+	}
+	var functions []int
+	for addr := range targets {
+		functions = append(functions, addr)
+	}
+	sort.Ints(functions)
+	functionsHit := 0
+	for _, addr := range functions {
+		fmt.Fprintf(w, "FN:%d,%s\n", c.program.LineOf(addr), c.functionName(addr))
+	}
+	for _, addr := range functions {
+		fmt.Fprintf(w, "FNDA:%d,%s\n", c.Hits[addr], c.functionName(addr))
+		if c.Hits[addr] > 0 {
+			functionsHit++
+		}
+	}
+	fmt.Fprintf(w, "FNF:%d\nFNH:%d\n", len(functions), functionsHit)
+
+	// Branches, two outcomes per conditional jump
+	block := 0
+	for pc, inst := range c.program.Instructions {
+		if !isConditionalJump(inst.Opcode) {
+			continue
+		}
+		line := c.program.LineOf(pc)
+		taken, notTaken := "-", "-"
+		if c.Hits[pc] > 0 {
+			taken, notTaken = fmt.Sprint(c.Taken[pc]), fmt.Sprint(c.NotTaken[pc])
+		}
+		fmt.Fprintf(w, "BRDA:%d,%d,0,%s\n", line, block, taken)
+		fmt.Fprintf(w, "BRDA:%d,%d,1,%s\n", line, block, notTaken)
+		block++
+	}
+	branches, branchesHit := c.branchCounts()
+	fmt.Fprintf(w, "BRF:%d\nBRH:%d\n", branches, branchesHit)
+
+	// Lines
+	lineHits := map[int]uint64{}
+	var lines []int
+	for pc := range c.program.Instructions {
+		line := c.program.LineOf(pc)
+		if _, ok := lineHits[line]; !ok {
+			lines = append(lines, line)
+		}
+		lineHits[line] += c.Hits[pc]
+	}
+	linesHit := 0
+	for _, line := range lines {
+		fmt.Fprintf(w, "DA:%d,%d\n", line, lineHits[line])
+		if lineHits[line] > 0 {
+			linesHit++
+		}
+	}
+	fmt.Fprintf(w, "LF:%d\nLH:%d\n", len(lines), linesHit)
+	fmt.Fprintln(w, "end_of_record")
+}
+
+// functionName returns the label of a subroutine, or a name derived from its address.
+func (c *Coverage) functionName(addr int) string {
+	if label, ok := c.program.LabelAt(addr); ok {
+		return label
+	}
+	return fmt.Sprintf("sub_0x%02X", addr)
+}
+
+// reportCoverage merges the coverage of this run with earlier runs and writes
+// the reports requested by opts.
+func reportCoverage(c *Coverage, opts Options) {
+	if opts.Coverage != "" {
+		previous, err := LoadCoverage(opts.Coverage)
+		if err == nil {
+			err = c.Merge(previous)
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			utils.RED.Printf("Error: %v\n", err)
+			return
+		}
+		if err := c.Save(opts.Coverage); err != nil {
+			utils.RED.Printf("Error saving coverage: %v\n", err)
+			return
+		}
+	}
+
+	if opts.CoverageListing {
+		c.WriteListing(os.Stdout)
+	} else {
+		utils.GREEN.Println(c.Summary())
+	}
+
+	if opts.LCOV != "" {
+		file, err := os.Create(opts.LCOV)
+		if err != nil {
+			utils.RED.Printf("Error writing LCOV report: %v\n", err)
+			return
+		}
+		defer file.Close()
+		c.WriteLCOV(file)
+	}
+}
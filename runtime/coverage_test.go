@@ -0,0 +1,105 @@
+package runtime
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+const coverageScript = `        JZ R0 zero
+        LOAD R1 1
+        HALT
+zero:   LOAD R1 2
+        JNZ R1 done
+        LOAD R1 3
+done:   HALT`
+
+func runCoverage(t *testing.T, r0 int) *Coverage {
+	t.Helper()
+	program, err := commands.Assemble(coverageScript, commands.ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	coverage := NewCoverage(program, "test.ass")
+	cpu := NewCPU()
+	cpu.registers[0] = r0
+	cpu.AddObserver(coverage)
+	cpu.LoadProgram(program.Instructions)
+	cpu.Run()
+	return coverage
+}
+
+func TestCoverageBranches(t *testing.T) {
+	coverage := runCoverage(t, 0)
+	expectedHits := []uint64{1, 0, 0, 1, 1, 0, 1}
+	for pc, hits := range expectedHits {
+		if coverage.Hits[pc] != hits {
+			t.Errorf("hits at pc %d = %d, want %d", pc, coverage.Hits[pc], hits)
+		}
+	}
+	if coverage.Taken[0] != 1 || coverage.NotTaken[0] != 0 || coverage.Taken[4] != 1 {
+		t.Errorf("taken = %v, not taken = %v", coverage.Taken, coverage.NotTaken)
+	}
+	summary := coverage.Summary()
+	if summary != "Coverage: 4/7 instructions (57.1%), 2/4 branches (50.0%) over 1 run(s)" {
+		t.Errorf("Summary() = %q", summary)
+	}
+
+	var listing bytes.Buffer
+	coverage.WriteListing(&listing)
+	for _, want := range []string{
+		"    #####:    2:         LOAD R1 1",
+		"        1:    1:         JZ R0 zero  <- always taken",
+	} {
+		if !strings.Contains(listing.String(), want) {
+			t.Errorf("listing does not contain %q:\n%s", want, listing.String())
+		}
+	}
+}
+
+func TestCoverageMergeAndSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coverage.json")
+	first := runCoverage(t, 0)
+	if err := first.Save(path); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	second := runCoverage(t, 1)
+	previous, err := LoadCoverage(path)
+	if err != nil {
+		t.Fatalf("LoadCoverage() error = %v", err)
+	}
+	if err := second.Merge(previous); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+	if second.Runs != 2 || second.Taken[0] != 1 || second.NotTaken[0] != 1 || second.Hits[1] != 1 {
+		t.Errorf("merged coverage = %+v", second)
+	}
+
+	program, _ := commands.Assemble("HALT", commands.ParseOptions{})
+	if err := NewCoverage(program, "other.ass").Merge(previous); err == nil {
+		t.Errorf("merging coverage of a different program should fail")
+	}
+}
+
+func TestCoverageLCOV(t *testing.T) {
+	coverage := runCoverage(t, 0)
+	var out bytes.Buffer
+	coverage.WriteLCOV(&out)
+	for _, want := range []string{
+		"SF:test.ass\n",
+		"BRDA:1,0,0,1\nBRDA:1,0,1,0\n",
+		"BRDA:5,1,0,1\nBRDA:5,1,1,0\n",
+		"BRF:4\nBRH:2\n",
+		"DA:2,0\n",
+		"LF:7\nLH:4\n",
+		"end_of_record\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("LCOV output does not contain %q:\n%s", want, out.String())
+		}
+	}
+}
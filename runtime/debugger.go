@@ -0,0 +1,473 @@
+package runtime
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Number of source lines shown on each side of the current line by "list"
+const LIST_CONTEXT = 4
+
+// Debugger drives a CPU one instruction at a time under user control.
+type Debugger struct {
+	cpu         *CPU
+	program     *commands.Program
+	breakpoints map[int]bool // Instruction addresses to stop at
+	watches     *WatchSet    // Watchpoints, which stop execution when hit
+	lastCommand string       // Repeated when the user enters an empty line
+}
+
+// NewDebugger creates a debugger for a CPU that has program loaded.
+func NewDebugger(cpu *CPU, program *commands.Program) *Debugger {
+	watches := NewWatchSet()
+	watches.Stop = true
+	cpu.SetWatches(watches)
+	cpu.SetHistory(NewHistory(DEFAULT_HISTORY_SIZE))
+	return &Debugger{
+		cpu:         cpu,
+		program:     program,
+		breakpoints: map[int]bool{},
+		watches:     watches,
+	}
+}
+
+// RunDebugger assembles the script in filename and starts an interactive debugging session.
+func RunDebugger(cpu *CPU, filename string, opts Options) {
+	if !configureCPU(cpu, opts) {
+		return
+	}
+	program, _, ok := prepareProgram(cpu, filename, opts)
+	if !ok || !loadMemoryIn(cpu, opts) {
+		return
+	}
+	d := NewDebugger(cpu, program)
+	cpu.SetHistory(NewHistory(opts.HistorySize))
+	if err := d.watches.AddSpecs(opts.Watches); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return
+	}
+	d.Start(stdin)
+	saveMemoryOut(cpu, opts)
+}
+
+// Start reads debugger commands from in until it is exhausted or the user quits.
+func (d *Debugger) Start(in io.Reader) {
+	reader := bufio.NewReader(in)
+	utils.GREEN.Println("TinyASS debugger")
+	utils.BLUE.Println("Type 'help' for commands, 'quit' to exit")
+	d.printLocation()
+
+	for {
+		utils.BLUE.Print("(tdb) ")
+		line, ok := readLine(reader)
+		if !ok {
+			break
+		}
+		if !d.Exec(line) {
+			return
+		}
+	}
+}
+
+// Exec runs a single debugger command. It returns false when the session should end.
+func (d *Debugger) Exec(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		fields = strings.Fields(d.lastCommand)
+		if len(fields) == 0 {
+			return true
+		}
+	} else {
+		d.lastCommand = line
+	}
+
+	args := fields[1:]
+	switch strings.ToLower(fields[0]) {
+	case "quit", "q", "exit":
+		return false
+	case "help", "h":
+		printDebugHelp()
+	case "break", "b":
+		d.setBreakpoint(args)
+	case "delete", "d":
+		d.deleteBreakpoint(args)
+	case "breaks":
+		d.listBreakpoints()
+	case "watch", "w":
+		d.setWatchpoint(args)
+	case "unwatch":
+		d.deleteWatchpoint(args)
+	case "watches":
+		d.listWatchpoints()
+	case "step", "s":
+		d.step(args)
+	case "next", "n":
+		d.next()
+	case "continue", "c":
+		d.resume(func() bool { return false })
+	case "finish", "f":
+		d.finish()
+	case "back", "reverse-step", "rs":
+		d.back(args)
+	case "reverse-continue", "rc":
+		d.reverseContinue()
+	case "goto":
+		d.gotoStep(args)
+	case "history":
+		printHistory(d.cpu)
+	case "reg":
+		printRegisters(d.cpu.registers)
+	case "mem":
+		d.showMemory(args)
+	case "cycles":
+		printCycles(d.cpu)
+	case "mmu":
+		printMMU(d.cpu)
+	case "cache":
+		printCache(d.cpu)
+	case "list", "l":
+		d.list(args)
+	case "save", "load":
+		if len(args) != 1 {
+			utils.RED.Printf("%s requires a file name\nExample: %s state.json\n", fields[0], fields[0])
+			break
+		}
+		if program, _ := replSnapshotCommand(d.cpu, fields); program != nil {
+			d.program = program
+			d.breakpoints = map[int]bool{}
+			d.printLocation()
+		}
+	default:
+		utils.RED.Printf("Unknown command: %s\nType 'help' for commands\n", fields[0])
+	}
+	return true
+}
+
+// resolve converts a line number, label or 0x address to an instruction address.
+func (d *Debugger) resolve(loc string) (int, error) {
+	if addr, ok := d.program.Labels[loc]; ok {
+		return addr, nil
+	}
+	if strings.HasPrefix(loc, "0x") || strings.HasPrefix(loc, "0X") {
+		addr, err := commands.ParseMemory(loc)
+		if err != nil || addr >= len(d.program.Instructions) {
+			return 0, fmt.Errorf("no instruction at address %s", loc)
+		}
+		return addr, nil
+	}
+	line, err := strconv.Atoi(loc)
+	if err != nil {
+		return 0, fmt.Errorf("unknown location: %s\nUse a line number, a label or a 0x address", loc)
+	}
+	addr, ok := d.program.AddressOfLine(line)
+	if !ok {
+		return 0, fmt.Errorf("no instruction on or after line %d", line)
+	}
+	return addr, nil
+}
+
+func (d *Debugger) setBreakpoint(args []string) {
+	if len(args) != 1 {
+		utils.RED.Println("break requires 1 operand\nExample: break 12, break loop or break 0x04")
+		return
+	}
+	addr, err := d.resolve(args[0])
+	if err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return
+	}
+	d.breakpoints[addr] = true
+	utils.GREEN.Printf("Breakpoint at %s\n", d.describe(addr))
+}
+
+func (d *Debugger) deleteBreakpoint(args []string) {
+	if len(args) == 0 {
+		d.breakpoints = map[int]bool{}
+		utils.GREEN.Println("All breakpoints deleted")
+		return
+	}
+	addr, err := d.resolve(args[0])
+	if err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return
+	}
+	if !d.breakpoints[addr] {
+		utils.RED.Printf("No breakpoint at %s\n", d.describe(addr))
+		return
+	}
+	delete(d.breakpoints, addr)
+	utils.GREEN.Printf("Deleted breakpoint at %s\n", d.describe(addr))
+}
+
+func (d *Debugger) listBreakpoints() {
+	if len(d.breakpoints) == 0 {
+		utils.GREY.Println("No breakpoints")
+		return
+	}
+	addrs := make([]int, 0, len(d.breakpoints))
+	for addr := range d.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		utils.GREEN.Printf("  %s\n", d.describe(addr))
+	}
+}
+
+func (d *Debugger) setWatchpoint(args []string) {
+	wp, err := ParseWatchpoint(strings.Join(args, " "))
+	if err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return
+	}
+	id := d.watches.Add(wp)
+	utils.GREEN.Printf("Watchpoint %d: %s\n", id, wp.Spec)
+}
+
+func (d *Debugger) deleteWatchpoint(args []string) {
+	if len(args) == 0 {
+		d.watches.Clear()
+		utils.GREEN.Println("All watchpoints deleted")
+		return
+	}
+	id, err := strconv.Atoi(args[0])
+	if err != nil || !d.watches.Remove(id) {
+		utils.RED.Printf("No watchpoint number %s\n", args[0])
+		return
+	}
+	utils.GREEN.Printf("Deleted watchpoint %d\n", id)
+}
+
+func (d *Debugger) listWatchpoints() {
+	if len(d.watches.Points()) == 0 {
+		utils.GREY.Println("No watchpoints")
+		return
+	}
+	for _, wp := range d.watches.Points() {
+		utils.GREEN.Printf("  %d: %s\n", wp.ID, wp.Spec)
+	}
+}
+
+// step executes up to n instructions, stopping early at breakpoints.
+func (d *Debugger) step(args []string) {
+	count := 1
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			utils.RED.Printf("Error: invalid step count: %s\n", args[0])
+			return
+		}
+		count = n
+	}
+	executed := 0
+	d.resume(func() bool {
+		executed++
+		return executed >= count
+	})
+}
+
+// next executes one instruction, running a called subroutine to completion.
+func (d *Debugger) next() {
+	if d.finished() {
+		d.resume(nil)
+		return
+	}
+	if d.cpu.program[d.cpu.pc].Opcode != commands.CALL {
+		d.step(nil)
+		return
+	}
+	depth := d.cpu.sp
+	d.resume(func() bool { return d.cpu.sp >= depth })
+}
+
+// finish runs until the current subroutine returns to its caller.
+func (d *Debugger) finish() {
+	if d.cpu.sp >= d.cpu.stackTop {
+		utils.RED.Println("\"finish\" not meaningful in the outermost frame")
+		return
+	}
+	depth := d.cpu.sp
+	d.resume(func() bool { return d.cpu.sp > depth })
+}
+
+// resume executes instructions until the program stops, a breakpoint is reached
+// or done reports true. At least one instruction is executed, so resuming from
+// a breakpoint moves past it.
+func (d *Debugger) resume(done func() bool) {
+	// Ctrl-C interrupts a long run and returns to the prompt
+	interrupt, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for executed := 1; ; executed++ {
+		if executed%CANCEL_CHECK_INTERVAL == 0 && interrupt.Err() != nil {
+			utils.YELLOW.Println("Interrupted")
+			d.printLocation()
+			return
+		}
+		running := d.cpu.Step()
+		hits := d.watches.TakeHits()
+		for _, hit := range hits {
+			utils.YELLOW.Println(hit)
+		}
+		if !running {
+			utils.GREEN.Println("Execution completed.")
+			return
+		}
+		if len(hits) > 0 {
+			d.printLocation()
+			return
+		}
+		if d.breakpoints[d.cpu.pc] {
+			utils.YELLOW.Printf("Breakpoint reached at %s\n", d.describe(d.cpu.pc))
+			d.printLocation()
+			return
+		}
+		if done != nil && done() {
+			d.printLocation()
+			return
+		}
+	}
+}
+
+// finished reports whether the program can no longer execute instructions.
+func (d *Debugger) finished() bool {
+	return d.cpu.halted || d.cpu.pc < 0 || d.cpu.pc >= len(d.cpu.program)
+}
+
+// back reverts up to n instructions.
+func (d *Debugger) back(args []string) {
+	count, ok := parseCount(args)
+	if !ok {
+		return
+	}
+	for i := 0; i < count; i++ {
+		if !d.cpu.StepBack() {
+			utils.RED.Println("No more reverse-execution history")
+			break
+		}
+	}
+	d.printLocation()
+}
+
+// reverseContinue runs backwards until a breakpoint or the start of the history is reached.
+func (d *Debugger) reverseContinue() {
+	for {
+		if !d.cpu.StepBack() {
+			utils.YELLOW.Println("Reached the start of the reverse-execution history")
+			break
+		}
+		if d.breakpoints[d.cpu.pc] {
+			utils.YELLOW.Printf("Breakpoint reached at %s\n", d.describe(d.cpu.pc))
+			break
+		}
+	}
+	d.printLocation()
+}
+
+// gotoStep moves execution to the given instruction count.
+func (d *Debugger) gotoStep(args []string) {
+	if len(args) != 1 {
+		utils.RED.Println("goto requires 1 operand\nExample: goto 12")
+		return
+	}
+	step, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		utils.RED.Printf("Error: invalid instruction count: %s\n", args[0])
+		return
+	}
+	if err := d.cpu.GotoStep(step); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+	}
+	d.watches.TakeHits() // Accesses replayed by goto are not reported
+	d.printLocation()
+}
+
+func (d *Debugger) showMemory(args []string) {
+	if len(args) == 0 {
+		printMemory(*d.cpu.memory)
+		return
+	}
+	start, err := commands.ParseMemory(args[0])
+	if err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return
+	}
+	count := 1
+	if len(args) > 1 {
+		count, err = strconv.Atoi(args[1])
+		if err != nil || count < 1 {
+			utils.RED.Printf("Error: invalid cell count: %s\n", args[1])
+			return
+		}
+	}
+	printMemoryRange(*d.cpu.memory, start, count)
+}
+
+// list prints the source around the current location, or around loc if given.
+func (d *Debugger) list(args []string) {
+	center := d.program.LineOf(d.cpu.pc)
+	if len(args) > 0 {
+		addr, err := d.resolve(args[0])
+		if err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return
+		}
+		center = d.program.LineOf(addr)
+	}
+	if center == 0 {
+		center = len(d.program.Source)
+	}
+
+	current := -1
+	if !d.finished() {
+		current = d.program.LineOf(d.cpu.pc)
+	}
+	breakLines := map[int]bool{}
+	for addr := range d.breakpoints {
+		breakLines[d.program.LineOf(addr)] = true
+	}
+
+	first := max(center-LIST_CONTEXT, 1)
+	last := min(center+LIST_CONTEXT, len(d.program.Source))
+	for line := first; line <= last; line++ {
+		marker := "  "
+		if breakLines[line] {
+			marker = "* "
+		}
+		text := fmt.Sprintf("%4d  %s", line, d.program.Source[line-1])
+		if line == current {
+			utils.BOLD_YELLOW.Printf("=>%s\n", text)
+		} else {
+			utils.GREY.Printf("%s%s\n", marker, text)
+		}
+	}
+}
+
+// printLocation shows the instruction that will execute next.
+func (d *Debugger) printLocation() {
+	if d.finished() {
+		utils.GREY.Printf("The program is not running (after %d instructions)\n", d.cpu.steps)
+		return
+	}
+	line := d.program.LineOf(d.cpu.pc)
+	utils.YELLOW.Printf("=> #%d %s: %s\n", d.cpu.steps, d.describe(d.cpu.pc), strings.TrimSpace(d.program.Source[line-1]))
+}
+
+// describe formats an instruction address with its source line and label.
+func (d *Debugger) describe(addr int) string {
+	desc := fmt.Sprintf("0x%02X line %d", addr, d.program.LineOf(addr))
+	if label, ok := d.program.LabelAt(addr); ok {
+		desc += " <" + label + ">"
+	}
+	return desc
+}
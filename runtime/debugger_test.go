@@ -0,0 +1,89 @@
+package runtime
+
+import (
+	"testing"
+
+	"tinyass/commands"
+)
+
+const debugScript = `        LOAD R0 2
+        LOAD R1 1
+loop:   SUB R0 R0 R1
+        CALL show
+        JNZ R0 loop
+        HALT
+show:   PRINT R0
+        RET`
+
+func newTestDebugger(t *testing.T) *Debugger {
+	t.Helper()
+	program, err := commands.Assemble(debugScript, commands.ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	cpu := NewCPU()
+	cpu.LoadProgram(program.Instructions)
+	return NewDebugger(cpu, program)
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := newTestDebugger(t)
+
+	d.Exec("break show")
+	d.Exec("break 5")
+	if !d.breakpoints[6] || !d.breakpoints[4] {
+		t.Fatalf("breakpoints = %v, want addresses 4 and 6", d.breakpoints)
+	}
+
+	d.Exec("continue")
+	if d.cpu.pc != 6 {
+		t.Errorf("pc after continue = %d, want 6", d.cpu.pc)
+	}
+	d.Exec("continue")
+	if d.cpu.pc != 4 {
+		t.Errorf("pc after second continue = %d, want 4", d.cpu.pc)
+	}
+
+	d.Exec("delete")
+	d.Exec("continue")
+	if !d.finished() || d.cpu.registers[0] != 0 {
+		t.Errorf("program should run to completion, pc = %d, R0 = %d", d.cpu.pc, d.cpu.registers[0])
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	d := newTestDebugger(t)
+
+	d.Exec("step 3")
+	if d.cpu.pc != 3 {
+		t.Fatalf("pc after step 3 = %d, want 3", d.cpu.pc)
+	}
+
+	// next steps over the CALL
+	d.Exec("next")
+	if d.cpu.pc != 4 {
+		t.Errorf("pc after next = %d, want 4", d.cpu.pc)
+	}
+
+	d.Exec("step 2")
+	d.Exec("step")
+	if d.cpu.pc != 6 {
+		t.Fatalf("pc after stepping into the call = %d, want 6", d.cpu.pc)
+	}
+
+	// finish returns to the caller
+	d.Exec("finish")
+	if d.cpu.pc != 4 || d.cpu.sp != commands.MEMORY_SIZE {
+		t.Errorf("after finish pc = %d, sp = %d, want 4 and %d", d.cpu.pc, d.cpu.sp, commands.MEMORY_SIZE)
+	}
+
+	// an empty line repeats the last command
+	d.Exec("")
+	if d.cpu.sp != commands.MEMORY_SIZE {
+		t.Errorf("finish in the outermost frame should not run, sp = %d", d.cpu.sp)
+	}
+
+	if d.Exec("quit") {
+		t.Errorf("quit should end the session")
+	}
+}
@@ -0,0 +1,331 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Default addresses of the standard devices, below the stack at the top of memory
+const (
+	CONSOLE_ADDRESS  = 0xE0
+	KEYBOARD_ADDRESS = 0xE1
+	TIMER_ADDRESS    = 0xE2
+	RNG_ADDRESS      = 0xE4
+)
+
+// Seed of the random number generator until a program writes its own
+const DEFAULT_RNG_SEED = 1
+
+// Device is a peripheral mapped into a range of memory addresses. Loads and
+// stores to the range go to the device instead of memory.
+type Device interface {
+	Name() string
+	Size() int                 // Number of memory cells the device occupies
+	Read(offset int) int       // Load from the cell at offset into the range
+	Write(offset int, val int) // Store to the cell at offset into the range
+}
+
+// StatefulDevice is a device whose state is saved in snapshots.
+type StatefulDevice interface {
+	Device
+	SaveState() (json.RawMessage, error)
+	RestoreState(state json.RawMessage) error
+}
+
+// mapping is a device mapped at a start address.
+type mapping struct {
+	start  int
+	device Device
+}
+
+// Bus routes memory accesses to the devices mapped into memory.
+type Bus struct {
+	mappings []*mapping
+	devices  [commands.MEMORY_SIZE]*mapping // Device mapped at each address, nil for memory
+}
+
+// NewBus creates a bus with no devices mapped.
+func NewBus() *Bus {
+	return &Bus{}
+}
+
+// Map places a device at start. The device must fit in memory and must not
+// overlap a device that is already mapped.
+func (b *Bus) Map(start int, device Device) error {
+	end := start + device.Size()
+	if start < 0 || device.Size() <= 0 || end > commands.MEMORY_SIZE {
+		return fmt.Errorf("%s at 0x%02X does not fit in memory", device.Name(), start)
+	}
+	for addr := start; addr < end; addr++ {
+		if other := b.devices[addr]; other != nil {
+			return fmt.Errorf("%s at 0x%02X overlaps %s at 0x%02X", device.Name(), start, other.device.Name(), other.start)
+		}
+	}
+	m := &mapping{start, device}
+	b.mappings = append(b.mappings, m)
+	for addr := start; addr < end; addr++ {
+		b.devices[addr] = m
+	}
+	return nil
+}
+
+// Devices returns the mapped devices in the order they were mapped.
+func (b *Bus) Devices() []Device {
+	devices := make([]Device, len(b.mappings))
+	for i, m := range b.mappings {
+		devices[i] = m.device
+	}
+	return devices
+}
+
+// lookup returns the device mapped at addr and the offset of addr into it.
+func (b *Bus) lookup(addr int) (Device, int, bool) {
+	m := b.devices[addr]
+	if m == nil {
+		return nil, 0, false
+	}
+	return m.device, addr - m.start, true
+}
+
+// SetBus attaches a device bus. A nil bus makes every address plain memory.
+func (cpu *CPU) SetBus(bus *Bus) {
+	cpu.bus = bus
+}
+
+// Console writes every value stored to it as a character.
+type Console struct {
+	out io.Writer
+}
+
+// NewConsole creates a console writing to out.
+func NewConsole(out io.Writer) *Console {
+	return &Console{out: out}
+}
+
+func (c *Console) Name() string { return "console" }
+func (c *Console) Size() int    { return 1 }
+func (c *Console) Read(offset int) int {
+	return 0
+}
+func (c *Console) Write(offset int, val int) {
+	fmt.Fprint(c.out, string(rune(val)))
+}
+
+// Keyboard returns the next byte of input on every load, or -1 at the end of input.
+type Keyboard struct {
+	in *bufio.Reader
+}
+
+// NewKeyboard creates a keyboard reading from in. A *bufio.Reader in is used as
+// is, so its buffer can be shared.
+func NewKeyboard(in io.Reader) *Keyboard {
+	return &Keyboard{in: bufio.NewReader(in)}
+}
+
+func (k *Keyboard) Name() string { return "keyboard" }
+func (k *Keyboard) Size() int    { return 1 }
+func (k *Keyboard) Read(offset int) int {
+	b, err := k.in.ReadByte()
+	if err != nil {
+		return -1
+	}
+	return int(b)
+}
+func (k *Keyboard) Write(offset int, val int) {}
+
+// Timer counts the cycles since it was last reset. Storing any value to the
+// counter resets it. Storing a period of n cycles to the second cell raises
+// TIMER_IRQ every n cycles, 0 stops the interrupts.
+type Timer struct {
+	clock  func() uint64
+	base   uint64 // Clock value at the last reset
+	period uint64 // Cycles between interrupts, 0 for none
+	next   uint64 // Clock value at which the next interrupt is raised
+}
+
+// Timer cells
+const (
+	TIMER_COUNTER = 0
+	TIMER_PERIOD  = 1
+)
+
+// timerState is the timer state saved in snapshots.
+type timerState struct {
+	Base   uint64 `json:"base"`
+	Period uint64 `json:"period,omitempty"`
+	Next   uint64 `json:"next,omitempty"`
+}
+
+// NewTimer creates a timer counting the cycles of cpu.
+func NewTimer(cpu *CPU) *Timer {
+	return &Timer{clock: cpu.Cycles}
+}
+
+func (t *Timer) Name() string { return "timer" }
+func (t *Timer) Size() int    { return 2 }
+func (t *Timer) Read(offset int) int {
+	if offset == TIMER_PERIOD {
+		return int(t.period)
+	}
+	return int(t.clock() - t.base)
+}
+func (t *Timer) Write(offset int, val int) {
+	if offset == TIMER_PERIOD {
+		t.period = uint64(max(val, 0))
+		t.next = t.clock() + t.period
+		return
+	}
+	t.base = t.clock()
+}
+
+// PollInterrupt raises TIMER_IRQ once a period has elapsed.
+func (t *Timer) PollInterrupt() (int, bool) {
+	if t.period == 0 || t.clock() < t.next {
+		return 0, false
+	}
+	t.next = t.clock() + t.period
+	return TIMER_IRQ, true
+}
+
+func (t *Timer) SaveState() (json.RawMessage, error) {
+	return json.Marshal(timerState{t.base, t.period, t.next})
+}
+
+func (t *Timer) RestoreState(state json.RawMessage) error {
+	var saved timerState
+	if err := json.Unmarshal(state, &saved); err != nil {
+		return err
+	}
+	t.base, t.period, t.next = saved.Base, saved.Period, saved.Next
+	return nil
+}
+
+// RNG returns a pseudo-random number from 0 to 255 on every load. Storing a
+// value seeds it, so runs are reproducible.
+type RNG struct {
+	state uint32 // xorshift32 state, never zero
+}
+
+// NewRNG creates a random number generator with the default seed.
+func NewRNG() *RNG {
+	r := &RNG{}
+	r.Write(0, DEFAULT_RNG_SEED)
+	return r
+}
+
+func (r *RNG) Name() string { return "rng" }
+func (r *RNG) Size() int    { return 1 }
+func (r *RNG) Read(offset int) int {
+	r.state ^= r.state << 13
+	r.state ^= r.state >> 17
+	r.state ^= r.state << 5
+	return int(r.state & 0xFF)
+}
+func (r *RNG) Write(offset int, val int) {
+	r.state = uint32(val)
+	if r.state == 0 {
+		r.state = DEFAULT_RNG_SEED
+	}
+}
+
+func (r *RNG) SaveState() (json.RawMessage, error) {
+	return json.Marshal(r.state)
+}
+
+func (r *RNG) RestoreState(state json.RawMessage) error {
+	return json.Unmarshal(state, &r.state)
+}
+
+// ParseDeviceSpec parses "name" or "name@0xNN" into a device for cpu and the
+// address to map it at. Devices are console, keyboard, timer and rng.
+func ParseDeviceSpec(cpu *CPU, spec string) (Device, int, error) {
+	name, at, hasAddress := strings.Cut(spec, "@")
+	var device Device
+	var addr int
+	switch strings.ToLower(name) {
+	case "console":
+		device, addr = NewConsole(os.Stdout), CONSOLE_ADDRESS
+	case "keyboard":
+		device, addr = NewKeyboard(stdin), KEYBOARD_ADDRESS
+	case "timer":
+		device, addr = NewTimer(cpu), TIMER_ADDRESS
+	case "rng":
+		device, addr = NewRNG(), RNG_ADDRESS
+	default:
+		return nil, 0, fmt.Errorf("unknown device: %s\nDevices are console, keyboard, timer and rng", name)
+	}
+	if hasAddress {
+		var err error
+		if addr, err = commands.ParseMemory(at); err != nil {
+			return nil, 0, err
+		}
+	}
+	return device, addr, nil
+}
+
+// attachDevices maps the devices named in specs onto a new bus for cpu.
+func attachDevices(cpu *CPU, specs []string) error {
+	bus := NewBus()
+	for _, spec := range specs {
+		device, addr, err := ParseDeviceSpec(cpu, spec)
+		if err != nil {
+			return err
+		}
+		for _, other := range bus.Devices() {
+			if other.Name() == device.Name() {
+				return fmt.Errorf("device %s is already mapped", device.Name())
+			}
+		}
+		if err := bus.Map(addr, device); err != nil {
+			return err
+		}
+	}
+	cpu.SetBus(bus)
+	return nil
+}
+
+// saveDevices returns the state of the stateful devices on the bus by name.
+func (cpu *CPU) saveDevices() (map[string]json.RawMessage, error) {
+	if cpu.bus == nil {
+		return nil, nil
+	}
+	states := map[string]json.RawMessage{}
+	for _, device := range cpu.bus.Devices() {
+		if stateful, ok := device.(StatefulDevice); ok {
+			state, err := stateful.SaveState()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", device.Name(), err)
+			}
+			states[device.Name()] = state
+		}
+	}
+	if len(states) == 0 {
+		return nil, nil
+	}
+	return states, nil
+}
+
+// restoreDevices restores the state of the devices on the bus that have state
+// in states. Devices that are not attached are ignored.
+func (cpu *CPU) restoreDevices(states map[string]json.RawMessage) error {
+	if cpu.bus == nil {
+		return nil
+	}
+	for _, device := range cpu.bus.Devices() {
+		stateful, ok := device.(StatefulDevice)
+		state, saved := states[device.Name()]
+		if !ok || !saved {
+			continue
+		}
+		if err := stateful.RestoreState(state); err != nil {
+			return fmt.Errorf("invalid %s state in snapshot: %v", device.Name(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// mapDevices gives cpu a bus with devices mapped from 0xE0 on.
+func mapDevices(t *testing.T, cpu *CPU, devices ...Device) {
+	t.Helper()
+	bus := NewBus()
+	for i, device := range devices {
+		if err := bus.Map(0xE0+i, device); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cpu.SetBus(bus)
+}
+
+func TestBusMap(t *testing.T) {
+	bus := NewBus()
+	if err := bus.Map(0xE0, NewRNG()); err != nil {
+		t.Fatal(err)
+	}
+	if err := bus.Map(0xE0, NewTimer(NewCPU())); err == nil || !strings.Contains(err.Error(), "overlaps rng") {
+		t.Errorf("Map() error = %v, want an overlap error", err)
+	}
+	if err := bus.Map(commands.MEMORY_SIZE, NewRNG()); err == nil {
+		t.Errorf("Map() should reject devices outside memory")
+	}
+	if devices := bus.Devices(); len(devices) != 1 || devices[0].Name() != "rng" {
+		t.Errorf("Devices() = %v", devices)
+	}
+}
+
+func TestConsoleAndKeyboard(t *testing.T) {
+	// Echo the input in upper case until the end of input
+	source := `
+loop:
+    LOADM R0 0xE1
+    LOAD R1 0
+    LT R1 R0 R1
+    JNZ R1 done
+    LOAD R1 32
+    SUB R0 R0 R1
+    STORE R0 0xE0
+    JMP loop
+done:
+    HALT
+`
+	var out bytes.Buffer
+	cpu := assembleCPU(t, source)
+	mapDevices(t, cpu, NewConsole(&out), NewKeyboard(strings.NewReader("tiny")))
+	cpu.Run()
+	if out.String() != "TINY" {
+		t.Errorf("console output = %q, want TINY", out.String())
+	}
+	if cpu.memory[0xE0] != 0 || cpu.memory[0xE1] != 0 {
+		t.Errorf("device accesses should not touch memory")
+	}
+}
+
+func TestStackStopsAtDevices(t *testing.T) {
+	var out bytes.Buffer
+	cpu := assembleCPU(t, "recurse:\nCALL recurse")
+	bus := NewBus()
+	if err := bus.Map(0xF0, NewConsole(&out)); err != nil {
+		t.Fatal(err)
+	}
+	cpu.SetBus(bus)
+	cpu.Run()
+	if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_STACK || cpu.sp != 0xF1 || out.Len() != 0 {
+		t.Errorf("fault = %v with sp = 0x%02X and console output %q, want a stack overflow at the console",
+			cpu.Fault(), cpu.sp, out.String())
+	}
+}
+
+func TestTimer(t *testing.T) {
+	cpu := assembleCPU(t, "STORE R0 0xE0\nLOAD R1 1\nLOAD R1 2\nLOADM R2 0xE0\n")
+	mapDevices(t, cpu)
+	cpu.bus.Map(0xE0, NewTimer(cpu))
+	cpu.SetCostTable(nil)
+	cpu.Run()
+	if cpu.registers[2] != 3 { // STORE, LOAD and LOAD ran since the reset
+		t.Errorf("timer = %d, want 3", cpu.registers[2])
+	}
+}
+
+func TestRNGSeedAndSnapshot(t *testing.T) {
+	source := "LOAD R0 42\nSTORE R0 0xE0\nLOADM R1 0xE0\nLOADM R2 0xE0\nLOADM R3 0xE0\n"
+	first := assembleCPU(t, source)
+	mapDevices(t, first, NewRNG())
+	first.Run()
+	second := assembleCPU(t, source)
+	mapDevices(t, second, NewRNG())
+	second.Run()
+	if first.registers != second.registers {
+		t.Errorf("seeded runs differ: %v vs %v", first.registers, second.registers)
+	}
+	if first.registers[1] == first.registers[2] && first.registers[2] == first.registers[3] {
+		t.Errorf("random numbers should vary: %v", first.registers)
+	}
+
+	// A snapshot taken mid-run continues with the same random numbers
+	cpu := assembleCPU(t, source)
+	mapDevices(t, cpu, NewRNG())
+	cpu.Step()
+	cpu.Step()
+	cpu.Step()
+	snap, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := snap.Devices["rng"]; !ok {
+		t.Fatalf("snapshot has no rng state: %v", snap.Devices)
+	}
+	restored := assembleCPU(t, "")
+	mapDevices(t, restored, NewRNG())
+	if _, err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	restored.Run()
+	if restored.registers != first.registers {
+		t.Errorf("restored run = %v, want %v", restored.registers, first.registers)
+	}
+}
+
+func TestParseDeviceSpec(t *testing.T) {
+	cpu := NewCPU()
+	if device, addr, err := ParseDeviceSpec(cpu, "timer"); err != nil || device.Name() != "timer" || addr != TIMER_ADDRESS {
+		t.Errorf("ParseDeviceSpec(timer) = %v, 0x%02X, %v", device, addr, err)
+	}
+	if device, addr, err := ParseDeviceSpec(cpu, "RNG@0x40"); err != nil || device.Name() != "rng" || addr != 0x40 {
+		t.Errorf("ParseDeviceSpec(RNG@0x40) = %v, 0x%02X, %v", device, addr, err)
+	}
+	if _, _, err := ParseDeviceSpec(cpu, "disk"); err == nil {
+		t.Errorf("ParseDeviceSpec() should reject unknown devices")
+	}
+	if err := attachDevices(cpu, []string{"rng", "rng@0x40"}); err == nil {
+		t.Errorf("attachDevices() should reject a device mapped twice")
+	}
+}
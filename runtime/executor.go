@@ -2,7 +2,9 @@ package runtime
 
 import (
 	"bufio"
+	"context"
 	"os"
+	"os/signal"
 	"strings"
 
 	"tinyass/commands"
@@ -11,141 +13,543 @@ import (
 
 // CPU state
 type CPU struct {
-	memory    [commands.MEMORY_SIZE]int
-	registers [4]int // R0-R3
-	pc        int    // Program counter
-	program   []commands.Instruction
+	memory     *[commands.MEMORY_SIZE]int // Shared by the cores of a Machine
+	registers  [4]int                     // R0-R3
+	pc         int                        // Program counter
+	sp         int                        // Stack pointer, grows down from the top of memory
+	program    []commands.Instruction
+	script     *commands.Program // Assembled program with its source, for snapshots
+	scriptFile string            // File the script was loaded from
+	halted     bool              // Set once HALT or an error stops the program
+	fault      *Fault            // Error that stopped the program, if any
+	interrupts bool              // Whether pending interrupts are taken
+	pending    uint              // Pending interrupt lines, one bit per line
+
+	instPC  int                  // Address of the instruction being executed
+	inst    commands.Instruction // Instruction being executed
+	watches *WatchSet            // Active watchpoints, nil when none are set
+	history *History             // Undo log for reverse execution, nil when disabled
+	steps   uint64               // Number of instructions executed
+
+	observers []StepObserver // Notified after every instruction
+	record    StepRecord     // Record of the instruction being executed
+
+	bus         *Bus       // Memory-mapped devices, nil when none are attached
+	machine     *Machine   // Machine the CPU is a core of, nil for a single CPU
+	core        int        // Core number within the machine
+	stackFloor  int        // Lowest address the stack may grow to
+	stackTop    int        // Address above the stack, where it starts
+	costs       *CostTable // Timing model, nil when every instruction takes one cycle
+	cycles      uint64     // Cycles spent so far
+	memAccesses uint64     // Memory accesses made by the current instruction
+	memCycles   uint64     // Cycles the cache hierarchy charged for those accesses
+	jumped      bool       // Whether the current instruction transferred control
+
+	protection    *Protection       // Memory regions, nil when memory is unprotected
+	configRegions []commands.Region // Regions configured for the machine rather than the program
+	aborted       bool              // Set when the current instruction raised a protection or page fault
+	mmu           *MMU              // Address translation, nil when addresses are physical
+	user          bool              // Whether the CPU runs in user mode
+	syscalls      *SyscallTable     // Host system calls
+	exitStatus    int               // Status passed to the exit system call
+	exited        bool              // Whether the exit system call was made
+	cache         *Cache            // First cache level, nil when memory is accessed directly
+	engine        string            // Execution engine used by RunContext, see SetEngine
 }
 
 // Create new CPU instance
 func NewCPU() *CPU {
 	return &CPU{
-		pc: 0,
+		memory:     new([commands.MEMORY_SIZE]int),
+		pc:         0,
+		sp:         commands.MEMORY_SIZE,
+		stackFloor: STACK_FLOOR,
+		stackTop:   commands.MEMORY_SIZE,
+		costs:      DefaultCostTable(),
+		syscalls:   NewSyscallTable(stdin, os.Stdout),
 	}
 }
 
 // Load program into memory
 func (cpu *CPU) LoadProgram(instructions []commands.Instruction) {
 	cpu.program = instructions
+	cpu.halted = false
+	cpu.fault = nil
 }
 
 // Execute one instruction
 func (cpu *CPU) Execute(inst commands.Instruction) bool {
+	cpu.instPC = cpu.pc - 1 // Execute runs after the PC has moved past inst
+	cpu.inst = inst
+	if cpu.history != nil {
+		cpu.history.begin(cpu)
+	}
+	cpu.steps++
+	if cpu.observers != nil {
+		cpu.record = StepRecord{Step: cpu.steps, PC: cpu.instPC, Inst: inst, Changes: cpu.record.Changes[:0]}
+	}
+	cpu.memAccesses = 0
+	cpu.memCycles = 0
+	cpu.jumped = false
+	cpu.aborted = false
+	sp := cpu.sp
+
+	ok := cpu.execute(inst) && cpu.checkTransfer() && !cpu.aborted
+	if cpu.mmu != nil && cpu.mmu.fault != nil {
+		ok = cpu.trapPageFault(sp)
+	}
+
+	cost := cpu.instructionCost(inst)
+	cpu.cycles += cost
+	if cpu.observers != nil {
+		cpu.record.Cycles = cost
+		cpu.record.Jumped = cpu.jumped
+		for _, observer := range cpu.observers {
+			observer.ObserveStep(&cpu.record)
+		}
+	}
+	return ok
+}
+
+// execute carries out the effect of a single instruction.
+func (cpu *CPU) execute(inst commands.Instruction) bool {
+	if cpu.user && IsPrivileged(inst.Opcode) {
+		return cpu.privilegeFault(inst)
+	}
 	switch inst.Opcode {
 	case commands.LOAD:
-		cpu.registers[inst.Operands[0]] = inst.Operands[1]
+		cpu.setReg(inst.Operands[0], inst.Operands[1])
 	case commands.STORE:
-		cpu.memory[inst.Operands[1]] = cpu.registers[inst.Operands[0]]
+		cpu.writeMem(inst.Operands[1], cpu.reg(inst.Operands[0]))
+	case commands.LOADM:
+		cpu.setReg(inst.Operands[0], cpu.readMem(inst.Operands[1]))
+	case commands.CAS:
+		cpu.synchronize(inst.Operands[2])
+		old := cpu.readMem(inst.Operands[2])
+		if old == cpu.reg(inst.Operands[0]) {
+			cpu.writeMem(inst.Operands[2], cpu.reg(inst.Operands[1]))
+		}
+		cpu.setReg(inst.Operands[0], old)
+	case commands.XCHG:
+		cpu.synchronize(inst.Operands[1])
+		old := cpu.readMem(inst.Operands[1])
+		cpu.writeMem(inst.Operands[1], cpu.reg(inst.Operands[0]))
+		cpu.setReg(inst.Operands[0], old)
+	case commands.FENCE:
+		if cpu.machine != nil && cpu.machine.race != nil {
+			cpu.machine.race.fenced(cpu.core)
+		}
+	case commands.CORE:
+		cpu.setReg(inst.Operands[0], cpu.core)
+	case commands.SETPTB:
+		if cpu.mmu == nil {
+			return cpu.raise(FAULT_PAGE, cpu.instPC, "SETPTB needs an MMU (run with --mmu) on program counter %d", cpu.instPC)
+		}
+		if err := cpu.mmu.setBase(cpu.reg(inst.Operands[0])); err != nil {
+			return cpu.raise(FAULT_PAGE, cpu.instPC, "%v on program counter %d", err, cpu.instPC)
+		}
+	case commands.SYSCALL:
+		return cpu.syscall(inst.Operands[0])
+	case commands.USER:
+		cpu.user = true
+		cpu.pc = inst.Operands[0]
+		cpu.jumped = true
+	case commands.TLBFLUSH:
+		if cpu.mmu != nil {
+			cpu.mmu.tlb.flush()
+		}
 	case commands.ADD:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] + cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])+cpu.reg(inst.Operands[2]))
 	case commands.SUB:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] - cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])-cpu.reg(inst.Operands[2]))
 	case commands.MUL:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] * cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])*cpu.reg(inst.Operands[2]))
 	case commands.DIV:
-		if cpu.registers[inst.Operands[2]] == 0 {
-			utils.RED.Printf("Error: Division by zero on program counter %d\n", cpu.pc)
-			return false
+		if cpu.reg(inst.Operands[2]) == 0 {
+			return cpu.raise(FAULT_DIVISION_BY_ZERO, cpu.instPC, "Division by zero on program counter %d", cpu.pc)
 		}
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] / cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])/cpu.reg(inst.Operands[2]))
 	case commands.REM:
-		if cpu.registers[inst.Operands[2]] == 0 {
-			utils.RED.Println("Error: Division by zero")
-			return false
+		if cpu.reg(inst.Operands[2]) == 0 {
+			return cpu.raise(FAULT_DIVISION_BY_ZERO, cpu.instPC, "Division by zero")
 		}
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] % cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])%cpu.reg(inst.Operands[2]))
 	case commands.AND:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] & cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])&cpu.reg(inst.Operands[2]))
 	case commands.OR:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] | cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])|cpu.reg(inst.Operands[2]))
 	case commands.XOR:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] ^ cpu.registers[inst.Operands[2]]
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])^cpu.reg(inst.Operands[2]))
 	case commands.NOT:
-		cpu.registers[inst.Operands[0]] = ^cpu.registers[inst.Operands[1]]
+		cpu.setReg(inst.Operands[0], ^cpu.reg(inst.Operands[1]))
 	case commands.SHL:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] << uint(inst.Operands[2])
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])<<uint(cpu.reg(inst.Operands[2])))
 	case commands.SHR:
-		cpu.registers[inst.Operands[0]] = cpu.registers[inst.Operands[1]] >> uint(inst.Operands[2])
+		cpu.setReg(inst.Operands[0], cpu.reg(inst.Operands[1])>>uint(cpu.reg(inst.Operands[2])))
+	case commands.GT, commands.LT, commands.GTE, commands.LTE, commands.EQ, commands.NEQ:
+		cpu.setReg(inst.Operands[0], compare(inst.Opcode, cpu.reg(inst.Operands[1]), cpu.reg(inst.Operands[2])))
 	case commands.JMP:
 		cpu.pc = inst.Operands[0]
+		cpu.jumped = true
 		return true
 	case commands.JZ:
-		if cpu.registers[inst.Operands[0]] == 0 {
+		if cpu.reg(inst.Operands[0]) == 0 {
 			cpu.pc = inst.Operands[1]
+			cpu.jumped = true
+			cpu.record.Taken = true
 			return true
 		}
 	case commands.JNZ:
-		if cpu.registers[inst.Operands[0]] != 0 {
+		if cpu.reg(inst.Operands[0]) != 0 {
 			cpu.pc = inst.Operands[1]
+			cpu.jumped = true
+			cpu.record.Taken = true
 			return true
 		}
 	case commands.PRINT:
 		// Print a value from a register or memory
 		if inst.Operands[0] == -1 { //
-			utils.BLUE.Printf("Register R%d = %d\n", inst.Operands[1], cpu.registers[inst.Operands[1]])
-		} else {
-			utils.BLUE.Printf("Memory[%d] = %d\n", inst.Operands[0], cpu.memory[inst.Operands[0]])
+			utils.BLUE.Printf("%sRegister R%d = %d\n", cpu.outputPrefix(), inst.Operands[1], cpu.reg(inst.Operands[1]))
+		} else if val := cpu.readMem(inst.Operands[0]); !cpu.aborted {
+			utils.BLUE.Printf("%sMemory[%d] = %d\n", cpu.outputPrefix(), inst.Operands[0], val)
+		}
+	case commands.CALL:
+		if cpu.sp <= cpu.stackFloor {
+			return cpu.raise(FAULT_STACK, cpu.instPC, "Stack overflow on program counter %d", cpu.pc)
+		}
+		if !cpu.push(cpu.pc) {
+			return false
 		}
+		cpu.pc = inst.Operands[0]
+		cpu.jumped = true
+	case commands.RET:
+		if cpu.sp >= cpu.stackTop {
+			return cpu.raise(FAULT_STACK, cpu.instPC, "Stack underflow on program counter %d", cpu.pc)
+		}
+		pc, ok := cpu.pop()
+		if !ok {
+			return false
+		}
+		cpu.pc = pc
+		cpu.jumped = true
+	case commands.CYCLES:
+		cpu.setReg(inst.Operands[0], int(cpu.cycles))
+	case commands.EI:
+		cpu.interrupts = true
+	case commands.DI:
+		cpu.interrupts = false
+	case commands.IRET:
+		return cpu.returnFromInterrupt()
+	case commands.IRQ:
+		return cpu.interrupt(inst.Operands[0])
 	case commands.HALT:
 		return false
 	}
 	return true
 }
 
-func RunFile(cpu *CPU) {
+// compare evaluates a comparison opcode, returning 1 when it holds and 0 otherwise.
+func compare(opcode, a, b int) int {
+	var result bool
+	switch opcode {
+	case commands.GT:
+		result = a > b
+	case commands.LT:
+		result = a < b
+	case commands.GTE:
+		result = a >= b
+	case commands.LTE:
+		result = a <= b
+	case commands.EQ:
+		result = a == b
+	case commands.NEQ:
+		result = a != b
+	}
+	if result {
+		return 1
+	}
+	return 0
+}
+
+// reg reads a register on behalf of the executing instruction.
+func (cpu *CPU) reg(r int) int {
+	val := cpu.registers[r]
+	if cpu.watches != nil {
+		cpu.watches.check(cpu, true, r, val, val, false)
+	}
+	return val
+}
+
+// setReg writes a register on behalf of the executing instruction.
+func (cpu *CPU) setReg(r, val int) {
+	if cpu.aborted {
+		return
+	}
+	if cpu.watches != nil {
+		cpu.watches.check(cpu, true, r, cpu.registers[r], val, true)
+	}
+	if cpu.history != nil {
+		cpu.history.record(true, r, cpu.registers[r])
+	}
+	if cpu.observers != nil {
+		cpu.record.Changes = append(cpu.record.Changes, Change{true, r, cpu.registers[r], val})
+	}
+	cpu.registers[r] = val
+}
+
+// readMem reads a memory cell on behalf of the executing instruction.
+func (cpu *CPU) readMem(addr int) int {
+	addr, ok := cpu.translate(addr, false)
+	if !ok || !cpu.protect(addr, ACCESS_READ) {
+		return 0
+	}
+	return cpu.load(addr)
+}
+
+// writeMem writes a memory cell on behalf of the executing instruction.
+func (cpu *CPU) writeMem(addr, val int) {
+	addr, ok := cpu.translate(addr, true)
+	if ok && cpu.protectVectors(addr, ACCESS_WRITE) && cpu.protect(addr, ACCESS_WRITE) {
+		cpu.store(addr, val)
+	}
+}
+
+// load reads a memory cell once the access has been allowed.
+func (cpu *CPU) load(addr int) int {
+	cpu.access(addr, false)
+	cpu.checkRace(addr, false)
+	val := cpu.memory[addr]
+	if cpu.bus != nil {
+		if device, offset, ok := cpu.bus.lookup(addr); ok {
+			val = device.Read(offset)
+		}
+	}
+	if cpu.watches != nil {
+		cpu.watches.check(cpu, false, addr, val, val, false)
+	}
+	return val
+}
+
+// store writes a memory cell once the access has been allowed.
+func (cpu *CPU) store(addr, val int) {
+	cpu.access(addr, true)
+	cpu.checkRace(addr, true)
+	if cpu.watches != nil {
+		cpu.watches.check(cpu, false, addr, cpu.memory[addr], val, true)
+	}
+	if cpu.bus != nil {
+		if device, offset, ok := cpu.bus.lookup(addr); ok {
+			device.Write(offset, val) // Devices are not memory, so the write is not recorded
+			return
+		}
+	}
+	if cpu.history != nil {
+		cpu.history.record(false, addr, cpu.memory[addr])
+	}
+	if cpu.observers != nil {
+		cpu.record.Changes = append(cpu.record.Changes, Change{false, addr, cpu.memory[addr], val})
+	}
+	cpu.memory[addr] = val
+}
+
+// Step fetches and executes the instruction at the program counter, or enters
+// the handler of a pending interrupt instead.
+// It returns false once the program has halted, failed or run past its last instruction.
+func (cpu *CPU) Step() bool {
+	if cpu.halted || cpu.pc < 0 || cpu.pc >= len(cpu.program) {
+		return false
+	}
+	inst := cpu.program[cpu.pc]
+	if line, ok := cpu.pollInterrupts(); ok {
+		inst = commands.Instruction{Opcode: commands.IRQ, Operands: []int{line}}
+	}
+	cpu.pc++
+	if !cpu.Execute(inst) {
+		cpu.halted = true
+		return false
+	}
+	return true
+}
+
+// Run executes the loaded program until it stops.
+func (cpu *CPU) Run() {
+	cpu.RunContext(context.Background(), Limits{})
+}
 
-	filename := os.Args[1]
-	// Read and execute the script
+// loadScript reads and assembles the script in filename, reporting any error to the user.
+func loadScript(filename string, opts Options) (*commands.Program, bool) {
 	script, err := os.ReadFile(filename)
 	if err != nil {
 		utils.RED.Printf("Error reading file %s: %v\n", filename, err)
+		return nil, false
+	}
+	program, err := commands.Assemble(string(script), opts.parseOptions())
+	if err != nil {
+		utils.RED.Printf("Error parsing %v\n", err)
+		return nil, false
+	}
+	return program, true
+}
+
+// prepareProgram loads the program to run into cpu: the snapshot named by
+// opts.Resume, or else the script in filename. It returns the program and the
+// file it was assembled from, reporting any error to the user.
+func prepareProgram(cpu *CPU, filename string, opts Options) (*commands.Program, string, bool) {
+	if opts.Resume != "" {
+		program, err := RestoreFile(cpu, opts.Resume)
+		if err != nil {
+			utils.RED.Printf("Error restoring snapshot: %v\n", err)
+			return nil, "", false
+		}
+		return program, cpu.scriptFile, true
+	}
+	program, ok := loadScript(filename, opts)
+	if !ok {
+		return nil, "", false
+	}
+	if err := cpu.protectProgram(program); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return nil, "", false
+	}
+	cpu.LoadScript(program, filename)
+	return program, filename, true
+}
+
+// RunFile assembles the script in filename and runs it on cpu. When opts.Resume
+// names a snapshot, the program in the snapshot continues instead.
+func RunFile(cpu *CPU, filename string, opts Options) {
+	if opts.Cores > 1 {
+		if m := runMachine(filename, opts); m != nil {
+			cpu.exitStatus, cpu.exited = m.ExitStatus()
+		}
+		return
+	}
+	if !configureCPU(cpu, opts) {
+		return
+	}
+	program, filename, ok := prepareProgram(cpu, filename, opts)
+	if !ok || !loadMemoryIn(cpu, opts) {
 		return
 	}
 
-	// Parse the script into instructions
-	lines := strings.Split(string(script), "\n")
-	var instructions []commands.Instruction
-	for i, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, ";") { // Skip empty lines or comments
-			continue
+	if len(opts.Watches) > 0 {
+		watches := NewWatchSet()
+		if err := watches.AddSpecs(opts.Watches); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return
 		}
+		cpu.SetWatches(watches)
+	}
 
-		inst, err := commands.ParseInstruction(line)
+	if opts.Trace != "" {
+		tracer, closeTrace, err := openTrace(opts, program)
 		if err != nil {
-			utils.RED.Printf("Error parsing line %d: %v\n", i+1, err)
+			utils.RED.Printf("Error: %v\n", err)
 			return
 		}
-		instructions = append(instructions, inst)
+		defer closeTrace()
+		cpu.AddObserver(tracer)
 	}
 
-	// Load the instructions into the CPU and execute them
-	cpu.LoadProgram(instructions)
-	for cpu.pc < len(cpu.program) {
-		inst := cpu.program[cpu.pc]
-		cpu.pc++
-		if !cpu.Execute(inst) {
-			break
+	var profiler *Profiler
+	if opts.Profile {
+		profiler = NewProfiler(program)
+		cpu.AddObserver(profiler)
+	}
+
+	var pipeline *Pipeline
+	if opts.Pipeline != "" {
+		var err error
+		if pipeline, err = NewPipeline(opts.Pipeline, opts.PipelineDiagram); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return
+		}
+		cpu.AddObserver(pipeline)
+	}
+
+	var branches *BranchProfiler
+	if names := opts.predictors(); len(names) > 0 {
+		var err error
+		if branches, err = NewBranchProfiler(program, names, opts.MispredictPenalty); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return
+		}
+		cpu.AddObserver(branches)
+	}
+
+	var coverage *Coverage
+	if opts.coverageEnabled() {
+		coverage = NewCoverage(program, filename)
+		cpu.AddObserver(coverage)
+	}
+
+	// Execute the program. Ctrl-C stops a runaway program.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err := cpu.RunContext(ctx, Limits{MaxSteps: opts.MaxSteps, Timeout: opts.Timeout})
+
+	if stoppedEarly(err) {
+		utils.YELLOW.Println("Execution stopped.")
+	} else {
+		utils.GREEN.Println("Execution completed.")
+	}
+	printExitStatus(cpu.ExitStatus())
+	if opts.SaveSnapshot != "" {
+		if err := SaveSnapshot(cpu, opts.SaveSnapshot); err != nil {
+			utils.RED.Printf("Error saving snapshot: %v\n", err)
 		}
 	}
+	saveMemoryOut(cpu, opts)
+	if cpu.mmu != nil {
+		printTLB(cpu)
+	}
+	if cpu.cache != nil {
+		printCache(cpu)
+	}
+	if profiler != nil {
+		profiler.Report(os.Stdout)
+	}
+	if pipeline != nil {
+		pipeline.Diagram(os.Stdout)
+		pipeline.Report(os.Stdout)
+	}
+	if branches != nil {
+		branches.Report(os.Stdout)
+	}
+	if coverage != nil {
+		reportCoverage(coverage, opts)
+	}
+}
 
-	utils.GREEN.Println("Execution completed.")
+// readLine reads a line from in without its line ending. It returns false at
+// the end of input. Unlike a bufio.Scanner it reads nothing past the line, so
+// in can be shared with programs reading the same input.
+func readLine(in *bufio.Reader) (string, bool) {
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimRight(line, "\r\n"), true
 }
 
-func StartRepl(cpu *CPU) {
-	scanner := bufio.NewScanner(os.Stdin)
+// StartRepl reads instructions from standard input and executes them one at a time.
+func StartRepl(cpu *CPU, opts Options) {
 	utils.GREEN.Println("Tiny Assembly Interpreter")
 	utils.BLUE.Println("Type 'help' for commands, 'exit' to quit")
+	if !configureCPU(cpu, opts) || !loadMemoryIn(cpu, opts) {
+		return
+	}
+	defer saveMemoryOut(cpu, opts)
+	cpu.SetHistory(NewHistory(opts.HistorySize))
 
 	for {
 		utils.BLUE.Print("TinyASS > ")
-		if !scanner.Scan() {
+		line, ok := readLine(stdin)
+		if !ok {
 			break
 		}
 
-		line := scanner.Text()
-
-		switch strings.ToLower(line) {
+		switch strings.ToLower(strings.TrimSpace(line)) {
 		case "exit":
 			return
 		case "cls":
@@ -158,14 +562,30 @@ func StartRepl(cpu *CPU) {
 			printRegisters(cpu.registers)
 			continue
 		case "mem":
-			printMemory(cpu.memory)
+			printMemory(*cpu.memory)
+			continue
+		case "cycles":
+			printCycles(cpu)
+			continue
+		case "mmu":
+			printMMU(cpu)
+			continue
+		case "cache":
+			printCache(cpu)
 			continue
 		case "version":
 			utils.GREEN.Println("TinyASS version 1.0.0")
 			continue
 		}
 
-		inst, err := commands.ParseInstruction(strings.ToUpper(line))
+		if replHistoryCommand(cpu, strings.Fields(strings.ToLower(line))) {
+			continue
+		}
+		if _, ok := replSnapshotCommand(cpu, strings.Fields(line)); ok {
+			continue
+		}
+
+		inst, err := commands.ParseInstructionWithOptions(line, opts.parseOptions())
 		if err != nil {
 			utils.RED.Printf("Error: %v\n", err)
 			continue
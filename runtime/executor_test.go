@@ -41,8 +41,8 @@ func TestCPUExecute(t *testing.T) {
 		{
 			name:        "PRINT memory",
 			instruction: commands.Instruction{Opcode: commands.PRINT, Operands: []int{100}},
-			initialCPU:  CPU{memory: [commands.MEMORY_SIZE]int{100: 42}},
-			expectedCPU: CPU{memory: [commands.MEMORY_SIZE]int{100: 42}},
+			initialCPU:  CPU{memory: &[commands.MEMORY_SIZE]int{100: 42}},
+			expectedCPU: CPU{memory: &[commands.MEMORY_SIZE]int{100: 42}},
 		},
 	}
 
@@ -70,3 +70,51 @@ func TestCPULoadProgram(t *testing.T) {
 		}
 	}
 }
+
+func TestCPUCallAndReturn(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.CALL, Operands: []int{3}},
+		{Opcode: commands.LOAD, Operands: []int{1, 7}},
+		{Opcode: commands.HALT, Operands: []int{}},
+		{Opcode: commands.LOAD, Operands: []int{0, 5}},
+		{Opcode: commands.RET, Operands: []int{}},
+	})
+	cpu.Run()
+	if cpu.registers[0] != 5 || cpu.registers[1] != 7 {
+		t.Errorf("registers = %v, want R0 = 5 and R1 = 7", cpu.registers)
+	}
+	if cpu.sp != commands.MEMORY_SIZE {
+		t.Errorf("sp = %d, want %d", cpu.sp, commands.MEMORY_SIZE)
+	}
+	if cpu.Step() {
+		t.Errorf("Step() after HALT = true, want false")
+	}
+}
+
+func TestCPUComparisonsAndShifts(t *testing.T) {
+	tests := []struct {
+		name     string
+		opcode   int
+		a, b     int
+		expected int
+	}{
+		{"GT", commands.GT, 5, 3, 1},
+		{"GT", commands.GT, 3, 3, 0},
+		{"LT", commands.LT, 2, 3, 1},
+		{"GTE", commands.GTE, 3, 3, 1},
+		{"LTE", commands.LTE, 4, 3, 0},
+		{"EQ", commands.EQ, 7, 7, 1},
+		{"NEQ", commands.NEQ, 7, 7, 0},
+		{"SHL", commands.SHL, 3, 2, 12},
+		{"SHR", commands.SHR, 12, 2, 3},
+	}
+
+	for _, tt := range tests {
+		cpu := CPU{registers: [4]int{0, tt.a, tt.b, 0}}
+		cpu.Execute(commands.Instruction{Opcode: tt.opcode, Operands: []int{0, 1, 2}})
+		if cpu.registers[0] != tt.expected {
+			t.Errorf("%s %d %d = %d, want %d", tt.name, tt.a, tt.b, cpu.registers[0], tt.expected)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"tinyass/utils"
+)
+
+// Fault kinds
+const (
+	FAULT_DIVISION_BY_ZERO = iota // DIV or REM by zero
+	FAULT_STACK                   // Stack overflow or underflow
+	FAULT_LIMIT                   // Step or time limit exceeded
+	FAULT_CANCELLED               // Run cancelled by the caller or the user
+	FAULT_PROTECTION              // Access or jump not allowed by the memory regions
+	FAULT_PAGE                    // Page fault without a handler, or a misconfigured MMU
+	FAULT_PRIVILEGE               // Privileged instruction in user mode without a handler
+	FAULT_SYSCALL                 // Unknown system call or invalid arguments
+)
+
+// Number of instructions executed between checks for cancellation and timeouts
+const CANCEL_CHECK_INTERVAL = 1024
+
+// Fault is an error that stopped the CPU.
+type Fault struct {
+	Kind    int
+	PC      int    // Address of the instruction that faulted, or that was about to run
+	Step    uint64 // Instructions executed when the fault was raised
+	Message string
+}
+
+func (f *Fault) Error() string {
+	return f.Message
+}
+
+// Limits bounds how long a program may run. Zero values mean no limit.
+type Limits struct {
+	MaxSteps uint64
+	Timeout  time.Duration
+}
+
+// Fault returns the fault that stopped the CPU, or nil.
+func (cpu *CPU) Fault() *Fault {
+	return cpu.fault
+}
+
+// raise records a fault, reports it to the user and returns false so
+// instructions can stop execution with "return cpu.raise(...)".
+func (cpu *CPU) raise(kind int, pc int, format string, args ...interface{}) bool {
+	cpu.fault = &Fault{Kind: kind, PC: pc, Step: cpu.steps, Message: fmt.Sprintf(format, args...)}
+	utils.RED.Printf("Error: %s\n", cpu.fault.Message)
+	return false
+}
+
+// RunContext executes the loaded program until it stops, exceeds limits or ctx
+// is cancelled. It returns the fault that stopped the program, if any. Limit and
+// cancellation faults leave the CPU able to continue.
+func (cpu *CPU) RunContext(ctx context.Context, limits Limits) error {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	cpu.fault = nil
+
+	step := cpu.stepper()
+	var executed uint64
+	for {
+		if limits.MaxSteps > 0 && executed >= limits.MaxSteps && runnable(cpu) {
+			cpu.raise(FAULT_LIMIT, cpu.pc, "step limit of %d exceeded at pc 0x%02X after %d instructions",
+				limits.MaxSteps, cpu.pc, cpu.steps)
+			return cpu.fault
+		}
+		if executed%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				return cpu.cancelled(err, limits)
+			}
+		}
+		if !step() {
+			break
+		}
+		executed++
+	}
+	if cpu.fault != nil {
+		return cpu.fault
+	}
+	return nil
+}
+
+// cancelled raises the fault for a context that ended.
+func (cpu *CPU) cancelled(err error, limits Limits) error {
+	switch {
+	case !errors.Is(err, context.DeadlineExceeded):
+		cpu.raise(FAULT_CANCELLED, cpu.pc, "execution cancelled at pc 0x%02X after %d instructions", cpu.pc, cpu.steps)
+	case limits.Timeout > 0:
+		cpu.raise(FAULT_LIMIT, cpu.pc, "time limit of %v exceeded at pc 0x%02X after %d instructions",
+			limits.Timeout, cpu.pc, cpu.steps)
+	default:
+		cpu.raise(FAULT_LIMIT, cpu.pc, "deadline exceeded at pc 0x%02X after %d instructions", cpu.pc, cpu.steps)
+	}
+	return cpu.fault
+}
+
+// stoppedEarly reports whether err is a limit or cancellation fault, after
+// which the program could still continue.
+func stoppedEarly(err error) bool {
+	var fault *Fault
+	return errors.As(err, &fault) && (fault.Kind == FAULT_LIMIT || fault.Kind == FAULT_CANCELLED)
+}
@@ -0,0 +1,98 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"tinyass/commands"
+)
+
+func newLoopCPU() *CPU {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{1, 1}},
+		{Opcode: commands.ADD, Operands: []int{0, 0, 1}},
+		{Opcode: commands.JMP, Operands: []int{1}},
+	})
+	return cpu
+}
+
+func TestRunContextStepLimit(t *testing.T) {
+	cpu := newLoopCPU()
+	err := cpu.RunContext(context.Background(), Limits{MaxSteps: 100})
+
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != FAULT_LIMIT {
+		t.Fatalf("RunContext() error = %v, want a limit fault", err)
+	}
+	if fault.Step != 100 || fault.PC != 2 || cpu.Fault() != fault {
+		t.Errorf("fault = %+v, want step 100 at pc 2", fault)
+	}
+	if !stoppedEarly(err) {
+		t.Errorf("a limit fault should count as stopping early")
+	}
+
+	// The program can continue after a limit
+	if err := cpu.RunContext(context.Background(), Limits{MaxSteps: 10}); err == nil || cpu.steps != 110 {
+		t.Errorf("second run: error = %v, steps = %d, want a fault after 110 instructions", err, cpu.steps)
+	}
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	cpu := newLoopCPU()
+	start := time.Now()
+	err := cpu.RunContext(context.Background(), Limits{Timeout: 20 * time.Millisecond})
+
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != FAULT_LIMIT {
+		t.Fatalf("RunContext() error = %v, want a limit fault", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("timeout took %v to stop the program", elapsed)
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	cpu := newLoopCPU()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := cpu.RunContext(ctx, Limits{})
+
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != FAULT_CANCELLED || fault.Step != 0 {
+		t.Errorf("RunContext() error = %v, want a cancellation fault before the first instruction", err)
+	}
+}
+
+func TestRunContextFaults(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{0, 1}},
+		{Opcode: commands.DIV, Operands: []int{0, 0, 1}},
+		{Opcode: commands.HALT, Operands: []int{}},
+	})
+	err := cpu.RunContext(context.Background(), Limits{MaxSteps: 100})
+
+	var fault *Fault
+	if !errors.As(err, &fault) || fault.Kind != FAULT_DIVISION_BY_ZERO || fault.PC != 1 {
+		t.Errorf("RunContext() error = %v, want a division fault at pc 1", err)
+	}
+	if stoppedEarly(err) || !cpu.halted {
+		t.Errorf("a division fault should halt the program")
+	}
+
+	cpu = NewCPU()
+	cpu.LoadProgram([]commands.Instruction{{Opcode: commands.HALT, Operands: []int{}}})
+	if err := cpu.RunContext(context.Background(), Limits{MaxSteps: 1}); err != nil {
+		t.Errorf("RunContext() error = %v for a program that halts", err)
+	}
+
+	// Running off the end of the program within the limit is not a limit fault
+	cpu = NewCPU()
+	cpu.LoadProgram([]commands.Instruction{{Opcode: commands.LOAD, Operands: []int{0, 1}}})
+	if err := cpu.RunContext(context.Background(), Limits{MaxSteps: 1}); err != nil {
+		t.Errorf("RunContext() error = %v for a program that ends within the limit", err)
+	}
+}
@@ -0,0 +1,52 @@
+package runtime
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// assemble assembles source, failing the test on errors.
+func assemble(t *testing.T, source string) *commands.Program {
+	t.Helper()
+	program, err := commands.Assemble(source, commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+// assembleCPU creates a CPU with source loaded as the script "test.ass". Tests
+// enable the features they exercise on the returned CPU.
+func assembleCPU(t *testing.T, source string) *CPU {
+	t.Helper()
+	cpu := NewCPU()
+	cpu.LoadScript(assemble(t, source), "test.ass")
+	return cpu
+}
+
+// captureStdout returns what f writes to standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	defer func() {
+		w.Close()
+		os.Stdout = stdout
+	}()
+	f()
+	w.Close()
+	os.Stdout = stdout
+	return <-output
+}
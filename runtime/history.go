@@ -0,0 +1,213 @@
+package runtime
+
+import (
+	"fmt"
+	"strconv"
+
+	"tinyass/utils"
+)
+
+// Number of executed instructions remembered for reverse execution by default
+const DEFAULT_HISTORY_SIZE = 10000
+
+// undoChange is the previous value of a register or memory cell written by an instruction.
+type undoChange struct {
+	register bool
+	index    int
+	old      int
+}
+
+// undoEntry holds everything needed to revert a single executed instruction.
+type undoEntry struct {
+	steps   uint64 // Instruction count before the instruction ran
+	cycles  uint64 // Cycle count before the instruction ran
+	pc      int
+	sp      int
+	halted  bool
+	fault   *Fault
+	flags   int  // Flags word, see CPU.flags
+	pending uint // Pending interrupt lines
+	ptb     int  // Page-table base, see CPU.pageTableBase
+	changes []undoChange
+}
+
+// History is a bounded undo log of executed instructions. Once full, the
+// oldest entries are forgotten.
+type History struct {
+	entries []undoEntry // Ring buffer
+	start   int         // Index of the oldest entry
+	count   int
+}
+
+// NewHistory creates an undo log remembering at most size instructions. A
+// size of zero or less gives an empty log, which disables reverse execution.
+func NewHistory(size int) *History {
+	return &History{entries: make([]undoEntry, max(size, 0))}
+}
+
+// SetHistory enables reverse execution with the given undo log, or disables it when h is nil.
+func (cpu *CPU) SetHistory(h *History) {
+	if h != nil && len(h.entries) == 0 {
+		h = nil
+	}
+	cpu.history = h
+}
+
+// Len returns the number of instructions that can be undone.
+func (h *History) Len() int {
+	return h.count
+}
+
+// begin starts a new entry for the instruction about to execute.
+func (h *History) begin(cpu *CPU) {
+	idx := (h.start + h.count) % len(h.entries)
+	if h.count == len(h.entries) {
+		h.start = (h.start + 1) % len(h.entries)
+	} else {
+		h.count++
+	}
+	entry := &h.entries[idx]
+	entry.steps = cpu.steps
+	entry.cycles = cpu.cycles
+	entry.pc = cpu.pc - 1 // Execute runs after the PC has moved past the instruction
+	entry.sp = cpu.sp
+	entry.halted = cpu.halted
+	entry.fault = cpu.fault
+	entry.flags = cpu.flags()
+	entry.pending = cpu.pending
+	entry.ptb = cpu.pageTableBase()
+	entry.changes = entry.changes[:0]
+}
+
+// record remembers the old value of a location written by the current instruction.
+func (h *History) record(register bool, index, old int) {
+	if h.count == 0 {
+		return
+	}
+	entry := &h.entries[(h.start+h.count-1)%len(h.entries)]
+	entry.changes = append(entry.changes, undoChange{register, index, old})
+}
+
+// StepBack reverts the most recently executed instruction. It returns false
+// when there is no history left to undo.
+func (cpu *CPU) StepBack() bool {
+	h := cpu.history
+	if h == nil || h.count == 0 {
+		return false
+	}
+	h.count--
+	entry := &h.entries[(h.start+h.count)%len(h.entries)]
+	for i := len(entry.changes) - 1; i >= 0; i-- {
+		c := entry.changes[i]
+		if c.register {
+			cpu.registers[c.index] = c.old
+		} else {
+			cpu.memory[c.index] = c.old
+		}
+	}
+	cpu.steps = entry.steps
+	cpu.cycles = entry.cycles
+	cpu.pc = entry.pc
+	cpu.sp = entry.sp
+	cpu.halted = entry.halted
+	cpu.fault = entry.fault
+	cpu.setFlags(entry.flags)
+	cpu.pending = entry.pending
+	if cpu.mmu != nil {
+		cpu.mmu.setBase(entry.ptb)
+	}
+	return true
+}
+
+// oldestStep returns the earliest instruction count that can be rewound to.
+func (cpu *CPU) oldestStep() uint64 {
+	h := cpu.history
+	if h == nil || h.count == 0 {
+		return cpu.steps
+	}
+	return h.entries[h.start].steps
+}
+
+// GotoStep moves execution to the given instruction count, rewinding through the
+// history or running forward as needed.
+func (cpu *CPU) GotoStep(step uint64) error {
+	if step < cpu.oldestStep() {
+		return fmt.Errorf("instruction %d is no longer in the history (oldest is %d)", step, cpu.oldestStep())
+	}
+	for cpu.steps > step {
+		cpu.StepBack()
+	}
+	for cpu.steps < step {
+		if !cpu.Step() && cpu.steps < step {
+			return fmt.Errorf("program stopped after %d instructions", cpu.steps)
+		}
+	}
+	return nil
+}
+
+// replHistoryCommand handles the reverse execution commands of the REPL and
+// reports whether fields was one of them.
+func replHistoryCommand(cpu *CPU, fields []string) bool {
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "back":
+		count, ok := parseCount(fields[1:])
+		if !ok {
+			return true
+		}
+		for i := 0; i < count; i++ {
+			if !cpu.StepBack() {
+				utils.RED.Println("No more reverse-execution history")
+				break
+			}
+		}
+	case "reverse-continue", "rc":
+		for cpu.StepBack() {
+		}
+	case "goto":
+		if len(fields) != 2 {
+			utils.RED.Println("goto requires 1 operand\nExample: goto 12")
+			return true
+		}
+		step, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			utils.RED.Printf("Error: invalid instruction count: %s\n", fields[1])
+			return true
+		}
+		if err := cpu.GotoStep(step); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+		}
+	case "history":
+		printHistory(cpu)
+		return true
+	default:
+		return false
+	}
+	utils.GREY.Printf("At instruction %d\n", cpu.steps)
+	return true
+}
+
+// parseCount parses an optional repeat count argument, defaulting to 1.
+func parseCount(args []string) (int, bool) {
+	if len(args) == 0 {
+		return 1, true
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		utils.RED.Printf("Error: invalid count: %s\n", args[0])
+		return 0, false
+	}
+	return n, true
+}
+
+// printHistory shows the range of instruction counts that can be reached.
+func printHistory(cpu *CPU) {
+	if cpu.history == nil {
+		utils.GREY.Println("Reverse execution is disabled")
+		return
+	}
+	utils.GREEN.Printf("At instruction %d, history holds instructions %d to %d (limit %d)\n",
+		cpu.steps, cpu.oldestStep(), cpu.steps, len(cpu.history.entries))
+}
@@ -0,0 +1,100 @@
+package runtime
+
+import (
+	"testing"
+
+	"tinyass/commands"
+)
+
+func newHistoryCPU(size int) *CPU {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{0, 3}},
+		{Opcode: commands.LOAD, Operands: []int{1, 1}},
+		{Opcode: commands.STORE, Operands: []int{0, 0x10}},
+		{Opcode: commands.SUB, Operands: []int{0, 0, 1}},
+		{Opcode: commands.JNZ, Operands: []int{0, 2}},
+		{Opcode: commands.HALT, Operands: []int{}},
+	})
+	cpu.SetHistory(NewHistory(size))
+	return cpu
+}
+
+func TestStepBackRestoresState(t *testing.T) {
+	cpu := newHistoryCPU(DEFAULT_HISTORY_SIZE)
+	cpu.Run()
+	if cpu.steps != 12 || !cpu.halted {
+		t.Fatalf("program ran %d instructions, halted = %v", cpu.steps, cpu.halted)
+	}
+
+	// Undo HALT and the final JNZ, SUB and STORE
+	for i := 0; i < 4; i++ {
+		if !cpu.StepBack() {
+			t.Fatalf("StepBack() %d failed", i)
+		}
+	}
+	if cpu.halted || cpu.pc != 2 || cpu.steps != 8 {
+		t.Errorf("after 4 steps back: pc = %d, steps = %d, halted = %v", cpu.pc, cpu.steps, cpu.halted)
+	}
+	if cpu.registers[0] != 1 || cpu.memory[0x10] != 2 {
+		t.Errorf("after 4 steps back: R0 = %d, Memory[0x10] = %d, want 1 and 2", cpu.registers[0], cpu.memory[0x10])
+	}
+
+	for cpu.StepBack() {
+	}
+	if cpu.steps != 0 || cpu.pc != 0 || cpu.registers != [4]int{} || cpu.memory[0x10] != 0 {
+		t.Errorf("rewinding everything should restore the initial state, got pc = %d, registers = %v", cpu.pc, cpu.registers)
+	}
+}
+
+func TestHistoryIsBounded(t *testing.T) {
+	cpu := newHistoryCPU(5)
+	cpu.Run()
+	if cpu.history.Len() != 5 {
+		t.Errorf("history holds %d entries, want 5", cpu.history.Len())
+	}
+	if err := cpu.GotoStep(6); err == nil {
+		t.Errorf("GotoStep(6) should fail once the instruction has been forgotten")
+	}
+	if err := cpu.GotoStep(7); err != nil {
+		t.Fatalf("GotoStep(7) error = %v", err)
+	}
+	if cpu.steps != 7 || cpu.pc != 4 || cpu.registers[0] != 1 {
+		t.Errorf("after GotoStep(7): steps = %d, pc = %d, R0 = %d", cpu.steps, cpu.pc, cpu.registers[0])
+	}
+	if err := cpu.GotoStep(10); err != nil || cpu.steps != 10 {
+		t.Errorf("GotoStep(10) forward error = %v, steps = %d", err, cpu.steps)
+	}
+}
+
+func TestHistoryDisabled(t *testing.T) {
+	for _, size := range []int{0, -1} {
+		cpu := newHistoryCPU(size)
+		cpu.Run()
+		if cpu.history != nil || cpu.StepBack() {
+			t.Errorf("NewHistory(%d) should disable reverse execution", size)
+		}
+	}
+}
+
+func TestDebuggerReverseContinue(t *testing.T) {
+	d := newTestDebugger(t)
+	d.Exec("break show")
+	d.Exec("continue")
+	d.Exec("continue")
+	if d.cpu.registers[0] != 0 {
+		t.Fatalf("R0 = %d at the second breakpoint, want 0", d.cpu.registers[0])
+	}
+	d.Exec("reverse-continue")
+	if d.cpu.pc != 6 || d.cpu.registers[0] != 1 {
+		t.Errorf("reverse-continue stopped at pc %d with R0 = %d, want pc 6 and R0 = 1", d.cpu.pc, d.cpu.registers[0])
+	}
+	d.Exec("back 2")
+	if d.cpu.pc != 2 {
+		t.Errorf("pc after back 2 = %d, want 2", d.cpu.pc)
+	}
+	d.Exec("goto 0")
+	if d.cpu.pc != 0 || d.cpu.registers != [4]int{} {
+		t.Errorf("goto 0 should restore the initial state, pc = %d, registers = %v", d.cpu.pc, d.cpu.registers)
+	}
+}
@@ -0,0 +1,110 @@
+package runtime
+
+import (
+	"fmt"
+)
+
+// Interrupt controller layout
+const (
+	NUM_IRQ_LINES = 8    // Interrupt lines, numbered from 0 (highest priority)
+	VECTOR_TABLE  = 0xD0 // Memory cells holding the handler address of each line
+	TIMER_IRQ     = 0    // Line raised by the timer device
+)
+
+// Bits of the flags word pushed on the stack when an interrupt is taken
+const (
+	FLAG_INTERRUPTS_ENABLED = 1 << iota
+	FLAG_USER_MODE
+)
+
+// InterruptSource is a device that can raise interrupts. It is polled between instructions.
+type InterruptSource interface {
+	Device
+	// PollInterrupt returns the line to raise, and false when there is nothing to raise.
+	PollInterrupt() (int, bool)
+}
+
+// RaiseInterrupt marks an interrupt line as pending. The interrupt is taken
+// before the next instruction once interrupts are enabled.
+func (cpu *CPU) RaiseInterrupt(line int) error {
+	if line < 0 || line >= NUM_IRQ_LINES {
+		return fmt.Errorf("invalid interrupt line %d (lines are 0 to %d)", line, NUM_IRQ_LINES-1)
+	}
+	cpu.pending |= 1 << line
+	return nil
+}
+
+// InterruptsEnabled reports whether pending interrupts will be taken.
+func (cpu *CPU) InterruptsEnabled() bool {
+	return cpu.interrupts
+}
+
+// flags returns the flags word saved on the stack by an interrupt.
+func (cpu *CPU) flags() int {
+	flags := 0
+	if cpu.interrupts {
+		flags |= FLAG_INTERRUPTS_ENABLED
+	}
+	if cpu.user {
+		flags |= FLAG_USER_MODE
+	}
+	return flags
+}
+
+// setFlags restores a flags word saved by an interrupt.
+func (cpu *CPU) setFlags(flags int) {
+	cpu.interrupts = flags&FLAG_INTERRUPTS_ENABLED != 0
+	cpu.user = flags&FLAG_USER_MODE != 0
+}
+
+// pollInterrupts collects interrupts raised by devices and returns the pending
+// line to take now, if interrupts are enabled.
+func (cpu *CPU) pollInterrupts() (int, bool) {
+	if cpu.bus != nil {
+		for _, device := range cpu.bus.Devices() {
+			if source, ok := device.(InterruptSource); ok {
+				if line, raised := source.PollInterrupt(); raised {
+					cpu.RaiseInterrupt(line)
+				}
+			}
+		}
+	}
+	if !cpu.interrupts || cpu.pending == 0 {
+		return 0, false
+	}
+	for line := 0; line < NUM_IRQ_LINES; line++ {
+		if cpu.pending&(1<<line) != 0 {
+			return line, true
+		}
+	}
+	return 0, false
+}
+
+// interrupt enters the handler for a line like a trap, returning to the
+// interrupted instruction. The handler address is read from the vector table.
+func (cpu *CPU) interrupt(line int) bool {
+	if cpu.sp-2 < cpu.stackFloor {
+		return cpu.raise(FAULT_STACK, cpu.instPC, "Stack overflow taking interrupt %d on program counter %d", line, cpu.instPC)
+	}
+	cpu.pending &^= 1 << line
+	return cpu.trap(cpu.load(VECTOR_TABLE+line), cpu.instPC) // The vector table is read at its physical address
+}
+
+// returnFromInterrupt pops the flags and return address pushed by interrupt.
+func (cpu *CPU) returnFromInterrupt() bool {
+	if cpu.sp+2 > cpu.stackTop {
+		return cpu.raise(FAULT_STACK, cpu.instPC, "Stack underflow on program counter %d", cpu.pc)
+	}
+	flags, ok := cpu.pop()
+	if !ok {
+		return false
+	}
+	pc, ok := cpu.pop()
+	if !ok {
+		return false
+	}
+	cpu.setFlags(flags)
+	cpu.pc = pc
+	cpu.jumped = true
+	return true
+}
@@ -0,0 +1,121 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+
+	"tinyass/commands"
+)
+
+const tickScript = `
+    LOAD R0 tick
+    STORE R0 0xD0
+    LOAD R0 50
+    STORE R0 0xE3
+    LOAD R0 1
+    EI
+wait:
+    LOADM R1 0x40
+    LOAD R2 3
+    LT R2 R1 R2
+    JNZ R2 wait
+    HALT
+tick:
+    LOADM R3 0x40
+    ADD R3 R3 R0
+    STORE R3 0x40
+    IRET
+`
+
+func newTickCPU(t *testing.T) *CPU {
+	t.Helper()
+	cpu := assembleCPU(t, tickScript)
+	mapDevices(t, cpu)
+	cpu.bus.Map(0xE2, NewTimer(cpu))
+	return cpu
+}
+
+func TestTimerInterrupts(t *testing.T) {
+	cpu := newTickCPU(t)
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.memory[0x40] != 3 {
+		t.Errorf("ticks = %d, want 3", cpu.memory[0x40])
+	}
+	if cpu.sp != commands.MEMORY_SIZE || !cpu.InterruptsEnabled() {
+		t.Errorf("sp = %d, interrupts = %v, want the stack unwound and interrupts enabled", cpu.sp, cpu.interrupts)
+	}
+}
+
+func TestInterruptEntryAndReturn(t *testing.T) {
+	cpu := newTickCPU(t)
+	for cpu.pc != 6 { // Run the setup, up to the wait loop
+		cpu.Step()
+	}
+	cpu.RaiseInterrupt(2)
+	cpu.memory[VECTOR_TABLE+2] = 11 // tick
+	cpu.Step()
+	if cpu.pc != 11 || cpu.interrupts || cpu.pending != 0 {
+		t.Fatalf("after interrupt pc = %d, interrupts = %v, pending = %b", cpu.pc, cpu.interrupts, cpu.pending)
+	}
+	if cpu.memory[cpu.sp] != FLAG_INTERRUPTS_ENABLED || cpu.memory[cpu.sp+1] != 6 {
+		t.Errorf("stack = %v, want flags then the interrupted pc", cpu.memory[cpu.sp:])
+	}
+
+	// Taking the interrupt can be undone
+	steps := cpu.steps
+	cpu.SetHistory(NewHistory(10))
+	cpu.RaiseInterrupt(2)
+	cpu.pc, cpu.interrupts = 6, true
+	cpu.Step()
+	cpu.StepBack()
+	if cpu.pc != 6 || !cpu.interrupts || cpu.pending&(1<<2) == 0 || cpu.steps != steps {
+		t.Errorf("after StepBack pc = %d, interrupts = %v, pending = %b", cpu.pc, cpu.interrupts, cpu.pending)
+	}
+}
+
+func TestInterruptsDisabled(t *testing.T) {
+	cpu := newTickCPU(t)
+	cpu.program[5] = commands.Instruction{Opcode: commands.DI, Operands: []int{}} // Replace EI
+	cpu.RaiseInterrupt(0)
+	cpu.RunContext(context.Background(), Limits{MaxSteps: 200})
+	if cpu.memory[0x40] != 0 || cpu.pending&1 == 0 {
+		t.Errorf("interrupts were taken while disabled")
+	}
+	if err := cpu.RaiseInterrupt(NUM_IRQ_LINES); err == nil {
+		t.Errorf("RaiseInterrupt() should reject invalid lines")
+	}
+}
+
+func TestIRETStackUnderflow(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{{Opcode: commands.IRET, Operands: []int{}}})
+	cpu.Run()
+	if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_STACK {
+		t.Errorf("fault = %v, want a stack fault", cpu.Fault())
+	}
+}
+
+func TestStackStopsAboveVectors(t *testing.T) {
+	for _, engine := range []string{ENGINE_INTERPRETER, ENGINE_COMPILED} {
+		cpu := assembleCPU(t, "LOAD R0 0x02\nSTORE R0 0xDD\nrecurse:\nCALL recurse")
+		cpu.SetEngine(engine)
+		cpu.Run()
+		if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_STACK || cpu.sp != STACK_FLOOR || cpu.memory[SYSCALL_NUMBER] != 2 {
+			t.Errorf("%s: fault = %v with sp = 0x%02X and 0xDD = %d, want a stack overflow above the vectors",
+				engine, cpu.Fault(), cpu.sp, cpu.memory[SYSCALL_NUMBER])
+		}
+	}
+
+	// An interrupt needs two free cells
+	cpu := assembleCPU(t, "LOAD R0 0x01\nSTORE R0 0xD0")
+	cpu.sp = STACK_FLOOR + 1
+	cpu.interrupts = true
+	cpu.RaiseInterrupt(0)
+	cpu.Run()
+	if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_STACK || cpu.sp != STACK_FLOOR+1 {
+		t.Errorf("fault = %v with sp = 0x%02X, want a stack overflow taking the interrupt", cpu.Fault(), cpu.sp)
+	}
+}
@@ -0,0 +1,331 @@
+package runtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Machine limits and stack layout
+const (
+	MAX_CORES       = 4
+	CORE_STACK_SIZE = 8            // Cells reserved for the stack of each core
+	CORE_STACK_TOP  = VECTOR_TABLE // Address above the stack of core 0, the next cores' stacks follow below
+)
+
+// Scheduling modes
+const (
+	SCHEDULE_SEEDED     = "seeded"     // One core at a time, chosen by a seeded random number generator
+	SCHEDULE_GOROUTINES = "goroutines" // Every core in its own goroutine
+)
+
+// Machine is a set of cores sharing one memory. Each core has its own registers,
+// program counter and stack; devices and the timing model are shared as well.
+type Machine struct {
+	Cores  []*CPU
+	memory *[commands.MEMORY_SIZE]int
+	mu     sync.Mutex    // Held while a core executes an instruction in goroutine mode
+	race   *RaceDetector // Nil unless race detection is enabled
+	fault  *Fault        // Limit or cancellation that stopped the machine
+}
+
+// NewMachine creates a machine with the given number of cores. Their stacks
+// lie below the vectors, away from the devices at the top of memory.
+func NewMachine(cores int) (*Machine, error) {
+	if cores < 1 || cores > MAX_CORES {
+		return nil, fmt.Errorf("invalid number of cores %d (1 to %d)", cores, MAX_CORES)
+	}
+	m := &Machine{memory: new([commands.MEMORY_SIZE]int)}
+	for i := 0; i < cores; i++ {
+		cpu := NewCPU()
+		cpu.memory = m.memory
+		cpu.stackTop = CORE_STACK_TOP - i*CORE_STACK_SIZE
+		cpu.stackFloor = cpu.stackTop - CORE_STACK_SIZE
+		cpu.sp = cpu.stackTop
+		cpu.core = i
+		cpu.machine = m
+		m.Cores = append(m.Cores, cpu)
+	}
+	return m, nil
+}
+
+// share gives every core the cost table, device bus and memory protection of the
+// first core, and an MMU and caches like the first core's. Each core has its own
+// page-table base, TLB and private caches.
+func (m *Machine) share() {
+	first := m.Cores[0]
+	for _, cpu := range m.Cores[1:] {
+		cpu.costs = first.costs
+		cpu.bus = first.bus
+		cpu.protection = first.protection
+		cpu.user = first.user
+		if first.cache != nil {
+			cpu.cache, _ = NewCacheHierarchy(first.cache.configs())
+		}
+		if first.mmu != nil {
+			cpu.mmu, _ = NewMMU(len(first.mmu.tlb.entries))
+		}
+	}
+}
+
+// LoadScript loads the same program into every core.
+func (m *Machine) LoadScript(program *commands.Program, file string) {
+	for _, cpu := range m.Cores {
+		cpu.LoadScript(program, file)
+	}
+}
+
+// EnableRaceDetector starts recording races between plain memory accesses of different cores.
+func (m *Machine) EnableRaceDetector() {
+	m.race = NewRaceDetector(len(m.Cores))
+}
+
+// Races returns the data races detected so far.
+func (m *Machine) Races() []Race {
+	if m.race == nil {
+		return nil
+	}
+	return m.race.races
+}
+
+// Steps returns the number of instructions executed by all cores.
+func (m *Machine) Steps() uint64 {
+	var steps uint64
+	for _, cpu := range m.Cores {
+		steps += cpu.steps
+	}
+	return steps
+}
+
+// runnable reports whether a core can execute another instruction.
+func runnable(cpu *CPU) bool {
+	return !cpu.halted && cpu.pc >= 0 && cpu.pc < len(cpu.program)
+}
+
+// Run executes every core until all have stopped, the limits are exceeded or ctx is
+// cancelled. It returns the first fault, if any.
+func (m *Machine) Run(ctx context.Context, limits Limits, schedule string, seed int64) error {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+	m.fault = nil
+
+	switch schedule {
+	case SCHEDULE_SEEDED, "":
+		m.runSeeded(ctx, limits, seed)
+	case SCHEDULE_GOROUTINES:
+		m.runGoroutines(ctx, limits)
+	default:
+		return fmt.Errorf("unknown schedule: %s (use seeded or goroutines)", schedule)
+	}
+
+	if m.fault != nil {
+		return m.fault
+	}
+	for _, cpu := range m.Cores {
+		if cpu.fault != nil {
+			return cpu.fault
+		}
+	}
+	return nil
+}
+
+// runSeeded interleaves the cores one instruction at a time. The same seed
+// always produces the same interleaving.
+func (m *Machine) runSeeded(ctx context.Context, limits Limits, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	ready := make([]*CPU, 0, len(m.Cores))
+	var executed uint64
+	for {
+		ready = ready[:0]
+		for _, cpu := range m.Cores {
+			if runnable(cpu) {
+				ready = append(ready, cpu)
+			}
+		}
+		if len(ready) == 0 {
+			return
+		}
+		if limits.MaxSteps > 0 && executed >= limits.MaxSteps {
+			m.stop(FAULT_LIMIT, "step limit of %d exceeded after %d instructions", limits.MaxSteps, m.Steps())
+			return
+		}
+		if executed%CANCEL_CHECK_INTERVAL == 0 {
+			if err := ctx.Err(); err != nil {
+				m.cancelled(err, limits)
+				return
+			}
+		}
+		ready[rng.Intn(len(ready))].Step()
+		executed++
+	}
+}
+
+// runGoroutines runs every core in its own goroutine. Instructions execute one
+// at a time, so each is atomic, but the interleaving is up to the Go scheduler.
+func (m *Machine) runGoroutines(ctx context.Context, limits Limits) {
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var executed atomic.Uint64
+	var limitHit atomic.Bool
+	var wg sync.WaitGroup
+	for _, cpu := range m.Cores {
+		wg.Add(1)
+		go func(cpu *CPU) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				if n%CANCEL_CHECK_INTERVAL == 0 && ctx.Err() != nil {
+					return
+				}
+				m.mu.Lock()
+				if !runnable(cpu) {
+					m.mu.Unlock()
+					return
+				}
+				if limits.MaxSteps > 0 && executed.Add(1) > limits.MaxSteps {
+					m.mu.Unlock()
+					limitHit.Store(true)
+					cancel()
+					return
+				}
+				cpu.Step()
+				m.mu.Unlock()
+			}
+		}(cpu)
+	}
+	wg.Wait()
+
+	switch {
+	case limitHit.Load():
+		m.stop(FAULT_LIMIT, "step limit of %d exceeded after %d instructions", limits.MaxSteps, m.Steps())
+	case parent.Err() != nil:
+		m.cancelled(parent.Err(), limits)
+	}
+}
+
+// stop records a fault that stopped the whole machine and reports it to the user.
+func (m *Machine) stop(kind int, format string, args ...interface{}) {
+	m.fault = &Fault{Kind: kind, PC: -1, Step: m.Steps(), Message: fmt.Sprintf(format, args...)}
+	utils.RED.Printf("Error: %s\n", m.fault.Message)
+}
+
+// cancelled stops the machine for a context that ended.
+func (m *Machine) cancelled(err error, limits Limits) {
+	switch {
+	case !errors.Is(err, context.DeadlineExceeded):
+		m.stop(FAULT_CANCELLED, "execution cancelled after %d instructions", m.Steps())
+	case limits.Timeout > 0:
+		m.stop(FAULT_LIMIT, "time limit of %v exceeded after %d instructions", limits.Timeout, m.Steps())
+	default:
+		m.stop(FAULT_LIMIT, "deadline exceeded after %d instructions", m.Steps())
+	}
+}
+
+// outputPrefix labels the output of a core when several cores share the console.
+func (cpu *CPU) outputPrefix() string {
+	if cpu.machine == nil || len(cpu.machine.Cores) < 2 {
+		return ""
+	}
+	return fmt.Sprintf("Core %d: ", cpu.core)
+}
+
+// isAtomic reports whether opcode accesses memory atomically.
+func isAtomic(opcode int) bool {
+	return opcode == commands.CAS || opcode == commands.XCHG
+}
+
+// checkRace reports a plain memory access to the race detector, if enabled.
+func (cpu *CPU) checkRace(addr int, write bool) {
+	if cpu.machine != nil && cpu.machine.race != nil && !isAtomic(cpu.inst.Opcode) {
+		cpu.machine.race.access(cpu.core, cpu.instPC, addr, write)
+	}
+}
+
+// synchronize orders an atomic instruction on addr for the race detector, if enabled.
+func (cpu *CPU) synchronize(addr int) {
+	if cpu.machine != nil && cpu.machine.race != nil {
+		cpu.machine.race.synchronize(cpu.core, addr)
+	}
+}
+
+// ExitStatus returns the status passed to the exit system call by any core, and
+// false if no core called it.
+func (m *Machine) ExitStatus() (int, bool) {
+	for _, cpu := range m.Cores {
+		if status, ok := cpu.ExitStatus(); ok {
+			return status, true
+		}
+	}
+	return 0, false
+}
+
+// runMachine assembles the script in filename and runs it on opts.Cores cores.
+// It returns the machine, or nil when it could not be started.
+func runMachine(filename string, opts Options) *Machine {
+	if opts.Trace != "" || opts.Profile || opts.Pipeline != "" || len(opts.Predictors) > 0 || opts.coverageEnabled() || len(opts.Watches) > 0 ||
+		opts.Resume != "" || opts.SaveSnapshot != "" {
+		utils.RED.Println("Error: tracing, profiling, the pipeline model, branch prediction, coverage, watchpoints and snapshots need a single core")
+		return nil
+	}
+	m, err := NewMachine(opts.Cores)
+	if err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return nil
+	}
+	program, ok := loadScript(filename, opts)
+	if !ok || !configureCPU(m.Cores[0], opts) || !loadMemoryIn(m.Cores[0], opts) {
+		return nil
+	}
+	if err := m.Cores[0].protectProgram(program); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return nil
+	}
+	m.share()
+	m.LoadScript(program, filename)
+	if opts.Race {
+		m.EnableRaceDetector()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	err = m.Run(ctx, Limits{MaxSteps: opts.MaxSteps, Timeout: opts.Timeout}, opts.Schedule, opts.Seed)
+	var fault *Fault
+	if err != nil && !errors.As(err, &fault) {
+		utils.RED.Printf("Error: %v\n", err)
+		return nil
+	}
+
+	if stoppedEarly(err) {
+		utils.YELLOW.Println("Execution stopped.")
+	} else {
+		utils.GREEN.Println("Execution completed.")
+	}
+	for _, race := range m.Races() {
+		utils.YELLOW.Println(race.Describe(program))
+	}
+	if opts.Race {
+		utils.GREEN.Printf("%d data race(s) detected\n", len(m.Races()))
+	}
+	for _, cpu := range m.Cores {
+		if cpu.mmu != nil {
+			printTLB(cpu)
+		}
+		if cpu.cache != nil {
+			printCache(cpu)
+		}
+	}
+	printExitStatus(m.ExitStatus())
+	saveMemoryOut(m.Cores[0], opts)
+	return m
+}
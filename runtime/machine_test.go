@@ -0,0 +1,152 @@
+package runtime
+
+import (
+	"context"
+	"testing"
+)
+
+// Each core adds 1 to the counter at 0x40 ten times, taking the lock at 0x41 with CAS.
+const lockedCounterScript = `
+    LOAD R3 10
+again:
+    LOAD R0 0
+    LOAD R1 1
+    CAS R0 R1 0x41
+    JNZ R0 again
+    LOADM R2 0x40
+    ADD R2 R2 R1
+    STORE R2 0x40
+    LOAD R0 0
+    XCHG R0 0x41
+    SUB R3 R3 R1
+    JNZ R3 again
+`
+
+// The same without the lock.
+const racyCounterScript = `
+    LOAD R3 10
+    LOAD R1 1
+again:
+    LOADM R2 0x40
+    ADD R2 R2 R1
+    STORE R2 0x40
+    SUB R3 R3 R1
+    JNZ R3 again
+`
+
+func newTestMachine(t *testing.T, cores int, source string) *Machine {
+	t.Helper()
+	m, err := NewMachine(cores)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.LoadScript(assemble(t, source), "test.ass")
+	m.EnableRaceDetector()
+	return m
+}
+
+func TestMachineLockedCounter(t *testing.T) {
+	for _, schedule := range []string{SCHEDULE_SEEDED, SCHEDULE_GOROUTINES} {
+		m := newTestMachine(t, 4, lockedCounterScript)
+		if err := m.Run(context.Background(), Limits{MaxSteps: 100000}, schedule, 7); err != nil {
+			t.Fatalf("%s: Run() error = %v", schedule, err)
+		}
+		if m.memory[0x40] != 40 || m.memory[0x41] != 0 {
+			t.Errorf("%s: counter = %d, lock = %d, want 40 and 0", schedule, m.memory[0x40], m.memory[0x41])
+		}
+		if races := m.Races(); len(races) != 0 {
+			t.Errorf("%s: unexpected races: %v", schedule, races)
+		}
+	}
+}
+
+func TestMachineRacyCounter(t *testing.T) {
+	run := func(seed int64) int {
+		m := newTestMachine(t, 2, racyCounterScript)
+		m.Run(context.Background(), Limits{}, SCHEDULE_SEEDED, seed)
+		races := m.Races()
+		if len(races) != 1 || races[0].Addr != 0x40 || races[0].First.Core == races[0].Second.Core {
+			t.Errorf("races = %v, want one race on 0x40 between the cores", races)
+		}
+		return m.memory[0x40]
+	}
+	if first, second := run(3), run(3); first != second {
+		t.Errorf("the same seed gave counters %d and %d", first, second)
+	}
+}
+
+func TestMachineCores(t *testing.T) {
+	m := newTestMachine(t, 3, "CORE R0\nCALL 0x03\nHALT\nCORE R1\nRET\n")
+	m.Run(context.Background(), Limits{}, SCHEDULE_SEEDED, 1)
+	for i, cpu := range m.Cores {
+		if cpu.registers[0] != i || cpu.registers[1] != i {
+			t.Errorf("core %d registers = %v", i, cpu.registers)
+		}
+		if cpu.sp != CORE_STACK_TOP-i*CORE_STACK_SIZE {
+			t.Errorf("core %d sp = %d", i, cpu.sp)
+		}
+	}
+	if m.memory[CORE_STACK_TOP-1] != 2 || m.memory[CORE_STACK_TOP-1-CORE_STACK_SIZE] != 2 {
+		t.Errorf("return addresses should be pushed on separate stacks")
+	}
+
+	if _, err := NewMachine(MAX_CORES + 1); err == nil {
+		t.Errorf("NewMachine() should reject too many cores")
+	}
+	if err := m.Run(context.Background(), Limits{}, "round-robin", 1); err == nil {
+		t.Errorf("Run() should reject unknown schedules")
+	}
+}
+
+func TestMachineStackOverflow(t *testing.T) {
+	// Core 0 recurses, core 1 calls a subroutine that halts
+	m := newTestMachine(t, 2, "CORE R0\nJZ R0 recurse\nCALL done\nHALT\nrecurse:\nCALL recurse\ndone:\nHALT\n")
+	m.Run(context.Background(), Limits{}, SCHEDULE_SEEDED, 1)
+	first := m.Cores[0]
+	if first.fault == nil || first.fault.Kind != FAULT_STACK || first.sp != CORE_STACK_TOP-CORE_STACK_SIZE {
+		t.Errorf("core 0 fault = %v with sp = %d, want a stack overflow once its stack is full", first.fault, first.sp)
+	}
+	if m.memory[CORE_STACK_TOP-1-CORE_STACK_SIZE] != 3 {
+		t.Errorf("the return address of core 1 was overwritten with %d", m.memory[CORE_STACK_TOP-1-CORE_STACK_SIZE])
+	}
+
+	// Core 1 returns without a call instead of popping the stack of core 0
+	m = newTestMachine(t, 2, "CORE R0\nJZ R0 wait\nRET\nwait:\nCALL wait")
+	m.Run(context.Background(), Limits{MaxSteps: 20}, SCHEDULE_SEEDED, 1)
+	if fault := m.Cores[1].fault; fault == nil || fault.Kind != FAULT_STACK || m.Cores[1].sp != CORE_STACK_TOP-CORE_STACK_SIZE {
+		t.Errorf("core 1 fault = %v with sp = %d, want a stack underflow", fault, m.Cores[1].sp)
+	}
+
+	// The stacks of all cores stay clear of the vectors and the devices
+	m = newTestMachine(t, MAX_CORES, "HALT")
+	for i, cpu := range m.Cores {
+		if cpu.stackFloor < 0 || cpu.stackTop > VECTOR_TABLE {
+			t.Errorf("core %d stack 0x%02X-0x%02X overlaps the vectors or devices", i, cpu.stackFloor, cpu.stackTop-1)
+		}
+	}
+}
+
+func TestMachineStepLimit(t *testing.T) {
+	m := newTestMachine(t, 2, "loop:\nJMP loop\n")
+	err := m.Run(context.Background(), Limits{MaxSteps: 50}, SCHEDULE_GOROUTINES, 1)
+	if !stoppedEarly(err) || m.Steps() != 50 {
+		t.Errorf("Run() error = %v after %d instructions, want a limit fault after 50", err, m.Steps())
+	}
+}
+
+func TestRaceDetectorFence(t *testing.T) {
+	d := NewRaceDetector(2)
+	d.access(0, 0, 0x10, true)
+	d.fenced(0)
+	d.fenced(1)
+	d.access(1, 0, 0x10, false)
+	if len(d.races) != 0 {
+		t.Errorf("accesses ordered by fences reported as a race: %v", d.races)
+	}
+
+	d.access(1, 1, 0x11, true)
+	d.access(0, 1, 0x11, false)
+	if len(d.races) != 1 || d.races[0].Addr != 0x11 || !d.races[0].First.Write {
+		t.Errorf("races = %v, want a write/read race on 0x11", d.races)
+	}
+}
@@ -0,0 +1,317 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"tinyass/utils"
+)
+
+// Memory image formats. Every format stores one byte per memory cell, so only
+// memory holding values 0-255 can be saved.
+const (
+	MEMIMAGE_RAW  = "raw"  // Bytes in address order
+	MEMIMAGE_DUMP = "dump" // Text hex dump, 16 cells per line
+	MEMIMAGE_IHEX = "ihex" // Intel HEX records
+)
+
+// Cells per line of a hex dump and per Intel HEX data record
+const MEMIMAGE_LINE = 16
+
+// ImageFormat returns the format named by format, or the format implied by the
+// extension of path when format is empty.
+func ImageFormat(path, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case MEMIMAGE_RAW, MEMIMAGE_DUMP, MEMIMAGE_IHEX:
+		return strings.ToLower(format), nil
+	case "":
+	default:
+		return "", fmt.Errorf("unknown memory image format: %s (use raw, dump or ihex)", format)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".hex", ".ihex", ".ihx":
+		return MEMIMAGE_IHEX, nil
+	case ".txt", ".dump":
+		return MEMIMAGE_DUMP, nil
+	}
+	return MEMIMAGE_RAW, nil
+}
+
+// Number of out-of-range cells named by the error of WriteMemoryImage
+const MEMIMAGE_MAX_REPORTED = 4
+
+// WriteMemoryImage writes memory to w in the given format. It fails without
+// writing anything when a cell holds a value that does not fit in a byte.
+func WriteMemoryImage(w io.Writer, memory []int, format string) error {
+	if err := checkImageValues(memory); err != nil {
+		return err
+	}
+	switch format {
+	case MEMIMAGE_RAW:
+		data := make([]byte, len(memory))
+		for i, val := range memory {
+			data[i] = byte(val)
+		}
+		_, err := w.Write(data)
+		return err
+	case MEMIMAGE_DUMP:
+		return writeHexDump(w, memory)
+	case MEMIMAGE_IHEX:
+		return writeIntelHex(w, memory)
+	}
+	return fmt.Errorf("unknown memory image format: %s", format)
+}
+
+// checkImageValues reports the cells whose values do not fit in a byte.
+func checkImageValues(memory []int) error {
+	var cells []string
+	count := 0
+	for addr, val := range memory {
+		if val < 0 || val > 0xFF {
+			if count++; count <= MEMIMAGE_MAX_REPORTED {
+				cells = append(cells, fmt.Sprintf("0x%02X = %d", addr, val))
+			}
+		}
+	}
+	if count == 0 {
+		return nil
+	}
+	if count > MEMIMAGE_MAX_REPORTED {
+		cells = append(cells, fmt.Sprintf("and %d more", count-MEMIMAGE_MAX_REPORTED))
+	}
+	return fmt.Errorf("%d cells do not fit in a byte: %s", count, strings.Join(cells, ", "))
+}
+
+// ReadMemoryImage reads an image in the given format into memory. Cells the
+// image does not cover keep their values.
+func ReadMemoryImage(r io.Reader, memory []int, format string) error {
+	switch format {
+	case MEMIMAGE_RAW:
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if len(data) > len(memory) {
+			return fmt.Errorf("image has %d bytes, memory has %d cells", len(data), len(memory))
+		}
+		for i, b := range data {
+			memory[i] = int(b)
+		}
+		return nil
+	case MEMIMAGE_DUMP:
+		return readHexDump(r, memory)
+	case MEMIMAGE_IHEX:
+		return readIntelHex(r, memory)
+	}
+	return fmt.Errorf("unknown memory image format: %s", format)
+}
+
+// writeHexDump writes lines of the form "0x10: 48 69 00 ...  |Hi.|".
+func writeHexDump(w io.Writer, memory []int) error {
+	bw := bufio.NewWriter(w)
+	for start := 0; start < len(memory); start += MEMIMAGE_LINE {
+		end := min(start+MEMIMAGE_LINE, len(memory))
+		fmt.Fprintf(bw, "0x%02X:", start)
+		text := make([]byte, 0, MEMIMAGE_LINE)
+		for _, val := range memory[start:end] {
+			b := byte(val)
+			fmt.Fprintf(bw, " %02X", b)
+			if b < 0x20 || b > 0x7E {
+				b = '.'
+			}
+			text = append(text, b)
+		}
+		fmt.Fprintf(bw, "  |%s|\n", text)
+	}
+	return bw.Flush()
+}
+
+// readHexDump reads lines written by writeHexDump. The text column is optional
+// and blank lines and ';' comments are ignored.
+func readHexDump(r io.Reader, memory []int) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexAny(text, "|;"); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		addrText, bytesText, ok := strings.Cut(text, ":")
+		if !ok {
+			return fmt.Errorf("line %d: expected an address followed by ':'", line)
+		}
+		addr, err := strconv.ParseUint(trimHexPrefix(strings.TrimSpace(addrText)), 16, 32)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid address: %s", line, strings.TrimSpace(addrText))
+		}
+		for _, field := range strings.Fields(bytesText) {
+			b, err := strconv.ParseUint(field, 16, 8)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid byte: %s", line, field)
+			}
+			if int(addr) >= len(memory) {
+				return fmt.Errorf("line %d: address 0x%02X is outside memory", line, addr)
+			}
+			memory[addr] = int(b)
+			addr++
+		}
+	}
+	return scanner.Err()
+}
+
+// trimHexPrefix removes a 0x or 0X prefix.
+func trimHexPrefix(s string) string {
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return s[2:]
+	}
+	return s
+}
+
+// Intel HEX record types
+const (
+	IHEX_DATA = 0x00
+	IHEX_EOF  = 0x01
+)
+
+// writeIntelHex writes memory as data records followed by an end-of-file record.
+func writeIntelHex(w io.Writer, memory []int) error {
+	bw := bufio.NewWriter(w)
+	for start := 0; start < len(memory); start += MEMIMAGE_LINE {
+		end := min(start+MEMIMAGE_LINE, len(memory))
+		data := make([]byte, 0, MEMIMAGE_LINE)
+		for _, val := range memory[start:end] {
+			data = append(data, byte(val))
+		}
+		writeIntelHexRecord(bw, start, IHEX_DATA, data)
+	}
+	writeIntelHexRecord(bw, 0, IHEX_EOF, nil)
+	return bw.Flush()
+}
+
+// writeIntelHexRecord writes one ":LLAAAATT<data>CC" record.
+func writeIntelHexRecord(w io.Writer, addr, kind int, data []byte) {
+	record := []byte{byte(len(data)), byte(addr >> 8), byte(addr), byte(kind)}
+	record = append(record, data...)
+	fmt.Fprintf(w, ":%X%02X\n", record, intelHexChecksum(record))
+}
+
+// intelHexChecksum returns the two's complement of the sum of the record bytes.
+func intelHexChecksum(record []byte) byte {
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+	return -sum
+}
+
+// readIntelHex reads data records until the end-of-file record. Extended address
+// records are rejected, as memory is far smaller than 64K.
+func readIntelHex(r io.Reader, memory []int) error {
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if !strings.HasPrefix(text, ":") || len(text)%2 != 1 {
+			return fmt.Errorf("line %d: invalid Intel HEX record", line)
+		}
+		record := make([]byte, len(text)/2)
+		for i := range record {
+			b, err := strconv.ParseUint(text[1+2*i:3+2*i], 16, 8)
+			if err != nil {
+				return fmt.Errorf("line %d: invalid Intel HEX record", line)
+			}
+			record[i] = byte(b)
+		}
+		if len(record) < 5 || int(record[0]) != len(record)-5 {
+			return fmt.Errorf("line %d: Intel HEX record length does not match its data", line)
+		}
+		if intelHexChecksum(record[:len(record)-1]) != record[len(record)-1] {
+			return fmt.Errorf("line %d: Intel HEX checksum mismatch", line)
+		}
+
+		addr := int(record[1])<<8 | int(record[2])
+		data := record[4 : len(record)-1]
+		switch record[3] {
+		case IHEX_DATA:
+			if addr+len(data) > len(memory) {
+				return fmt.Errorf("line %d: data at 0x%04X is outside memory", line, addr)
+			}
+			for i, b := range data {
+				memory[addr+i] = int(b)
+			}
+		case IHEX_EOF:
+			return nil
+		default:
+			return fmt.Errorf("line %d: unsupported Intel HEX record type %02X", line, record[3])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("missing Intel HEX end-of-file record")
+}
+
+// LoadMemoryImage reads the image at path into memory. An empty format is
+// chosen from the file extension, see ImageFormat.
+func (cpu *CPU) LoadMemoryImage(path, format string) error {
+	format, err := ImageFormat(path, format)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	memory := *cpu.memory // Keep memory unchanged if the image is invalid
+	if err := ReadMemoryImage(bytes.NewReader(data), memory[:], format); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	*cpu.memory = memory
+	return nil
+}
+
+// SaveMemoryImage writes memory to path. An empty format is chosen from the
+// file extension, see ImageFormat.
+func (cpu *CPU) SaveMemoryImage(path, format string) error {
+	format, err := ImageFormat(path, format)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := WriteMemoryImage(&buf, cpu.memory[:], format); err != nil {
+		return err
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
+
+// loadMemoryIn applies opts.MemIn to cpu, reporting any error to the user.
+func loadMemoryIn(cpu *CPU, opts Options) bool {
+	if opts.MemIn == "" {
+		return true
+	}
+	if err := cpu.LoadMemoryImage(opts.MemIn, opts.MemFormat); err != nil {
+		utils.RED.Printf("Error loading memory image: %v\n", err)
+		return false
+	}
+	return true
+}
+
+// saveMemoryOut writes memory to opts.MemOut, reporting any error to the user.
+func saveMemoryOut(cpu *CPU, opts Options) {
+	if opts.MemOut == "" {
+		return
+	}
+	if err := cpu.SaveMemoryImage(opts.MemOut, opts.MemFormat); err != nil {
+		utils.RED.Printf("Error saving memory image: %v\n", err)
+	}
+}
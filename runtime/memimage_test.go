@@ -0,0 +1,130 @@
+package runtime
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+func TestImageFormat(t *testing.T) {
+	tests := []struct {
+		path, format, want string
+	}{
+		{"data.bin", "", MEMIMAGE_RAW},
+		{"data", "", MEMIMAGE_RAW},
+		{"data.hex", "", MEMIMAGE_IHEX},
+		{"data.IHX", "", MEMIMAGE_IHEX},
+		{"data.txt", "", MEMIMAGE_DUMP},
+		{"data.hex", "DUMP", MEMIMAGE_DUMP},
+	}
+	for _, tt := range tests {
+		got, err := ImageFormat(tt.path, tt.format)
+		if err != nil || got != tt.want {
+			t.Errorf("ImageFormat(%q, %q) = %q, %v, want %q", tt.path, tt.format, got, err, tt.want)
+		}
+	}
+	if _, err := ImageFormat("data.bin", "elf"); err == nil {
+		t.Errorf("ImageFormat() should reject unknown formats")
+	}
+}
+
+func TestMemoryImageRoundTrip(t *testing.T) {
+	memory := make([]int, commands.MEMORY_SIZE)
+	for i := range memory {
+		memory[i] = i * 7 % 256
+	}
+
+	for _, format := range []string{MEMIMAGE_RAW, MEMIMAGE_DUMP, MEMIMAGE_IHEX} {
+		var buf bytes.Buffer
+		if err := WriteMemoryImage(&buf, memory, format); err != nil {
+			t.Fatalf("%s: WriteMemoryImage() error = %v", format, err)
+		}
+		got := make([]int, commands.MEMORY_SIZE)
+		if err := ReadMemoryImage(&buf, got, format); err != nil {
+			t.Fatalf("%s: ReadMemoryImage() error = %v", format, err)
+		}
+		for i := range got {
+			if got[i] != memory[i] {
+				t.Errorf("%s: cell 0x%02X = %d, want %d", format, i, got[i], memory[i])
+				break
+			}
+		}
+	}
+}
+
+func TestWriteMemoryImageOutOfRange(t *testing.T) {
+	memory := make([]int, commands.MEMORY_SIZE)
+	memory[0x10] = 300
+	memory[0x11] = -1
+	for _, format := range []string{MEMIMAGE_RAW, MEMIMAGE_DUMP, MEMIMAGE_IHEX} {
+		var buf bytes.Buffer
+		err := WriteMemoryImage(&buf, memory, format)
+		if err == nil || !strings.Contains(err.Error(), "0x10 = 300, 0x11 = -1") {
+			t.Errorf("%s: WriteMemoryImage() error = %v, want one naming cells 0x10 and 0x11", format, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%s: WriteMemoryImage() wrote %d bytes before failing", format, buf.Len())
+		}
+	}
+}
+
+func TestWriteIntelHex(t *testing.T) {
+	memory := make([]int, 16)
+	copy(memory, []int{0x48, 0x69})
+	var buf bytes.Buffer
+	WriteMemoryImage(&buf, memory, MEMIMAGE_IHEX)
+	want := ":10000000486900000000000000000000000000003F\n:00000001FF\n"
+	if buf.String() != want {
+		t.Errorf("Intel HEX =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestReadHexDumpPartial(t *testing.T) {
+	memory := make([]int, commands.MEMORY_SIZE)
+	memory[0x30] = 9
+	dump := "; dataset 1\n0x20: 01 02 03  |...|\n\n0XFE: 0A 0B\n"
+	if err := ReadMemoryImage(strings.NewReader(dump), memory, MEMIMAGE_DUMP); err != nil {
+		t.Fatal(err)
+	}
+	if memory[0x20] != 1 || memory[0x22] != 3 || memory[0xFF] != 0x0B || memory[0x30] != 9 {
+		t.Errorf("memory = %v", memory)
+	}
+	if err := ReadMemoryImage(strings.NewReader("0xFF: 01 02\n"), memory, MEMIMAGE_DUMP); err == nil {
+		t.Errorf("ReadMemoryImage() should reject data past the end of memory")
+	}
+}
+
+func TestReadIntelHexErrors(t *testing.T) {
+	tests := map[string]string{
+		"checksum":   ":0100000048B8\n:00000001FF\n",
+		"length":     ":02000000480000\n:00000001FF\n",
+		"no eof":     ":0100000048B7\n",
+		"outside":    ":010100004800B6\n:00000001FF\n",
+		"ext. addr.": ":020000040000FA\n:00000001FF\n",
+	}
+	for name, image := range tests {
+		memory := make([]int, commands.MEMORY_SIZE)
+		if err := ReadMemoryImage(strings.NewReader(image), memory, MEMIMAGE_IHEX); err == nil {
+			t.Errorf("%s: ReadMemoryImage() should fail", name)
+		}
+	}
+}
+
+func TestLoadMemoryImageKeepsMemoryOnError(t *testing.T) {
+	cpu := NewCPU()
+	cpu.memory[0] = 5
+	path := filepath.Join(t.TempDir(), "data.hex")
+	cpu.SaveMemoryImage(path, "")
+
+	cpu.memory[0] = 6
+	if err := cpu.LoadMemoryImage(path, ""); err != nil || cpu.memory[0] != 5 {
+		t.Errorf("LoadMemoryImage() error = %v, memory[0] = %d, want 5", err, cpu.memory[0])
+	}
+	cpu.memory[0] = 6
+	if err := cpu.LoadMemoryImage(path, MEMIMAGE_DUMP); err == nil || cpu.memory[0] != 6 {
+		t.Errorf("an invalid image should leave memory unchanged, error = %v", err)
+	}
+}
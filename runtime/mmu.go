@@ -0,0 +1,252 @@
+package runtime
+
+import (
+	"fmt"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Paging layout. Virtual and physical addresses both split into a page number
+// and an offset within the page.
+const (
+	PAGE_SIZE        = 16                               // Cells per page
+	NUM_PAGES        = commands.MEMORY_SIZE / PAGE_SIZE // Pages in the address space, and entries in a page table
+	PAGING_OFF       = -1                               // Page-table base while paging is disabled
+	DEFAULT_TLB_SIZE = 4
+)
+
+// Bits of a page-table entry. The low bits hold the physical frame number.
+const (
+	PTE_FRAME    = NUM_PAGES - 1 // Mask of the frame number
+	PTE_VALID    = NUM_PAGES     // The page is mapped
+	PTE_WRITABLE = NUM_PAGES << 1
+)
+
+// Page fault trap layout, next to the interrupt vector table. The CPU stores the
+// faulting virtual address and the cause before entering the handler.
+const (
+	PAGE_FAULT_VECTOR = VECTOR_TABLE + NUM_IRQ_LINES // Handler address, 0 for none
+	PAGE_FAULT_ADDR   = PAGE_FAULT_VECTOR + 1
+	PAGE_FAULT_CAUSE  = PAGE_FAULT_VECTOR + 2
+)
+
+// Page fault causes
+const (
+	PAGE_NOT_PRESENT = 1 // The page-table entry is not valid
+	PAGE_READ_ONLY   = 2 // Write to a page that is not writable
+)
+
+// tlbEntry is a cached translation.
+type tlbEntry struct {
+	valid    bool
+	page     int
+	frame    int
+	writable bool
+}
+
+// TLB caches recent translations so most accesses skip the page-table walk.
+// Entries are replaced in round-robin order.
+type TLB struct {
+	entries []tlbEntry
+	next    int // Entry replaced by the next miss
+	Hits    uint64
+	Misses  uint64
+}
+
+// NewTLB creates a TLB with the given number of entries.
+func NewTLB(size int) *TLB {
+	return &TLB{entries: make([]tlbEntry, size)}
+}
+
+// lookup returns the cached entry for page, counting a hit or a miss.
+func (t *TLB) lookup(page int) (*tlbEntry, bool) {
+	for i := range t.entries {
+		if t.entries[i].valid && t.entries[i].page == page {
+			t.Hits++
+			return &t.entries[i], true
+		}
+	}
+	t.Misses++
+	return nil, false
+}
+
+// insert caches a translation, replacing the next entry in turn.
+func (t *TLB) insert(entry tlbEntry) {
+	if len(t.entries) == 0 {
+		return
+	}
+	t.entries[t.next] = entry
+	t.next = (t.next + 1) % len(t.entries)
+}
+
+// flush discards every cached translation.
+func (t *TLB) flush() {
+	clear(t.entries)
+	t.next = 0
+}
+
+// pageFault is a failed translation, delivered to the handler once the instruction is aborted.
+type pageFault struct {
+	addr  int
+	cause int
+}
+
+// MMU translates the virtual addresses used by instructions into physical
+// addresses through a page table held in memory.
+type MMU struct {
+	base  int // Physical address of the page table, PAGING_OFF while disabled
+	tlb   *TLB
+	fault *pageFault // Fault raised by the current instruction, if any
+}
+
+// NewMMU creates an MMU with paging disabled and a TLB of the given size.
+func NewMMU(tlbSize int) (*MMU, error) {
+	if tlbSize < 0 || tlbSize > NUM_PAGES {
+		return nil, fmt.Errorf("invalid TLB size %d (0 to %d entries)", tlbSize, NUM_PAGES)
+	}
+	return &MMU{base: PAGING_OFF, tlb: NewTLB(tlbSize)}, nil
+}
+
+// SetMMU places an MMU between the CPU and memory, or removes it when mmu is nil.
+func (cpu *CPU) SetMMU(mmu *MMU) {
+	cpu.mmu = mmu
+}
+
+// MMU returns the CPU's MMU, or nil.
+func (cpu *CPU) MMU() *MMU {
+	return cpu.mmu
+}
+
+// Paging reports whether addresses are being translated.
+func (m *MMU) Paging() bool {
+	return m.base != PAGING_OFF
+}
+
+// TLB returns the MMU's translation cache, with its statistics.
+func (m *MMU) TLB() *TLB {
+	return m.tlb
+}
+
+// setBase points the MMU at a page table and discards cached translations. A
+// negative base disables paging.
+func (m *MMU) setBase(base int) error {
+	if base < 0 {
+		base = PAGING_OFF
+	} else if base > commands.MEMORY_SIZE-NUM_PAGES {
+		return fmt.Errorf("page table at 0x%02X does not fit in memory", base)
+	}
+	m.base = base
+	m.tlb.flush()
+	return nil
+}
+
+// pageTableBase returns the page-table base, PAGING_OFF without an MMU.
+func (cpu *CPU) pageTableBase() int {
+	if cpu.mmu == nil {
+		return PAGING_OFF
+	}
+	return cpu.mmu.base
+}
+
+// translate maps a virtual address to a physical one. A missing or read-only
+// page records a page fault and aborts the instruction.
+func (cpu *CPU) translate(addr int, write bool) (int, bool) {
+	if cpu.aborted {
+		return 0, false
+	}
+	if cpu.mmu == nil || !cpu.mmu.Paging() {
+		return addr, true
+	}
+	page, offset := addr/PAGE_SIZE, addr%PAGE_SIZE
+	entry, ok := cpu.mmu.tlb.lookup(page)
+	if !ok {
+		cpu.access(cpu.mmu.base+page, false) // The page-table walk reads memory
+		pte := cpu.memory[cpu.mmu.base+page]
+		if pte&PTE_VALID == 0 {
+			return 0, cpu.pageFault(addr, PAGE_NOT_PRESENT)
+		}
+		walked := tlbEntry{valid: true, page: page, frame: pte & PTE_FRAME, writable: pte&PTE_WRITABLE != 0}
+		cpu.mmu.tlb.insert(walked)
+		entry = &walked
+	}
+	if write && !entry.writable {
+		return 0, cpu.pageFault(addr, PAGE_READ_ONLY)
+	}
+	return entry.frame*PAGE_SIZE + offset, true
+}
+
+// pageFault aborts the current instruction so the fault can be delivered to the handler.
+func (cpu *CPU) pageFault(addr, cause int) bool {
+	cpu.aborted = true
+	cpu.mmu.fault = &pageFault{addr, cause}
+	return false
+}
+
+// trapPageFault enters the page fault handler for the fault raised by the
+// instruction that started with the stack pointer at sp. The instruction's
+// address is pushed, so IRET runs it again once the handler has mapped the page.
+// Without a handler, or when the trap itself faults, the CPU stops.
+func (cpu *CPU) trapPageFault(sp int) bool {
+	fault := cpu.mmu.fault
+	cpu.mmu.fault = nil
+	cpu.aborted = false
+	cpu.sp = sp
+	if cpu.inst.Opcode == commands.IRQ {
+		cpu.pending |= 1 << cpu.inst.Operands[0] // Take the interrupt again after the handler
+	}
+	causes := map[int]string{PAGE_NOT_PRESENT: "page not present", PAGE_READ_ONLY: "page is read-only"}
+	handler := cpu.memory[PAGE_FAULT_VECTOR]
+	if handler == 0 {
+		return cpu.raise(FAULT_PAGE, cpu.instPC, "Page fault at 0x%02X (%s) on program counter %d",
+			fault.addr, causes[fault.cause], cpu.instPC)
+	}
+	cpu.store(PAGE_FAULT_ADDR, fault.addr)
+	cpu.store(PAGE_FAULT_CAUSE, fault.cause)
+	if !cpu.trap(handler, cpu.instPC) {
+		if cpu.fault != nil {
+			return false
+		}
+		cpu.mmu.fault = nil
+		return cpu.raise(FAULT_PAGE, cpu.instPC, "Double fault: the page fault at 0x%02X could not be delivered on program counter %d",
+			fault.addr, cpu.instPC)
+	}
+	return true
+}
+
+// configureMMU attaches an MMU to cpu when opts asks for one.
+func configureMMU(cpu *CPU, opts Options) error {
+	if !opts.MMU {
+		return nil
+	}
+	mmu, err := NewMMU(opts.TLBSize)
+	if err != nil {
+		return err
+	}
+	cpu.SetMMU(mmu)
+	return nil
+}
+
+// printMMU shows the paging state and TLB statistics.
+func printMMU(cpu *CPU) {
+	if cpu.mmu == nil {
+		utils.YELLOW.Println("No MMU (run with --mmu)")
+		return
+	}
+	if cpu.mmu.Paging() {
+		utils.GREEN.Printf("Paging enabled, page table at 0x%02X\n", cpu.mmu.base)
+	} else {
+		utils.GREEN.Println("Paging disabled")
+	}
+	printTLB(cpu)
+}
+
+// printTLB shows the hit rate of the CPU's TLB.
+func printTLB(cpu *CPU) {
+	t := cpu.mmu.tlb
+	rate := 0.0
+	if total := t.Hits + t.Misses; total > 0 {
+		rate = 100 * float64(t.Hits) / float64(total)
+	}
+	utils.GREEN.Printf("%sTLB: %d hits, %d misses (%.1f%% hit rate, %d entries)\n", cpu.outputPrefix(), t.Hits, t.Misses, rate, len(t.entries))
+}
@@ -0,0 +1,160 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// Maps virtual page 0 to frame 2 and the stack page to itself, then stores through the mapping.
+const pagedScript = `
+    LOAD R0 0x32
+    STORE R0 0xC0
+    LOAD R0 0x3F
+    STORE R0 0xCF
+    LOAD R0 0xC0
+    SETPTB R0
+    LOAD R1 7
+    STORE R1 0x05
+    LOADM R2 0x05
+    HALT
+`
+
+// Maps page 4 on demand from the page fault handler.
+const demandPagingScript = `
+    LOAD R0 handler
+    STORE R0 0xD8
+    LOAD R0 0x3C
+    STORE R0 0xCC
+    LOAD R0 0x3D
+    STORE R0 0xCD
+    LOAD R0 0x3F
+    STORE R0 0xCF
+    LOAD R0 0xC0
+    SETPTB R0
+    LOAD R1 9
+    STORE R1 0x40
+    HALT
+handler:
+    LOAD R2 1
+    ADD R3 R3 R2
+    LOAD R2 0x34
+    STORE R2 0xC4
+    IRET
+`
+
+func TestPagedTranslation(t *testing.T) {
+	cpu := assembleCPU(t, pagedScript)
+	mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+	cpu.SetMMU(mmu)
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.memory[0x25] != 7 || cpu.memory[0x05] != 0 || cpu.registers[2] != 7 {
+		t.Errorf("virtual 0x05 should map to physical 0x25: memory[0x25] = %d, memory[0x05] = %d, R2 = %d",
+			cpu.memory[0x25], cpu.memory[0x05], cpu.registers[2])
+	}
+	tlb := cpu.MMU().TLB()
+	if tlb.Hits != 1 || tlb.Misses != 1 {
+		t.Errorf("TLB hits = %d, misses = %d, want 1 and 1", tlb.Hits, tlb.Misses)
+	}
+}
+
+func TestPageFaultHandler(t *testing.T) {
+	cpu := assembleCPU(t, demandPagingScript)
+	mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+	cpu.SetMMU(mmu)
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.memory[0x40] != 9 || cpu.registers[3] != 1 {
+		t.Errorf("memory[0x40] = %d after %d faults, want 9 after 1", cpu.memory[0x40], cpu.registers[3])
+	}
+	if cpu.memory[PAGE_FAULT_ADDR] != 0x40 || cpu.memory[PAGE_FAULT_CAUSE] != PAGE_NOT_PRESENT {
+		t.Errorf("fault address = 0x%02X, cause = %d", cpu.memory[PAGE_FAULT_ADDR], cpu.memory[PAGE_FAULT_CAUSE])
+	}
+	if cpu.sp != commands.MEMORY_SIZE {
+		t.Errorf("sp = %d after IRET, want %d", cpu.sp, commands.MEMORY_SIZE)
+	}
+}
+
+func TestPageFaultOnPrint(t *testing.T) {
+	// PRINT faults on the unmapped page and runs again after the handler maps it
+	source := strings.Replace(demandPagingScript, "LOAD R1 9\n    STORE R1 0x40", "PRINT MEM 0x40", 1)
+	cpu := assembleCPU(t, source)
+	mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+	cpu.SetMMU(mmu)
+	cpu.memory[0x40] = 9
+	output := captureStdout(t, cpu.Run)
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.registers[3] != 1 || strings.Count(output, "Memory[") != 1 || !strings.Contains(output, "Memory[64] = 9") {
+		t.Errorf("output after %d faults = %q, want Memory[64] = 9 printed once", cpu.registers[3], output)
+	}
+}
+
+func TestPageFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		pc     int
+	}{
+		{"not present", "LOAD R0 0xC0\nSETPTB R0\nLOADM R1 0x10\nHALT", 2},
+		{"read-only", "LOAD R0 0x11\nSTORE R0 0xC1\nLOAD R0 0xC0\nSETPTB R0\nLOADM R1 0x10\nSTORE R1 0x10\nHALT", 5},
+		{"table outside memory", "LOAD R0 0xF8\nSETPTB R0\nHALT", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := assembleCPU(t, tt.source)
+			mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+			cpu.SetMMU(mmu)
+			cpu.Run()
+			fault := cpu.Fault()
+			if fault == nil || fault.Kind != FAULT_PAGE || fault.PC != tt.pc {
+				t.Errorf("fault = %+v, want a page fault at pc %d", fault, tt.pc)
+			}
+		})
+	}
+
+	cpu := NewCPU()
+	program, _ := commands.Assemble("LOAD R0 0xC0\nSETPTB R0", commands.ParseOptions{})
+	cpu.LoadScript(program, "test.ass")
+	cpu.Run()
+	if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_PAGE {
+		t.Errorf("SETPTB without an MMU should fault, got %v", cpu.Fault())
+	}
+}
+
+func TestPagingHistoryAndSnapshot(t *testing.T) {
+	cpu := assembleCPU(t, pagedScript)
+	mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+	cpu.SetMMU(mmu)
+	cpu.SetHistory(NewHistory(100))
+	for i := 0; i < 6; i++ {
+		cpu.Step()
+	}
+	if !cpu.MMU().Paging() {
+		t.Fatal("SETPTB should enable paging")
+	}
+
+	snap, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewCPU()
+	if _, err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if restored.pageTableBase() != 0xC0 {
+		t.Errorf("restored page-table base = %d, want 0xC0", restored.pageTableBase())
+	}
+
+	cpu.StepBack()
+	if cpu.MMU().Paging() {
+		t.Errorf("stepping back over SETPTB should disable paging")
+	}
+}
@@ -0,0 +1,33 @@
+package runtime
+
+import "tinyass/commands"
+
+// Change is a register or memory cell written by an instruction.
+type Change struct {
+	Register bool
+	Index    int // Register number or memory address
+	Old      int
+	New      int
+}
+
+// StepRecord describes one executed instruction.
+type StepRecord struct {
+	Step    uint64 // Instruction count, starting at 1
+	PC      int    // Address of the instruction
+	Inst    commands.Instruction
+	Changes []Change // Writes in the order they happened
+	Cycles  uint64   // Cycles spent on the instruction
+	Taken   bool     // Whether a conditional jump was taken
+	Jumped  bool     // Whether the instruction transferred control
+}
+
+// StepObserver is notified after every instruction the CPU executes. The record
+// is reused for the next instruction, so observers must copy what they keep.
+type StepObserver interface {
+	ObserveStep(rec *StepRecord)
+}
+
+// AddObserver registers an observer for all following instructions.
+func (cpu *CPU) AddObserver(observer StepObserver) {
+	cpu.observers = append(cpu.observers, observer)
+}
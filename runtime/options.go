@@ -0,0 +1,155 @@
+package runtime
+
+import (
+	"strings"
+	"time"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Options configures how scripts and REPL input are run.
+type Options struct {
+	// StrictCase requires mnemonics and registers to be written in upper case.
+	StrictCase bool
+	// Watches are watchpoint specifications, logged when run from a file
+	// and stopping execution in the debugger.
+	Watches []string
+	// HistorySize is the number of instructions the debugger and REPL can step
+	// back through. Zero disables reverse execution.
+	HistorySize int
+	// Trace is the file that receives one record per executed instruction,
+	// "-" for standard output. Empty disables tracing.
+	Trace string
+	// TraceFormat is TRACE_TEXT or TRACE_JSONL.
+	TraceFormat string
+	// Profile prints a hotspot report and annotated listing when a script finishes.
+	Profile bool
+	// Coverage is a file accumulating coverage data across runs of a script.
+	Coverage string
+	// CoverageListing prints the source annotated with coverage counts.
+	CoverageListing bool
+	// LCOV is a file receiving the coverage as an LCOV tracefile.
+	LCOV string
+	// Costs is a file overriding the default cycle cost table.
+	Costs string
+	// MaxSteps stops a script after this many instructions, 0 for no limit.
+	MaxSteps uint64
+	// Timeout stops a script after this much wall-clock time, 0 for no limit.
+	Timeout time.Duration
+	// Resume is a snapshot file to continue from instead of starting a script.
+	Resume string
+	// SaveSnapshot is a file receiving the machine state when a script stops.
+	SaveSnapshot string
+	// MemIn is a memory image loaded before the program starts.
+	MemIn string
+	// MemOut is a file receiving a memory image when the program stops.
+	MemOut string
+	// MemFormat is the format of MemIn and MemOut, MEMIMAGE_RAW, MEMIMAGE_DUMP or
+	// MEMIMAGE_IHEX. Empty chooses the format from the file extension.
+	MemFormat string
+	// Devices are device specifications, "name" or "name@0xNN", mapped into memory.
+	Devices []string
+	// Cores is the number of cores running the script against shared memory.
+	Cores int
+	// Schedule is how cores are interleaved, SCHEDULE_SEEDED or SCHEDULE_GOROUTINES.
+	Schedule string
+	// Seed makes the seeded schedule reproducible.
+	Seed int64
+	// Race reports data races between cores.
+	Race bool
+	// Regions are memory regions, "kind 0xSS 0xEE", protected in addition to
+	// those the script declares with .region.
+	Regions []string
+	// MMU translates addresses through page tables once a program sets a page-table base.
+	MMU bool
+	// TLBSize is the number of translations the MMU caches.
+	TLBSize int
+	// Caches describe the cache levels between the CPU and memory, L1 first,
+	// see ParseCacheConfig.
+	Caches []string
+	// Pipeline models a 5-stage pipeline in PIPELINE_FORWARDING or PIPELINE_STALL
+	// mode and reports its timing when a script finishes. Empty disables it.
+	Pipeline string
+	// PipelineDiagram is the number of instructions drawn in the pipeline diagram.
+	PipelineDiagram int
+	// Predictors are the branch predictors compared when a script finishes, or
+	// "all"; an entry may list several separated by commas.
+	Predictors []string
+	// MispredictPenalty is the cycles charged per mispredicted branch.
+	MispredictPenalty uint64
+	// UserMode starts programs in user mode, where privileged instructions fault.
+	UserMode bool
+	// Engine is the execution engine, ENGINE_INTERPRETER or ENGINE_COMPILED.
+	Engine string
+}
+
+// coverageEnabled reports whether any coverage output was requested.
+func (opts Options) coverageEnabled() bool {
+	return opts.Coverage != "" || opts.CoverageListing || opts.LCOV != ""
+}
+
+// predictors returns the names of the branch predictors to compare.
+func (opts Options) predictors() []string {
+	var names []string
+	for _, entry := range opts.Predictors {
+		for _, name := range strings.Split(entry, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// parseOptions returns the parser settings implied by the run options.
+func (opts Options) parseOptions() commands.ParseOptions {
+	return commands.ParseOptions{StrictCase: opts.StrictCase}
+}
+
+// configureCPU applies the machine settings in opts to cpu, reporting any error to the user.
+func configureCPU(cpu *CPU, opts Options) bool {
+	if opts.Costs != "" {
+		table, err := LoadCostTable(opts.Costs)
+		if err != nil {
+			utils.RED.Printf("Error loading cost table: %v\n", err)
+			return false
+		}
+		cpu.SetCostTable(table)
+	}
+	if len(opts.Devices) > 0 {
+		if err := attachDevices(cpu, opts.Devices); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return false
+		}
+	}
+	cpu.SetUserMode(opts.UserMode)
+	if err := cpu.SetEngine(opts.Engine); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	if err := configureCache(cpu, opts); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	if err := configureMMU(cpu, opts); err != nil {
+		utils.RED.Printf("Error: %v\n", err)
+		return false
+	}
+	if len(opts.Regions) > 0 {
+		cpu.configRegions = nil
+		for _, spec := range opts.Regions {
+			region, err := ParseRegionSpec(spec)
+			if err != nil {
+				utils.RED.Printf("Error: %v\n", err)
+				return false
+			}
+			cpu.configRegions = append(cpu.configRegions, region)
+		}
+		if err := cpu.protectProgram(nil); err != nil {
+			utils.RED.Printf("Error: %v\n", err)
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Pipeline modes
+const (
+	PIPELINE_FORWARDING = "forwarding" // Results are forwarded to EX; branches are predicted not taken
+	PIPELINE_STALL      = "stall"      // Operands wait for write-back; fetch stalls until every branch resolves
+)
+
+// Pipeline stages
+const (
+	STAGE_IF  = iota // Instruction fetch
+	STAGE_ID         // Decode and register read
+	STAGE_EX         // Execute
+	STAGE_MEM        // Memory access
+	STAGE_WB         // Register write-back
+	NUM_STAGES
+)
+
+// Stage names as drawn in the pipeline diagram
+var stageNames = [NUM_STAGES]string{"IF", "ID", "EX", "ME", "WB"}
+
+// pipeStage is the cycle each stage of an instruction starts in. An instruction
+// stays in a stage until the next one starts, so the gaps are stalls.
+type pipeStage [NUM_STAGES]uint64
+
+// pipeRow is an instruction drawn in the diagram.
+type pipeRow struct {
+	pc     int
+	text   string
+	stages pipeStage
+}
+
+// Pipeline models a classic 5-stage in-order pipeline. It observes the
+// instructions the CPU executes and schedules each through IF, ID, EX, MEM and
+// WB, delaying it for data hazards on registers and for control hazards after
+// jumps. The CPU still computes the results; the pipeline only decides when
+// each instruction would complete.
+type Pipeline struct {
+	mode  string
+	prev  pipeStage
+	fetch uint64    // Earliest cycle the next instruction can be fetched
+	ready [4]uint64 // Cycle from which each register's value can enter EX
+
+	Instructions  uint64
+	Cycles        uint64 // Cycle the last instruction left WB
+	DataStalls    uint64 // Cycles instructions waited in ID for operands
+	ControlStalls uint64 // Fetch cycles lost to jumps
+	Flushes       uint64 // Jumps that discarded fetched instructions
+
+	diagram []pipeRow
+	limit   int // Instructions to draw
+}
+
+// NewPipeline creates a pipeline model. The first diagramLimit instructions are kept for Diagram.
+func NewPipeline(mode string, diagramLimit int) (*Pipeline, error) {
+	if mode != PIPELINE_FORWARDING && mode != PIPELINE_STALL {
+		return nil, fmt.Errorf("unknown pipeline mode: %s (use forwarding or stall)", mode)
+	}
+	return &Pipeline{mode: mode, fetch: 1, limit: diagramLimit}, nil
+}
+
+// registerUse returns the registers an instruction reads and writes, and
+// whether the written value comes from memory and is only known after MEM.
+func registerUse(inst commands.Instruction) (reads, writes []int, load bool) {
+	ops := inst.Operands
+	switch inst.Opcode {
+	case commands.LOAD, commands.CYCLES, commands.CORE:
+		return nil, ops[:1], false
+	case commands.LOADM:
+		return nil, ops[:1], true
+	case commands.STORE, commands.JZ, commands.JNZ, commands.SETPTB:
+		return ops[:1], nil, false
+	case commands.NOT:
+		return ops[1:2], ops[:1], false
+	case commands.ADD, commands.SUB, commands.MUL, commands.DIV, commands.REM, commands.AND, commands.OR,
+		commands.XOR, commands.SHL, commands.SHR, commands.GT, commands.LT, commands.GTE, commands.LTE,
+		commands.EQ, commands.NEQ:
+		return ops[1:3], ops[:1], false
+	case commands.CAS:
+		return ops[:2], ops[:1], true
+	case commands.XCHG:
+		return ops[:1], ops[:1], true
+	case commands.PRINT:
+		if ops[0] == -1 {
+			return ops[1:2], nil, false
+		}
+	case commands.SYSCALL:
+		return []int{0, 1, 2}, []int{0}, false
+	}
+	return nil, nil, false
+}
+
+// isBranch reports whether opcode may transfer control.
+func isBranch(opcode int) bool {
+	switch opcode {
+	case commands.JMP, commands.JZ, commands.JNZ, commands.CALL, commands.RET, commands.IRET,
+		commands.IRQ, commands.SYSCALL, commands.USER:
+		return true
+	}
+	return false
+}
+
+// resolvedInDecode reports whether the target of a jump is known in ID, so only
+// one fetched instruction is lost. Other jumps resolve in EX.
+func resolvedInDecode(opcode int) bool {
+	return opcode == commands.JMP || opcode == commands.CALL || opcode == commands.USER
+}
+
+// ObserveStep schedules one executed instruction.
+func (p *Pipeline) ObserveStep(rec *StepRecord) {
+	var s pipeStage
+	s[STAGE_IF] = max(p.fetch, p.prev[STAGE_ID])
+	s[STAGE_ID] = max(s[STAGE_IF]+1, p.prev[STAGE_EX])
+
+	reads, writes, load := registerUse(rec.Inst)
+	earliest := max(s[STAGE_ID]+1, p.prev[STAGE_MEM])
+	s[STAGE_EX] = earliest
+	for _, r := range reads {
+		s[STAGE_EX] = max(s[STAGE_EX], p.ready[r])
+	}
+	p.DataStalls += s[STAGE_EX] - earliest
+	s[STAGE_MEM] = s[STAGE_EX] + 1
+	s[STAGE_WB] = s[STAGE_MEM] + 1
+
+	for _, r := range writes {
+		switch {
+		case p.mode == PIPELINE_STALL:
+			p.ready[r] = s[STAGE_WB] + 1 // Read in ID while WB writes, then on to EX
+		case load:
+			p.ready[r] = s[STAGE_MEM] + 1
+		default:
+			p.ready[r] = s[STAGE_EX] + 1
+		}
+	}
+
+	p.fetch = s[STAGE_IF] + 1
+	if rec.Jumped || (p.mode == PIPELINE_STALL && isBranch(rec.Inst.Opcode)) {
+		resolved := s[STAGE_EX]
+		if resolvedInDecode(rec.Inst.Opcode) {
+			resolved = s[STAGE_ID]
+		}
+		p.ControlStalls += resolved - s[STAGE_IF]
+		p.fetch = resolved + 1
+		if p.mode == PIPELINE_FORWARDING {
+			p.Flushes++
+		}
+	}
+
+	p.prev = s
+	p.Instructions++
+	p.Cycles = s[STAGE_WB]
+	if len(p.diagram) < p.limit {
+		p.diagram = append(p.diagram, pipeRow{rec.PC, commands.Disassemble(rec.Inst), s})
+	}
+}
+
+// CPI returns the average number of cycles per instruction.
+func (p *Pipeline) CPI() float64 {
+	if p.Instructions == 0 {
+		return 0
+	}
+	return float64(p.Cycles) / float64(p.Instructions)
+}
+
+// Report writes a summary of the pipeline's performance.
+func (p *Pipeline) Report(w io.Writer) {
+	fmt.Fprintf(w, "Pipeline (%s): %d instructions in %d cycles, CPI %.2f\n", p.mode, p.Instructions, p.Cycles, p.CPI())
+	fmt.Fprintf(w, "  %d data stall cycles, %d control stall cycles", p.DataStalls, p.ControlStalls)
+	if p.mode == PIPELINE_FORWARDING {
+		fmt.Fprintf(w, ", %d flushes", p.Flushes)
+	}
+	fmt.Fprintln(w)
+}
+
+// Diagram draws the cycles each of the first instructions spent in each stage.
+// "**" marks a cycle an instruction was stalled in the stage before it.
+func (p *Pipeline) Diagram(w io.Writer) {
+	if len(p.diagram) == 0 {
+		return
+	}
+	width := len("Cycle")
+	for _, row := range p.diagram {
+		width = max(width, len(row.text)+len("0x00 "))
+	}
+	first := p.diagram[0].stages[STAGE_IF]
+	last := p.diagram[len(p.diagram)-1].stages[STAGE_WB]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-*s", width, "Cycle")
+	for c := first; c <= last; c++ {
+		fmt.Fprintf(&b, " %3d", c)
+	}
+	fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	for _, row := range p.diagram {
+		b.Reset()
+		fmt.Fprintf(&b, "%-*s", width, fmt.Sprintf("0x%02X %s", row.pc, row.text))
+		for c := first; c <= row.stages[STAGE_WB]; c++ {
+			b.WriteString(" " + pipeCell(row.stages, c))
+		}
+		fmt.Fprintln(w, strings.TrimRight(b.String(), " "))
+	}
+}
+
+// pipeCell is the diagram cell of an instruction in cycle c.
+func pipeCell(s pipeStage, c uint64) string {
+	if c < s[STAGE_IF] {
+		return "   "
+	}
+	for stage := NUM_STAGES - 1; stage >= 0; stage-- {
+		if c == s[stage] {
+			return " " + stageNames[stage]
+		}
+		if c > s[stage] {
+			return " **"
+		}
+	}
+	return "   "
+}
@@ -0,0 +1,100 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// A load-use hazard and a taken branch on every iteration.
+const pipelineScript = `
+    LOAD R0 3
+    LOAD R1 1
+    STORE R0 0x40
+loop:
+    LOADM R2 0x40
+    ADD R3 R2 R1
+    SUB R0 R0 R1
+    JNZ R0 loop
+    HALT
+`
+
+func runPipeline(t *testing.T, source, mode string, diagram int) *Pipeline {
+	t.Helper()
+	program, err := commands.Assemble(source, commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := NewPipeline(mode, diagram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU()
+	cpu.LoadScript(program, "test.ass")
+	cpu.AddObserver(pipeline)
+	cpu.Run()
+	return pipeline
+}
+
+func TestPipelineHazards(t *testing.T) {
+	tests := []struct {
+		mode                 string
+		cycles, data, contrl uint64
+	}{
+		// 16 instructions fill the pipeline in 20 cycles, plus one load-use stall per
+		// iteration and two cycles lost to each of the two taken branches.
+		{PIPELINE_FORWARDING, 27, 3, 4},
+		{PIPELINE_STALL, 39, 13, 12},
+	}
+	for _, tt := range tests {
+		p := runPipeline(t, pipelineScript, tt.mode, 0)
+		if p.Instructions != 16 || p.Cycles != tt.cycles || p.DataStalls != tt.data || p.ControlStalls != tt.contrl {
+			t.Errorf("%s: %d instructions, %d cycles, %d data and %d control stalls; want 16, %d, %d and %d",
+				tt.mode, p.Instructions, p.Cycles, p.DataStalls, p.ControlStalls, tt.cycles, tt.data, tt.contrl)
+		}
+	}
+}
+
+func TestPipelineNoHazards(t *testing.T) {
+	p := runPipeline(t, "LOAD R0 1\nLOAD R1 2\nLOAD R2 3\nLOAD R3 4", PIPELINE_FORWARDING, 0)
+	if p.Cycles != 8 || p.DataStalls != 0 || p.ControlStalls != 0 {
+		t.Errorf("independent instructions took %d cycles, want 4 + 4 to fill the pipeline", p.Cycles)
+	}
+}
+
+func TestPipelineDiagram(t *testing.T) {
+	p := runPipeline(t, pipelineScript, PIPELINE_FORWARDING, 5)
+	var out bytes.Buffer
+	p.Diagram(&out)
+	lines := strings.Split(strings.TrimRight(out.String(), "\n"), "\n")
+	want := []string{
+		"Cycle                1   2   3   4   5   6   7   8   9  10",
+		"0x00 LOAD R0 3      IF  ID  EX  ME  WB",
+		"0x01 LOAD R1 1          IF  ID  EX  ME  WB",
+		"0x02 STORE R0 0x40          IF  ID  EX  ME  WB",
+		"0x03 LOADM R2 0x40              IF  ID  EX  ME  WB",
+		"0x04 ADD R3 R2 R1                   IF  ID  **  EX  ME  WB",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("diagram:\n%s", out.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, lines[i], want[i])
+		}
+	}
+
+	out.Reset()
+	p.Report(&out)
+	if !strings.Contains(out.String(), "16 instructions in 27 cycles, CPI 1.69") {
+		t.Errorf("report = %q", out.String())
+	}
+}
+
+func TestPipelineMode(t *testing.T) {
+	if _, err := NewPipeline("superscalar", 0); err == nil {
+		t.Errorf("NewPipeline() should reject unknown modes")
+	}
+}
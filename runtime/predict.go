@@ -0,0 +1,241 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Branch predictor names
+const (
+	PREDICT_TAKEN     = "taken"     // Static: every branch is taken
+	PREDICT_NOT_TAKEN = "not-taken" // Static: no branch is taken
+	PREDICT_1BIT      = "1bit"      // The last outcome of the branch
+	PREDICT_2BIT      = "2bit"      // A saturating counter per branch
+	PREDICT_GSHARE    = "gshare"    // Counters indexed by the address XOR the global history
+)
+
+// Predictor settings
+const (
+	PREDICTOR_TABLE_BITS       = 6 // Dynamic predictors have 2^bits entries, indexed by the low address bits
+	DEFAULT_MISPREDICT_PENALTY = 2 // Cycles lost when a branch resolved in EX was mispredicted
+)
+
+// Predictors lists every predictor, in report order.
+var Predictors = []string{PREDICT_TAKEN, PREDICT_NOT_TAKEN, PREDICT_1BIT, PREDICT_2BIT, PREDICT_GSHARE}
+
+// BranchPredictor guesses the outcome of a branch before it is resolved and
+// learns from the actual outcome.
+type BranchPredictor interface {
+	Name() string
+	Predict(pc int) bool
+	Update(pc int, taken bool)
+}
+
+// NewPredictor creates the predictor with the given name.
+func NewPredictor(name string) (BranchPredictor, error) {
+	switch strings.ToLower(name) {
+	case PREDICT_TAKEN:
+		return staticPredictor(true), nil
+	case PREDICT_NOT_TAKEN:
+		return staticPredictor(false), nil
+	case PREDICT_1BIT:
+		return &oneBitPredictor{}, nil
+	case PREDICT_2BIT:
+		return &twoBitPredictor{}, nil
+	case PREDICT_GSHARE:
+		return &gsharePredictor{}, nil
+	}
+	return nil, fmt.Errorf("unknown branch predictor: %s (use %s or all)", name, strings.Join(Predictors, ", "))
+}
+
+// predictorIndex maps an address to a table entry.
+func predictorIndex(pc int) int {
+	return pc & (1<<PREDICTOR_TABLE_BITS - 1)
+}
+
+// staticPredictor always predicts the same outcome.
+type staticPredictor bool
+
+func (p staticPredictor) Name() string {
+	if p {
+		return PREDICT_TAKEN
+	}
+	return PREDICT_NOT_TAKEN
+}
+func (p staticPredictor) Predict(pc int) bool       { return bool(p) }
+func (p staticPredictor) Update(pc int, taken bool) {}
+
+// oneBitPredictor predicts that a branch goes the same way as last time.
+type oneBitPredictor struct {
+	last [1 << PREDICTOR_TABLE_BITS]bool
+}
+
+func (p *oneBitPredictor) Name() string              { return PREDICT_1BIT }
+func (p *oneBitPredictor) Predict(pc int) bool       { return p.last[predictorIndex(pc)] }
+func (p *oneBitPredictor) Update(pc int, taken bool) { p.last[predictorIndex(pc)] = taken }
+
+// counter is a 2-bit saturating counter: 0 and 1 predict not taken, 2 and 3 taken.
+// Counters start at 0, strongly not taken.
+type counter uint8
+
+func (c counter) taken() bool { return c >= 2 }
+
+func (c *counter) update(taken bool) {
+	if taken && *c < 3 {
+		*c++
+	} else if !taken && *c > 0 {
+		*c--
+	}
+}
+
+// twoBitPredictor needs two wrong guesses in a row to change its prediction for a branch.
+type twoBitPredictor struct {
+	counters [1 << PREDICTOR_TABLE_BITS]counter
+}
+
+func (p *twoBitPredictor) Name() string              { return PREDICT_2BIT }
+func (p *twoBitPredictor) Predict(pc int) bool       { return p.counters[predictorIndex(pc)].taken() }
+func (p *twoBitPredictor) Update(pc int, taken bool) { p.counters[predictorIndex(pc)].update(taken) }
+
+// gsharePredictor shares its counters between branches, indexed by the
+// address combined with the outcomes of the most recent branches.
+type gsharePredictor struct {
+	counters [1 << PREDICTOR_TABLE_BITS]counter
+	history  int // Last outcomes, most recent in the lowest bit
+}
+
+func (p *gsharePredictor) Name() string        { return PREDICT_GSHARE }
+func (p *gsharePredictor) index(pc int) int    { return predictorIndex(pc ^ p.history) }
+func (p *gsharePredictor) Predict(pc int) bool { return p.counters[p.index(pc)].taken() }
+func (p *gsharePredictor) Update(pc int, taken bool) {
+	p.counters[p.index(pc)].update(taken)
+	p.history <<= 1
+	if taken {
+		p.history |= 1
+	}
+	p.history = predictorIndex(p.history)
+}
+
+// branchSite counts the executions of one branch instruction.
+type branchSite struct {
+	runs   uint64
+	taken  uint64
+	misses []uint64 // Mispredictions per predictor
+}
+
+// BranchProfiler runs several predictors side by side over the branches a
+// program executes: JZ, JNZ and JMP, which is always taken.
+type BranchProfiler struct {
+	program    *commands.Program
+	predictors []BranchPredictor
+	penalty    uint64
+	sites      map[int]*branchSite
+}
+
+// NewBranchProfiler creates a profiler comparing the named predictors ("all"
+// selects every predictor). Each misprediction costs penalty cycles.
+func NewBranchProfiler(program *commands.Program, names []string, penalty uint64) (*BranchProfiler, error) {
+	b := &BranchProfiler{program: program, penalty: penalty, sites: map[int]*branchSite{}}
+	for _, name := range names {
+		if strings.EqualFold(name, "all") {
+			return NewBranchProfiler(program, Predictors, penalty)
+		}
+		predictor, err := NewPredictor(name)
+		if err != nil {
+			return nil, err
+		}
+		b.predictors = append(b.predictors, predictor)
+	}
+	return b, nil
+}
+
+// ObserveStep lets every predictor guess the outcome of a branch, then learn it.
+func (b *BranchProfiler) ObserveStep(rec *StepRecord) {
+	var taken bool
+	switch rec.Inst.Opcode {
+	case commands.JZ, commands.JNZ:
+		taken = rec.Taken
+	case commands.JMP:
+		taken = true
+	default:
+		return
+	}
+	site := b.sites[rec.PC]
+	if site == nil {
+		site = &branchSite{misses: make([]uint64, len(b.predictors))}
+		b.sites[rec.PC] = site
+	}
+	site.runs++
+	if taken {
+		site.taken++
+	}
+	for i, predictor := range b.predictors {
+		if predictor.Predict(rec.PC) != taken {
+			site.misses[i]++
+		}
+		predictor.Update(rec.PC, taken)
+	}
+}
+
+// Mispredictions returns the number of mispredicted branches per predictor, in the order they were named.
+func (b *BranchProfiler) Mispredictions() []uint64 {
+	misses := make([]uint64, len(b.predictors))
+	for _, site := range b.sites {
+		for i, n := range site.misses {
+			misses[i] += n
+		}
+	}
+	return misses
+}
+
+// Branches returns the number of branches executed.
+func (b *BranchProfiler) Branches() uint64 {
+	var runs uint64
+	for _, site := range b.sites {
+		runs += site.runs
+	}
+	return runs
+}
+
+// Report writes the accuracy of every predictor, then the mispredictions and
+// the cycles they cost per branch site.
+func (b *BranchProfiler) Report(w io.Writer) {
+	branches := b.Branches()
+	fmt.Fprintf(w, "Branch prediction: %d branches, %d cycles per misprediction\n", branches, b.penalty)
+	fmt.Fprintf(w, "  %-10s %8s %9s %8s\n", "Predictor", "Correct", "Accuracy", "Penalty")
+	for i, misses := range b.Mispredictions() {
+		accuracy := 0.0
+		if branches > 0 {
+			accuracy = 100 * float64(branches-misses) / float64(branches)
+		}
+		fmt.Fprintf(w, "  %-10s %8d %8.1f%% %8d\n", b.predictors[i].Name(), branches-misses, accuracy, misses*b.penalty)
+	}
+	if len(b.sites) == 0 {
+		return
+	}
+
+	pcs := make([]int, 0, len(b.sites))
+	for pc := range b.sites {
+		pcs = append(pcs, pc)
+	}
+	sort.Ints(pcs)
+	fmt.Fprintln(w, "Mispredictions/penalty cycles per branch:")
+	fmt.Fprintf(w, "  %-26s %6s %6s", "Branch", "Runs", "Taken")
+	for _, predictor := range b.predictors {
+		fmt.Fprintf(w, " %11s", predictor.Name())
+	}
+	fmt.Fprintln(w)
+	for _, pc := range pcs {
+		site := b.sites[pc]
+		name := fmt.Sprintf("0x%02X line %d %s", pc, b.program.LineOf(pc), commands.Disassemble(b.program.Instructions[pc]))
+		fmt.Fprintf(w, "  %-26s %6d %6d", name, site.runs, site.taken)
+		for _, misses := range site.misses {
+			fmt.Fprintf(w, " %11s", fmt.Sprintf("%d/%d", misses, misses*b.penalty))
+		}
+		fmt.Fprintln(w)
+	}
+}
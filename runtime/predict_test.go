@@ -0,0 +1,97 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+// mispredictions feeds outcomes of the branch at pc to a predictor and counts
+// the wrong guesses from index skip on.
+func mispredictions(t *testing.T, name string, pc int, outcomes []bool, skip int) int {
+	t.Helper()
+	p, err := NewPredictor(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	misses := 0
+	for i, taken := range outcomes {
+		if p.Predict(pc) != taken && i >= skip {
+			misses++
+		}
+		p.Update(pc, taken)
+	}
+	return misses
+}
+
+func TestPredictorsOnLoop(t *testing.T) {
+	// A loop branch taken 9 times, then falling through, three times over.
+	var outcomes []bool
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 9; j++ {
+			outcomes = append(outcomes, true)
+		}
+		outcomes = append(outcomes, false)
+	}
+	want := map[string]int{PREDICT_TAKEN: 3, PREDICT_NOT_TAKEN: 27, PREDICT_1BIT: 6, PREDICT_2BIT: 5}
+	for name, misses := range want {
+		if got := mispredictions(t, name, 0x10, outcomes, 0); got != misses {
+			t.Errorf("%s: %d mispredictions, want %d", name, got, misses)
+		}
+	}
+}
+
+func TestGshareLearnsPatterns(t *testing.T) {
+	var outcomes []bool
+	for i := 0; i < 100; i++ {
+		outcomes = append(outcomes, i%2 == 0)
+	}
+	if misses := mispredictions(t, PREDICT_GSHARE, 0x10, outcomes, 80); misses != 0 {
+		t.Errorf("gshare mispredicted an alternating branch %d times after warming up", misses)
+	}
+	if misses := mispredictions(t, PREDICT_1BIT, 0x10, outcomes, 80); misses != 20 {
+		t.Errorf("1bit mispredicted an alternating branch %d times, want every time", misses)
+	}
+}
+
+func TestBranchProfiler(t *testing.T) {
+	program, err := commands.Assemble("LOAD R0 3\nLOAD R1 1\nloop:\nSUB R0 R0 R1\nJNZ R0 loop\nJMP end\nend:\nHALT", commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBranchProfiler(program, []string{"all"}, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU()
+	cpu.LoadScript(program, "test.ass")
+	cpu.AddObserver(b)
+	cpu.Run()
+
+	// JNZ goes taken, taken, not taken; JMP is always taken.
+	if b.Branches() != 4 {
+		t.Errorf("Branches() = %d, want 4", b.Branches())
+	}
+	misses := b.Mispredictions()
+	if misses[0] != 1 || misses[1] != 3 {
+		t.Errorf("static mispredictions = %d taken, %d not taken; want 1 and 3", misses[0], misses[1])
+	}
+
+	var out bytes.Buffer
+	b.Report(&out)
+	for _, want := range []string{
+		"4 branches, 4 cycles per misprediction",
+		"0x03 line 5 JNZ R0 0x02         3      2         1/4         2/8",
+		"0x04 line 6 JMP 0x05            1      1         0/0         1/4",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report does not contain %q:\n%s", want, out.String())
+		}
+	}
+
+	if _, err := NewBranchProfiler(program, []string{"oracle"}, 2); err == nil {
+		t.Errorf("NewBranchProfiler() should reject unknown predictors")
+	}
+}
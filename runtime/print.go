@@ -39,10 +39,26 @@ func printMemory(memory [commands.MEMORY_SIZE]int) {
 	utils.BLUE.Println("----------------")
 }
 
+func printMemoryRange(memory [commands.MEMORY_SIZE]int, start, count int) {
+	// Show a slice of memory, one cell per line, highlighting nonzero values
+	for addr := start; addr < start+count && addr < commands.MEMORY_SIZE; addr++ {
+		if memory[addr] == 0 {
+			utils.GREY.Printf("%02X: %d\n", addr, memory[addr])
+		} else {
+			utils.BOLD_YELLOW.Printf("%02X: %d\n", addr, memory[addr])
+		}
+	}
+}
+
+func printCycles(cpu *CPU) {
+	utils.GREEN.Printf("%d cycles in %d instructions\n", cpu.cycles, cpu.steps)
+}
+
 func printHelp() {
 	utils.GREEN.Println("Commands:")
 	utils.GREEN.Println("  LOAD reg val      \t - Load value into register")
 	utils.GREEN.Println("  STORE reg addr    \t - Store value from register into memory address")
+	utils.GREEN.Println("  LOADM reg addr    \t - Load value from memory address into register")
 	utils.GREEN.Println("  ADD dest s1 s2    \t - Add s1 and s2 into dest")
 	utils.GREEN.Println("  SUB dest s1 s2    \t - Subtract s2 from s1 into dest")
 	utils.GREEN.Println("  MUL dest s1 s2    \t - Multiply s1 and s2 into dest")
@@ -63,13 +79,66 @@ func printHelp() {
 	utils.GREEN.Println("  JMP addr          \t - Jump to address")
 	utils.GREEN.Println("  JZ reg addr       \t - Jump to address if register is zero")
 	utils.GREEN.Println("  JNZ reg addr      \t - Jump to address if register is not zero")
+	utils.GREEN.Println("  CYCLES dest       \t - Load the cycle counter into dest")
+	utils.GREEN.Println("  CALL addr         \t - Call subroutine at address")
+	utils.GREEN.Println("  RET               \t - Return from subroutine")
+	utils.GREEN.Println("  EI                \t - Enable interrupts")
+	utils.GREEN.Println("  DI                \t - Disable interrupts")
+	utils.GREEN.Println("  IRET              \t - Return from interrupt handler")
+	utils.GREEN.Println("  CAS exp new addr  \t - If memory equals exp, store new; exp receives the old value")
+	utils.GREEN.Println("  XCHG reg addr     \t - Swap register and memory atomically")
+	utils.GREEN.Println("  FENCE             \t - Order memory accesses across cores")
+	utils.GREEN.Println("  CORE dest         \t - Load the core number into dest")
+	utils.GREEN.Println("  SETPTB reg        \t - Enable paging with the page table at reg, or disable it if negative")
+	utils.GREEN.Println("  TLBFLUSH          \t - Discard the translations cached in the TLB")
+	utils.GREEN.Println("  SYSCALL n         \t - Make system call n (0 exit, 1 write, 2 read, 3 time)")
+	utils.GREEN.Println("  USER addr         \t - Jump to address in user mode")
 	utils.GREEN.Println("  HALT              \t - Stop execution")
 	utils.GREEN.Println("  reg               \t - Show registers")
 	utils.GREEN.Println("  mem               \t - Show memory")
+	utils.GREEN.Println("  cycles            \t - Show the cycle and instruction counters")
+	utils.GREEN.Println("  mmu               \t - Show the paging state and TLB statistics")
+	utils.GREEN.Println("  cache             \t - Show cache hit and miss statistics")
 	utils.GREEN.Println("  PRINT Rn          \t - Print value of register Rn")
 	utils.GREEN.Println("  PRINT MEM addr    \t - Print value at memory address")
+	utils.GREEN.Println("  back [n]          \t - Undo the last n instructions")
+	utils.GREEN.Println("  reverse-continue  \t - Undo all recorded instructions")
+	utils.GREEN.Println("  goto n            \t - Rewind to instruction count n")
+	utils.GREEN.Println("  history           \t - Show the recorded instruction range")
+	utils.GREEN.Println("  save file         \t - Save the machine state to a snapshot file")
+	utils.GREEN.Println("  load file         \t - Restore the machine state from a snapshot file")
 	utils.GREEN.Println("  version           \t - Show version info")
 	utils.GREEN.Println("  exit              \t - Exit interpreter")
 	utils.GREEN.Println("  cls               \t - Clear the screen")
 	utils.GREEN.Println("  help              \t - Show this help message")
 }
+
+func printDebugHelp() {
+	utils.GREEN.Println("Debugger commands:")
+	utils.GREEN.Println("  break loc         \t - Set a breakpoint at a line number, label or 0x address")
+	utils.GREEN.Println("  delete [loc]      \t - Remove a breakpoint, or all breakpoints")
+	utils.GREEN.Println("  breaks            \t - List breakpoints")
+	utils.GREEN.Println("  watch spec        \t - Stop when a register or memory range is accessed, e.g.")
+	utils.GREEN.Println("                    \t   watch 0x10, watch read R1, watch access 0x20-0x2F, watch 0x10 == 42")
+	utils.GREEN.Println("  unwatch [n]       \t - Remove watchpoint n, or all watchpoints")
+	utils.GREEN.Println("  watches           \t - List watchpoints")
+	utils.GREEN.Println("  step [n]          \t - Execute n instructions, entering calls")
+	utils.GREEN.Println("  next              \t - Execute one instruction, stepping over calls")
+	utils.GREEN.Println("  continue          \t - Run until a breakpoint or the end of the program")
+	utils.GREEN.Println("  finish            \t - Run until the current subroutine returns")
+	utils.GREEN.Println("  back [n]          \t - Undo the last n instructions")
+	utils.GREEN.Println("  reverse-continue  \t - Run backwards to the previous breakpoint")
+	utils.GREEN.Println("  goto n            \t - Move to instruction count n, backwards or forwards")
+	utils.GREEN.Println("  history           \t - Show the recorded instruction range")
+	utils.GREEN.Println("  reg               \t - Show registers")
+	utils.GREEN.Println("  mem [addr [n]]    \t - Show memory, or n cells starting at addr")
+	utils.GREEN.Println("  cycles            \t - Show the cycle and instruction counters")
+	utils.GREEN.Println("  mmu               \t - Show the paging state and TLB statistics")
+	utils.GREEN.Println("  cache             \t - Show cache hit and miss statistics")
+	utils.GREEN.Println("  list [loc]        \t - Show source around the current or given location")
+	utils.GREEN.Println("  save file         \t - Save the machine state to a snapshot file")
+	utils.GREEN.Println("  load file         \t - Restore the machine state and program from a snapshot file")
+	utils.GREEN.Println("  quit              \t - Exit the debugger")
+	utils.GREEN.Println("  help              \t - Show this help message")
+	utils.GREEN.Println("An empty line repeats the previous command.")
+}
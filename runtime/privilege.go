@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"fmt"
+
+	"tinyass/commands"
+)
+
+// Trap layout, after the page fault cells. A handler address of 0 means no
+// handler is installed.
+const (
+	PRIVILEGE_FAULT_VECTOR = PAGE_FAULT_CAUSE + 1       // Handler for privileged instructions run in user mode
+	SYSCALL_VECTOR         = PRIVILEGE_FAULT_VECTOR + 1 // Supervisor handler for SYSCALL
+	SYSCALL_NUMBER         = SYSCALL_VECTOR + 1         // Number of the system call being handled
+)
+
+// Lowest address of the stack of a single CPU. The stack grows down from the
+// top of memory and overflows before pushes reach the vectors.
+const STACK_FLOOR = SYSCALL_NUMBER + 1
+
+// SupervisorOnly reports whether addr holds a trap or interrupt vector, which
+// user mode may not write: a user program could otherwise install its own
+// handler and run it in supervisor mode.
+func SupervisorOnly(addr int) bool {
+	return addr >= VECTOR_TABLE && addr <= SYSCALL_NUMBER
+}
+
+// VectorFault returns the message of the protection fault raised when user
+// mode writes (ACCESS_WRITE) or pushes (ACCESS_STACK) to the vector at addr.
+func VectorFault(access, addr, pc int) string {
+	kinds := [...]string{ACCESS_WRITE: "write", ACCESS_STACK: "stack access"}
+	return fmt.Sprintf("Protection fault: %s of 0x%02X in the supervisor-only vectors from user mode on program counter %d",
+		kinds[access], addr, pc)
+}
+
+// IsPrivileged reports whether opcode may only run in supervisor mode.
+func IsPrivileged(opcode int) bool {
+	switch opcode {
+	case commands.EI, commands.DI, commands.IRET, commands.SETPTB, commands.TLBFLUSH, commands.USER:
+		return true
+	}
+	return false
+}
+
+// UserMode reports whether the CPU runs in user mode. It starts in supervisor mode.
+func (cpu *CPU) UserMode() bool {
+	return cpu.user
+}
+
+// SetUserMode switches between user and supervisor mode.
+func (cpu *CPU) SetUserMode(user bool) {
+	cpu.user = user
+}
+
+// trap enters a supervisor handler: ret and the flags are pushed, interrupts
+// are disabled and the CPU switches to supervisor mode until IRET. It returns
+// false when the pushes fault.
+func (cpu *CPU) trap(handler, ret int) bool {
+	if cpu.sp-2 < cpu.stackFloor {
+		return cpu.raise(FAULT_STACK, cpu.instPC, "Stack overflow entering a trap handler on program counter %d", cpu.instPC)
+	}
+	if !cpu.push(ret) || !cpu.push(cpu.flags()) {
+		return false
+	}
+	cpu.interrupts = false
+	cpu.user = false
+	cpu.pc = handler
+	cpu.jumped = true
+	return true
+}
+
+// privilegeFault handles a privileged instruction run in user mode. The handler
+// receives the address of the instruction; without one the CPU stops.
+func (cpu *CPU) privilegeFault(inst commands.Instruction) bool {
+	handler := cpu.memory[PRIVILEGE_FAULT_VECTOR]
+	if handler == 0 {
+		return cpu.raise(FAULT_PRIVILEGE, cpu.instPC, "Privileged instruction %s in user mode on program counter %d",
+			commands.Mnemonic(inst.Opcode), cpu.instPC)
+	}
+	return cpu.trap(handler, cpu.instPC)
+}
+
+// syscall traps into the supervisor handler when one is installed, passing the
+// call number in SYSCALL_NUMBER, and serves the call from the host's table otherwise.
+func (cpu *CPU) syscall(n int) bool {
+	handler := cpu.memory[SYSCALL_VECTOR]
+	if handler == 0 {
+		return cpu.syscalls.call(cpu, n)
+	}
+	cpu.store(SYSCALL_NUMBER, n)
+	return cpu.trap(handler, cpu.pc)
+}
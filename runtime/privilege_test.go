@@ -0,0 +1,179 @@
+package runtime
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"tinyass/commands"
+)
+
+// A kernel that serves SYSCALL itself and stops user programs that run privileged instructions.
+const kernelScript = `
+    LOAD R0 syscall
+    STORE R0 0xDC
+    LOAD R0 privileged
+    STORE R0 0xDB
+    USER main
+syscall:
+    LOADM R3 0xDD
+    IRET
+privileged:
+    LOAD R2 99
+    HALT
+main:
+    SYSCALL 5
+    LOAD R1 1
+    EI
+    LOAD R1 2
+`
+
+func TestKernelTraps(t *testing.T) {
+	cpu := assembleCPU(t, kernelScript)
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.registers[3] != 5 || cpu.registers[1] != 1 || cpu.registers[2] != 99 {
+		t.Errorf("registers = %v, want the syscall number in R3, R1 = 1 and the fault handler's 99 in R2", cpu.registers)
+	}
+	if cpu.UserMode() {
+		t.Errorf("the privilege fault handler should run in supervisor mode")
+	}
+	// The fault handler's return address and the user mode flags are left on the stack.
+	if cpu.memory[commands.MEMORY_SIZE-1] != 11 || cpu.memory[commands.MEMORY_SIZE-2]&FLAG_USER_MODE == 0 {
+		t.Errorf("stack = %v", cpu.memory[commands.MEMORY_SIZE-2:])
+	}
+}
+
+func TestHostSyscalls(t *testing.T) {
+	cpu := assembleCPU(t, `
+    LOAD R0 79
+    STORE R0 0x40
+    LOAD R0 75
+    STORE R0 0x41
+    LOAD R1 0x40
+    LOAD R2 2
+    SYSCALL 1
+    SYSCALL 2
+    MUL R3 R0 R2
+    SYSCALL 2
+    ADD R3 R3 R0
+    SYSCALL 3
+    SUB R0 R0 R3
+    SYSCALL 0
+    LOAD R0 7
+`)
+	var out bytes.Buffer
+	syscalls := NewSyscallTable(strings.NewReader("a"), &out)
+	syscalls.now = func() time.Time { return time.UnixMilli(1234) }
+	cpu.SetSyscalls(syscalls)
+	cpu.Run()
+	if out.String() != "OK" {
+		t.Errorf("output = %q, want %q", out.String(), "OK")
+	}
+	// R3 = 'a'*2 + -1 for the end of input, then the exit status is the time minus R3.
+	status, ok := cpu.ExitStatus()
+	if want := 1234 - (97*2 - 1); !ok || status != want || cpu.registers[0] != want {
+		t.Errorf("ExitStatus() = %d, %v, want %d", status, ok, want)
+	}
+}
+
+func TestSyscallSharesKeyboardInput(t *testing.T) {
+	saved := stdin
+	defer func() { stdin = saved }()
+	stdin = bufio.NewReader(strings.NewReader("ab"))
+
+	cpu := assembleCPU(t, "LOADM R1 0xE1\nSYSCALL 2\nLOADM R2 0xE1")
+	if err := attachDevices(cpu, []string{"keyboard"}); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Run()
+	if cpu.registers[1] != 'a' || cpu.registers[0] != 'b' || cpu.registers[2] != -1 {
+		t.Errorf("registers = %v, want 'a' from the keyboard, 'b' from SYSCALL 2, then the end of input", cpu.registers)
+	}
+}
+
+func TestSyscallFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		kind   int
+	}{
+		{"unknown syscall", "SYSCALL 42", FAULT_SYSCALL},
+		{"write outside memory", "LOAD R1 0xFE\nLOAD R2 4\nSYSCALL 1", FAULT_SYSCALL},
+		{"privileged without handler", "USER 0x01\nDI", FAULT_PRIVILEGE},
+		{"USER in user mode", "USER 0x01\nUSER 0x00", FAULT_PRIVILEGE},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := assembleCPU(t, tt.source)
+			cpu.Run()
+			if cpu.Fault() == nil || cpu.Fault().Kind != tt.kind {
+				t.Errorf("fault = %v, want kind %d", cpu.Fault(), tt.kind)
+			}
+		})
+	}
+}
+
+func TestUserModeCannotWriteVectors(t *testing.T) {
+	tests := []struct {
+		name, source, message string
+	}{
+		{"install a syscall handler", "USER start\nstart: LOAD R0 evil\nSTORE R0 0xDC\nSYSCALL 7\nevil: DI",
+			"write of 0xDC in the supervisor-only vectors from user mode on program counter 2"},
+		{"XCHG an interrupt vector", "USER 0x01\nXCHG R0 0xD0", "write of 0xD0"},
+		{"CAS the fault vector", "USER 0x01\nCAS R0 R1 0xDB", "write of 0xDB"},
+	}
+	for _, tt := range tests {
+		for _, engine := range []string{ENGINE_INTERPRETER, ENGINE_COMPILED} {
+			cpu := assembleCPU(t, tt.source)
+			cpu.SetEngine(engine)
+			cpu.RunContext(context.Background(), Limits{MaxSteps: 1000})
+			fault := cpu.Fault()
+			if fault == nil || fault.Kind != FAULT_PROTECTION || !strings.Contains(fault.Message, tt.message) {
+				t.Errorf("%s (%s): fault = %v, want a protection fault containing %q", tt.name, engine, fault, tt.message)
+			}
+			if cpu.registers[0] != 0 && tt.name != "install a syscall handler" {
+				t.Errorf("%s (%s): the faulting instruction changed R0 to %d", tt.name, engine, cpu.registers[0])
+			}
+		}
+	}
+
+	// The stack page is mapped onto the vectors, so the third push reaches 0xDD
+	cpu := assembleCPU(t, "LOAD R1 0x3D\nSTORE R1 0xCF\nLOAD R1 0xC0\nSETPTB R1\nUSER 0x05\nCALL 0x05")
+	mmu, _ := NewMMU(DEFAULT_TLB_SIZE)
+	cpu.SetMMU(mmu)
+	cpu.Run()
+	if fault := cpu.Fault(); fault == nil || fault.Kind != FAULT_PROTECTION || !strings.Contains(fault.Message, "stack access of 0xDD") {
+		t.Errorf("push through the MMU: fault = %v, want a protection fault for 0xDD", fault)
+	}
+
+	// The supervisor installs the vectors before entering user mode
+	cpu = assembleCPU(t, kernelScript)
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Errorf("supervisor writes faulted: %v", cpu.Fault())
+	}
+}
+
+func TestInterruptKeepsUserMode(t *testing.T) {
+	cpu := assembleCPU(t, "LOAD R0 0x03\nSTORE R0 0xD0\nUSER 0x04\nIRET\nLOAD R1 1\nLOAD R1 2")
+	cpu.SetUserMode(false)
+	cpu.interrupts = true
+	for i := 0; i < 3; i++ {
+		cpu.Step()
+	}
+	cpu.RaiseInterrupt(0)
+	cpu.Step() // Enters the handler in supervisor mode
+	if cpu.UserMode() || cpu.pc != 3 {
+		t.Fatalf("interrupt should enter the handler at 3 in supervisor mode, pc = %d, user = %v", cpu.pc, cpu.UserMode())
+	}
+	cpu.Step() // IRET
+	if !cpu.UserMode() || cpu.pc != 4 {
+		t.Errorf("IRET should return to user mode at 4, pc = %d, user = %v", cpu.pc, cpu.UserMode())
+	}
+}
@@ -0,0 +1,212 @@
+package runtime
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Number of instructions listed in the hotspot report
+const PROFILE_TOP = 10
+
+// Profiler counts executions and cycles per instruction, source line and label.
+type Profiler struct {
+	program     *commands.Program
+	counts      []uint64 // Executions per instruction address
+	cycles      []uint64 // Cycles per instruction address
+	total       uint64
+	totalCycles uint64 // Includes the cycles of interrupt entries
+
+	interrupts      uint64 // Interrupts taken
+	interruptCycles uint64 // Cycles spent entering interrupt handlers
+
+	calls     map[int]uint64 // Calls per subroutine address
+	inclusive map[int]uint64 // Cycles spent inside each subroutine, including callees
+	frames    []profileFrame // Subroutines currently running
+	active    map[int]int    // Number of frames per subroutine, to handle recursion
+}
+
+// profileFrame is a subroutine call that has not returned yet.
+type profileFrame struct {
+	target int    // Subroutine address
+	start  uint64 // Total cycles when it was entered
+}
+
+// NewProfiler creates a profiler for program.
+func NewProfiler(program *commands.Program) *Profiler {
+	return &Profiler{
+		program:   program,
+		counts:    make([]uint64, len(program.Instructions)),
+		cycles:    make([]uint64, len(program.Instructions)),
+		calls:     map[int]uint64{},
+		inclusive: map[int]uint64{},
+		active:    map[int]int{},
+	}
+}
+
+// ObserveStep accounts for one executed instruction.
+func (p *Profiler) ObserveStep(rec *StepRecord) {
+	if rec.PC < 0 || rec.PC >= len(p.counts) {
+		return
+	}
+	if rec.Inst.Opcode == commands.IRQ {
+		// Taking an interrupt does not run the interrupted instruction
+		p.interrupts++
+		p.interruptCycles += rec.Cycles
+		p.totalCycles += rec.Cycles
+		return
+	}
+	p.counts[rec.PC]++
+	p.cycles[rec.PC] += rec.Cycles
+	p.total++
+	p.totalCycles += rec.Cycles
+
+	switch rec.Inst.Opcode {
+	case commands.CALL:
+		target := rec.Inst.Operands[0]
+		p.calls[target]++
+		p.active[target]++
+		p.frames = append(p.frames, profileFrame{target, p.totalCycles})
+	case commands.RET:
+		if len(p.frames) > 0 {
+			p.leave(p.frames[len(p.frames)-1], p.totalCycles)
+			p.frames = p.frames[:len(p.frames)-1]
+		}
+	}
+}
+
+// leave credits a finished call to its subroutine. Recursive calls are only
+// counted once, by the outermost frame.
+func (p *Profiler) leave(frame profileFrame, now uint64) {
+	p.active[frame.target]--
+	if p.active[frame.target] == 0 {
+		p.inclusive[frame.target] += now - frame.start
+	}
+}
+
+// percent formats part as a percentage of the total cycle count.
+func (p *Profiler) percent(part uint64) string {
+	if p.totalCycles == 0 {
+		return "0.0%"
+	}
+	return fmt.Sprintf("%.1f%%", float64(part)*100/float64(p.totalCycles))
+}
+
+// Report writes the hotspot tables and an annotated source listing to w.
+func (p *Profiler) Report(w io.Writer) {
+	// Close subroutines that never returned, e.g. because of HALT
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		p.leave(p.frames[i], p.totalCycles)
+	}
+	p.frames = nil
+
+	fmt.Fprintln(w, "---- PROFILE ----")
+	fmt.Fprintf(w, "Executed %d instructions in %d cycles\n", p.total, p.totalCycles)
+	if p.interrupts > 0 {
+		fmt.Fprintf(w, "Took %d interrupts in %d cycles (%s)\n", p.interrupts, p.interruptCycles, p.percent(p.interruptCycles))
+	}
+	p.reportHotspots(w)
+	p.reportLabels(w)
+	p.reportSource(w)
+	fmt.Fprintln(w, "-----------------")
+}
+
+func (p *Profiler) reportHotspots(w io.Writer) {
+	var pcs []int
+	for pc, count := range p.counts {
+		if count > 0 {
+			pcs = append(pcs, pc)
+		}
+	}
+	sort.SliceStable(pcs, func(i, j int) bool {
+		if p.cycles[pcs[i]] != p.cycles[pcs[j]] {
+			return p.cycles[pcs[i]] > p.cycles[pcs[j]]
+		}
+		return p.counts[pcs[i]] > p.counts[pcs[j]]
+	})
+	if len(pcs) > PROFILE_TOP {
+		pcs = pcs[:PROFILE_TOP]
+	}
+
+	fmt.Fprintln(w, "\nHotspots:")
+	fmt.Fprintf(w, "  %10s %10s %7s  %-4s  %4s  %s\n", "COUNT", "CYCLES", "%", "PC", "LINE", "INSTRUCTION")
+	for _, pc := range pcs {
+		fmt.Fprintf(w, "  %10d %10d %7s  0x%02X  %4d  %s\n", p.counts[pc], p.cycles[pc], p.percent(p.cycles[pc]),
+			pc, p.program.LineOf(pc), commands.Disassemble(p.program.Instructions[pc]))
+	}
+}
+
+func (p *Profiler) reportLabels(w io.Writer) {
+	if len(p.program.Labels) == 0 {
+		return
+	}
+
+	// Attribute every instruction to the closest label before it
+	type region struct {
+		name  string
+		start int
+		self  uint64
+	}
+	var regions []*region
+	for name, addr := range p.program.Labels {
+		regions = append(regions, &region{name: name, start: addr})
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].start != regions[j].start {
+			return regions[i].start < regions[j].start
+		}
+		return regions[i].name < regions[j].name
+	})
+	for pc, cycles := range p.cycles {
+		var owner *region
+		for _, r := range regions {
+			if r.start <= pc && (owner == nil || r.start > owner.start) {
+				owner = r
+			}
+		}
+		if owner != nil {
+			owner.self += cycles
+		}
+	}
+	sort.SliceStable(regions, func(i, j int) bool { return regions[i].self > regions[j].self })
+
+	fmt.Fprintln(w, "\nLabels:")
+	fmt.Fprintf(w, "  %-16s %8s %10s %7s %10s\n", "LABEL", "CALLS", "SELF", "%", "TOTAL")
+	for _, r := range regions {
+		total := "-"
+		if p.calls[r.start] > 0 {
+			total = fmt.Sprint(p.inclusive[r.start])
+		}
+		fmt.Fprintf(w, "  %-16s %8d %10d %7s %10s\n", r.name, p.calls[r.start], r.self, p.percent(r.self), total)
+	}
+}
+
+func (p *Profiler) reportSource(w io.Writer) {
+	lineCounts := map[int]uint64{}
+	lineCycles := map[int]uint64{}
+	hasCode := map[int]bool{}
+	for pc := range p.counts {
+		line := p.program.LineOf(pc)
+		lineCounts[line] += p.counts[pc]
+		lineCycles[line] += p.cycles[pc]
+		hasCode[line] = true
+	}
+
+	fmt.Fprintln(w, "\nAnnotated source:")
+	fmt.Fprintf(w, "  %10s %10s  %4s  %s\n", "COUNT", "CYCLES", "LINE", "SOURCE")
+	for i, text := range p.program.Source {
+		line := i + 1
+		if line == len(p.program.Source) && strings.TrimSpace(text) == "" {
+			break // Trailing newline
+		}
+		text = strings.TrimRight(text, " \t\r")
+		if !hasCode[line] {
+			fmt.Fprintf(w, "  %10s %10s  %4d  %s\n", "", "", line, text)
+			continue
+		}
+		fmt.Fprintf(w, "  %10d %10d  %4d  %s\n", lineCounts[line], lineCycles[line], line, text)
+	}
+}
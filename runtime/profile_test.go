@@ -0,0 +1,91 @@
+package runtime
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+func TestProfilerCounts(t *testing.T) {
+	program, err := commands.Assemble(debugScript, commands.ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	profiler := NewProfiler(program)
+	cpu := NewCPU()
+	cpu.AddObserver(profiler)
+	cpu.LoadProgram(program.Instructions)
+	cpu.Run()
+
+	expected := []uint64{1, 1, 2, 2, 2, 1, 2, 2}
+	for pc, count := range expected {
+		if profiler.counts[pc] != count {
+			t.Errorf("count at pc %d = %d, want %d", pc, profiler.counts[pc], count)
+		}
+	}
+	// With the default timing model CALL and RET take 5 cycles each, taken jumps 2
+	if profiler.total != 13 || profiler.totalCycles != 30 {
+		t.Errorf("total = %d instructions, %d cycles, want 13 and 30", profiler.total, profiler.totalCycles)
+	}
+	show := program.Labels["show"]
+	if profiler.calls[show] != 2 || profiler.inclusive[show] != 12 {
+		t.Errorf("show: %d calls, %d inclusive cycles, want 2 and 12", profiler.calls[show], profiler.inclusive[show])
+	}
+
+	var out bytes.Buffer
+	profiler.Report(&out)
+	report := out.String()
+	for _, want := range []string{
+		"Executed 13 instructions in 30 cycles",
+		"0x03     4  CALL 0x06",
+		"show                    2         12   40.0%         12",
+		"         2          2     7  show:   PRINT R0",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("report does not contain %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestProfilerUnfinishedCall(t *testing.T) {
+	program, err := commands.Assemble("CALL sub\nsub: LOAD R0 1\nHALT", commands.ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	profiler := NewProfiler(program)
+	cpu := NewCPU()
+	cpu.AddObserver(profiler)
+	cpu.LoadProgram(program.Instructions)
+	cpu.SetCostTable(nil)
+	cpu.Run()
+	profiler.Report(&bytes.Buffer{})
+	if profiler.inclusive[1] != 2 {
+		t.Errorf("inclusive cycles of a call ended by HALT = %d, want 2", profiler.inclusive[1])
+	}
+}
+
+func TestProfilerInterrupts(t *testing.T) {
+	cpu := newTickCPU(t)
+	profiler := NewProfiler(cpu.script)
+	coverage := NewCoverage(cpu.script, "test.ass")
+	cpu.AddObserver(profiler)
+	cpu.AddObserver(coverage)
+	cpu.Run()
+
+	// Interrupt entries are not executions of the interrupted instruction
+	for pc, count := range profiler.counts {
+		if count != coverage.Hits[pc] {
+			t.Errorf("count at pc %d = %d, want %d as in the coverage", pc, count, coverage.Hits[pc])
+		}
+	}
+	if profiler.interrupts != 3 || profiler.totalCycles != cpu.cycles {
+		t.Errorf("%d interrupts, %d cycles, want 3 and %d", profiler.interrupts, profiler.totalCycles, cpu.cycles)
+	}
+	var out bytes.Buffer
+	profiler.Report(&out)
+	if !strings.Contains(out.String(), "Took 3 interrupts in") {
+		t.Errorf("report does not list the interrupts:\n%s", out.String())
+	}
+}
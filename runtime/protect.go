@@ -0,0 +1,181 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// Kinds of memory access checked against protection regions
+const (
+	ACCESS_READ  = iota // LOADM, PRINT and the read half of CAS and XCHG
+	ACCESS_WRITE        // STORE and the write half of CAS and XCHG
+	ACCESS_STACK        // Pushes and pops by CALL, RET, interrupts and IRET
+)
+
+// Protection assigns memory regions to addresses and decides which accesses they allow.
+// Addresses outside every region allow plain reads and writes, and stack accesses
+// unless a stack region is declared.
+type Protection struct {
+	regions []commands.Region
+	cells   [commands.MEMORY_SIZE]*commands.Region // Region of each address, nil when none
+	stack   bool                                   // Whether a stack region is declared
+}
+
+// NewProtection builds the protection map for a set of regions, which must not overlap.
+func NewProtection(regions []commands.Region) (*Protection, error) {
+	p := &Protection{regions: regions}
+	for i := range p.regions {
+		region := &p.regions[i]
+		if region.Start < 0 || region.End >= commands.MEMORY_SIZE || region.End < region.Start {
+			return nil, fmt.Errorf("region %v is outside memory", region)
+		}
+		for addr := region.Start; addr <= region.End; addr++ {
+			if other := p.cells[addr]; other != nil {
+				return nil, fmt.Errorf("region %v overlaps region %v", region, other)
+			}
+			p.cells[addr] = region
+		}
+		if region.Kind == commands.REGION_STACK {
+			p.stack = true
+		}
+	}
+	return p, nil
+}
+
+// Regions returns the declared regions.
+func (p *Protection) Regions() []commands.Region {
+	return p.regions
+}
+
+// allows reports whether an access to addr is permitted, and the region that decided it.
+func (p *Protection) allows(addr, access int) (*commands.Region, bool) {
+	region := p.cells[addr]
+	if region == nil {
+		return nil, access != ACCESS_STACK || !p.stack
+	}
+	switch region.Kind {
+	case commands.REGION_RODATA:
+		return region, access == ACCESS_READ
+	case commands.REGION_DATA, commands.REGION_DEVICE:
+		return region, access != ACCESS_STACK
+	case commands.REGION_STACK:
+		return region, access == ACCESS_STACK
+	}
+	return region, false // Guard regions allow nothing
+}
+
+// ParseRegionSpec parses a region given on the command line, e.g. "rodata 0x00 0x1F".
+func ParseRegionSpec(spec string) (commands.Region, error) {
+	region, err := commands.ParseRegion(strings.Fields(spec))
+	if err != nil {
+		return commands.Region{}, fmt.Errorf("invalid region %q: %v", spec, err)
+	}
+	return region, nil
+}
+
+// SetRegions protects memory with the given regions. No regions turns protection off.
+func (cpu *CPU) SetRegions(regions []commands.Region) error {
+	if len(regions) == 0 {
+		cpu.protection = nil
+		return nil
+	}
+	protection, err := NewProtection(regions)
+	if err != nil {
+		return err
+	}
+	cpu.protection = protection
+	return nil
+}
+
+// protectProgram protects memory with the regions configured for the machine and
+// those declared by the program.
+func (cpu *CPU) protectProgram(program *commands.Program) error {
+	regions := append([]commands.Region(nil), cpu.configRegions...)
+	if program != nil {
+		regions = append(regions, program.Regions...)
+	}
+	return cpu.SetRegions(regions)
+}
+
+// protect checks an access by the executing instruction. A violation raises a
+// protection fault and aborts the instruction, so it has no further effect.
+func (cpu *CPU) protect(addr, access int) bool {
+	if cpu.aborted {
+		return false
+	}
+	if cpu.protection == nil {
+		return true
+	}
+	region, ok := cpu.protection.allows(addr, access)
+	if ok {
+		return true
+	}
+	cpu.aborted = true
+	kinds := [...]string{ACCESS_READ: "read", ACCESS_WRITE: "write", ACCESS_STACK: "stack access"}
+	where := "outside the stack region"
+	if region != nil {
+		where = "in " + region.String()
+	}
+	cpu.raise(FAULT_PROTECTION, cpu.instPC, "Protection fault: %s of 0x%02X %s on program counter %d",
+		kinds[access], addr, where, cpu.instPC)
+	return false
+}
+
+// protectVectors faults a write or push to the vectors in user mode, whether or
+// not protection regions are declared. Like protect it aborts the instruction.
+func (cpu *CPU) protectVectors(addr, access int) bool {
+	if cpu.aborted {
+		return false
+	}
+	if !cpu.user || !SupervisorOnly(addr) {
+		return true
+	}
+	cpu.aborted = true
+	return cpu.raise(FAULT_PROTECTION, cpu.instPC, "%s", VectorFault(access, addr, cpu.instPC))
+}
+
+// checkTransfer faults when protection is active and the instruction transferred
+// control outside the program. Code does not live in memory, so this is the
+// no-execute check: only the program's own instructions may run.
+func (cpu *CPU) checkTransfer() bool {
+	if cpu.protection == nil || !cpu.jumped || len(cpu.program) == 0 || cpu.aborted {
+		return true
+	}
+	if cpu.pc >= 0 && cpu.pc <= len(cpu.program) {
+		return true
+	}
+	cpu.aborted = true
+	return cpu.raise(FAULT_PROTECTION, cpu.instPC, "Protection fault: jump to non-executable address 0x%02X on program counter %d",
+		cpu.pc, cpu.instPC)
+}
+
+// push stores val on the stack. The stack overflows when it reaches a device,
+// which would otherwise receive return addresses and flags.
+func (cpu *CPU) push(val int) bool {
+	addr, ok := cpu.translate(cpu.sp-1, true)
+	if !ok || !cpu.protectVectors(addr, ACCESS_STACK) || !cpu.protect(addr, ACCESS_STACK) {
+		return false
+	}
+	if cpu.bus != nil {
+		if device, _, ok := cpu.bus.lookup(addr); ok {
+			return cpu.raise(FAULT_STACK, cpu.instPC, "Stack overflow into the %s at 0x%02X on program counter %d",
+				device.Name(), addr, cpu.instPC)
+		}
+	}
+	cpu.sp--
+	cpu.store(addr, val)
+	return true
+}
+
+// pop removes the value on top of the stack.
+func (cpu *CPU) pop() (int, bool) {
+	addr, ok := cpu.translate(cpu.sp, false)
+	if !ok || !cpu.protect(addr, ACCESS_STACK) {
+		return 0, false
+	}
+	val := cpu.load(addr)
+	cpu.sp++
+	return val, true
+}
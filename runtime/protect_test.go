@@ -0,0 +1,127 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+func TestProtectionFaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		pc     int
+	}{
+		{"write to rodata", ".region rodata 0x00 0x0F\nLOAD R0 1\nSTORE R0 0x05\nHALT", 1},
+		{"read of guard", ".region guard 0x20 0x20\nLOADM R0 0x20\nHALT", 0},
+		{"plain write to stack", ".region stack 0xF0 0xFF\nLOAD R0 1\nSTORE R0 0xFF\nHALT", 1},
+		{"call outside stack", ".region stack 0x80 0x8F\nCALL sub\nHALT\nsub: RET", 0},
+		{"stack into device", ".region device 0xFF 0xFF\nCALL sub\nHALT\nsub: RET", 0},
+		{"jump outside program", ".region data 0x00 0x0F\nLOAD R0 1\nJMP 0x40", 1},
+		{"CAS on rodata", ".region rodata 0x00 0x0F\nLOAD R0 0\nLOAD R1 1\nCAS R0 R1 0x00\nHALT", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cpu := assembleCPU(t, tt.source)
+			if err := cpu.protectProgram(cpu.script); err != nil {
+				t.Fatal(err)
+			}
+			cpu.Run()
+			fault := cpu.Fault()
+			if fault == nil || fault.Kind != FAULT_PROTECTION || fault.PC != tt.pc {
+				t.Fatalf("fault = %+v, want a protection fault at pc %d", fault, tt.pc)
+			}
+			if !cpu.halted {
+				t.Errorf("a protection fault should stop the CPU")
+			}
+		})
+	}
+}
+
+func TestProtectionAllows(t *testing.T) {
+	cpu := assembleCPU(t, `
+.region rodata 0x00 0x0F
+.region data 0x10 0x1F
+.region stack 0xF8 0xFF
+    LOADM R0 0x00
+    LOAD R1 7
+    STORE R1 0x10
+    STORE R1 0x40
+    CALL sub
+    HALT
+sub:
+    RET
+`)
+	if err := cpu.protectProgram(cpu.script); err != nil {
+		t.Fatal(err)
+	}
+	cpu.memory[0x00] = 3
+	cpu.Run()
+	if cpu.Fault() != nil {
+		t.Fatalf("unexpected fault: %v", cpu.Fault())
+	}
+	if cpu.registers[0] != 3 || cpu.memory[0x10] != 7 || cpu.memory[0x40] != 7 || cpu.memory[0xFF] != 5 {
+		t.Errorf("registers = %v, memory = %v", cpu.registers, cpu.memory)
+	}
+}
+
+func TestProtectionAbortsInstruction(t *testing.T) {
+	// The write half of CAS faults, so R0 must not receive the old value.
+	cpu := assembleCPU(t, ".region rodata 0x00 0x0F\nLOAD R0 5\nLOAD R1 1\nCAS R0 R1 0x00\nHALT")
+	if err := cpu.protectProgram(cpu.script); err != nil {
+		t.Fatal(err)
+	}
+	cpu.memory[0x00] = 5
+	cpu.Run()
+	if cpu.registers[0] != 5 || cpu.memory[0x00] != 5 {
+		t.Errorf("faulting CAS changed state: R0 = %d, memory = %d", cpu.registers[0], cpu.memory[0x00])
+	}
+
+	cpu = assembleCPU(t, ".region stack 0x80 0x8F\nCALL sub\nHALT\nsub: RET")
+	if err := cpu.protectProgram(cpu.script); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Run()
+	if cpu.sp != commands.MEMORY_SIZE || cpu.pc != 1 {
+		t.Errorf("faulting CALL moved sp to %d and pc to %d", cpu.sp, cpu.pc)
+	}
+
+	cpu = assembleCPU(t, ".region guard 0x10 0x1F\nPRINT MEM 0x10")
+	if err := cpu.protectProgram(cpu.script); err != nil {
+		t.Fatal(err)
+	}
+	if output := captureStdout(t, cpu.Run); strings.Contains(output, "Memory[16]") {
+		t.Errorf("faulting PRINT printed a value: %q", output)
+	}
+}
+
+func TestConfiguredRegions(t *testing.T) {
+	cpu := NewCPU()
+	if !configureCPU(cpu, Options{Regions: []string{"rodata 0x00 0x0F"}}) {
+		t.Fatal("configureCPU() failed")
+	}
+	program, err := commands.Assemble(".region data 0x10 0x1F\nLOAD R0 1\nSTORE R0 0x00", commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.protectProgram(program); err != nil {
+		t.Fatal(err)
+	}
+	if regions := cpu.protection.Regions(); len(regions) != 2 {
+		t.Errorf("regions = %v, want the configured and declared regions", regions)
+	}
+	cpu.LoadScript(program, "test.ass")
+	cpu.Run()
+	if cpu.Fault() == nil || cpu.Fault().Kind != FAULT_PROTECTION {
+		t.Errorf("configured rodata region was not enforced: %v", cpu.Fault())
+	}
+
+	overlapping, _ := commands.Assemble(".region data 0x08 0x1F\nHALT", commands.ParseOptions{})
+	if err := cpu.protectProgram(overlapping); err == nil {
+		t.Errorf("protectProgram() should reject regions overlapping the configured ones")
+	}
+	if configureCPU(NewCPU(), Options{Regions: []string{"heap 0x00 0x0F"}}) {
+		t.Errorf("configureCPU() should reject unknown region kinds")
+	}
+}
@@ -0,0 +1,143 @@
+package runtime
+
+import (
+	"fmt"
+
+	"tinyass/commands"
+)
+
+// RaceAccess is one side of a data race.
+type RaceAccess struct {
+	Core  int
+	PC    int
+	Write bool
+}
+
+// Race is a pair of accesses to the same address by different cores, at least
+// one of them a write, that are not ordered by CAS, XCHG or FENCE.
+type Race struct {
+	Addr          int
+	First, Second RaceAccess
+}
+
+// Describe explains the race, naming source lines from program.
+func (r Race) Describe(program *commands.Program) string {
+	return fmt.Sprintf("Data race on 0x%02X: %s and %s", r.Addr, describeAccess(r.First, program), describeAccess(r.Second, program))
+}
+
+func describeAccess(a RaceAccess, program *commands.Program) string {
+	kind := "read"
+	if a.Write {
+		kind = "write"
+	}
+	return fmt.Sprintf("core %d %s at pc 0x%02X (line %d)", a.Core, kind, a.PC, program.LineOf(a.PC))
+}
+
+// vectorClock holds, for every core, the last instruction of that core known to happen before.
+type vectorClock []uint64
+
+// join merges other into c.
+func (c vectorClock) join(other vectorClock) {
+	for i, t := range other {
+		c[i] = max(c[i], t)
+	}
+}
+
+// epoch is an access by one core at one time.
+type epoch struct {
+	access RaceAccess
+	time   uint64
+}
+
+// cellHistory holds the accesses to a cell that later accesses are checked against.
+type cellHistory struct {
+	write   *epoch
+	reads   map[int]epoch // Last read by each core since the last write
+	reports bool          // Whether a race on the cell was reported already
+}
+
+// RaceDetector finds data races with vector clocks. Atomic instructions
+// synchronize through the address they access, FENCE synchronizes through a
+// clock shared by all fences, so a FENCE after a write and a FENCE before a
+// read on another core order the two.
+type RaceDetector struct {
+	clocks []vectorClock        // Clock of each core
+	syncs  map[int]vectorClock  // Clock released by atomic instructions, per address
+	fence  vectorClock          // Clock released by FENCE instructions
+	cells  map[int]*cellHistory // Plain accesses, per address
+	races  []Race
+}
+
+// NewRaceDetector creates a race detector for the given number of cores.
+func NewRaceDetector(cores int) *RaceDetector {
+	d := &RaceDetector{
+		syncs: map[int]vectorClock{},
+		fence: make(vectorClock, cores),
+		cells: map[int]*cellHistory{},
+	}
+	for i := 0; i < cores; i++ {
+		clock := make(vectorClock, cores)
+		clock[i] = 1
+		d.clocks = append(d.clocks, clock)
+	}
+	return d
+}
+
+// access checks a plain memory access against earlier accesses by other cores.
+func (d *RaceDetector) access(core, pc, addr int, write bool) {
+	cell := d.cells[addr]
+	if cell == nil {
+		cell = &cellHistory{reads: map[int]epoch{}}
+		d.cells[addr] = cell
+	}
+	clock := d.clocks[core]
+	now := RaceAccess{Core: core, PC: pc, Write: write}
+
+	if w := cell.write; w != nil && w.access.Core != core && w.time > clock[w.access.Core] {
+		d.report(cell, addr, w.access, now)
+	}
+	if write {
+		for other, r := range cell.reads {
+			if other != core && r.time > clock[other] {
+				d.report(cell, addr, r.access, now)
+			}
+		}
+		cell.write = &epoch{now, clock[core]}
+		clear(cell.reads)
+	} else {
+		cell.reads[core] = epoch{now, clock[core]}
+	}
+}
+
+// report records a race, once per address.
+func (d *RaceDetector) report(cell *cellHistory, addr int, first, second RaceAccess) {
+	if cell.reports {
+		return
+	}
+	cell.reports = true
+	d.races = append(d.races, Race{Addr: addr, First: first, Second: second})
+}
+
+// synchronize orders an atomic access with every earlier atomic access to addr.
+func (d *RaceDetector) synchronize(core, addr int) {
+	sync := d.syncs[addr]
+	if sync == nil {
+		sync = make(vectorClock, len(d.clocks))
+		d.syncs[addr] = sync
+	}
+	d.release(core, sync)
+}
+
+// fenced orders a FENCE with every earlier FENCE.
+func (d *RaceDetector) fenced(core int) {
+	d.release(core, d.fence)
+}
+
+// release acquires the clock in sync, publishes the core's clock to it and
+// starts a new time step for the core.
+func (d *RaceDetector) release(core int, sync vectorClock) {
+	clock := d.clocks[core]
+	clock.join(sync)
+	sync.join(clock)
+	clock[core]++
+}
@@ -0,0 +1,230 @@
+package runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Snapshot file identification
+const (
+	SNAPSHOT_FORMAT  = "tinyass-snapshot"
+	SNAPSHOT_VERSION = 1
+)
+
+// Snapshot is the complete state of a machine, as stored in a snapshot file.
+type Snapshot struct {
+	Format     string `json:"format"`
+	Version    int    `json:"version"`
+	WordSize   int    `json:"word_size"`   // Bits in a register or memory cell
+	MemorySize int    `json:"memory_size"` // Number of memory cells
+
+	Registers []int  `json:"registers"`
+	Memory    []int  `json:"memory"`
+	PC        int    `json:"pc"`
+	SP        int    `json:"sp"`
+	Halted    bool   `json:"halted"`
+	Fault     *Fault `json:"fault,omitempty"`
+	Flags     int    `json:"flags"`                // Interrupt enable flag, as pushed by interrupts
+	Pending   uint   `json:"pending,omitempty"`    // Pending interrupt lines
+	PageTable *int   `json:"page_table,omitempty"` // Page-table base while paging is enabled
+	Steps     uint64 `json:"steps"`
+	Cycles    uint64 `json:"cycles"`
+
+	File   string   `json:"file,omitempty"` // Script the program was loaded from
+	Source []string `json:"source"`         // Program source, assembled again on restore
+
+	// Devices holds the state of memory-mapped devices by name, for the
+	// devices that have state.
+	Devices map[string]json.RawMessage `json:"devices,omitempty"`
+}
+
+// LoadScript loads an assembled program, keeping its source for snapshots.
+func (cpu *CPU) LoadScript(program *commands.Program, file string) {
+	cpu.LoadProgram(program.Instructions)
+	cpu.script = program
+	cpu.scriptFile = file
+}
+
+// Snapshot captures the current machine state.
+func (cpu *CPU) Snapshot() (*Snapshot, error) {
+	devices, err := cpu.saveDevices()
+	if err != nil {
+		return nil, err
+	}
+	snap := &Snapshot{
+		Format:     SNAPSHOT_FORMAT,
+		Version:    SNAPSHOT_VERSION,
+		WordSize:   strconv.IntSize,
+		MemorySize: commands.MEMORY_SIZE,
+		Registers:  append([]int(nil), cpu.registers[:]...),
+		Memory:     append([]int(nil), cpu.memory[:]...),
+		PC:         cpu.pc,
+		SP:         cpu.sp,
+		Halted:     cpu.halted,
+		Fault:      cpu.fault,
+		Flags:      cpu.flags(),
+		Pending:    cpu.pending,
+		Steps:      cpu.steps,
+		Cycles:     cpu.cycles,
+		Source:     []string{},
+		Devices:    devices,
+	}
+	if base := cpu.pageTableBase(); base != PAGING_OFF {
+		snap.PageTable = &base
+	}
+
+	if cpu.script != nil && len(cpu.script.Instructions) == len(cpu.program) {
+		snap.File = cpu.scriptFile
+		snap.Source = cpu.script.Source
+	} else {
+		// Programs loaded without source are stored disassembled
+		for _, inst := range cpu.program {
+			snap.Source = append(snap.Source, commands.Disassemble(inst))
+		}
+	}
+	return snap, nil
+}
+
+// Restore replaces the machine state with a snapshot and returns the restored program.
+func (cpu *CPU) Restore(snap *Snapshot) (*commands.Program, error) {
+	if snap.Format != SNAPSHOT_FORMAT {
+		return nil, fmt.Errorf("not a TinyASS snapshot")
+	}
+	if snap.Version < 1 || snap.Version > SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("unsupported snapshot version %d (supported up to %d)", snap.Version, SNAPSHOT_VERSION)
+	}
+	if snap.WordSize > strconv.IntSize {
+		return nil, fmt.Errorf("snapshot uses %d-bit words, this machine has %d-bit words", snap.WordSize, strconv.IntSize)
+	}
+	if snap.MemorySize != commands.MEMORY_SIZE || len(snap.Memory) != commands.MEMORY_SIZE {
+		return nil, fmt.Errorf("snapshot has %d memory cells, this machine has %d", snap.MemorySize, commands.MEMORY_SIZE)
+	}
+	if len(snap.Registers) != len(cpu.registers) {
+		return nil, fmt.Errorf("snapshot has %d registers, this machine has %d", len(snap.Registers), len(cpu.registers))
+	}
+	if snap.PC < 0 {
+		return nil, fmt.Errorf("invalid program counter in snapshot: %d", snap.PC)
+	}
+	if snap.SP < 0 || snap.SP > commands.MEMORY_SIZE {
+		return nil, fmt.Errorf("invalid stack pointer in snapshot: %d", snap.SP)
+	}
+
+	program, err := commands.Assemble(strings.Join(snap.Source, "\n"), commands.ParseOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid program in snapshot: %v", err)
+	}
+
+	if err := cpu.restoreDevices(snap.Devices); err != nil {
+		return nil, err
+	}
+	if err := cpu.protectProgram(program); err != nil {
+		return nil, err
+	}
+	if err := cpu.restorePaging(snap.PageTable); err != nil {
+		return nil, err
+	}
+	cpu.LoadScript(program, snap.File)
+	copy(cpu.registers[:], snap.Registers)
+	copy(cpu.memory[:], snap.Memory)
+	cpu.pc = snap.PC
+	cpu.sp = snap.SP
+	cpu.halted = snap.Halted
+	cpu.fault = snap.Fault
+	cpu.setFlags(snap.Flags)
+	cpu.pending = snap.Pending
+	cpu.steps = snap.Steps
+	cpu.cycles = snap.Cycles
+	if cpu.history != nil {
+		cpu.history = NewHistory(len(cpu.history.entries)) // Old entries refer to the previous state
+	}
+	return program, nil
+}
+
+// restorePaging restores the page-table base of a snapshot, adding an MMU when
+// the snapshot was taken with paging enabled.
+func (cpu *CPU) restorePaging(base *int) error {
+	if base == nil {
+		if cpu.mmu != nil {
+			cpu.mmu.setBase(PAGING_OFF)
+		}
+		return nil
+	}
+	mmu := cpu.mmu
+	if mmu == nil {
+		mmu, _ = NewMMU(DEFAULT_TLB_SIZE)
+	}
+	if err := mmu.setBase(*base); err != nil {
+		return fmt.Errorf("invalid page table in snapshot: %v", err)
+	}
+	cpu.mmu = mmu
+	return nil
+}
+
+// SaveSnapshot writes the machine state to path.
+func SaveSnapshot(cpu *CPU, path string) error {
+	snap, err := cpu.Snapshot()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// LoadSnapshot reads a snapshot file written by SaveSnapshot.
+func LoadSnapshot(path string) (*Snapshot, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snap Snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("invalid snapshot %s: %v", path, err)
+	}
+	return &snap, nil
+}
+
+// RestoreFile loads the snapshot at path into cpu and returns the restored program.
+func RestoreFile(cpu *CPU, path string) (*commands.Program, error) {
+	snap, err := LoadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	return cpu.Restore(snap)
+}
+
+// replSnapshotCommand handles the "save file" and "load file" commands of the
+// REPL and debugger. It returns the restored program after a load, and false when
+// fields are not a snapshot command. A single operand tells "load file" apart
+// from the LOAD instruction.
+func replSnapshotCommand(cpu *CPU, fields []string) (*commands.Program, bool) {
+	if len(fields) != 2 {
+		return nil, false
+	}
+	switch strings.ToLower(fields[0]) {
+	case "save":
+		if err := SaveSnapshot(cpu, fields[1]); err != nil {
+			utils.RED.Printf("Error saving snapshot: %v\n", err)
+			return nil, true
+		}
+		utils.GREEN.Printf("Snapshot saved to %s\n", fields[1])
+		return nil, true
+	case "load":
+		program, err := RestoreFile(cpu, fields[1])
+		if err != nil {
+			utils.RED.Printf("Error restoring snapshot: %v\n", err)
+			return nil, true
+		}
+		utils.GREEN.Printf("Snapshot restored from %s at instruction %d\n", fields[1], cpu.steps)
+		return program, true
+	}
+	return nil, false
+}
@@ -0,0 +1,115 @@
+package runtime
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+const snapshotScript = `; Sum 1..n into memory
+    LOAD R0 0
+    LOAD R1 1
+loop:
+    ADD R0 R0 R1
+    STORE R0 0x10
+    CALL bump
+    JMP loop
+bump:
+    LOAD R3 1
+    ADD R1 R1 R3
+    RET
+`
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	program, err := commands.Assemble(snapshotScript, commands.ParseOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := NewCPU()
+	cpu.LoadScript(program, "sum.ass")
+	cpu.RunContext(context.Background(), Limits{MaxSteps: 50})
+
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := SaveSnapshot(cpu, path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewCPU()
+	got, err := RestoreFile(restored, path)
+	if err != nil {
+		t.Fatalf("RestoreFile() error = %v", err)
+	}
+	if !reflect.DeepEqual(got.Instructions, program.Instructions) || got.Labels["bump"] != program.Labels["bump"] {
+		t.Errorf("restored program differs from the original")
+	}
+	if restored.registers != cpu.registers || *restored.memory != *cpu.memory || restored.pc != cpu.pc ||
+		restored.sp != cpu.sp || restored.steps != cpu.steps || restored.cycles != cpu.cycles {
+		t.Errorf("restored state differs from the original")
+	}
+	if restored.scriptFile != "sum.ass" {
+		t.Errorf("script file = %q, want sum.ass", restored.scriptFile)
+	}
+
+	// Both machines continue identically
+	cpu.RunContext(context.Background(), Limits{MaxSteps: 30})
+	restored.RunContext(context.Background(), Limits{MaxSteps: 30})
+	if restored.registers != cpu.registers || *restored.memory != *cpu.memory || restored.cycles != cpu.cycles {
+		t.Errorf("execution diverged after restore: %v vs %v", restored.registers, cpu.registers)
+	}
+}
+
+func TestSnapshotWithoutSource(t *testing.T) {
+	cpu := newLoopCPU()
+	cpu.RunContext(context.Background(), Limits{MaxSteps: 10})
+
+	snap, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"LOAD R1 1", "ADD R0 R0 R1", "JMP 0x01"}
+	if !reflect.DeepEqual(snap.Source, want) {
+		t.Errorf("Source = %q, want %q", snap.Source, want)
+	}
+
+	restored := NewCPU()
+	if _, err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.program, cpu.program) || restored.registers != cpu.registers {
+		t.Errorf("restored machine differs from the original")
+	}
+}
+
+func TestRestoreChecksCompatibility(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Snapshot)
+		want   string
+	}{
+		{"format", func(s *Snapshot) { s.Format = "other" }, "not a TinyASS snapshot"},
+		{"version", func(s *Snapshot) { s.Version = SNAPSHOT_VERSION + 1 }, "unsupported snapshot version"},
+		{"word size", func(s *Snapshot) { s.WordSize = strconv.IntSize * 2 }, "-bit words"},
+		{"memory size", func(s *Snapshot) { s.MemorySize = 512 }, "memory cells"},
+		{"registers", func(s *Snapshot) { s.Registers = s.Registers[:2] }, "registers"},
+		{"stack pointer", func(s *Snapshot) { s.SP = -1 }, "stack pointer"},
+		{"program", func(s *Snapshot) { s.Source = []string{"FOO R1"} }, "invalid program"},
+	}
+	for _, tt := range tests {
+		snap, _ := newLoopCPU().Snapshot()
+		tt.modify(snap)
+		cpu := NewCPU()
+		cpu.setReg(0, 42)
+		_, err := cpu.Restore(snap)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: Restore() error = %v, want %q", tt.name, err, tt.want)
+		}
+		if cpu.registers[0] != 42 {
+			t.Errorf("%s: a rejected snapshot should leave the machine unchanged", tt.name)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Host system calls, served when no supervisor handler is installed
+const (
+	SYS_EXIT  = 0 // Stop with the exit status in R0
+	SYS_WRITE = 1 // Write the R2 characters starting at the address in R1
+	SYS_READ  = 2 // Read one character into R0, -1 at the end of input
+	SYS_TIME  = 3 // Load the host time in milliseconds since the Unix epoch into R0
+)
+
+// Syscall is a host implementation of a system call. It returns false when the
+// program should stop.
+type Syscall func(cpu *CPU) bool
+
+// SyscallTable holds the system calls the host provides to programs.
+type SyscallTable struct {
+	calls map[int]Syscall
+	in    *bufio.Reader
+	out   io.Writer
+	now   func() time.Time
+}
+
+// stdin is the only buffered reader of standard input. The REPL, the debugger,
+// the keyboard device and the read system call all share it, so none of them
+// buffers input another one needs.
+var stdin = bufio.NewReader(os.Stdin)
+
+// NewSyscallTable creates the standard system calls, reading from in and writing
+// to out. A *bufio.Reader in is used as is, so its buffer can be shared.
+func NewSyscallTable(in io.Reader, out io.Writer) *SyscallTable {
+	t := &SyscallTable{calls: map[int]Syscall{}, in: bufio.NewReader(in), out: out, now: time.Now}
+	t.Register(SYS_EXIT, sysExit)
+	t.Register(SYS_WRITE, t.write)
+	t.Register(SYS_READ, t.read)
+	t.Register(SYS_TIME, t.time)
+	return t
+}
+
+// Register adds or replaces the system call with number n.
+func (t *SyscallTable) Register(n int, call Syscall) {
+	t.calls[n] = call
+}
+
+// SetSyscalls replaces the host system call table.
+func (cpu *CPU) SetSyscalls(t *SyscallTable) {
+	cpu.syscalls = t
+}
+
+// call runs system call n for the executing instruction.
+func (t *SyscallTable) call(cpu *CPU, n int) bool {
+	call, ok := t.calls[n]
+	if !ok {
+		return cpu.raise(FAULT_SYSCALL, cpu.instPC, "Unknown system call %d on program counter %d", n, cpu.instPC)
+	}
+	return call(cpu)
+}
+
+// ExitStatus returns the status passed to the exit system call, and false if it was not called.
+func (cpu *CPU) ExitStatus() (int, bool) {
+	return cpu.exitStatus, cpu.exited
+}
+
+// printExitStatus reports the status passed to the exit system call, if it was called.
+func printExitStatus(status int, exited bool) {
+	if exited {
+		utils.GREEN.Printf("Exit status %d\n", status)
+	}
+}
+
+// sysExit stops the program. On a machine every core stops.
+func sysExit(cpu *CPU) bool {
+	cpu.exitStatus = cpu.reg(0)
+	cpu.exited = true
+	if cpu.machine != nil {
+		for _, core := range cpu.machine.Cores {
+			core.halted = true
+		}
+	}
+	return false
+}
+
+func (t *SyscallTable) write(cpu *CPU) bool {
+	addr, n := cpu.reg(1), cpu.reg(2)
+	if n < 0 || addr < 0 || addr+n > commands.MEMORY_SIZE {
+		return cpu.raise(FAULT_SYSCALL, cpu.instPC, "write of %d cells at 0x%02X is outside memory on program counter %d", n, addr, cpu.instPC)
+	}
+	text := make([]rune, 0, n)
+	for i := 0; i < n; i++ {
+		text = append(text, rune(cpu.readMem(addr+i)))
+		if cpu.aborted {
+			return false // Nothing is written until every cell could be read
+		}
+	}
+	fmt.Fprint(t.out, string(text))
+	return true
+}
+
+func (t *SyscallTable) read(cpu *CPU) bool {
+	b, err := t.in.ReadByte()
+	if err != nil {
+		cpu.setReg(0, -1)
+	} else {
+		cpu.setReg(0, int(b))
+	}
+	return true
+}
+
+func (t *SyscallTable) time(cpu *CPU) bool {
+	cpu.setReg(0, int(t.now().UnixMilli()))
+	return true
+}
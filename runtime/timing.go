@@ -0,0 +1,133 @@
+package runtime
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"tinyass/commands"
+)
+
+// CostTable is the timing model: how many cycles each instruction takes.
+type CostTable struct {
+	Opcodes      map[int]uint64 // Base cost per opcode
+	Default      uint64         // Cost of opcodes missing from Opcodes
+	BranchTaken  uint64         // Extra cycles when control is transferred (JMP, CALL, RET, taken JZ/JNZ)
+	MemoryAccess uint64         // Extra cycles per memory read or write
+}
+
+// DefaultCostTable returns the timing model used unless another one is configured.
+// Simple ALU operations take one cycle, multiplication and division are slower.
+func DefaultCostTable() *CostTable {
+	return &CostTable{
+		Opcodes: map[int]uint64{
+			commands.MUL:  3,
+			commands.DIV:  10,
+			commands.REM:  10,
+			commands.CALL: 2,
+			commands.RET:  2,
+		},
+		Default:      1,
+		BranchTaken:  1,
+		MemoryAccess: 2,
+	}
+}
+
+// Cost returns the base cost of an opcode.
+func (t *CostTable) Cost(opcode int) uint64 {
+	if cost, ok := t.Opcodes[opcode]; ok {
+		return cost
+	}
+	return t.Default
+}
+
+// ParseCostTable reads cost overrides on top of the default table. Each line holds a
+// mnemonic or one of the keywords "default", "branch-taken" and "memory", followed by
+// a number of cycles:
+//
+//	MUL 4          ; multiplication is slow
+//	branch-taken 2
+func ParseCostTable(r io.Reader) (*CostTable, error) {
+	table := DefaultCostTable()
+	opcodes := map[string]int{}
+	for opcode := commands.LOAD; opcode < commands.NUM_OPCODES; opcode++ {
+		opcodes[commands.Mnemonic(opcode)] = opcode
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := commands.SplitFields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a name and a number of cycles\nExample: MUL 4", line)
+		}
+		cost, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid number of cycles: %s", line, fields[1])
+		}
+		switch name := strings.ToUpper(fields[0]); name {
+		case "DEFAULT":
+			table.Default = cost
+		case "BRANCH-TAKEN":
+			table.BranchTaken = cost
+		case "MEMORY":
+			table.MemoryAccess = cost
+		default:
+			opcode, ok := opcodes[name]
+			if !ok {
+				return nil, fmt.Errorf("line %d: unknown instruction: %s", line, fields[0])
+			}
+			table.Opcodes[opcode] = cost
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// LoadCostTable reads a cost table file, see ParseCostTable.
+func LoadCostTable(path string) (*CostTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	table, err := ParseCostTable(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return table, nil
+}
+
+// SetCostTable changes the timing model. A nil table makes every instruction take one cycle.
+func (cpu *CPU) SetCostTable(table *CostTable) {
+	cpu.costs = table
+}
+
+// Cycles returns the number of cycles spent so far.
+func (cpu *CPU) Cycles() uint64 {
+	return cpu.cycles
+}
+
+// instructionCost returns the cycles taken by the instruction that just executed.
+func (cpu *CPU) instructionCost(inst commands.Instruction) uint64 {
+	if cpu.costs == nil {
+		return 1
+	}
+	cost := cpu.costs.Cost(inst.Opcode)
+	if cpu.cache != nil {
+		cost += cpu.memCycles
+	} else {
+		cost += cpu.memAccesses * cpu.costs.MemoryAccess
+	}
+	if cpu.jumped {
+		cost += cpu.costs.BranchTaken
+	}
+	return cost
+}
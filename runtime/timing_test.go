@@ -0,0 +1,80 @@
+package runtime
+
+import (
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+func TestCycleCounting(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{0, 1}},   // 1
+		{Opcode: commands.MUL, Operands: []int{1, 0, 0}}, // 3
+		{Opcode: commands.STORE, Operands: []int{1, 16}}, // 1 + 2 memory
+		{Opcode: commands.JNZ, Operands: []int{0, 5}},    // 1 + 1 taken
+		{Opcode: commands.HALT, Operands: []int{}},       // skipped
+		{Opcode: commands.JZ, Operands: []int{0, 0}},     // 1, not taken
+		{Opcode: commands.CYCLES, Operands: []int{2}},    // 1
+		{Opcode: commands.HALT, Operands: []int{}},       // 1
+	})
+	cpu.Run()
+
+	if cpu.registers[2] != 10 {
+		t.Errorf("CYCLES R2 = %d, want 10", cpu.registers[2])
+	}
+	if cpu.Cycles() != 12 {
+		t.Errorf("Cycles() = %d, want 12", cpu.Cycles())
+	}
+}
+
+func TestCycleCountingWithoutCostTable(t *testing.T) {
+	cpu := NewCPU()
+	cpu.SetCostTable(nil)
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{0, 1}},
+		{Opcode: commands.STORE, Operands: []int{0, 16}},
+		{Opcode: commands.JMP, Operands: []int{3}},
+		{Opcode: commands.HALT, Operands: []int{}},
+	})
+	cpu.Run()
+	if cpu.Cycles() != 4 {
+		t.Errorf("Cycles() = %d, want 4", cpu.Cycles())
+	}
+}
+
+func TestParseCostTable(t *testing.T) {
+	table, err := ParseCostTable(strings.NewReader("; slow multiplier\nmul 8\nSHL 2\n\nbranch-taken 3\nmemory 0\ndefault 2"))
+	if err != nil {
+		t.Fatalf("ParseCostTable() error = %v", err)
+	}
+	if table.Cost(commands.MUL) != 8 || table.Cost(commands.SHL) != 2 || table.Cost(commands.DIV) != 10 {
+		t.Errorf("opcode costs = %v", table.Opcodes)
+	}
+	if table.Cost(commands.ADD) != 2 || table.BranchTaken != 3 || table.MemoryAccess != 0 {
+		t.Errorf("table = %+v", table)
+	}
+
+	for _, source := range []string{"FOO 1", "MUL", "MUL -1", "MUL 1 2"} {
+		if _, err := ParseCostTable(strings.NewReader(source)); err == nil {
+			t.Errorf("ParseCostTable(%q) should fail", source)
+		}
+	}
+}
+
+func TestStepBackRestoresCycles(t *testing.T) {
+	cpu := newHistoryCPU(DEFAULT_HISTORY_SIZE)
+	cpu.Run()
+	cycles := cpu.Cycles()
+	cpu.StepBack()
+	cpu.Step()
+	if cpu.Cycles() != cycles {
+		t.Errorf("cycles after stepping back and forward = %d, want %d", cpu.Cycles(), cycles)
+	}
+	for cpu.StepBack() {
+	}
+	if cpu.Cycles() != 0 {
+		t.Errorf("cycles after rewinding everything = %d, want 0", cpu.Cycles())
+	}
+}
@@ -0,0 +1,158 @@
+package runtime
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Trace formats
+const (
+	TRACE_TEXT  = "text"  // One human-readable line per instruction
+	TRACE_JSONL = "jsonl" // One JSON object per line
+)
+
+// Tracer writes a record of every executed instruction.
+type Tracer struct {
+	w       *bufio.Writer
+	format  string
+	program *commands.Program // Optional, adds source line numbers
+	flush   bool              // Flush after every record, for interactive output
+	err     error             // First write error
+}
+
+// traceChange is the JSON form of a Change.
+type traceChange struct {
+	Reg  string `json:"reg,omitempty"`
+	Addr *int   `json:"addr,omitempty"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+}
+
+// traceRecord is the JSON form of a StepRecord.
+type traceRecord struct {
+	Step    uint64        `json:"step"`
+	PC      int           `json:"pc"`
+	Line    int           `json:"line,omitempty"`
+	Inst    string        `json:"inst"`
+	Changes []traceChange `json:"changes"`
+}
+
+// NewTracer creates a tracer writing records in the given format to w.
+// program may be nil when no source information is available.
+func NewTracer(w io.Writer, format string, program *commands.Program) (*Tracer, error) {
+	if format != TRACE_TEXT && format != TRACE_JSONL {
+		return nil, fmt.Errorf("invalid trace format: %s\nValid formats are %s and %s", format, TRACE_TEXT, TRACE_JSONL)
+	}
+	return &Tracer{w: bufio.NewWriter(w), format: format, program: program}, nil
+}
+
+// ObserveStep writes the record of one instruction.
+func (t *Tracer) ObserveStep(rec *StepRecord) {
+	if t.err != nil {
+		return
+	}
+	if t.format == TRACE_JSONL {
+		t.err = t.writeJSON(rec)
+	} else {
+		t.err = t.writeText(rec)
+	}
+	if t.flush && t.err == nil {
+		t.err = t.w.Flush()
+	}
+}
+
+// Flush writes any buffered records and returns the first error encountered while tracing.
+func (t *Tracer) Flush() error {
+	if err := t.w.Flush(); t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+func (t *Tracer) line(pc int) int {
+	if t.program == nil {
+		return 0
+	}
+	return t.program.LineOf(pc)
+}
+
+func (t *Tracer) writeText(rec *StepRecord) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "#%-6d pc=0x%02X", rec.Step, rec.PC)
+	if line := t.line(rec.PC); line > 0 {
+		fmt.Fprintf(&sb, " line=%-4d", line)
+	}
+	fmt.Fprintf(&sb, " %-18s", commands.Disassemble(rec.Inst))
+	for _, c := range rec.Changes {
+		if c.Register {
+			fmt.Fprintf(&sb, " R%d: %d -> %d", c.Index, c.Old, c.New)
+		} else {
+			fmt.Fprintf(&sb, " [0x%02X]: %d -> %d", c.Index, c.Old, c.New)
+		}
+	}
+	_, err := fmt.Fprintln(t.w, strings.TrimRight(sb.String(), " "))
+	return err
+}
+
+func (t *Tracer) writeJSON(rec *StepRecord) error {
+	out := traceRecord{
+		Step:    rec.Step,
+		PC:      rec.PC,
+		Line:    t.line(rec.PC),
+		Inst:    commands.Disassemble(rec.Inst),
+		Changes: make([]traceChange, 0, len(rec.Changes)),
+	}
+	for _, c := range rec.Changes {
+		change := traceChange{Old: c.Old, New: c.New}
+		if c.Register {
+			change.Reg = fmt.Sprintf("R%d", c.Index)
+		} else {
+			addr := c.Index
+			change.Addr = &addr
+		}
+		out.Changes = append(out.Changes, change)
+	}
+	data, err := json.Marshal(out)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	_, err = t.w.Write(data)
+	return err
+}
+
+// openTrace creates the tracer requested by opts. The returned function flushes
+// and closes the trace output, reporting any error to the user.
+func openTrace(opts Options, program *commands.Program) (*Tracer, func(), error) {
+	out := os.Stdout
+	if opts.Trace != "-" {
+		file, err := os.Create(opts.Trace)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = file
+	}
+	tracer, err := NewTracer(out, opts.TraceFormat, program)
+	if err != nil {
+		if out != os.Stdout {
+			out.Close()
+		}
+		return nil, nil, err
+	}
+	tracer.flush = out == os.Stdout // Keep the trace in step with PRINT output
+	return tracer, func() {
+		if err := tracer.Flush(); err != nil {
+			utils.RED.Printf("Error writing trace: %v\n", err)
+		}
+		if out != os.Stdout {
+			out.Close()
+		}
+	}, nil
+}
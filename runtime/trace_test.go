@@ -0,0 +1,73 @@
+package runtime
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"tinyass/commands"
+)
+
+func runTraced(t *testing.T, format string) string {
+	t.Helper()
+	program, err := commands.Assemble("LOAD R0 7\nSTORE R0 0x10\nPRINT R0\nHALT", commands.ParseOptions{})
+	if err != nil {
+		t.Fatalf("Assemble() error = %v", err)
+	}
+	var out bytes.Buffer
+	tracer, err := NewTracer(&out, format, program)
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+	cpu := NewCPU()
+	cpu.AddObserver(tracer)
+	cpu.LoadProgram(program.Instructions)
+	cpu.Run()
+	if err := tracer.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	return out.String()
+}
+
+func TestTraceText(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(runTraced(t, TRACE_TEXT)), "\n")
+	expected := []string{
+		"#1      pc=0x00 line=1    LOAD R0 7          R0: 0 -> 7",
+		"#2      pc=0x01 line=2    STORE R0 0x10      [0x10]: 0 -> 7",
+		"#3      pc=0x02 line=3    PRINT R0",
+		"#4      pc=0x03 line=4    HALT",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("trace has %d lines, want %d:\n%s", len(lines), len(expected), strings.Join(lines, "\n"))
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("line %d = %q, want %q", i+1, lines[i], expected[i])
+		}
+	}
+}
+
+func TestTraceJSONLines(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(runTraced(t, TRACE_JSONL)), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("trace has %d lines, want 4", len(lines))
+	}
+
+	var rec traceRecord
+	if err := json.Unmarshal([]byte(lines[1]), &rec); err != nil {
+		t.Fatalf("invalid JSON %q: %v", lines[1], err)
+	}
+	if rec.Step != 2 || rec.PC != 1 || rec.Line != 2 || rec.Inst != "STORE R0 0x10" {
+		t.Errorf("record = %+v", rec)
+	}
+	if len(rec.Changes) != 1 || rec.Changes[0].Addr == nil || *rec.Changes[0].Addr != 16 || rec.Changes[0].New != 7 {
+		t.Errorf("changes = %+v, want Memory[16] = 7", rec.Changes)
+	}
+}
+
+func TestTraceInvalidFormat(t *testing.T) {
+	if _, err := NewTracer(&bytes.Buffer{}, "xml", nil); err == nil {
+		t.Errorf("NewTracer() with an invalid format should fail")
+	}
+}
@@ -0,0 +1,228 @@
+package runtime
+
+import (
+	"fmt"
+	"strings"
+
+	"tinyass/commands"
+	"tinyass/utils"
+)
+
+// Watchpoint access modes
+const (
+	WATCH_WRITE  = 1 << iota // Trigger when the location is written
+	WATCH_READ               // Trigger when the location is read
+	WATCH_ACCESS = WATCH_WRITE | WATCH_READ
+)
+
+// Watchpoint triggers on accesses to a register or a range of memory cells.
+type Watchpoint struct {
+	ID       int
+	Spec     string // Text the watchpoint was created from
+	Register bool   // Watch register Start instead of memory
+	Start    int    // First watched register or address
+	End      int    // Last watched address (inclusive)
+	Mode     int    // WATCH_WRITE, WATCH_READ or WATCH_ACCESS
+	Cond     string // Optional comparison applied to the accessed value: ==, !=, <, <=, >, >=
+	Value    int    // Right hand side of Cond
+}
+
+// WatchHit describes an access that triggered a watchpoint.
+type WatchHit struct {
+	Watch    *Watchpoint
+	PC       int                  // Address of the instruction that made the access
+	Inst     commands.Instruction // Instruction that made the access
+	Register bool
+	Index    int // Register number or memory address
+	Old      int // Value before the access
+	New      int // Value after the access
+	Write    bool
+}
+
+// WatchSet holds the watchpoints of a CPU. Hits are logged as they happen
+// unless Stop is set, in which case they are kept for TakeHits.
+type WatchSet struct {
+	Stop   bool
+	points []*Watchpoint
+	nextID int
+	hits   []WatchHit
+}
+
+// NewWatchSet creates an empty set of watchpoints.
+func NewWatchSet() *WatchSet {
+	return &WatchSet{nextID: 1}
+}
+
+// SetWatches attaches a set of watchpoints to the CPU, or detaches them when ws is nil.
+func (cpu *CPU) SetWatches(ws *WatchSet) {
+	cpu.watches = ws
+}
+
+// ParseWatchpoint parses a watchpoint specification of the form
+//
+//	[read|write|access] target [op value]
+//
+// where target is a register (R2), an address (0x10) or an address range (0x10-0x1F).
+// Without a mode the watchpoint triggers on writes.
+func ParseWatchpoint(spec string) (*Watchpoint, error) {
+	fields := strings.Fields(spec)
+	wp := &Watchpoint{Spec: strings.Join(fields, " "), Mode: WATCH_WRITE}
+
+	if len(fields) > 0 {
+		switch strings.ToLower(fields[0]) {
+		case "write":
+			fields = fields[1:]
+		case "read":
+			wp.Mode = WATCH_READ
+			fields = fields[1:]
+		case "access":
+			wp.Mode = WATCH_ACCESS
+			fields = fields[1:]
+		}
+	}
+	if len(fields) != 1 && len(fields) != 3 {
+		return nil, fmt.Errorf("invalid watchpoint: %q\nExample: write 0x10, read R1, 0x20-0x2F == 0", spec)
+	}
+
+	target := strings.ToUpper(fields[0])
+	if strings.HasPrefix(target, "R") {
+		reg, err := commands.ParseRegister(target)
+		if err != nil {
+			return nil, err
+		}
+		wp.Register, wp.Start, wp.End = true, reg, reg
+	} else {
+		first, last, found := strings.Cut(target, "-")
+		start, err := commands.ParseMemory(first)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if found {
+			if end, err = commands.ParseMemory(last); err != nil {
+				return nil, err
+			}
+		}
+		if end < start {
+			return nil, fmt.Errorf("invalid address range: %s", fields[0])
+		}
+		wp.Start, wp.End = start, end
+	}
+
+	if len(fields) == 3 {
+		switch fields[1] {
+		case "==", "!=", "<", "<=", ">", ">=":
+			wp.Cond = fields[1]
+		default:
+			return nil, fmt.Errorf("invalid comparison: %s\nValid comparisons are ==, !=, <, <=, >, >=", fields[1])
+		}
+		val, err := commands.ParseValue(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		wp.Value = val
+	}
+	return wp, nil
+}
+
+// Add registers a watchpoint and returns its ID.
+func (ws *WatchSet) Add(wp *Watchpoint) int {
+	wp.ID = ws.nextID
+	ws.nextID++
+	ws.points = append(ws.points, wp)
+	return wp.ID
+}
+
+// AddSpecs parses and adds each watchpoint specification in specs.
+func (ws *WatchSet) AddSpecs(specs []string) error {
+	for _, spec := range specs {
+		wp, err := ParseWatchpoint(spec)
+		if err != nil {
+			return err
+		}
+		ws.Add(wp)
+	}
+	return nil
+}
+
+// Remove deletes the watchpoint with the given ID and reports whether it existed.
+func (ws *WatchSet) Remove(id int) bool {
+	for i, wp := range ws.points {
+		if wp.ID == id {
+			ws.points = append(ws.points[:i], ws.points[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear deletes all watchpoints.
+func (ws *WatchSet) Clear() {
+	ws.points = nil
+}
+
+// Points returns the active watchpoints in creation order.
+func (ws *WatchSet) Points() []*Watchpoint {
+	return ws.points
+}
+
+// TakeHits returns and forgets the hits collected since the last call.
+func (ws *WatchSet) TakeHits() []WatchHit {
+	hits := ws.hits
+	ws.hits = nil
+	return hits
+}
+
+// check records a hit for every watchpoint matching the access.
+func (ws *WatchSet) check(cpu *CPU, register bool, index, old, new int, write bool) {
+	for _, wp := range ws.points {
+		if !wp.matches(register, index, new, write) {
+			continue
+		}
+		hit := WatchHit{wp, cpu.instPC, cpu.inst, register, index, old, new, write}
+		if ws.Stop {
+			ws.hits = append(ws.hits, hit)
+		} else {
+			utils.YELLOW.Println(hit)
+		}
+	}
+}
+
+// matches reports whether an access triggers the watchpoint.
+func (wp *Watchpoint) matches(register bool, index, val int, write bool) bool {
+	if wp.Register != register || index < wp.Start || index > wp.End {
+		return false
+	}
+	if write && wp.Mode&WATCH_WRITE == 0 || !write && wp.Mode&WATCH_READ == 0 {
+		return false
+	}
+	switch wp.Cond {
+	case "==":
+		return val == wp.Value
+	case "!=":
+		return val != wp.Value
+	case "<":
+		return val < wp.Value
+	case "<=":
+		return val <= wp.Value
+	case ">":
+		return val > wp.Value
+	case ">=":
+		return val >= wp.Value
+	}
+	return true
+}
+
+// String formats the hit with the location and instruction that caused it.
+func (hit WatchHit) String() string {
+	name := fmt.Sprintf("Memory[0x%02X]", hit.Index)
+	if hit.Register {
+		name = fmt.Sprintf("R%d", hit.Index)
+	}
+	access := fmt.Sprintf("%s read (%d)", name, hit.New)
+	if hit.Write {
+		access = fmt.Sprintf("%s written: %d -> %d", name, hit.Old, hit.New)
+	}
+	return fmt.Sprintf("Watchpoint %d (%s): %s at pc 0x%02X: %s",
+		hit.Watch.ID, hit.Watch.Spec, access, hit.PC, commands.Disassemble(hit.Inst))
+}
@@ -0,0 +1,95 @@
+package runtime
+
+import (
+	"testing"
+
+	"tinyass/commands"
+)
+
+func TestParseWatchpoint(t *testing.T) {
+	tests := []struct {
+		spec     string
+		expected Watchpoint
+		hasError bool
+	}{
+		{"0x10", Watchpoint{Start: 16, End: 16, Mode: WATCH_WRITE}, false},
+		{"read r1", Watchpoint{Register: true, Start: 1, End: 1, Mode: WATCH_READ}, false},
+		{"access 0x20-0x2F", Watchpoint{Start: 32, End: 47, Mode: WATCH_ACCESS}, false},
+		{"write 0x10 == 42", Watchpoint{Start: 16, End: 16, Mode: WATCH_WRITE, Cond: "==", Value: 42}, false},
+		{"R4", Watchpoint{}, true},
+		{"0x20-0x10", Watchpoint{}, true},
+		{"0x10 ~ 3", Watchpoint{}, true},
+		{"", Watchpoint{}, true},
+	}
+
+	for _, test := range tests {
+		wp, err := ParseWatchpoint(test.spec)
+		if (err != nil) != test.hasError {
+			t.Errorf("ParseWatchpoint(%q) error = %v, wantErr %v", test.spec, err, test.hasError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		e := test.expected
+		if wp.Register != e.Register || wp.Start != e.Start || wp.End != e.End || wp.Mode != e.Mode || wp.Cond != e.Cond || wp.Value != e.Value {
+			t.Errorf("ParseWatchpoint(%q) = %+v, want %+v", test.spec, *wp, e)
+		}
+	}
+}
+
+func TestWatchSetHits(t *testing.T) {
+	cpu := NewCPU()
+	cpu.LoadProgram([]commands.Instruction{
+		{Opcode: commands.LOAD, Operands: []int{0, 5}},
+		{Opcode: commands.STORE, Operands: []int{0, 0x10}},
+		{Opcode: commands.LOAD, Operands: []int{0, 42}},
+		{Opcode: commands.STORE, Operands: []int{0, 0x11}},
+		{Opcode: commands.PRINT, Operands: []int{0x10}},
+		{Opcode: commands.HALT, Operands: []int{}},
+	})
+
+	watches := NewWatchSet()
+	watches.Stop = true
+	if err := watches.AddSpecs([]string{"0x10-0x11 == 42", "read 0x10", "write R0"}); err != nil {
+		t.Fatalf("AddSpecs() error = %v", err)
+	}
+	cpu.SetWatches(watches)
+	cpu.Run()
+
+	hits := watches.TakeHits()
+	expected := []struct {
+		id, pc int
+		write  bool
+	}{
+		{3, 0, true},  // LOAD R0 5
+		{3, 2, true},  // LOAD R0 42
+		{1, 3, true},  // STORE R0 0x11 writes 42
+		{2, 4, false}, // PRINT MEM 0x10
+	}
+	if len(hits) != len(expected) {
+		t.Fatalf("got %d hits, want %d: %v", len(hits), len(expected), hits)
+	}
+	for i, e := range expected {
+		if hits[i].Watch.ID != e.id || hits[i].PC != e.pc || hits[i].Write != e.write {
+			t.Errorf("hit %d = %v, want watchpoint %d at pc %d", i, hits[i], e.id, e.pc)
+		}
+	}
+	if len(watches.TakeHits()) != 0 {
+		t.Errorf("TakeHits() should clear collected hits")
+	}
+}
+
+func TestDebuggerStopsAtWatchpoint(t *testing.T) {
+	d := newTestDebugger(t)
+	d.Exec("watch R0 == 0")
+	d.Exec("continue")
+	// SUB R0 R0 R1 at address 2 makes R0 zero on the second iteration
+	if d.cpu.pc != 3 || d.cpu.registers[0] != 0 {
+		t.Errorf("stopped at pc %d with R0 = %d, want pc 3 and R0 = 0", d.cpu.pc, d.cpu.registers[0])
+	}
+	d.Exec("unwatch 1")
+	if len(d.watches.Points()) != 0 {
+		t.Errorf("unwatch should remove the watchpoint")
+	}
+}